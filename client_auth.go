@@ -1,7 +1,9 @@
 package vnc
 
 import (
+	"crypto/cipher"
 	"crypto/des"
+	"fmt"
 	"io"
 )
 
@@ -13,6 +15,10 @@ const (
 	VNCSecType
 )
 
+const (
+	TightSecType = SecurityType(16)
+)
+
 // A ClientAuth implements a method of authenticating with a remote server.
 type ClientAuth interface {
 	// Type returns the byte identifier sent by the server to
@@ -38,6 +44,11 @@ func (*NoneAuth) Handshake(*ClientConn) error {
 // VNCAuth is VNC authentication, 7.2.2
 type VNCAuth struct {
 	Password string
+
+	// AllowTruncate allows passwords longer than 8 bytes, of which only
+	// the first 8 bytes are used by VNC authentication. Otherwise such
+	// passwords are rejected before anything is sent to the server.
+	AllowTruncate bool
 }
 
 func (a *VNCAuth) Type() SecurityType {
@@ -45,6 +56,10 @@ func (a *VNCAuth) Type() SecurityType {
 }
 
 func (a *VNCAuth) Handshake(c *ClientConn) error {
+	if len(a.Password) > 8 && !a.AllowTruncate {
+		return fmt.Errorf("VNC password is longer than 8 bytes and would be truncated.")
+	}
+
 	challenge := make([]byte, 16)
 	if _, err := io.ReadFull(c.r, challenge); err != nil {
 		return err
@@ -66,15 +81,7 @@ func (a *VNCAuth) encrypt(pw string, bytes []byte) ([]byte, error) {
 	key := make([]byte, 8)
 	copy(key, pw)
 
-	// Each byte of the password needs to be reversed. This is a
-	// non RFC-documented behaviour of VNC clients and servers
-	for i := range key {
-		key[i] = (key[i]&0x55)<<1 | (key[i]&0xAA)>>1 // Swap adjacent bits
-		key[i] = (key[i]&0x33)<<2 | (key[i]&0xCC)>>2 // Swap adjacent pairs
-		key[i] = (key[i]&0x0F)<<4 | (key[i]&0xF0)>>4 // Swap the 2 halves
-	}
-
-	cypher, err := des.NewCipher(key)
+	cypher, err := vncDESCipher(key)
 	if err != nil {
 		return nil, err
 	}
@@ -88,3 +95,131 @@ func (a *VNCAuth) encrypt(pw string, bytes []byte) ([]byte, error) {
 
 	return crypted, nil
 }
+
+// vncDESCipher returns a DES cipher for the key as VNC uses it, with
+// the bits of each key byte reversed.
+func vncDESCipher(key []byte) (cipher.Block, error) {
+	reversed := make([]byte, len(key))
+	for i, b := range key {
+		// This is a non RFC-documented behaviour of VNC clients and
+		// servers
+		b = (b&0x55)<<1 | (b&0xAA)>>1 // Swap adjacent bits
+		b = (b&0x33)<<2 | (b&0xCC)>>2 // Swap adjacent pairs
+		b = (b&0x0F)<<4 | (b&0xF0)>>4 // Swap the 2 halves
+		reversed[i] = b
+	}
+	return des.NewCipher(reversed)
+}
+
+// Capability codes used by the Tight security type.
+const (
+	tightNoTunneling = 0
+	tightAuthNone    = 1
+	tightAuthVNC     = 2
+)
+
+// tightCapability identifies a tunneling or authentication method,
+// server message, client message or encoding in the Tight protocol
+// extensions.
+type tightCapability struct {
+	Code   int32
+	Vendor [4]byte
+	Name   [8]byte
+}
+
+// TightCapability identifies a server message, client message or
+// encoding supported by a server using the Tight security type, such as
+// code 7, vendor "TGHT", name "TIGHT___" for the Tight encoding.
+type TightCapability struct {
+	Code   int32
+	Vendor string
+	Name   string
+}
+
+// TightServerCaps lists the interaction capabilities a server using the
+// Tight security type sends after ServerInit.
+type TightServerCaps struct {
+	ServerMessages []TightCapability
+	ClientMessages []TightCapability
+	Encodings      []TightCapability
+}
+
+// readTightCapabilities reads a list of n capabilities, whose size is
+// checked against MaxMessageSize first since n comes from the server.
+func readTightCapabilities(c *ClientConn, n uint32) ([]tightCapability, error) {
+	if err := c.checkMessageSize(16 * int64(n)); err != nil {
+		return nil, err
+	}
+	caps := make([]tightCapability, n)
+	if err := readFixedSize(c.r, caps); err != nil {
+		return nil, err
+	}
+	return caps, nil
+}
+
+func tightCapabilities(caps []tightCapability) []TightCapability {
+	result := make([]TightCapability, len(caps))
+	for i, c := range caps {
+		result[i] = TightCapability{c.Code, string(c.Vendor[:]), string(c.Name[:])}
+	}
+	return result
+}
+
+// TightAuth is the Tight security type, which negotiates a tunnel and
+// an authentication method from lists of capabilities sent by the
+// server. None and VNC authentication are supported, and no tunneling
+// is used.
+type TightAuth struct {
+	// Password is used if the server selects VNC authentication.
+	Password string
+}
+
+func (*TightAuth) Type() SecurityType {
+	return TightSecType
+}
+
+func (a *TightAuth) Handshake(c *ClientConn) error {
+	var numTunnels uint32
+	if err := readFixedSize(c.r, &numTunnels); err != nil {
+		return err
+	}
+	if numTunnels > 0 {
+		if _, err := readTightCapabilities(c, numTunnels); err != nil {
+			return err
+		}
+		if err := writeFixedSize(c.c, int32(tightNoTunneling)); err != nil {
+			return err
+		}
+	}
+
+	var numAuthTypes uint32
+	if err := readFixedSize(c.r, &numAuthTypes); err != nil {
+		return err
+	} else if numAuthTypes == 0 {
+		// no authentication required
+		return nil
+	}
+
+	authTypes, err := readTightCapabilities(c, numAuthTypes)
+	if err != nil {
+		return err
+	}
+
+	for _, authType := range authTypes {
+		switch authType.Code {
+		case tightAuthNone:
+			return writeFixedSize(c.c, authType.Code)
+		case tightAuthVNC:
+			if err := writeFixedSize(c.c, authType.Code); err != nil {
+				return err
+			}
+			return (&VNCAuth{Password: a.Password}).Handshake(c)
+		}
+	}
+
+	codes := make([]int32, len(authTypes))
+	for i, authType := range authTypes {
+		codes[i] = authType.Code
+	}
+	return fmt.Errorf("No suitable Tight auth type found. Server supported: %v", codes)
+}
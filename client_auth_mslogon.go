@@ -0,0 +1,100 @@
+package vnc
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+)
+
+const (
+	MSLogonIISecType = SecurityType(113)
+)
+
+// MSLogonIIAuth is UltraVNC's MS-Logon II authentication, which logs in
+// with a Windows account. A 64-bit Diffie-Hellman exchange yields a key
+// that DES-encrypts the username and password.
+//
+// The key exchange is far too small to be secure; use it only over a
+// trusted network or tunnel.
+type MSLogonIIAuth struct {
+	// Username is at most 255 bytes.
+	Username string
+
+	// Password is at most 63 bytes.
+	Password string
+}
+
+func (*MSLogonIIAuth) Type() SecurityType {
+	return MSLogonIISecType
+}
+
+func (a *MSLogonIIAuth) Handshake(c *ClientConn) error {
+	if len(a.Username) >= 256 || len(a.Password) >= 64 {
+		return fmt.Errorf("MS-Logon II username or password is too long.")
+	}
+
+	var params struct {
+		Generator, Modulus, ServerKey uint64
+	}
+	if err := readFixedSize(c.r, &params); err != nil {
+		return err
+	} else if params.Modulus == 0 {
+		return fmt.Errorf("Invalid MS-Logon II modulus 0.")
+	}
+
+	var priv [8]byte
+	if _, err := rand.Read(priv[:]); err != nil {
+		return err
+	}
+	pub, key := msLogonIIKeys(params.Generator, params.Modulus, params.ServerKey, binary.BigEndian.Uint64(priv[:]))
+
+	if err := writeFixedSize(c.c, pub); err != nil {
+		return err
+	}
+
+	username, err := msLogonIIEncrypt(a.Username, 256, key)
+	if err != nil {
+		return err
+	}
+	password, err := msLogonIIEncrypt(a.Password, 64, key)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.c.Write(append(username, password...))
+	return err
+}
+
+// msLogonIIKeys computes the client's public key and the shared key of
+// the Diffie-Hellman exchange, given the server's parameters and key and
+// the client's private key.
+func msLogonIIKeys(gen, mod, serverKey, priv uint64) (pub, key uint64) {
+	m := new(big.Int).SetUint64(mod)
+	x := new(big.Int).SetUint64(priv)
+	pub = new(big.Int).Exp(new(big.Int).SetUint64(gen), x, m).Uint64()
+	key = new(big.Int).Exp(new(big.Int).SetUint64(serverKey), x, m).Uint64()
+	return
+}
+
+// msLogonIIEncrypt stores s nul-terminated in a field of the given size,
+// padded with random bytes, and encrypts it with DES in CBC mode, using
+// the shared key both as the VNC-style DES key and the IV.
+func msLogonIIEncrypt(s string, size int, key uint64) ([]byte, error) {
+	field := make([]byte, size)
+	if _, err := rand.Read(field); err != nil {
+		return nil, err
+	}
+	copy(field, s)
+	field[len(s)] = 0
+
+	keyBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(keyBytes, key)
+	block, err := vncDESCipher(keyBytes)
+	if err != nil {
+		return nil, err
+	}
+	cipher.NewCBCEncrypter(block, keyBytes).CryptBlocks(field, field)
+	return field, nil
+}
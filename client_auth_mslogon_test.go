@@ -0,0 +1,72 @@
+package vnc
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"math/big"
+	"testing"
+)
+
+func TestMSLogonIIAuth(t *testing.T) {
+	// 2^63-25, the largest prime below 2^63
+	const gen, mod, serverPriv = 5, 0x7fffffffffffffe7, 0x123456789
+	exp := func(base, e uint64) uint64 {
+		b, x, m := new(big.Int).SetUint64(base), new(big.Int).SetUint64(e), new(big.Int).SetUint64(mod)
+		return new(big.Int).Exp(b, x, m).Uint64()
+	}
+	serverKey := exp(gen, serverPriv)
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantErr  bool
+	}{
+		{"credentials", "DOMAIN\\user", "secret", false},
+		{"empty", "", "", false},
+		{"longest", string(bytes.Repeat([]byte{'u'}, 255)), string(bytes.Repeat([]byte{'p'}, 63)), false},
+		{"username too long", string(bytes.Repeat([]byte{'u'}, 256)), "", true},
+		{"password too long", "", string(bytes.Repeat([]byte{'p'}, 64)), true},
+	}
+	for _, tt := range tests {
+		c, tc := newTestClient(nil, wire(uint64(gen), uint64(mod), serverKey))
+		err := (&MSLogonIIAuth{Username: tt.username, Password: tt.password}).Handshake(c)
+		if tt.wantErr {
+			if err == nil || tc.out.Len() != 0 {
+				t.Errorf("%s: got %v, client wrote %d bytes", tt.name, err, tc.out.Len())
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		out := tc.out.Bytes()
+		if len(out) != 8+256+64 {
+			t.Errorf("%s: client wrote %d bytes", tt.name, len(out))
+			continue
+		}
+
+		// decrypt the credentials as the server does
+		keyBytes := make([]byte, 8)
+		binary.BigEndian.PutUint64(keyBytes, exp(binary.BigEndian.Uint64(out), serverPriv))
+		block, err := vncDESCipher(keyBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := out[8:]
+		cipher.NewCBCDecrypter(block, keyBytes).CryptBlocks(fields[:256], fields[:256])
+		cipher.NewCBCDecrypter(block, keyBytes).CryptBlocks(fields[256:], fields[256:])
+		username := fields[:bytes.IndexByte(fields, 0)]
+		password := fields[256 : 256+bytes.IndexByte(fields[256:], 0)]
+		if string(username) != tt.username || string(password) != tt.password {
+			t.Errorf("%s: server decrypted %q, %q", tt.name, username, password)
+		}
+	}
+
+	c, _ := newTestClient(nil, wire(uint64(gen), uint64(0), serverKey))
+	if err := (&MSLogonIIAuth{}).Handshake(c); err == nil {
+		t.Error("no error for a modulus of 0")
+	}
+}
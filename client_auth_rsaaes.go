@@ -0,0 +1,259 @@
+package vnc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+)
+
+// RealVNC RSA-AES security types. The "ne" variants only encrypt the
+// authentication, the others the whole session.
+const (
+	RA2SecType       = SecurityType(5)
+	RA2neSecType     = SecurityType(6)
+	RA2_256SecType   = SecurityType(129)
+	RA2ne_256SecType = SecurityType(130)
+)
+
+// RSA-AES credential sub-types, chosen by the server.
+const (
+	ra2UserPass = 1
+	ra2Pass     = 2
+)
+
+// Limits on the size of the server's RSA key, in bits.
+const (
+	ra2MinKeyBits = 1024
+	ra2MaxKeyBits = 8192
+)
+
+// RSAAESAuth is RealVNC's RSA-AES authentication. The client and server
+// exchange RSA public keys and use them to agree on AES keys, with which
+// the credentials, and unless NoEncryption is set the rest of the
+// session, are encrypted in EAX mode.
+type RSAAESAuth struct {
+	// Username is sent if the server asks for a username and password.
+	Username string
+
+	Password string
+
+	// NoEncryption selects the "ne" security types, which leave the
+	// session unencrypted after authentication.
+	NoEncryption bool
+
+	// AES256 selects the security types using 256-bit AES keys, derived
+	// with SHA-256, instead of 128-bit keys derived with SHA-1.
+	AES256 bool
+
+	// VerifyServerKey, if set, is called with the server's public key
+	// before anything else is sent, and aborts the handshake if it
+	// returns an error. This allows trust on first use, remembering the
+	// key and rejecting a different one later. If it is nil, any key is
+	// accepted, which leaves the connection open to interception.
+	VerifyServerKey func(key *rsa.PublicKey) error
+
+	// ClientKey is the client's RSA key. If it is nil, a 2048-bit key
+	// is generated for every handshake.
+	ClientKey *rsa.PrivateKey
+}
+
+func (a *RSAAESAuth) Type() SecurityType {
+	switch {
+	case a.NoEncryption && a.AES256:
+		return RA2ne_256SecType
+	case a.NoEncryption:
+		return RA2neSecType
+	case a.AES256:
+		return RA2_256SecType
+	}
+	return RA2SecType
+}
+
+func (a *RSAAESAuth) Handshake(c *ClientConn) error {
+	serverKey, serverKeyMsg, err := readRSAPublicKey(c)
+	if err != nil {
+		return err
+	}
+	if a.VerifyServerKey != nil {
+		if err := a.VerifyServerKey(serverKey); err != nil {
+			return err
+		}
+	}
+
+	clientKey := a.ClientKey
+	if clientKey == nil {
+		if clientKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			return err
+		}
+	}
+	clientKeyMsg := marshalRSAPublicKey(&clientKey.PublicKey)
+	if _, err := c.c.Write(clientKeyMsg); err != nil {
+		return err
+	}
+
+	// exchange randoms, each encrypted with the other side's key
+	keySize := 16
+	newHash := sha1.New
+	if a.AES256 {
+		keySize = 32
+		newHash = sha256.New
+	}
+	clientRandom := make([]byte, keySize)
+	if _, err := rand.Read(clientRandom); err != nil {
+		return err
+	}
+	encrypted, err := rsa.EncryptPKCS1v15(rand.Reader, serverKey, clientRandom)
+	if err != nil {
+		return err
+	}
+	if err := writeFixedSize(c.c, uint16(len(encrypted))); err != nil {
+		return err
+	}
+	if _, err := c.c.Write(encrypted); err != nil {
+		return err
+	}
+
+	var length uint16
+	if err := readFixedSize(c.r, &length); err != nil {
+		return err
+	} else if int(length) != clientKey.Size() {
+		return fmt.Errorf("Invalid RSA-AES random length %d.", length)
+	}
+	encrypted = make([]byte, length)
+	if _, err := io.ReadFull(c.r, encrypted); err != nil {
+		return err
+	}
+	serverRandom, err := rsa.DecryptPKCS1v15(nil, clientKey, encrypted)
+	if err != nil {
+		return err
+	} else if len(serverRandom) != keySize {
+		return fmt.Errorf("Invalid RSA-AES random size %d.", len(serverRandom))
+	}
+
+	conn, err := newRA2Conn(c, newHash, clientRandom, serverRandom)
+	if err != nil {
+		return err
+	}
+
+	// each side proves it knows both public keys
+	if _, err := conn.Write(ra2Hash(newHash, clientKeyMsg, serverKeyMsg)); err != nil {
+		return err
+	}
+	expected := ra2Hash(newHash, serverKeyMsg, clientKeyMsg)
+	serverHash := make([]byte, len(expected))
+	if _, err := io.ReadFull(conn, serverHash); err != nil {
+		return err
+	} else if subtle.ConstantTimeCompare(serverHash, expected) != 1 {
+		return fmt.Errorf("RSA-AES key hash mismatch.")
+	}
+
+	if err := a.sendCredentials(conn); err != nil {
+		return err
+	}
+
+	if !a.NoEncryption {
+		c.setConn(conn)
+	}
+	return nil
+}
+
+func (a *RSAAESAuth) sendCredentials(conn *eaxConn) error {
+	var subType uint8
+	if err := readFixedSize(conn, &subType); err != nil {
+		return err
+	}
+
+	username := a.Username
+	switch subType {
+	case ra2UserPass:
+	case ra2Pass:
+		username = ""
+	default:
+		return fmt.Errorf("Unsupported RSA-AES credential type %d.", subType)
+	}
+	if len(username) > 255 || len(a.Password) > 255 {
+		return fmt.Errorf("RSA-AES username or password is longer than 255 bytes.")
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteByte(uint8(len(username)))
+	buf.WriteString(username)
+	buf.WriteByte(uint8(len(a.Password)))
+	buf.WriteString(a.Password)
+	_, err := conn.Write(buf.Bytes())
+	return err
+}
+
+// readRSAPublicKey reads an RSA-AES public key message: the key length
+// in bits, then the modulus and the exponent, both of the key's length.
+// It returns the key and the raw message, which the key hashes cover.
+func readRSAPublicKey(c *ClientConn) (*rsa.PublicKey, []byte, error) {
+	var bits uint32
+	if err := readFixedSize(c.r, &bits); err != nil {
+		return nil, nil, err
+	} else if bits < ra2MinKeyBits || bits > ra2MaxKeyBits {
+		return nil, nil, fmt.Errorf("Unsupported RSA-AES key length %d.", bits)
+	}
+
+	size := int(bits+7) / 8
+	msg := make([]byte, 4+2*size)
+	binary.BigEndian.PutUint32(msg, bits)
+	if _, err := io.ReadFull(c.r, msg[4:]); err != nil {
+		return nil, nil, err
+	}
+
+	e := new(big.Int).SetBytes(msg[4+size:])
+	if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+		return nil, nil, fmt.Errorf("Unsupported RSA-AES public exponent %v.", e)
+	}
+	key := &rsa.PublicKey{N: new(big.Int).SetBytes(msg[4 : 4+size]), E: int(e.Int64())}
+	return key, msg, nil
+}
+
+func marshalRSAPublicKey(key *rsa.PublicKey) []byte {
+	size := key.Size()
+	msg := make([]byte, 4+2*size)
+	binary.BigEndian.PutUint32(msg, uint32(key.N.BitLen()))
+	key.N.FillBytes(msg[4 : 4+size])
+	big.NewInt(int64(key.E)).FillBytes(msg[4+size:])
+	return msg
+}
+
+// ra2Keys derives the keys encrypting each direction from the randoms:
+// the data sent by the server is encrypted with the hash of the client
+// random followed by the server random, and the data sent by the client
+// with the hash of the randoms the other way around.
+func ra2Keys(newHash func() hash.Hash, clientRandom, serverRandom []byte) (clientToServer, serverToClient []byte) {
+	keySize := len(clientRandom)
+	return ra2Hash(newHash, serverRandom, clientRandom)[:keySize],
+		ra2Hash(newHash, clientRandom, serverRandom)[:keySize]
+}
+
+func ra2Hash(newHash func() hash.Hash, a, b []byte) []byte {
+	h := newHash()
+	h.Write(a)
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// newRA2Conn returns the encrypted connection on top of the client's.
+func newRA2Conn(c *ClientConn, newHash func() hash.Hash, clientRandom, serverRandom []byte) (*eaxConn, error) {
+	encKey, decKey := ra2Keys(newHash, clientRandom, serverRandom)
+	enc, err := newEAX(encKey)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := newEAX(decKey)
+	if err != nil {
+		return nil, err
+	}
+	return &eaxConn{Conn: c.c, r: c.r, enc: enc, dec: dec}, nil
+}
@@ -0,0 +1,205 @@
+package vnc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestRA2Keys(t *testing.T) {
+	tests := []struct {
+		newHash                        func() hash.Hash
+		keySize                        int
+		clientToServer, serverToClient string
+	}{
+		{
+			sha1.New, 16,
+			"b97cd424c4711eb518790ce07939ebac",
+			"ae5bd8efea5322c4d9986d06680a7813",
+		},
+		{
+			sha256.New, 32,
+			"84e4bd6ca2af96412fdc62fe44d4e9709cdc31933081a62486a48a154b582d53",
+			"fdeab9acf3710362bd2658cdc9a29e8f9c757fcf9811603a8c447cd1d9151108",
+		},
+	}
+	for _, tt := range tests {
+		clientRandom := make([]byte, tt.keySize)
+		serverRandom := make([]byte, tt.keySize)
+		for i := range clientRandom {
+			clientRandom[i] = byte(i)
+			serverRandom[i] = byte(tt.keySize + i)
+		}
+
+		c2s, s2c := ra2Keys(tt.newHash, clientRandom, serverRandom)
+		if want := unhex(tt.clientToServer); !bytes.Equal(c2s, want) {
+			t.Errorf("client to server key = %x, want %x", c2s, want)
+		}
+		if want := unhex(tt.serverToClient); !bytes.Equal(s2c, want) {
+			t.Errorf("server to client key = %x, want %x", s2c, want)
+		}
+	}
+}
+
+// ra2Server plays the server side of the RSA-AES handshake, as
+// implemented by TigerVNC, asking for the credential type subType. It
+// returns the credentials received and a 5-byte message read from the
+// session, encrypted unless noEncryption is set.
+func ra2Server(nc net.Conn, newHash func() hash.Hash, keySize int, subType uint8, noEncryption bool, key *rsa.PrivateKey) (creds, session string, err error) {
+	r := bufio.NewReader(nc)
+	serverKeyMsg := marshalRSAPublicKey(&key.PublicKey)
+	if _, err := nc.Write(serverKeyMsg); err != nil {
+		return "", "", err
+	}
+
+	var bits uint32
+	if err := binary.Read(r, binary.BigEndian, &bits); err != nil {
+		return "", "", err
+	}
+	clientKeyMsg := make([]byte, 4+2*((bits+7)/8))
+	binary.BigEndian.PutUint32(clientKeyMsg, bits)
+	if _, err := io.ReadFull(r, clientKeyMsg[4:]); err != nil {
+		return "", "", err
+	}
+	clientKey, _, err := readRSAPublicKey(&ClientConn{r: bufio.NewReader(bytes.NewReader(clientKeyMsg))})
+	if err != nil {
+		return "", "", err
+	}
+
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", "", err
+	}
+	encrypted := make([]byte, length)
+	if _, err := io.ReadFull(r, encrypted); err != nil {
+		return "", "", err
+	}
+	clientRandom, err := rsa.DecryptPKCS1v15(nil, key, encrypted)
+	if err != nil {
+		return "", "", err
+	}
+
+	serverRandom := make([]byte, keySize)
+	rand.Read(serverRandom)
+	if encrypted, err = rsa.EncryptPKCS1v15(rand.Reader, clientKey, serverRandom); err != nil {
+		return "", "", err
+	}
+	nc.Write(append(wire(uint16(len(encrypted))), encrypted...))
+
+	// TigerVNC's SSecurityRSAAES::setCipher
+	enc, _ := newEAX(ra2Hash(newHash, clientRandom, serverRandom)[:keySize])
+	dec, _ := newEAX(ra2Hash(newHash, serverRandom, clientRandom)[:keySize])
+	conn := &eaxConn{Conn: nc, r: r, enc: enc, dec: dec}
+
+	clientHash := make([]byte, newHash().Size())
+	if _, err := io.ReadFull(conn, clientHash); err != nil {
+		return "", "", err
+	} else if !bytes.Equal(clientHash, ra2Hash(newHash, clientKeyMsg, serverKeyMsg)) {
+		return "", "", fmt.Errorf("client key hash mismatch")
+	}
+	conn.Write(ra2Hash(newHash, serverKeyMsg, clientKeyMsg))
+
+	conn.Write([]byte{subType})
+	for i := 0; i < 2; i++ {
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return "", "", err
+		}
+		field := make([]byte, size[0])
+		if _, err := io.ReadFull(conn, field); err != nil {
+			return "", "", err
+		}
+		creds += string(field) + "/"
+	}
+
+	var sr io.Reader = conn
+	if noEncryption {
+		sr = r
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(sr, buf); err != nil {
+		return creds, "", err
+	}
+	return creds, string(buf), nil
+}
+
+func TestRSAAESAuth(t *testing.T) {
+	serverKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		auth      RSAAESAuth
+		subType   uint8
+		wantCreds string
+	}{
+		{RSAAESAuth{Username: "user", Password: "secret"}, ra2UserPass, "user/secret/"},
+		{RSAAESAuth{Username: "user", Password: "secret", AES256: true}, ra2Pass, "/secret/"},
+		{RSAAESAuth{Password: "pw", NoEncryption: true}, ra2Pass, "/pw/"},
+		{RSAAESAuth{Password: "pw", NoEncryption: true, AES256: true}, ra2UserPass, "/pw/"},
+	}
+	for _, tt := range tests {
+		a, b := net.Pipe()
+		c, err := NewClientConn(&ClientConnConfig{ServerMessages: map[MessageID]ServerMessage{}}, a)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		newHash, keySize := sha1.New, 16
+		if tt.auth.AES256 {
+			newHash, keySize = sha256.New, 32
+		}
+		type result struct {
+			creds, session string
+			err            error
+		}
+		done := make(chan result, 1)
+		go func() {
+			creds, session, err := ra2Server(b, newHash, keySize, tt.subType, tt.auth.NoEncryption, serverKey)
+			if err != nil {
+				b.Close() // fail the client's handshake
+			}
+			done <- result{creds, session, err}
+		}()
+
+		var verified *rsa.PublicKey
+		tt.auth.ClientKey = clientKey
+		tt.auth.VerifyServerKey = func(key *rsa.PublicKey) error {
+			verified = key
+			return nil
+		}
+		if err := tt.auth.Handshake(c); err != nil {
+			t.Fatalf("%d: %v", tt.auth.Type(), err)
+		}
+		if verified == nil || verified.N.Cmp(serverKey.N) != 0 {
+			t.Errorf("%d: VerifyServerKey was not called with the server key", tt.auth.Type())
+		}
+
+		// after the credentials, the session goes on encrypted unless
+		// NoEncryption is set
+		c.c.Write([]byte("hello"))
+		res := <-done
+		if res.creds != tt.wantCreds {
+			t.Errorf("%d: server received %q, want %q (%v)", tt.auth.Type(), res.creds, tt.wantCreds, res.err)
+		}
+		if res.err != nil || res.session != "hello" {
+			t.Errorf("%d: session = %q, %v", tt.auth.Type(), res.session, res.err)
+		}
+		a.Close()
+		b.Close()
+	}
+}
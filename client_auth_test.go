@@ -0,0 +1,153 @@
+package vnc
+
+import (
+	"bytes"
+	"crypto/des"
+	"errors"
+	"math/bits"
+	"testing"
+)
+
+func tightCap(code int32, vendor, name string) tightCapability {
+	c := tightCapability{Code: code}
+	copy(c.Vendor[:], vendor)
+	copy(c.Name[:], name)
+	return c
+}
+
+// serverInit returns a ServerInit message for a 640x480 RGB888
+// framebuffer with the given desktop name.
+func serverInit(name string) []byte {
+	pf, _ := PixelFormatRGB888().MarshalBinary()
+	return wire(uint16(640), uint16(480), pf, uint32(len(name)), name)
+}
+
+func TestTightAuth(t *testing.T) {
+	challenge := bytes.Repeat([]byte{0x42}, 16)
+	response, err := (&VNCAuth{}).encrypt("secret", challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tightInit := wire(uint16(1), uint16(1), uint16(2), uint16(0),
+		tightCap(150, "TGHT", "CUS_EOCU"),
+		tightCap(132, "TGHT", "CUS_FTRT"),
+		tightCap(7, "TGHT", "TIGHT___"),
+		tightCap(-239, "TGHT", "RCHCURSR"))
+
+	tests := []struct {
+		name   string
+		server []byte
+		want   []byte // written by the client
+	}{
+		{
+			name: "no tunnels, no auth",
+			server: wire(ProtocolVersion3_8, uint8(1), TightSecType,
+				uint32(0), uint32(0), uint32(0), serverInit("tight"), tightInit),
+			want: wire(ProtocolVersion3_8, TightSecType, uint8(1)),
+		},
+		{
+			name: "tunnel and None auth",
+			server: wire(ProtocolVersion3_8, uint8(2), VNCSecType, TightSecType,
+				uint32(1), tightCap(tightNoTunneling, "TGHT", "NOTUNNEL"),
+				uint32(2), tightCap(113, "VENC", "VENCRYPT"), tightCap(tightAuthNone, "STDV", "NOAUTH__"),
+				uint32(0), serverInit("tight"), tightInit),
+			want: wire(ProtocolVersion3_8, TightSecType, int32(tightNoTunneling), int32(tightAuthNone), uint8(1)),
+		},
+		{
+			name: "VNC auth",
+			server: wire(ProtocolVersion3_8, uint8(1), TightSecType,
+				uint32(0), uint32(1), tightCap(tightAuthVNC, "STDV", "VNCAUTH_"), challenge,
+				uint32(0), serverInit("tight"), tightInit),
+			want: wire(ProtocolVersion3_8, TightSecType, int32(tightAuthVNC),
+				response, uint8(1)),
+		},
+	}
+	for _, tt := range tests {
+		cfg := &ClientConnConfig{Auth: []ClientAuth{&TightAuth{Password: "secret"}}}
+		c, tc := newTestClient(cfg, tt.server)
+		if err := c.Handshake(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := tc.out.Bytes(); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: client wrote %v, want %v", tt.name, got, tt.want)
+		}
+
+		want := &TightServerCaps{
+			ServerMessages: []TightCapability{{150, "TGHT", "CUS_EOCU"}},
+			ClientMessages: []TightCapability{{132, "TGHT", "CUS_FTRT"}},
+			Encodings:      []TightCapability{{7, "TGHT", "TIGHT___"}, {-239, "TGHT", "RCHCURSR"}},
+		}
+		if caps := c.ServerCaps; caps == nil || len(caps.Encodings) != 2 ||
+			caps.ServerMessages[0] != want.ServerMessages[0] || caps.ClientMessages[0] != want.ClientMessages[0] ||
+			caps.Encodings[0] != want.Encodings[0] || caps.Encodings[1] != want.Encodings[1] {
+			t.Errorf("%s: server caps %+v, want %+v", tt.name, caps, want)
+		}
+		if c.DesktopName != "tight" || c.FrameBufferWidth != 640 {
+			t.Errorf("%s: ServerInit read as %q %dx%d", tt.name, c.DesktopName, c.FrameBufferWidth, c.FrameBufferHeight)
+		}
+	}
+}
+
+func TestVNCAuth(t *testing.T) {
+	challenge := []byte("0123456789abcdef")
+	tests := []struct {
+		name    string
+		auth    VNCAuth
+		key     string // the DES key the server derives from its password
+		wantErr bool
+	}{
+		{"password", VNCAuth{Password: "secret"}, "secret\x00\x00", false},
+		{"8 bytes", VNCAuth{Password: "12345678"}, "12345678", false},
+		{"empty", VNCAuth{}, "\x00\x00\x00\x00\x00\x00\x00\x00", false},
+		{"truncated", VNCAuth{Password: "123456789", AllowTruncate: true}, "12345678", false},
+		{"too long", VNCAuth{Password: "123456789"}, "", true},
+	}
+	for _, tt := range tests {
+		c, tc := newTestClient(nil, challenge)
+		err := tt.auth.Handshake(c)
+		if tt.wantErr {
+			if err == nil || tc.in.Len() != len(challenge) {
+				t.Errorf("%s: got %v, challenge read", tt.name, err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		// VNC servers reverse the bits of each byte of the DES key
+		key := []byte(tt.key)
+		for i := range key {
+			key[i] = bits.Reverse8(key[i])
+		}
+		block, err := des.NewCipher(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := make([]byte, 16)
+		block.Encrypt(want, challenge)
+		block.Encrypt(want[8:], challenge[8:])
+		if !bytes.Equal(tc.out.Bytes(), want) {
+			t.Errorf("%s: response %x, want %x", tt.name, tc.out.Bytes(), want)
+		}
+	}
+}
+
+func TestTightAuthCountLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		server []byte
+	}{
+		{"tunnels", wire(uint32(0xffffffff))},
+		{"auth types", wire(uint32(0), uint32(0xffffffff))},
+	}
+	for _, tt := range tests {
+		c, _ := newTestClient(nil, tt.server)
+		err := (&TightAuth{}).Handshake(c)
+		var sizeErr *MessageSizeError
+		if !errors.As(err, &sizeErr) {
+			t.Errorf("%s: got %v, want a MessageSizeError", tt.name, err)
+		}
+	}
+}
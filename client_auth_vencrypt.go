@@ -0,0 +1,192 @@
+package vnc
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	VeNCryptSecType = SecurityType(19)
+)
+
+// VeNCrypt sub-types.
+const (
+	VeNCryptPlain     = uint32(256)
+	VeNCryptTLSNone   = uint32(257)
+	VeNCryptTLSVnc    = uint32(258)
+	VeNCryptTLSPlain  = uint32(259)
+	VeNCryptX509None  = uint32(260)
+	VeNCryptX509Vnc   = uint32(261)
+	VeNCryptX509Plain = uint32(262)
+)
+
+// VeNCryptAuth is the VeNCrypt security type, which upgrades the
+// connection to TLS and then runs an inner authentication over the
+// encrypted stream.
+//
+// The TLS sub-types are meant for anonymous Diffie-Hellman cipher
+// suites, which crypto/tls does not implement; they only work with
+// servers that present a certificate. Set InsecureSkipVerify in
+// TLSConfig to accept self-signed certificates.
+type VeNCryptAuth struct {
+	// SubTypes lists the sub-types the client accepts, in order of
+	// preference. If empty, the X509 and TLS variants of None and VNC
+	// authentication are accepted, plus Plain if Username is set.
+	SubTypes []uint32
+
+	// TLSConfig is used to establish the TLS connection. If it is nil
+	// or has no ServerName, the host of the ClientConnConfig address is
+	// used as the server name.
+	TLSConfig *tls.Config
+
+	// Username is used by the Plain sub-types.
+	Username string
+
+	// Password is used by the Vnc and Plain sub-types.
+	Password string
+}
+
+func (*VeNCryptAuth) Type() SecurityType {
+	return VeNCryptSecType
+}
+
+func (a *VeNCryptAuth) Handshake(c *ClientConn) error {
+	var version [2]uint8
+	if err := readFixedSize(c.r, &version); err != nil {
+		return err
+	} else if version[0] != 0 || version[1] < 2 {
+		return fmt.Errorf("Unsupported VeNCrypt version %d.%d.", version[0], version[1])
+	}
+
+	// we only speak version 0.2
+	if err := writeFixedSize(c.c, [2]uint8{0, 2}); err != nil {
+		return err
+	}
+
+	var status uint8
+	if err := readFixedSize(c.r, &status); err != nil {
+		return err
+	} else if status != 0 {
+		return fmt.Errorf("Server rejected VeNCrypt version 0.2.")
+	}
+
+	var numSubTypes uint8
+	if err := readFixedSize(c.r, &numSubTypes); err != nil {
+		return err
+	}
+	serverSubTypes := make([]uint32, numSubTypes)
+	if err := readFixedSize(c.r, serverSubTypes); err != nil {
+		return err
+	}
+
+	var subType uint32
+FindSubType:
+	for _, st := range a.subTypes() {
+		for _, serverSt := range serverSubTypes {
+			if st == serverSt {
+				subType = st
+				break FindSubType
+			}
+		}
+	}
+	if subType == 0 {
+		return fmt.Errorf("No suitable VeNCrypt sub-type found. Server supported: %v", serverSubTypes)
+	}
+
+	if err := writeFixedSize(c.c, subType); err != nil {
+		return err
+	}
+
+	if subType != VeNCryptPlain {
+		var ack uint8
+		if err := readFixedSize(c.r, &ack); err != nil {
+			return err
+		} else if ack != 1 {
+			return fmt.Errorf("Server rejected VeNCrypt sub-type %d.", subType)
+		}
+
+		if err := a.upgradeTLS(c); err != nil {
+			return err
+		}
+	}
+
+	switch subType {
+	case VeNCryptTLSVnc, VeNCryptX509Vnc:
+		return (&VNCAuth{Password: a.Password}).Handshake(c)
+	case VeNCryptPlain, VeNCryptTLSPlain, VeNCryptX509Plain:
+		return a.sendPlain(c)
+	}
+	return nil
+}
+
+func (a *VeNCryptAuth) subTypes() []uint32 {
+	if len(a.SubTypes) > 0 {
+		return a.SubTypes
+	}
+
+	subTypes := []uint32{VeNCryptX509Vnc, VeNCryptTLSVnc, VeNCryptX509None, VeNCryptTLSNone}
+	if a.Username != "" {
+		subTypes = append([]uint32{VeNCryptX509Plain, VeNCryptTLSPlain}, subTypes...)
+	}
+	return subTypes
+}
+
+// upgradeTLS replaces the connection and its reader with a TLS client
+// connection on top of the current one.
+func (a *VeNCryptAuth) upgradeTLS(c *ClientConn) error {
+	cfg := a.TLSConfig
+	if cfg == nil || (cfg.ServerName == "" && !cfg.InsecureSkipVerify) {
+		if cfg == nil {
+			cfg = new(tls.Config)
+		} else {
+			cfg = cfg.Clone()
+		}
+		if host, _, err := net.SplitHostPort(c.config.Address); err == nil {
+			cfg.ServerName = host
+		} else {
+			cfg.ServerName = c.config.Address
+		}
+	}
+
+	// Bytes the server sent after the acknowledgement may already be
+	// buffered, so the TLS connection must read those first.
+	var conn net.Conn = c.c
+	if n := c.r.Buffered(); n > 0 {
+		buffered := make([]byte, n)
+		if _, err := io.ReadFull(c.r, buffered); err != nil {
+			return err
+		}
+		conn = &prefixConn{conn, io.MultiReader(bytes.NewReader(buffered), c.c)}
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+
+	c.setConn(tlsConn)
+	return nil
+}
+
+func (a *VeNCryptAuth) sendPlain(c *ClientConn) error {
+	lengths := [2]uint32{uint32(len(a.Username)), uint32(len(a.Password))}
+	if err := writeFixedSize(c.c, lengths); err != nil {
+		return err
+	}
+	_, err := c.c.Write([]byte(a.Username + a.Password))
+	return err
+}
+
+// prefixConn is a net.Conn that reads from r instead of the connection,
+// used to replay data that was read ahead of a protocol upgrade.
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
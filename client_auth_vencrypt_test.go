@@ -0,0 +1,170 @@
+package vnc
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestVeNCryptAuth(t *testing.T) {
+	tests := []struct {
+		name    string
+		auth    VeNCryptAuth
+		server  []byte
+		client  []byte
+		wantErr bool
+	}{
+		{"Plain", VeNCryptAuth{SubTypes: []uint32{VeNCryptPlain}, Username: "user", Password: "secret"},
+			wire([2]uint8{0, 2}, uint8(0), uint8(2), VeNCryptTLSNone, VeNCryptPlain),
+			wire([2]uint8{0, 2}, VeNCryptPlain, uint32(4), uint32(6), "usersecret"), false},
+		{"newer version", VeNCryptAuth{SubTypes: []uint32{VeNCryptPlain}},
+			wire([2]uint8{0, 3}, uint8(0), uint8(1), VeNCryptPlain),
+			wire([2]uint8{0, 2}, VeNCryptPlain, uint32(0), uint32(0)), false},
+		{"version 0.1", VeNCryptAuth{},
+			wire([2]uint8{0, 1}), nil, true},
+		{"version rejected", VeNCryptAuth{},
+			wire([2]uint8{0, 2}, uint8(1)), wire([2]uint8{0, 2}), true},
+		{"no suitable sub-type", VeNCryptAuth{Username: "user"},
+			wire([2]uint8{0, 2}, uint8(0), uint8(1), VeNCryptPlain), wire([2]uint8{0, 2}), true},
+		{"sub-type rejected", VeNCryptAuth{},
+			wire([2]uint8{0, 2}, uint8(0), uint8(1), VeNCryptTLSNone, uint8(0)),
+			wire([2]uint8{0, 2}, VeNCryptTLSNone), true},
+	}
+	for _, tt := range tests {
+		c, tc := newTestClient(nil, tt.server)
+		err := tt.auth.Handshake(c)
+		if tt.wantErr && err == nil {
+			t.Errorf("%s: no error", tt.name)
+		} else if !tt.wantErr && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !bytes.Equal(tc.out.Bytes(), tt.client) {
+			t.Errorf("%s: client wrote %x, want %x", tt.name, tc.out.Bytes(), tt.client)
+		}
+	}
+}
+
+func TestVeNCryptSubTypes(t *testing.T) {
+	tests := []struct {
+		auth VeNCryptAuth
+		want []uint32
+	}{
+		{VeNCryptAuth{}, []uint32{VeNCryptX509Vnc, VeNCryptTLSVnc, VeNCryptX509None, VeNCryptTLSNone}},
+		{VeNCryptAuth{Username: "user"}, []uint32{VeNCryptX509Plain, VeNCryptTLSPlain,
+			VeNCryptX509Vnc, VeNCryptTLSVnc, VeNCryptX509None, VeNCryptTLSNone}},
+		{VeNCryptAuth{SubTypes: []uint32{VeNCryptPlain}, Username: "user"}, []uint32{VeNCryptPlain}},
+	}
+	for _, tt := range tests {
+		if got := tt.auth.subTypes(); !equalUint32s(got, tt.want) {
+			t.Errorf("%+v: got sub-types %v, want %v", tt.auth, got, tt.want)
+		}
+	}
+}
+
+func equalUint32s(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// selfSignedCert returns a certificate for the host name "vnc".
+func selfSignedCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "vnc"},
+		DNSNames:     []string{"vnc"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestVeNCryptTLS(t *testing.T) {
+	cert := selfSignedCert(t)
+	challenge := []byte("0123456789abcdef")
+	wantResponse, err := (&VNCAuth{}).encrypt("secret", challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, server := newPipeClient(t)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- func() error {
+			server.Write(wire([2]uint8{0, 2}))
+			var version [2]uint8
+			var subType uint32
+			if err := readFixedSize(server, &version); err != nil {
+				return err
+			}
+			server.Write(wire(uint8(0), uint8(2), VeNCryptTLSNone, VeNCryptTLSVnc))
+			if err := readFixedSize(server, &subType); err != nil {
+				return err
+			}
+			server.Write(wire(uint8(1)))
+
+			// VNC authentication and messages over TLS
+			tlsConn := tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}})
+			if _, err := tlsConn.Write(challenge); err != nil {
+				return err
+			}
+			response := make([]byte, 16+6)
+			if _, err := io.ReadFull(tlsConn, response); err != nil {
+				return err
+			}
+			if !bytes.Equal(response, append(wantResponse, wire(PointerEventMID, uint8(1), uint16(2), uint16(3))...)) {
+				t.Errorf("server received %x", response)
+			}
+			_, err := tlsConn.Write(wire(BellMID))
+			return err
+		}()
+	}()
+
+	auth := &VeNCryptAuth{Password: "secret", TLSConfig: &tls.Config{RootCAs: x509.NewCertPool()}}
+	auth.TLSConfig.RootCAs.AddCert(mustParseCert(t, cert.Certificate[0]))
+	c.config.Address = "vnc:5900"
+	if err := auth.Handshake(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendMsg(&PointerEventMsg{ButtonMask: 1, X: 2, Y: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := c.ReceiveMsg(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := msg.(*BellMsg); !ok {
+		t.Errorf("got %T over TLS, want a BellMsg", msg)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustParseCert(t *testing.T, der []byte) *x509.Certificate {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
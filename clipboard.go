@@ -0,0 +1,213 @@
+package vnc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ExtendedClipboardPseudoEncType is the Extended Clipboard
+// pseudo-encoding (0xC0A1E5CE). A client includes it in SetEncodings to
+// announce support for the extended cut text messages.
+const ExtendedClipboardPseudoEncType = EncodingType(-1063131698)
+
+// Extended clipboard formats, the lower 16 bits of the flags.
+const (
+	ClipboardText  = 1 << 0
+	ClipboardRTF   = 1 << 1
+	ClipboardHTML  = 1 << 2
+	ClipboardDIB   = 1 << 3
+	ClipboardFiles = 1 << 4
+
+	clipboardFormatMask = 0xffff
+)
+
+// Extended clipboard actions, the upper 8 bits of the flags.
+const (
+	ClipboardCaps    = 1 << 24
+	ClipboardRequest = 1 << 25
+	ClipboardPeek    = 1 << 26
+	ClipboardNotify  = 1 << 27
+	ClipboardProvide = 1 << 28
+)
+
+// ExtendedClipboardPseudoEncoding announces support for the extended
+// clipboard. The server never sends rectangles with it.
+type ExtendedClipboardPseudoEncoding struct{}
+
+func (*ExtendedClipboardPseudoEncoding) Type() EncodingType {
+	return ExtendedClipboardPseudoEncType
+}
+
+func (*ExtendedClipboardPseudoEncoding) Read(*ClientConn, *Rectangle) (Encoding, error) {
+	return new(ExtendedClipboardPseudoEncoding), nil
+}
+
+// ExtendedClipboard is the content of an extended clipboard message.
+// Flags combines one action with the formats it applies to.
+type ExtendedClipboard struct {
+	Flags uint32
+
+	// Sizes holds the maximum size accepted for each format of a Caps
+	// action, in the order of the format bits.
+	Sizes []uint32
+
+	// Data holds the data of each format of a Provide action, keyed by
+	// format.
+	Data map[uint32][]byte
+}
+
+// Action returns the action bits of the flags.
+func (cb *ExtendedClipboard) Action() uint32 {
+	return cb.Flags &^ clipboardFormatMask
+}
+
+// Formats returns the format bits of the flags.
+func (cb *ExtendedClipboard) Formats() uint32 {
+	return cb.Flags & clipboardFormatMask
+}
+
+// Text returns the text provided by a Provide action, with line endings
+// converted to "\n".
+func (cb *ExtendedClipboard) Text() (string, bool) {
+	data, ok := cb.Data[ClipboardText]
+	if !ok {
+		return "", false
+	}
+
+	// text is null-terminated UTF-8 with CRLF line endings
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		data = data[:i]
+	}
+	return strings.Replace(string(data), "\r\n", "\n", -1), true
+}
+
+// ExtendedClipboard reports whether the server announced support for
+// text through the Extended Clipboard, in which case ClientCutTextMsg
+// sends UTF-8 text.
+func (c *ClientConn) ExtendedClipboard() bool {
+	return c.clipboardCaps != nil && c.clipboardCaps.Flags&ClipboardText != 0
+}
+
+// readExtendedClipboard parses the payload of an extended cut text
+// message. The data of a Provide message may inflate to at most
+// maxSize bytes, so a small payload can't exhaust the memory.
+func readExtendedClipboard(payload []byte, maxSize int64) (*ExtendedClipboard, error) {
+	r := bytes.NewReader(payload)
+	cb := new(ExtendedClipboard)
+	if err := readFixedSize(r, &cb.Flags); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case cb.Flags&ClipboardCaps != 0:
+		for f := uint32(1); f <= clipboardFormatMask; f <<= 1 {
+			if cb.Flags&f == 0 {
+				continue
+			}
+			var size uint32
+			if err := readFixedSize(r, &size); err != nil {
+				return nil, err
+			}
+			cb.Sizes = append(cb.Sizes, size)
+		}
+
+	case cb.Flags&ClipboardProvide != 0:
+		zr, err := zlib.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		lr := &io.LimitedReader{R: zr, N: maxSize}
+
+		cb.Data = make(map[uint32][]byte)
+		for f := uint32(1); f <= clipboardFormatMask; f <<= 1 {
+			if cb.Flags&f == 0 {
+				continue
+			}
+			var size uint32
+			if err := readFixedSize(lr, &size); err != nil {
+				return nil, err
+			}
+			if int64(size) > lr.N {
+				return nil, &MessageSizeError{Size: maxSize - lr.N + int64(size), Max: maxSize}
+			}
+			data := new(bytes.Buffer)
+			if _, err := io.CopyN(data, lr, int64(size)); err != nil {
+				return nil, err
+			}
+			cb.Data[f] = data.Bytes()
+		}
+	}
+
+	return cb, nil
+}
+
+// ExtendedClientCutTextMsg sends an extended clipboard message to a
+// server that supports the Extended Clipboard pseudo-encoding.
+type ExtendedClientCutTextMsg struct {
+	ExtendedClipboard
+}
+
+func (m *ExtendedClientCutTextMsg) Send(c *ClientConn) error {
+	payload := new(bytes.Buffer)
+	if err := writeFixedSize(payload, m.Flags); err != nil {
+		return err
+	}
+
+	switch {
+	case m.Flags&ClipboardCaps != 0:
+		if err := writeFixedSize(payload, m.Sizes); err != nil {
+			return err
+		}
+
+	case m.Flags&ClipboardProvide != 0:
+		zw := zlib.NewWriter(payload)
+		for f := uint32(1); f <= clipboardFormatMask; f <<= 1 {
+			if m.Flags&f == 0 {
+				continue
+			}
+			data, ok := m.Data[f]
+			if !ok {
+				return fmt.Errorf("no clipboard data for format %#x", f)
+			}
+			if err := writeFixedSize(zw, uint32(len(data))); err != nil {
+				return err
+			}
+			if _, err := zw.Write(data); err != nil {
+				return err
+			}
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, 4, 8+payload.Len())
+	buf[0] = byte(ClientCutTextMID)
+	w := bytes.NewBuffer(buf)
+
+	// a negative length marks the extended format
+	if err := writeFixedSize(w, -int32(payload.Len())); err != nil {
+		return err
+	} else if _, err = payload.WriteTo(w); err != nil {
+		return err
+	} else if _, err = c.w.Write(w.Bytes()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// NewClipboardTextProvide returns an ExtendedClientCutTextMsg providing
+// text in the UTF-8 text format.
+func NewClipboardTextProvide(text string) *ExtendedClientCutTextMsg {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	text = strings.Replace(text, "\n", "\r\n", -1)
+	return &ExtendedClientCutTextMsg{ExtendedClipboard{
+		Flags: ClipboardProvide | ClipboardText,
+		Data:  map[uint32][]byte{ClipboardText: append([]byte(text), 0)},
+	}}
+}
@@ -0,0 +1,123 @@
+package vnc
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// sentAsServerCutText returns the cut text message sent by the client
+// framed as the server's ServerCutText message, without its type.
+func sentAsServerCutText(t *testing.T, m ClientMessage) []byte {
+	c, tc := newTestClient(nil, nil)
+	if err := c.SendMsg(m); err != nil {
+		t.Fatal(err)
+	}
+	return tc.out.Bytes()[1:]
+}
+
+func TestExtendedClipboardRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *ExtendedClientCutTextMsg
+	}{
+		{"caps", &ExtendedClientCutTextMsg{ExtendedClipboard{
+			Flags: ClipboardCaps | ClipboardText | ClipboardHTML,
+			Sizes: []uint32{20 << 20, 1 << 20},
+		}}},
+		{"provide", &ExtendedClientCutTextMsg{ExtendedClipboard{
+			Flags: ClipboardProvide | ClipboardText | ClipboardRTF,
+			Data:  map[uint32][]byte{ClipboardText: []byte("héllo\r\n\x00"), ClipboardRTF: []byte(`{\rtf1}`)},
+		}}},
+		{"request", &ExtendedClientCutTextMsg{ExtendedClipboard{Flags: ClipboardRequest | ClipboardText}}},
+	}
+	for _, tt := range tests {
+		c, _ := newTestClient(nil, sentAsServerCutText(t, tt.msg))
+		m, err := new(ServerCutTextMsg).Receive(c)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		cb := m.(*ServerCutTextMsg).Extended
+		if cb == nil || cb.Flags != tt.msg.Flags || len(cb.Sizes) != len(tt.msg.Sizes) || len(cb.Data) != len(tt.msg.Data) {
+			t.Errorf("%s: received %+v, want %+v", tt.name, cb, tt.msg.ExtendedClipboard)
+			continue
+		}
+		for i, size := range tt.msg.Sizes {
+			if cb.Sizes[i] != size {
+				t.Errorf("%s: size %d = %d, want %d", tt.name, i, cb.Sizes[i], size)
+			}
+		}
+		for f, data := range tt.msg.Data {
+			if !bytes.Equal(cb.Data[f], data) {
+				t.Errorf("%s: format %#x data %q, want %q", tt.name, f, cb.Data[f], data)
+			}
+		}
+	}
+
+	c, _ := newTestClient(nil, sentAsServerCutText(t, NewClipboardTextProvide("a\nb")))
+	m, err := new(ServerCutTextMsg).Receive(c)
+	if err != nil || m.(*ServerCutTextMsg).Text != "a\nb" {
+		t.Errorf("text provide received as %+v, %v", m, err)
+	}
+}
+
+func TestClientCutTextExtended(t *testing.T) {
+	caps := sentAsServerCutText(t, &ExtendedClientCutTextMsg{ExtendedClipboard{
+		Flags: ClipboardCaps | ClipboardText,
+		Sizes: []uint32{1 << 20},
+	}})
+	c, tc := newTestClient(nil, append([]byte{byte(ServerCutTextMID)}, caps...))
+
+	// UTF-8 text needs the Extended Clipboard
+	if err := c.SendMsg(&ClientCutTextMsg{Text: "€"}); err == nil {
+		t.Error("no error before the server announced the Extended Clipboard")
+	}
+	if _, err := c.ReceiveMsg(); err != nil {
+		t.Fatal(err)
+	} else if !c.ExtendedClipboard() {
+		t.Fatal("Extended Clipboard not announced")
+	}
+
+	tc.out.Reset()
+	if err := c.SendMsg(&ClientCutTextMsg{Text: "€"}); err != nil {
+		t.Fatal(err)
+	}
+	want := sentAsServerCutText(t, NewClipboardTextProvide("€"))
+	if got := tc.out.Bytes(); len(got) == 0 || !bytes.Equal(got[1:], want) {
+		t.Errorf("sent %x, want a text Provide message", got)
+	}
+}
+
+func TestExtendedClipboardInflateLimit(t *testing.T) {
+	const max = 1 << 20
+	tests := []struct {
+		name    string
+		data    map[uint32][]byte
+		wantErr bool
+	}{
+		{"within the limit", map[uint32][]byte{ClipboardText: make([]byte, max/2)}, false},
+		{"one format", map[uint32][]byte{ClipboardText: make([]byte, 2*max)}, true},
+		{"all formats", map[uint32][]byte{ClipboardText: make([]byte, max/2), ClipboardHTML: make([]byte, max/2)}, true},
+	}
+	for _, tt := range tests {
+		var flags uint32 = ClipboardProvide
+		for f := range tt.data {
+			flags |= f
+		}
+		// the zeros compress to a payload far below the limit
+		payload := sentAsServerCutText(t, &ExtendedClientCutTextMsg{ExtendedClipboard{Flags: flags, Data: tt.data}})
+		if len(payload) > max/100 {
+			t.Fatalf("%s: payload of %d bytes", tt.name, len(payload))
+		}
+
+		c, _ := newTestClient(&ClientConnConfig{MaxMessageSize: max}, payload)
+		_, err := new(ServerCutTextMsg).Receive(c)
+		var sizeErr *MessageSizeError
+		if tt.wantErr && !errors.As(err, &sizeErr) {
+			t.Errorf("%s: got %v, want a MessageSizeError", tt.name, err)
+		} else if !tt.wantErr && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
@@ -1,4 +1,4 @@
-// Package vnc implements the client side of the Remote Framebuffer protocol, typically used in VNC clients.
+// Package vnc implements the Remote Framebuffer protocol, typically used in VNC clients and servers.
 //
 // References:
 //   [PROTOCOL]: http://tools.ietf.org/html/rfc6143
@@ -6,26 +6,45 @@ package vnc
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
+	"sync"
+	"time"
 )
 
 type ClientConn struct {
 	c               net.Conn
 	r               *bufio.Reader
+	w               *bufio.Writer // client messages, flushed by SendMsg
+	sendMu          sync.Mutex    // serializes SendMsg and Flush
 	config          *ClientConnConfig
 	protocolVersion string
 	securityType    SecurityType
 
+	// The TLS config of a connection made with DialTLS, used to redial
+	// in Reconnect.
+	tlsConfig *tls.Config
+
 	// encodingMap supported by the client. This should not be modified
 	// directly. Instead, SetEncodings should be used.
 	encodingMap map[EncodingType]Encoding
 
+	// Encodings registered on this connection with RegisterEncoding.
+	registeredEncodings map[EncodingType]Encoding
+
 	// The pixel format associated with the connection. This shouldn't
 	// be modified. If you wish to set a new pixel format, use the
 	// SetPixelFormat method.
 	pixelFormat *PixelFormat
 
+	// The last SetEncodings and SetPixelFormat messages sent on the
+	// connection, kept so they can be replayed on a new connection.
+	lastSetEncodings   *SetEncodingsMsg
+	lastSetPixelFormat *SetPixelFormatMsg
+
 	// Width of the frame buffer in pixels, sent from the server.
 	FrameBufferWidth uint16
 
@@ -34,6 +53,37 @@ type ClientConn struct {
 
 	// Name associated with the desktop, sent from the server.
 	DesktopName string
+
+	// The interaction capabilities sent by the server after ServerInit
+	// when the Tight security type is used, or nil otherwise.
+	ServerCaps *TightServerCaps
+
+	// Arrival times of framebuffer updates, used for Stats.
+	frameRate frameRate
+
+	// The zlib streams of the Tight encoding.
+	tightZlib zlibStreams
+
+	// The zlib stream of the ZRLE encoding.
+	zrleZlib zlibStreams
+
+	// The Caps message of the server's Extended Clipboard, if any.
+	clipboardCaps *ExtendedClipboard
+
+	// The sample format last set for the QEMU audio stream.
+	qemuAudioFormat QEMUAudioFormat
+
+	// The channels of StartAutoRefresh, notified of every update.
+	refreshMu    sync.Mutex
+	refreshChans []chan updateSize
+
+	// Bytes read from the connection with StrictFraming or Metrics,
+	// counted to know how many bytes a decoder consumed.
+	bytesRead int64
+
+	// Serializes writes to the WireLog, and pauses it if non-zero.
+	wireLogMu  sync.Mutex
+	wireLogOff int32
 }
 
 // A ClientConnConfig structure is used to configure a ClientConn. After
@@ -52,17 +102,129 @@ type ClientConnConfig struct {
 
 	// A map of supported messages that can be read from the server.
 	// This only needs to contain NEW server messages, and doesn't
-	// need to explicitly contain the RFC-required messages.
+	// need to explicitly contain the RFC-required messages. It may
+	// replace them though, e.g. with StreamingFramebufferUpdateMsg.
 	ServerMessages map[MessageID]ServerMessage
+
+	// DefaultServerMessage, if set, is called to read server messages
+	// whose ID is not in ServerMessages, after the ID has been read. It
+	// must read the whole message, for instance skipping a message of a
+	// known length. Without it, ReceiveMsg returns an
+	// UnsupportedMessageError.
+	DefaultServerMessage func(c *ClientConn, id MessageID) (ServerMessage, error)
+
+	// Strict enables strict RFC 6143 compliance checking. Servers that
+	// deviate from the protocol, e.g. by announcing a non-standard
+	// version, returning an undefined SecurityResult or sending
+	// rectangles outside the framebuffer, are rejected with an error
+	// instead of being tolerated. This is mostly useful for testing
+	// servers for conformance.
+	Strict bool
+
+	// StrictFraming checks that encodings implementing FramedEncoding
+	// consume exactly the bytes of their rectangles, and returns an
+	// error naming the encoding otherwise. A decoder consuming too few
+	// or too many bytes desynchronizes the message stream, which
+	// otherwise shows up as obscure errors in later messages.
+	StrictFraming bool
+
+	// KeepAlive sets the period of the TCP keep-alive probes of the
+	// connection if positive, and disables them if negative. If 0, the
+	// system defaults are kept. Like TCP_NODELAY, which is always set
+	// so input events aren't delayed by Nagle's algorithm, it applies
+	// to connections given to NewClientConn too, if they are TCP
+	// connections or TLS connections over one.
+	KeepAlive time.Duration
+
+	// BatchWrites leaves the messages sent with SendMsg buffered until
+	// Flush is called, so several messages, such as a burst of input
+	// events, go out in a single write. Without it, SendMsg flushes
+	// every message.
+	BatchWrites bool
+
+	// Metrics, if set, receives the time and bytes taken to decode each
+	// rectangle. See DecodeMetrics for an implementation.
+	Metrics Metrics
+
+	// DecodeLimiter, if set, bounds the number of rectangles decoded at
+	// the same time by all the connections sharing it. Receiving a
+	// framebuffer update blocks while the limit is reached.
+	DecodeLimiter *DecodeLimiter
+
+	// OnBell, if set, receives a value for every Bell message, whether
+	// the messages are read with ReceiveMsg, Listen or a Session. The
+	// receive loop never blocks on it: bells arriving while the channel
+	// is full are dropped, so give it a buffer if they all matter.
+	OnBell chan struct{}
+
+	// WireLog, if set, receives a copy of the bytes read from and
+	// written to the server, for debugging. Each chunk is written as a
+	// direction marker, WireLogRead or WireLogWrite, its length as a
+	// 4-byte big-endian integer and the bytes. Connections upgraded by
+	// the security handshake, e.g. to TLS, are logged decrypted. See
+	// ClientConn.SetWireLogging to pause it.
+	WireLog io.Writer
+
+	// Recorder, if set, records the bytes read from the server, which
+	// can be replayed with ReplayConn. Like WireLog, it records
+	// connections upgraded by the security handshake decrypted, and
+	// errors writing the recording are ignored.
+	Recorder *Recorder
+
+	// Logger, if set, receives trace messages about the handshake
+	// phases, the messages received and the rectangles decoded.
+	Logger Logger
+
+	// MaxMessageSize limits the length the server may declare for
+	// variable-length data, such as cut text, the desktop name or a
+	// failure reason, so a hostile server can't make the client
+	// allocate huge buffers. If 0, DefaultMaxMessageSize is used.
+	MaxMessageSize uint32
+
+	// OnRectangle, if set, is called with every rectangle of a
+	// framebuffer update once it is decoded, before the update is
+	// returned, to report progress. The index counts from 0 and total
+	// is the number of rectangles the server declared, which is 65535
+	// when the server ends the update with a LastRect pseudo-rectangle.
+	OnRectangle func(index, total int, rect *Rectangle)
+
+	// OnPixelFormatChange, if set, is called with the new pixel format
+	// when the server announces it in the handshake and whenever a
+	// SetPixelFormat message is sent, so caches of decoded colors can
+	// be reset. It is called while SendMsg holds its lock, so it must
+	// not send messages.
+	OnPixelFormatChange func(*PixelFormat)
+
+	// OnServerInit, if set, is called during the handshake with the raw
+	// bytes of the ServerInit message, before they are parsed. This is
+	// useful to capture fixtures from real servers.
+	OnServerInit func(raw []byte)
 }
 
+// DefaultMaxMessageSize is the default ClientConnConfig.MaxMessageSize.
+const DefaultMaxMessageSize = 64 << 20
+
 func NewClientConn(cfg *ClientConnConfig, c net.Conn) (*ClientConn, error) {
-	if c == nil {
+	return NewClientConnContext(context.Background(), cfg, c)
+}
+
+// NewClientConnContext is like NewClientConn, but the context bounds the
+// dial to cfg.Address when no connection is given.
+func NewClientConnContext(ctx context.Context, cfg *ClientConnConfig, c net.Conn) (*ClientConn, error) {
+	dialed := c == nil
+	if dialed {
 		var err error
-		if c, err = net.Dial("tcp", cfg.Address); err != nil {
+		var d net.Dialer
+		if c, err = d.DialContext(ctx, "tcp", cfg.Address); err != nil {
 			return nil, err
 		}
 	}
+	if err := configureTCP(c, cfg.KeepAlive); err != nil {
+		if dialed {
+			c.Close()
+		}
+		return nil, err
+	}
 
 	// add NoneAuth if no authentication method is selected
 	if cfg.Auth == nil {
@@ -77,21 +239,232 @@ func NewClientConn(cfg *ClientConnConfig, c net.Conn) (*ClientConn, error) {
 		&ServerCutTextMsg{},
 	}
 	for _, m := range msgs {
-		cfg.ServerMessages[m.ID()] = m
+		if _, ok := cfg.ServerMessages[m.ID()]; !ok {
+			cfg.ServerMessages[m.ID()] = m
+		}
 	}
 
-	return &ClientConn{
-		c:           c,
-		r:           bufio.NewReader(c),
+	conn := &ClientConn{
 		config:      cfg,
 		encodingMap: map[EncodingType]Encoding{RawEncType: &RawEncoding{}},
-	}, nil
+	}
+	conn.setConn(c)
+	return conn, nil
+}
+
+// NewClientConnRW is like NewClientConn, but works over any duplex
+// stream, such as an SSH channel or an in-memory pipe. Unless rw is a
+// net.Conn, setting deadlines has no effect, so contexts can't
+// interrupt blocked reads and writes; close rw to abort them.
+func NewClientConnRW(cfg *ClientConnConfig, rw io.ReadWriteCloser) (*ClientConn, error) {
+	if nc, ok := rw.(net.Conn); ok {
+		return NewClientConn(cfg, nc)
+	}
+	return NewClientConn(cfg, &rwConn{rw})
+}
+
+// rwConn is a net.Conn over a stream without deadlines or addresses.
+type rwConn struct {
+	io.ReadWriteCloser
+}
+
+func (*rwConn) LocalAddr() net.Addr              { return nopAddr("stream") }
+func (*rwConn) RemoteAddr() net.Addr             { return nopAddr("stream") }
+func (*rwConn) SetDeadline(time.Time) error      { return nil }
+func (*rwConn) SetReadDeadline(time.Time) error  { return nil }
+func (*rwConn) SetWriteDeadline(time.Time) error { return nil }
+
+// nopAddr is the address of connections that aren't on a network, used
+// as both its network and its string.
+type nopAddr string
+
+func (a nopAddr) Network() string { return string(a) }
+func (a nopAddr) String() string  { return string(a) }
+
+// DialTLS connects to cfg.Address over TLS and returns a ClientConn for
+// the connection, ready for the handshake. This is for servers fronted
+// by a TLS tunnel such as stunnel, where the whole RFB stream, starting
+// with the ProtocolVersion, is encrypted; it is unrelated to the
+// VeNCrypt security type.
+func DialTLS(ctx context.Context, cfg *ClientConnConfig, tlsConfig *tls.Config) (*ClientConn, error) {
+	if cfg.ServerMessages == nil {
+		cfg.ServerMessages = make(map[MessageID]ServerMessage)
+	}
+	nc, err := dialTLS(ctx, cfg.Address, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := NewClientConnContext(ctx, cfg, nc)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	c.tlsConfig = tlsConfig
+	return c, nil
+}
+
+func dialTLS(ctx context.Context, address string, tlsConfig *tls.Config) (net.Conn, error) {
+	d := &tls.Dialer{Config: tlsConfig}
+	return d.DialContext(ctx, "tcp", address)
+}
+
+// configureTCP sets TCP_NODELAY and the keep-alive period on nc, if it
+// is a TCP connection, possibly under TLS.
+func configureTCP(nc net.Conn, keepAlive time.Duration) error {
+	if tc, ok := nc.(*tls.Conn); ok {
+		nc = tc.NetConn()
+	}
+	tc, ok := nc.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if err := tc.SetNoDelay(true); err != nil {
+		return err
+	}
+	switch {
+	case keepAlive > 0:
+		if err := tc.SetKeepAlive(true); err != nil {
+			return err
+		}
+		return tc.SetKeepAlivePeriod(keepAlive)
+	case keepAlive < 0:
+		return tc.SetKeepAlive(false)
+	}
+	return nil
+}
+
+// RegisterEncoding makes an encoding available on this connection, so
+// rectangles of its type can be decoded even if it was left out of the
+// last SetEncodings message. It must not be called concurrently with
+// ReceiveMsg.
+func (c *ClientConn) RegisterEncoding(enc Encoding) {
+	if c.registeredEncodings == nil {
+		c.registeredEncodings = make(map[EncodingType]Encoding)
+	}
+	c.registeredEncodings[enc.Type()] = enc
+}
+
+// encoding returns the encoding used to decode rectangles of the type.
+// Encodings sent in SetEncodings take precedence over those registered
+// on the connection, which take precedence over those registered with
+// the package-level RegisterEncoding.
+func (c *ClientConn) encoding(t EncodingType) (Encoding, bool) {
+	if enc, ok := c.encodingMap[t]; ok {
+		return enc, true
+	}
+	if enc, ok := c.registeredEncodings[t]; ok {
+		return enc, true
+	}
+	return registeredEncoding(t)
+}
+
+// A Logger receives trace messages from a ClientConn.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+}
+
+// debugf logs a trace message to the configured Logger, if any. The
+// arguments are boxed even without a Logger, so calls on hot paths check
+// for one first.
+func (c *ClientConn) debugf(format string, args ...interface{}) {
+	if c.config.Logger != nil {
+		c.config.Logger.Debugf(format, args...)
+	}
+}
+
+// maxMessageSize returns the MaxMessageSize in effect.
+func (c *ClientConn) maxMessageSize() int64 {
+	if c.config.MaxMessageSize != 0 {
+		return int64(c.config.MaxMessageSize)
+	}
+	return DefaultMaxMessageSize
+}
+
+// checkMessageSize returns a MessageSizeError if the server declared
+// data of the given size that exceeds MaxMessageSize.
+func (c *ClientConn) checkMessageSize(size int64) error {
+	if max := c.maxMessageSize(); size > max {
+		return &MessageSizeError{Size: size, Max: max}
+	}
+	return nil
 }
 
 func (c *ClientConn) Close() error {
 	return c.c.Close()
 }
 
+// Reconnect replaces the connection with a new one to
+// ClientConnConfig.Address, over TLS if the connection was made with
+// DialTLS, redoes the handshake and restores the last pixel format and
+// encodings set on the old connection. The config,
+// including ServerMessages, is kept. It must not be called concurrently
+// with ReceiveMsg; messages can't be sent until it returns.
+func (c *ClientConn) Reconnect(ctx context.Context) error {
+	if c.config.Address == "" {
+		return fmt.Errorf("cannot reconnect without an address")
+	}
+
+	var nc net.Conn
+	var err error
+	if c.tlsConfig != nil {
+		nc, err = dialTLS(ctx, c.config.Address, c.tlsConfig)
+	} else {
+		var d net.Dialer
+		nc, err = d.DialContext(ctx, "tcp", c.config.Address)
+	}
+	if err != nil {
+		return err
+	}
+	if err := configureTCP(nc, c.config.KeepAlive); err != nil {
+		nc.Close()
+		return err
+	}
+
+	c.sendMu.Lock()
+	c.c.Close()
+	c.setConn(nc)
+	c.encodingMap = map[EncodingType]Encoding{RawEncType: &RawEncoding{}}
+	c.tightZlib.resetMask(0x0f)
+	c.zrleZlib.reset(0)
+	c.clipboardCaps = nil
+	c.qemuAudioFormat = QEMUAudioFormat{}
+	c.ServerCaps = nil
+	c.sendMu.Unlock()
+
+	if err := c.HandshakeContext(ctx); err != nil {
+		return err
+	}
+	return c.resendFormats()
+}
+
+// SetDeadline sets the read and write deadlines of the underlying
+// connection, as with net.Conn.
+func (c *ClientConn) SetDeadline(t time.Time) error {
+	return c.c.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the underlying connection.
+// Reads are buffered, so data already buffered is returned regardless
+// of the deadline; it fires once ReceiveMsg waits on the connection.
+func (c *ClientConn) SetReadDeadline(t time.Time) error {
+	return c.c.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the underlying connection.
+func (c *ClientConn) SetWriteDeadline(t time.Time) error {
+	return c.c.SetWriteDeadline(t)
+}
+
+// Reader returns the reader that server messages are read from, for
+// ServerMessage and Encoding implementations outside this package and
+// for DefaultServerMessage. Reading from it outside of those breaks the
+// framing of the message stream.
+func (c *ClientConn) Reader() io.Reader {
+	return c.r
+}
+
 func (c *ClientConn) ReceiveMsg() (ServerMessage, error) {
 	var mid MessageID
 	if err := readFixedSize(c.r, &mid); err != nil {
@@ -100,7 +473,15 @@ func (c *ClientConn) ReceiveMsg() (ServerMessage, error) {
 
 	var m ServerMessage
 	if m = c.config.ServerMessages[mid]; m == nil {
-		return nil, fmt.Errorf("Unsupported Server Message %v.", mid)
+		if c.config.DefaultServerMessage != nil {
+			c.debugf("received message %d, passed to DefaultServerMessage", mid)
+			return c.config.DefaultServerMessage(c, mid)
+		}
+		return nil, &UnsupportedMessageError{mid}
+	}
+
+	if c.config.Logger != nil {
+		c.debugf("received message %d (%T)", mid, m)
 	}
 
 	var err error
@@ -111,10 +492,121 @@ func (c *ClientConn) ReceiveMsg() (ServerMessage, error) {
 	return m, nil
 }
 
+// tryReceiveWait is how long TryReceiveMsg waits for a message to start.
+const tryReceiveWait = time.Millisecond
+
+// TryReceiveMsg is like ReceiveMsg, but returns false instead of
+// blocking if no message is available. Once the first byte of a message
+// has arrived, the whole message is read, blocking if needed, so a
+// message is never left half-read. It clears the read deadline, and
+// blocks like ReceiveMsg on connections without deadlines, such as the
+// streams of NewClientConnRW.
+func (c *ClientConn) TryReceiveMsg() (ServerMessage, bool, error) {
+	if c.r.Buffered() == 0 {
+		if err := c.c.SetReadDeadline(time.Now().Add(tryReceiveWait)); err != nil {
+			return nil, false, err
+		}
+		_, err := c.r.Peek(1)
+		if err := c.c.SetReadDeadline(time.Time{}); err != nil {
+			return nil, false, err
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, false, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+	}
+
+	msg, err := c.ReceiveMsg()
+	if err != nil {
+		return nil, false, err
+	}
+	return msg, true, nil
+}
+
+// SendMsg sends a message to the server. It is safe to call from
+// multiple goroutines: each message is written as a whole before the
+// next one starts. With ClientConnConfig.BatchWrites, the message is
+// only buffered, and sent by the next Flush.
 func (c *ClientConn) SendMsg(m ClientMessage) error {
-	return m.Send(c)
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if err := m.Send(c); err != nil {
+		return err
+	}
+	if c.config.BatchWrites {
+		return nil
+	}
+	return c.w.Flush()
+}
+
+// Flush writes the buffered messages to the server. It is only needed
+// with ClientConnConfig.BatchWrites.
+func (c *ClientConn) Flush() error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return c.w.Flush()
+}
+
+// SecurityType returns the security type negotiated in the handshake.
+func (c *ClientConn) SecurityType() SecurityType {
+	return c.securityType
+}
+
+// ProtocolVersion returns the protocol version negotiated in the
+// handshake, one of the ProtocolVersion constants.
+func (c *ClientConn) ProtocolVersion() string {
+	return c.protocolVersion
 }
 
 func (c *ClientConn) PixelFormat() *PixelFormat {
 	return c.pixelFormat
 }
+
+// setPixelFormat makes pf the pixel format of the connection and
+// notifies OnPixelFormatChange.
+func (c *ClientConn) setPixelFormat(pf *PixelFormat) {
+	c.pixelFormat = pf
+	if c.config.OnPixelFormatChange != nil {
+		c.config.OnPixelFormatChange(pf)
+	}
+}
+
+// LastSetEncodings returns a copy of the last SetEncodings message sent
+// on the connection, or nil if none was sent yet.
+func (c *ClientConn) LastSetEncodings() *SetEncodingsMsg {
+	if c.lastSetEncodings == nil {
+		return nil
+	}
+	m := *c.lastSetEncodings
+	m.Encodings = append([]Encoding(nil), m.Encodings...)
+	return &m
+}
+
+// LastSetPixelFormat returns a copy of the last SetPixelFormat message
+// sent on the connection, or nil if none was sent yet.
+func (c *ClientConn) LastSetPixelFormat() *SetPixelFormatMsg {
+	if c.lastSetPixelFormat == nil {
+		return nil
+	}
+	m := *c.lastSetPixelFormat
+	return &m
+}
+
+// resendFormats sends the last SetPixelFormat and SetEncodings messages
+// again, restoring the client's preferences on a new connection. They
+// are flushed even with ClientConnConfig.BatchWrites, as nothing else
+// may follow to send them.
+func (c *ClientConn) resendFormats() error {
+	if m := c.LastSetPixelFormat(); m != nil {
+		if err := c.SendMsg(m); err != nil {
+			return err
+		}
+	}
+	if m := c.LastSetEncodings(); m != nil {
+		if err := c.SendMsg(m); err != nil {
+			return err
+		}
+	}
+	return c.Flush()
+}
@@ -0,0 +1,81 @@
+package vnc
+
+import (
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sockopt returns the value of a socket option of the connection.
+func sockopt(t *testing.T, tc *net.TCPConn, level, opt int) int {
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var optErr error
+	if err := raw.Control(func(fd uintptr) {
+		value, optErr = syscall.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		t.Fatal(err)
+	} else if optErr != nil {
+		t.Fatal(optErr)
+	}
+	return value
+}
+
+func TestNoDelay(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	tests := []struct {
+		name      string
+		keepAlive time.Duration
+		want      int // SO_KEEPALIVE
+	}{
+		{"keep-alive enabled", time.Minute, 1},
+		{"keep-alive disabled", -1, 0},
+	}
+	for _, tt := range tests {
+		nc, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc := nc.(*net.TCPConn)
+		tc.SetNoDelay(false)
+
+		c, err := NewClientConn(&ClientConnConfig{KeepAlive: tt.keepAlive, ServerMessages: make(map[MessageID]ServerMessage)}, nc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sockopt(t, tc, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); got == 0 {
+			t.Errorf("%s: TCP_NODELAY not set", tt.name)
+		}
+		if got := sockopt(t, tc, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); got != tt.want {
+			t.Errorf("%s: SO_KEEPALIVE is %d, want %d", tt.name, got, tt.want)
+		}
+		if tt.want != 0 {
+			if got := sockopt(t, tc, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); got != 60 {
+				t.Errorf("%s: keep-alive period of %ds, want 60s", tt.name, got)
+			}
+		}
+		c.Close()
+	}
+}
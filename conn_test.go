@@ -0,0 +1,417 @@
+package vnc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResendFormats(t *testing.T) {
+	c, tc := newTestClient(nil, nil)
+	if c.LastSetEncodings() != nil || c.LastSetPixelFormat() != nil {
+		t.Fatal("formats recorded before any were sent")
+	}
+
+	pf := &SetPixelFormatMsg{RFBPixelFormat: RFBPixelFormat{
+		BPP: 16, Depth: 16, TrueColor: 1, RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 11, GreenShift: 5}}
+	enc := &SetEncodingsMsg{Encodings: []Encoding{&RawEncoding{}}}
+	if err := c.SendMsg(pf); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendMsg(enc); err != nil {
+		t.Fatal(err)
+	}
+	sent := append([]byte(nil), tc.out.Bytes()...)
+
+	// changing the caller's message must not change the recorded one
+	enc.Encodings[0] = nil
+	if m := c.LastSetEncodings(); m == nil || len(m.Encodings) != 1 || m.Encodings[0] == nil {
+		t.Errorf("got LastSetEncodings %+v", m)
+	}
+	if m := c.LastSetPixelFormat(); m == nil || m.RFBPixelFormat != pf.RFBPixelFormat {
+		t.Errorf("got LastSetPixelFormat %+v", m)
+	}
+
+	tc.out.Reset()
+	if err := c.resendFormats(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tc.out.Bytes(), sent) {
+		t.Errorf("resent %x, want %x", tc.out.Bytes(), sent)
+	}
+}
+
+// chunkedMsg is a client message written one byte at a time, n times
+// the byte b.
+type chunkedMsg struct {
+	b byte
+	n int
+}
+
+func (m *chunkedMsg) Send(c *ClientConn) error {
+	for i := 0; i < m.n; i++ {
+		if _, err := c.c.Write([]byte{m.b}); err != nil {
+			return err
+		}
+		// give other senders a chance to cut in
+		runtime.Gosched()
+	}
+	return nil
+}
+
+func TestSendMsgConcurrent(t *testing.T) {
+	const senders, msgs, size = 4, 20, 16
+	c, server := newPipeClient(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(b byte) {
+			defer wg.Done()
+			for j := 0; j < msgs; j++ {
+				if err := c.SendMsg(&chunkedMsg{b, size}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(byte('a' + i))
+	}
+
+	// every message arrives in one piece
+	buf := make([]byte, size)
+	for i := 0; i < senders*msgs; i++ {
+		if _, err := io.ReadFull(server, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, bytes.Repeat(buf[:1], size)) {
+			t.Fatalf("message %d interleaved: %q", i, buf)
+		}
+	}
+	wg.Wait()
+}
+
+func TestBatchWrites(t *testing.T) {
+	input := func(c *ClientConn) error {
+		for _, m := range []ClientMessage{
+			&KeyEventMsg{DownFlag: 1, Key: 'a'},
+			&KeyEventMsg{Key: 'a'},
+			&PointerEventMsg{X: 1, Y: 2},
+		} {
+			if err := c.SendMsg(m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name   string
+		batch  bool
+		send   func(c *ClientConn) error
+		writes int
+		size   int
+	}{
+		{"unbatched", false, input, 3, 8 + 8 + 6},
+		{"batched", true, func(c *ClientConn) error {
+			if err := input(c); err != nil {
+				return err
+			}
+			return c.Flush()
+		}, 1, 8 + 8 + 6},
+		{"setupSession", true, (*ClientConn).setupSession, 1, 20 + 20 + 10},
+		{"resendFormats", true, func(c *ClientConn) error {
+			if err := c.setupSession(); err != nil {
+				return err
+			}
+			tc := c.c.(*testConn)
+			tc.out.Reset()
+			tc.writes = 0
+			return c.resendFormats()
+		}, 1, 20 + 20},
+		{"requestUpdate", true, func(c *ClientConn) error {
+			return c.requestUpdate(updateSize{640, 480}, true)
+		}, 1, 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, tc := newTestClient(&ClientConnConfig{BatchWrites: tt.batch}, nil)
+			if err := tt.send(c); err != nil {
+				t.Fatal(err)
+			}
+			if tc.writes != tt.writes {
+				t.Errorf("got %d writes, want %d", tc.writes, tt.writes)
+			}
+			if tc.out.Len() != tt.size {
+				t.Errorf("sent %d bytes, want %d", tc.out.Len(), tt.size)
+			}
+		})
+	}
+}
+
+func TestBatchWritesPixelFormat(t *testing.T) {
+	c, tc := newTestClient(&ClientConnConfig{BatchWrites: true}, nil)
+	if err := c.UseRGBA8888(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the format switches when the message is buffered, not when sent
+	if tc.writes != 0 {
+		t.Fatalf("got %d writes before Flush", tc.writes)
+	}
+	if got, want := *c.PixelFormat().RFBPixelFormat, PixelFormatRGBA8888(); got != want {
+		t.Errorf("pixel format %+v, want %+v", got, want)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	} else if tc.writes != 1 {
+		t.Errorf("got %d writes after Flush, want 1", tc.writes)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	c, server := newPipeClient(t)
+
+	// the server stalls in the middle of an update
+	go server.Write(wire(FramebufferUpdateMID, uint8(0)))
+
+	if err := c.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.ReceiveMsg()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Errorf("got error %v, want a timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReceiveMsg didn't time out")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the new server accepts the client and records what it sends
+	// after the handshake
+	hextile := &HextileEncoding{}
+	resent := make(chan []byte, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(wire(ProtocolVersion3_8, uint8(1), NoneSecType))
+		io.ReadFull(conn, make([]byte, 12+1)) // ProtocolVersion, security type
+		conn.Write(wire(uint32(0)))           // SecurityResult
+		io.ReadFull(conn, make([]byte, 1))    // ClientInit
+		conn.Write(serverInit("new"))
+		msgs := make([]byte, 20+8)
+		io.ReadFull(conn, msgs)
+		resent <- msgs
+	}()
+
+	cfg := &ClientConnConfig{Address: l.Addr().String(), Auth: []ClientAuth{&NoneAuth{}}}
+	c, _ := newTestClient(cfg, nil)
+	if err := c.UseBGR233(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendMsg(&SetEncodingsMsg{Encodings: []Encoding{hextile}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Reconnect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.DesktopName != "new" {
+		t.Errorf("got desktop name %q after reconnecting", c.DesktopName)
+	}
+
+	want := wire(SetPixelFormatMID, [3]byte{}, PixelFormatBGR233(),
+		SetEncodingsMID, uint8(0), uint16(1), HextileEncType)
+	select {
+	case got := <-resent:
+		if !bytes.Equal(got, want) {
+			t.Errorf("new server got %v, want %v", got, want)
+		}
+	case <-ctx.Done():
+		t.Fatal("formats not sent to the new server")
+	}
+	if got, want := *c.PixelFormat().RFBPixelFormat, PixelFormatBGR233(); got != want {
+		t.Errorf("pixel format %+v, want %+v", got, want)
+	}
+	if enc, _ := c.encoding(HextileEncType); enc != hextile {
+		t.Errorf("Hextile decoded with %v, want the restored encoding", enc)
+	}
+}
+
+func TestDialTLS(t *testing.T) {
+	cert := selfSignedCert(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the server runs the handshake in TLS on every connection
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write(wire(ProtocolVersion3_8, uint8(1), NoneSecType))
+				io.ReadFull(conn, make([]byte, 12+1)) // ProtocolVersion, security type
+				conn.Write(wire(uint32(0)))           // SecurityResult
+				io.ReadFull(conn, make([]byte, 1))    // ClientInit
+				conn.Write(serverInit("tls"))
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	tlsConfig := &tls.Config{ServerName: "vnc", RootCAs: x509.NewCertPool()}
+	tlsConfig.RootCAs.AddCert(mustParseCert(t, cert.Certificate[0]))
+	// ServerMessages may be left nil
+	cfg := &ClientConnConfig{
+		Address: l.Addr().String(),
+		Auth:    []ClientAuth{&NoneAuth{}},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := DialTLS(ctx, cfg, tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Handshake(); err != nil {
+		t.Fatal(err)
+	} else if c.DesktopName != "tls" {
+		t.Errorf("got desktop name %q", c.DesktopName)
+	}
+
+	c.DesktopName = ""
+	if err := c.Reconnect(ctx); err != nil {
+		t.Fatal(err)
+	} else if _, ok := c.c.(*tls.Conn); !ok || c.DesktopName != "tls" {
+		t.Errorf("reconnected with a %T to desktop %q", c.c, c.DesktopName)
+	}
+
+	// the certificate must be trusted
+	if _, err := DialTLS(ctx, cfg, &tls.Config{ServerName: "vnc"}); err == nil {
+		t.Error("no error for an untrusted certificate")
+	}
+}
+
+// pipeStream is a duplex stream of two pipes, which is not a net.Conn.
+type pipeStream struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func (s pipeStream) Close() error {
+	s.PipeReader.Close()
+	return s.PipeWriter.Close()
+}
+
+func TestNewClientConnRW(t *testing.T) {
+	clientR, serverW := io.Pipe()
+	serverR, clientW := io.Pipe()
+	server := pipeStream{serverR, serverW}
+	defer server.Close()
+	go func() {
+		server.Write(wire(ProtocolVersion3_8, uint8(1), NoneSecType))
+		io.ReadFull(server, make([]byte, 12+1)) // ProtocolVersion, security type
+		server.Write(wire(uint32(0)))           // SecurityResult
+		io.ReadFull(server, make([]byte, 1))    // ClientInit
+		server.Write(serverInit("pipe"))
+		io.Copy(io.Discard, server)
+	}()
+
+	cfg := &ClientConnConfig{Auth: []ClientAuth{&NoneAuth{}}, ServerMessages: make(map[MessageID]ServerMessage)}
+	c, err := NewClientConnRW(cfg, pipeStream{clientR, clientW})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Handshake(); err != nil {
+		t.Fatal(err)
+	} else if c.DesktopName != "pipe" {
+		t.Errorf("got desktop name %q", c.DesktopName)
+	}
+	if err := c.SetReadDeadline(time.Now()); err != nil {
+		t.Errorf("setting a deadline: %v", err)
+	}
+
+	// a net.Conn is used as is
+	nc, _ := net.Pipe()
+	defer nc.Close()
+	if c, err := NewClientConnRW(&ClientConnConfig{ServerMessages: make(map[MessageID]ServerMessage)}, nc); err != nil {
+		t.Fatal(err)
+	} else if c.c != nc {
+		t.Errorf("got a %T, want the net.Conn", c.c)
+	}
+}
+
+// lineLogger records the lines logged to it.
+type lineLogger []string
+
+func (l *lineLogger) Debugf(format string, args ...interface{}) {
+	*l = append(*l, fmt.Sprintf(format, args...))
+}
+
+func TestLogger(t *testing.T) {
+	logger := new(lineLogger)
+	cfg := &ClientConnConfig{Logger: logger, Auth: []ClientAuth{&NoneAuth{}}}
+	c, _ := newTestClient(cfg, wire(
+		ProtocolVersion3_8, uint8(1), NoneSecType, uint32(0), serverInit("desk"),
+		FramebufferUpdateMID, uint8(0), uint16(1), uint16(1), uint16(2), uint16(1), uint16(1), RawEncType, pixel(0, 0, 0)))
+	if err := c.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ReceiveMsg(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		`server protocol version "RFB 003.008\n", using "RFB 003.008\n"`,
+		"server security types [1], using 1",
+		"security result 0",
+		`server init: 640x480 framebuffer, 32 bpp, desktop "desk"`,
+		"received message 0 (*vnc.FramebufferUpdateMsg)",
+		"rectangle 1x1+1+2, encoding 0",
+	}
+	if got := *logger; len(got) != len(want) {
+		t.Fatalf("logged %q, want %q", got, want)
+	}
+	for i, line := range *logger {
+		if line != want[i] {
+			t.Errorf("line %d is %q, want %q", i, line, want[i])
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package vnc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// eaxTagSize is the size of the EAX authentication tag.
+const eaxTagSize = 16
+
+// eax implements the EAX authenticated encryption mode over AES, which
+// the RSA-AES security types use and crypto/cipher does not provide.
+type eax struct {
+	block  cipher.Block
+	k1, k2 [aes.BlockSize]byte // CMAC subkeys
+}
+
+func newEAX(key []byte) (*eax, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &eax{block: block}
+	var l [aes.BlockSize]byte
+	block.Encrypt(l[:], l[:])
+	cmacDouble(&e.k1, &l)
+	cmacDouble(&e.k2, &e.k1)
+	return e, nil
+}
+
+// cmacDouble sets dst to src multiplied by x in GF(2^128).
+func cmacDouble(dst, src *[aes.BlockSize]byte) {
+	carry := src[0] >> 7
+	for i := 0; i < aes.BlockSize-1; i++ {
+		dst[i] = src[i]<<1 | src[i+1]>>7
+	}
+	dst[aes.BlockSize-1] = src[aes.BlockSize-1]<<1 ^ carry*0x87
+}
+
+// omac returns the CMAC of the data prefixed with a block holding the
+// tweak t, as defined by EAX.
+func (e *eax) omac(t byte, data []byte) []byte {
+	msg := make([]byte, aes.BlockSize, aes.BlockSize+len(data))
+	msg[aes.BlockSize-1] = t
+	msg = append(msg, data...)
+
+	mac := make([]byte, aes.BlockSize)
+	for len(msg) > aes.BlockSize {
+		xorBytes(mac, msg[:aes.BlockSize])
+		e.block.Encrypt(mac, mac)
+		msg = msg[aes.BlockSize:]
+	}
+
+	// the last block is padded if it is partial
+	last := e.k1
+	if len(msg) < aes.BlockSize {
+		last = e.k2
+		last[len(msg)] ^= 0x80
+	}
+	xorBytes(last[:], msg)
+	xorBytes(mac, last[:])
+	e.block.Encrypt(mac, mac)
+	return mac
+}
+
+// seal encrypts and authenticates plaintext, and authenticates header,
+// returning the ciphertext followed by the tag.
+func (e *eax) seal(nonce, header, plaintext []byte) []byte {
+	n := e.omac(0, nonce)
+	out := make([]byte, len(plaintext), len(plaintext)+eaxTagSize)
+	cipher.NewCTR(e.block, n).XORKeyStream(out, plaintext)
+
+	tag := e.omac(2, out)
+	xorBytes(tag, n)
+	xorBytes(tag, e.omac(1, header))
+	return append(out, tag...)
+}
+
+// open verifies and decrypts ciphertext, which is followed by its tag.
+func (e *eax) open(nonce, header, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < eaxTagSize {
+		return nil, fmt.Errorf("EAX message too short")
+	}
+	ciphertext, tag := ciphertext[:len(ciphertext)-eaxTagSize], ciphertext[len(ciphertext)-eaxTagSize:]
+
+	n := e.omac(0, nonce)
+	expected := e.omac(2, ciphertext)
+	xorBytes(expected, n)
+	xorBytes(expected, e.omac(1, header))
+	if subtle.ConstantTimeCompare(expected, tag) != 1 {
+		return nil, fmt.Errorf("EAX message authentication failed")
+	}
+
+	out := make([]byte, len(ciphertext))
+	cipher.NewCTR(e.block, n).XORKeyStream(out, ciphertext)
+	return out, nil
+}
+
+// eaxConn is a net.Conn sending and receiving messages encrypted with
+// EAX as the RSA-AES security types do: each message is its 2-byte
+// length, which is authenticated, the ciphertext and the tag. The nonce
+// of each direction is a little-endian counter incremented after every
+// message.
+type eaxConn struct {
+	net.Conn
+	r io.Reader
+
+	enc, dec           *eax
+	encNonce, decNonce [aes.BlockSize]byte
+
+	// decrypted data not yet returned by Read
+	buf []byte
+}
+
+func (c *eaxConn) Read(b []byte) (int, error) {
+	for len(c.buf) == 0 {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(c.r, header); err != nil {
+			return 0, err
+		}
+		ciphertext := make([]byte, int(binary.BigEndian.Uint16(header))+eaxTagSize)
+		if _, err := io.ReadFull(c.r, ciphertext); err != nil {
+			return 0, err
+		}
+
+		var err error
+		if c.buf, err = c.dec.open(c.decNonce[:], header, ciphertext); err != nil {
+			return 0, err
+		}
+		incrementNonce(&c.decNonce)
+	}
+
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *eaxConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > 0xffff {
+			chunk = chunk[:0xffff]
+		}
+
+		header := make([]byte, 2)
+		binary.BigEndian.PutUint16(header, uint16(len(chunk)))
+		msg := append(header, c.enc.seal(c.encNonce[:], header, chunk)...)
+		if _, err := c.Conn.Write(msg); err != nil {
+			return written, err
+		}
+		incrementNonce(&c.encNonce)
+
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+// xorBytes sets dst[i] ^= src[i] for the bytes of src.
+func xorBytes(dst, src []byte) {
+	for i, b := range src {
+		dst[i] ^= b
+	}
+}
+
+func incrementNonce(nonce *[aes.BlockSize]byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package vnc
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// The test vectors of the EAX paper, "The EAX Mode of Operation".
+var eaxTests = []struct {
+	key, nonce, header, msg, cipher string
+}{
+	{
+		key:    "233952DEE4D5ED5F9B9C6D6FF80FF478",
+		nonce:  "62EC67F9C3A4A407FCB2A8C49031A8B3",
+		header: "6BFB914FD07EAE6B",
+		msg:    "",
+		cipher: "E037830E8389F27B025A2D6527E79D01",
+	},
+	{
+		key:    "91945D3F4DCBEE0BF45EF52255F095A4",
+		nonce:  "BECAF043B0A23D843194BA972C66DEBD",
+		header: "FA3BFD4806EB53FA",
+		msg:    "F7FB",
+		cipher: "19DD5C4C9331049D0BDAB0277408F67967E5",
+	},
+	{
+		key:    "01F74AD64077F2E704C0F60ADA3DD523",
+		nonce:  "70C3DB4F0D26368400A10ED05D2BFF5E",
+		header: "234A3463C1264AC6",
+		msg:    "1A47CB4933",
+		cipher: "D851D5BAE03A59F238A23E39199DC9266626C40F80",
+	},
+	{
+		key:    "D07CF6CBB7F313BDDE66B727AFD3C5E8",
+		nonce:  "8408DFFF3C1A2B1292DC199E46B7D617",
+		header: "33CCE2EABFF5A79D",
+		msg:    "481C9E39B1",
+		cipher: "632A9D131AD4C168A4225D8E1FF755939974A7BEDE",
+	},
+	{
+		key:    "35B6D0580005BBC12B0587124557D2C2",
+		nonce:  "FDB6B06676EEDC5C61D74276E1F8E816",
+		header: "AEB96EAEBE2970E9",
+		msg:    "40D0C07DA5E4",
+		cipher: "071DFE16C675CB0677E536F73AFE6A14B74EE49844DD",
+	},
+	{
+		key:    "8395FCF1E95BEBD697BD010BC766AAC3",
+		nonce:  "22E7ADD93CFC6393C57EC0B3C17D6B44",
+		header: "126735FCC320D25A",
+		msg:    "CA40D7446E545FFAED3BD12A740A659FFBBB3CEAB7",
+		cipher: "CB8920F87A6C75CFF39627B56E3ED197C552D295A7CFC46AFC253B4652B1AF3795B124AB6E",
+	},
+}
+
+func TestEAX(t *testing.T) {
+	for _, tt := range eaxTests {
+		e, err := newEAX(unhex(tt.key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce, header := unhex(tt.nonce), unhex(tt.header)
+
+		sealed := e.seal(nonce, header, unhex(tt.msg))
+		if want := unhex(tt.cipher); !bytes.Equal(sealed, want) {
+			t.Errorf("seal(%s) = %X, want %X", tt.msg, sealed, want)
+		}
+
+		opened, err := e.open(nonce, header, sealed)
+		if err != nil {
+			t.Errorf("open(%s): %v", tt.cipher, err)
+		} else if want := unhex(tt.msg); !bytes.Equal(opened, want) {
+			t.Errorf("open(%s) = %X, want %X", tt.cipher, opened, want)
+		}
+
+		sealed[0] ^= 1
+		if _, err := e.open(nonce, header, sealed); err == nil {
+			t.Errorf("open of corrupted %s succeeded", tt.cipher)
+		}
+	}
+}
+
+func TestEAXConn(t *testing.T) {
+	key1 := unhex("000102030405060708090a0b0c0d0e0f")
+	key2 := unhex("101112131415161718191a1b1c1d1e1f")
+	newConn := func(nc net.Conn, encKey, decKey []byte) *eaxConn {
+		enc, err := newEAX(encKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec, err := newEAX(decKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &eaxConn{Conn: nc, r: bufio.NewReader(nc), enc: enc, dec: dec}
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	client, server := newConn(a, key1, key2), newConn(b, key2, key1)
+
+	// a message longer than the 65535 bytes of an EAX message
+	msg := bytes.Repeat([]byte("0123456789abcdef"), 5000)
+	go func() {
+		client.Write([]byte("hello"))
+		client.Write(msg)
+	}()
+
+	got := make([]byte, 5+len(msg))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got[:5]) != "hello" || !bytes.Equal(got[5:], msg) {
+		t.Error("eaxConn corrupted the messages")
+	}
+}
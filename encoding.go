@@ -2,27 +2,57 @@ package vnc
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
+	"image/jpeg"
 	"image/png"
 	"io"
+	"math"
+	"sync"
 )
 
 type EncodingType int32
 
 const (
-	RawEncType                     = EncodingType(0)
-	CopyRectEncType                = EncodingType(1)
-	HextileEncType                 = EncodingType(5)
-	TightEncType                   = EncodingType(7) //
-	DesktopSizePseudoEncType       = EncodingType(-223)
-	CursorPseudoEncType            = EncodingType(-239)
-	TightPNGEncType                = EncodingType(-260) //
-	ContinuousUpdatesPseudoEncType = EncodingType(-313) //
+	RawEncType                       = EncodingType(0)
+	CopyRectEncType                  = EncodingType(1)
+	RREEncType                       = EncodingType(2)
+	CoRREEncType                     = EncodingType(4)
+	HextileEncType                   = EncodingType(5)
+	TightEncType                     = EncodingType(7)
+	TRLEEncType                      = EncodingType(15)
+	ZRLEEncType                      = EncodingType(16)
+	DesktopSizePseudoEncType         = EncodingType(-223)
+	LastRectPseudoEncType            = EncodingType(-224)
+	CursorPosPseudoEncType           = EncodingType(-232)
+	CursorPseudoEncType              = EncodingType(-239)
+	XCursorPseudoEncType             = EncodingType(-240)
+	TightPNGEncType                  = EncodingType(-260)
+	LEDStatePseudoEncType            = EncodingType(-261)
+	DesktopNamePseudoEncType         = EncodingType(-307)
+	ExtendedDesktopSizePseudoEncType = EncodingType(-308)
+	ContinuousUpdatesPseudoEncType   = EncodingType(-313) //
 )
 
+// IsPseudo reports whether the encoding type is one of the
+// pseudo-encodings known to this package. The rectangles of
+// pseudo-encodings don't carry framebuffer pixel data, so their position
+// and size may have a different meaning. Encodings of other types
+// declare themselves pseudo with PseudoEncoding.
+func (t EncodingType) IsPseudo() bool {
+	switch t {
+	case DesktopSizePseudoEncType, LastRectPseudoEncType, CursorPseudoEncType, XCursorPseudoEncType,
+		CursorPosPseudoEncType, LEDStatePseudoEncType, DesktopNamePseudoEncType, GIIPseudoEncType,
+		ExtendedDesktopSizePseudoEncType, XvpPseudoEncType, FencePseudoEncType, ContinuousUpdatesPseudoEncType,
+		ExtendedClipboardPseudoEncType, QEMUExtendedKeyEventPseudoEncType, QEMUAudioPseudoEncType:
+		return true
+	}
+	return isLevelPseudoEncType(t)
+}
+
 // Rectangle represents a rectangle of pixel data.
 type Rectangle struct {
 	X      uint16
@@ -32,6 +62,12 @@ type Rectangle struct {
 	Encoding
 }
 
+// EncodingType returns the type of the encoding used by the rectangle,
+// including pseudo-encodings.
+func (r *Rectangle) EncodingType() EncodingType {
+	return r.Encoding.Type()
+}
+
 // An Encoding implements a method for encoding pixel data that is
 // sent by the server to the client.
 type Encoding interface {
@@ -44,6 +80,213 @@ type Encoding interface {
 	Read(*ClientConn, *Rectangle) (Encoding, error)
 }
 
+// An ImageEncoding is an Encoding whose decoded pixel data is available
+// as an image. The image's bounds start at (0, 0), not at the
+// rectangle's position, and it may share memory with the encoding.
+type ImageEncoding interface {
+	Encoding
+
+	Image(*Rectangle) (image.Image, error)
+}
+
+// A PseudoEncoding is an Encoding that tells whether it is a
+// pseudo-encoding, for encodings whose type IsPseudo doesn't know, such
+// as ones added with RegisterEncoding. Rectangles of pseudo-encodings
+// are not checked against the framebuffer size, not drawn and not
+// counted as screen content.
+type PseudoEncoding interface {
+	Encoding
+
+	Pseudo() bool
+}
+
+// isPseudoEncoding reports whether enc is a pseudo-encoding, as
+// declared by its Pseudo method or else by its type.
+func isPseudoEncoding(enc Encoding) bool {
+	if pe, ok := enc.(PseudoEncoding); ok {
+		return pe.Pseudo()
+	}
+	return enc.Type().IsPseudo()
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[EncodingType]Encoding{}
+)
+
+// RegisterEncoding makes an encoding available to every connection, so
+// rectangles of its type can be decoded even if it was left out of the
+// last SetEncodings message. It replaces any encoding previously
+// registered for the same type.
+func RegisterEncoding(enc Encoding) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[enc.Type()] = enc
+}
+
+// registeredEncoding returns the encoding registered for the type with
+// RegisterEncoding.
+func registeredEncoding(t EncodingType) (Encoding, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	enc, ok := registry[t]
+	return enc, ok
+}
+
+// builtinEncoding returns a new instance of the encoding of the given
+// type implemented by this package, or the encoding registered for it
+// with RegisterEncoding, or nil.
+func builtinEncoding(t EncodingType) Encoding {
+	if enc, ok := registeredEncoding(t); ok {
+		return enc
+	}
+	if isLevelPseudoEncType(t) {
+		return &levelPseudoEncoding{t}
+	}
+
+	switch t {
+	case RawEncType:
+		return &RawEncoding{}
+	case CopyRectEncType:
+		return &CopyRectEncoding{}
+	case RREEncType:
+		return &RREEncoding{}
+	case CoRREEncType:
+		return &CoRREEncoding{}
+	case HextileEncType:
+		return &HextileEncoding{}
+	case TightEncType:
+		return &TightEncoding{}
+	case TRLEEncType:
+		return &TRLEEncoding{}
+	case ZRLEEncType:
+		return &ZRLEEncoding{}
+	case DesktopSizePseudoEncType:
+		return &DesktopSizePseudoEncoding{}
+	case LastRectPseudoEncType:
+		return &LastRectPseudoEncoding{}
+	case DesktopNamePseudoEncType:
+		return &DesktopNamePseudoEncoding{}
+	case ExtendedDesktopSizePseudoEncType:
+		return &ExtendedDesktopSizePseudoEncoding{}
+	case CursorPseudoEncType:
+		return &CursorPseudoEncoding{}
+	case XCursorPseudoEncType:
+		return &XCursorPseudoEncoding{}
+	case CursorPosPseudoEncType:
+		return &CursorPosPseudoEncoding{}
+	case LEDStatePseudoEncType:
+		return &LEDStatePseudoEncoding{}
+	case FencePseudoEncType:
+		return &FencePseudoEncoding{}
+	case GIIPseudoEncType:
+		return &GIIPseudoEncoding{}
+	case XvpPseudoEncType:
+		return &XvpPseudoEncoding{}
+	case ExtendedClipboardPseudoEncType:
+		return &ExtendedClipboardPseudoEncoding{}
+	case QEMUExtendedKeyEventPseudoEncType:
+		return &QEMUExtendedKeyEventPseudoEncoding{}
+	case QEMUAudioPseudoEncType:
+		return &QEMUAudioPseudoEncoding{}
+	}
+	return nil
+}
+
+// alwaysRequested lists the encoding types ClientConn.SetEncodings
+// requests in addition to the ones it is given.
+var alwaysRequested = []EncodingType{LastRectPseudoEncType}
+
+// RequestAlways registers an encoding like RegisterEncoding and makes
+// ClientConn.SetEncodings request it even if it isn't listed. This suits
+// pseudo-encodings the application always handles. LastRect is always
+// requested.
+func RequestAlways(enc Encoding) {
+	RegisterEncoding(enc)
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for _, t := range alwaysRequested {
+		if t == enc.Type() {
+			return
+		}
+	}
+	alwaysRequested = append(alwaysRequested, enc.Type())
+}
+
+func alwaysRequestedTypes() []EncodingType {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return append([]EncodingType(nil), alwaysRequested...)
+}
+
+// A FramedEncoding is an Encoding whose size on the wire follows from
+// the rectangle, which lets ClientConnConfig.StrictFraming check that
+// Read consumes exactly that many bytes.
+type FramedEncoding interface {
+	Encoding
+
+	// EncodedSize returns the number of bytes of the rectangle's data.
+	EncodedSize(c *ClientConn, rect *Rectangle) int
+}
+
+// An InPlaceEncoding is an Encoding that can decode a rectangle straight
+// into an image, such as the image of a Framebuffer, without
+// allocating a buffer for the rectangle's pixels. See
+// DirectFramebufferUpdateMsg.
+type InPlaceEncoding interface {
+	Encoding
+
+	// DecodeInto reads the rectangle's data like Read, but draws its
+	// pixels into dst at the rectangle's position, which must be
+	// within dst.
+	DecodeInto(c *ClientConn, rect *Rectangle, dst *image.RGBA) error
+}
+
+// inPlaceArea returns the area of dst covered by the rectangle, or an
+// error if the rectangle is not within dst.
+func inPlaceArea(rect *Rectangle, dst *image.RGBA) (image.Rectangle, error) {
+	area := image.Rect(int(rect.X), int(rect.Y),
+		int(rect.X)+int(rect.Width), int(rect.Y)+int(rect.Height))
+	if !area.In(dst.Rect) {
+		return area, fmt.Errorf("rectangle %v is outside of the %v image", area, dst.Rect)
+	}
+	return area, nil
+}
+
+// readPixelRows reads the pixels of the area of img, row by row, in the
+// pixel format.
+func readPixelRows(r io.Reader, pf *PixelFormat, img *image.RGBA, area image.Rectangle) error {
+	w := area.Dx()
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		off := img.PixOffset(area.Min.X, y)
+		if _, err := pf.ReadPixelsInto(r, w, img.Pix[off:off+4*w]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readPixelRGBA reads a single pixel in the pixel format, true color or
+// color map, decoding it into buf.
+func readPixelRGBA(r io.Reader, pf *PixelFormat, buf []byte) (color.RGBA, error) {
+	rgba, err := pf.ReadPixelsInto(r, 1, buf)
+	if err != nil {
+		return color.RGBA{}, err
+	}
+	return color.RGBA{rgba[0], rgba[1], rgba[2], rgba[3]}, nil
+}
+
+// fillRGBA fills the area of img with the color.
+func fillRGBA(img *image.RGBA, area image.Rectangle, col color.RGBA) {
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(area.Min.X, y):img.PixOffset(area.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			row[i], row[i+1], row[i+2], row[i+3] = col.R, col.G, col.B, col.A
+		}
+	}
+}
+
 // RawEncoding is raw pixel data sent by the server.
 //
 // See RFC 6143 Section 7.7.1
@@ -65,14 +308,73 @@ func (*RawEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
 	return enc, nil
 }
 
+func (*RawEncoding) EncodedSize(c *ClientConn, rect *Rectangle) int {
+	return int(rect.Width) * int(rect.Height) * int(c.pixelFormat.ByPP)
+}
+
+func (*RawEncoding) DecodeInto(c *ClientConn, rect *Rectangle, dst *image.RGBA) error {
+	area, err := inPlaceArea(rect, dst)
+	if err != nil {
+		return err
+	}
+	return readPixelRows(c.r, c.pixelFormat, dst, area)
+}
+
 func (enc *RawEncoding) RGBA(*Rectangle) ([]byte, error) {
 	return getData(enc.rgba)
 }
 
 func (enc *RawEncoding) PNG(rect *Rectangle) ([]byte, error) {
-	return rgbaToPNG(enc.rgba, int(rect.Width), int(rect.Height))
+	return encodePNG(enc, rect)
+}
+
+func (enc *RawEncoding) WritePNG(w io.Writer, rect *Rectangle) error {
+	return writeRGBAPNG(w, enc.rgba, int(rect.Width), int(rect.Height))
+}
+
+func (enc *RawEncoding) Image(rect *Rectangle) (image.Image, error) {
+	return rgbaImage(enc.rgba, int(rect.Width), int(rect.Height))
+}
+
+func (enc *RawEncoding) JPEG(rect *Rectangle, quality int) ([]byte, error) {
+	img, err := enc.Image(rect)
+	if err != nil {
+		return nil, err
+	}
+	return jpegEncode(img, quality)
+}
+
+// WriteRect writes img as a Raw encoded rectangle at position (x, y),
+// rectangle header included, with the pixels in the given pixel format.
+// It is the counterpart of Read.
+func (*RawEncoding) WriteRect(w io.Writer, pf *PixelFormat, img image.Image, x, y uint16) error {
+	bounds := img.Bounds()
+	if err := writeRectHeader(w, x, y, bounds.Dx(), bounds.Dy(), RawEncType); err != nil {
+		return err
+	}
+	return pf.writePixels(w, img, bounds)
+}
+
+// writeRectHeader writes the header of a rectangle in a framebuffer
+// update.
+func writeRectHeader(w io.Writer, x, y uint16, width, height int, encType EncodingType) error {
+	if width > math.MaxUint16 || height > math.MaxUint16 {
+		return fmt.Errorf("rectangle of %dx%d is too large", width, height)
+	}
+	for _, v := range []interface{}{x, y, uint16(width), uint16(height), encType} {
+		if err := writeFixedSize(w, v); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// CopyRectEncoding copies a rectangle of pixel data the client already
+// has from the source position (SX, SY) to the rectangle's position.
+// Since it references existing pixels, it has no image of its own and
+// must be applied to a framebuffer with Draw.
+//
+// See RFC 6143 Section 7.7.2
 type CopyRectEncoding struct {
 	SX, SY uint16
 }
@@ -89,67 +391,519 @@ func (*CopyRectEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error)
 	return enc, nil
 }
 
-type DesktopSizePseudoEncoding struct{}
+func (*CopyRectEncoding) EncodedSize(*ClientConn, *Rectangle) int {
+	return 4
+}
+
+// Draw copies the source area of the rectangle within dst to the
+// rectangle's position. Overlapping source and destination areas are
+// handled correctly.
+func (enc *CopyRectEncoding) Draw(dst draw.Image, rect *Rectangle) {
+	r := image.Rect(int(rect.X), int(rect.Y), int(rect.X)+int(rect.Width), int(rect.Y)+int(rect.Height))
+	draw.Draw(dst, r, dst, image.Pt(int(enc.SX), int(enc.SY)), draw.Src)
+}
+
+// RREEncoding is rise-and-run-length encoding, a background color
+// followed by solid colored subrectangles.
+//
+// See RFC 6143 Section 7.7.3
+type RREEncoding struct {
+	img *image.RGBA
+}
+
+func (*RREEncoding) Type() EncodingType {
+	return RREEncType
+}
+
+func (*RREEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	img, err := readRRE(c, rect, 2)
+	if err != nil {
+		return nil, err
+	}
+	return &RREEncoding{img}, nil
+}
+
+func (enc *RREEncoding) Image(*Rectangle) (image.Image, error) {
+	return enc.img, nil
+}
+
+func (enc *RREEncoding) RGBA(*Rectangle) ([]byte, error) {
+	return enc.img.Pix, nil
+}
+
+func (enc *RREEncoding) PNG(rect *Rectangle) ([]byte, error) {
+	return encodePNG(enc, rect)
+}
+
+func (enc *RREEncoding) WritePNG(w io.Writer, _ *Rectangle) error {
+	return png.Encode(w, enc.img)
+}
+
+// CoRREEncoding is the compact variant of RREEncoding, using single
+// byte subrectangle coordinates. Rectangles are at most 255x255.
+type CoRREEncoding struct {
+	img *image.RGBA
+}
+
+func (*CoRREEncoding) Type() EncodingType {
+	return CoRREEncType
+}
+
+func (*CoRREEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	img, err := readRRE(c, rect, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &CoRREEncoding{img}, nil
+}
+
+func (enc *CoRREEncoding) Image(*Rectangle) (image.Image, error) {
+	return enc.img, nil
+}
+
+func (enc *CoRREEncoding) RGBA(*Rectangle) ([]byte, error) {
+	return enc.img.Pix, nil
+}
+
+func (enc *CoRREEncoding) PNG(rect *Rectangle) ([]byte, error) {
+	return encodePNG(enc, rect)
+}
+
+func (enc *CoRREEncoding) WritePNG(w io.Writer, _ *Rectangle) error {
+	return png.Encode(w, enc.img)
+}
+
+// readRRE reads the RRE and CoRRE encodings, which only differ in the
+// size of the subrectangle coordinates.
+func readRRE(c *ClientConn, rect *Rectangle, coordSize int) (*image.RGBA, error) {
+	pf := c.pixelFormat
+	bounds := image.Rect(0, 0, int(rect.Width), int(rect.Height))
+	img := image.NewRGBA(bounds)
+
+	var numSubrects uint32
+	if err := readFixedSize(c.r, &numSubrects); err != nil {
+		return nil, err
+	}
+
+	bg, err := pf.ReadPixels(c.r, 1)
+	if err != nil {
+		return nil, err
+	}
+	draw.Draw(img, bounds, image.NewUniform(color.RGBA{bg[0], bg[1], bg[2], bg[3]}), image.ZP, draw.Src)
+
+	box := make([]byte, 4*coordSize)
+	for i := uint32(0); i < numSubrects; i++ {
+		fg, err := pf.ReadPixels(c.r, 1)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(c.r, box); err != nil {
+			return nil, err
+		}
+
+		var x, y, w, h int
+		if coordSize == 1 {
+			x, y, w, h = int(box[0]), int(box[1]), int(box[2]), int(box[3])
+		} else {
+			x = int(binary.BigEndian.Uint16(box[0:]))
+			y = int(binary.BigEndian.Uint16(box[2:]))
+			w = int(binary.BigEndian.Uint16(box[4:]))
+			h = int(binary.BigEndian.Uint16(box[6:]))
+		}
+
+		subrect := image.Rect(x, y, x+w, y+h)
+		if !subrect.In(bounds) {
+			return nil, fmt.Errorf("subrectangle %v exceeds rectangle %v", subrect, bounds)
+		}
+		draw.Draw(img, subrect, image.NewUniform(color.RGBA{fg[0], fg[1], fg[2], fg[3]}), image.ZP, draw.Src)
+	}
+
+	return img, nil
+}
+
+// DesktopSizePseudoEncoding signals a change of the framebuffer size.
+// The new size is carried in the rectangle's width and height, and
+// there is no payload to read. Reading it updates the framebuffer size
+// of the connection.
+type DesktopSizePseudoEncoding struct {
+	// The new framebuffer size.
+	Width, Height uint16
+}
 
 func (*DesktopSizePseudoEncoding) Type() EncodingType {
 	return DesktopSizePseudoEncType
 }
 
-func (*DesktopSizePseudoEncoding) Read(*ClientConn, *Rectangle) (Encoding, error) {
-	return new(DesktopSizePseudoEncoding), nil
+func (*DesktopSizePseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	c.FrameBufferWidth = rect.Width
+	c.FrameBufferHeight = rect.Height
+	return &DesktopSizePseudoEncoding{rect.Width, rect.Height}, nil
+}
+
+func (*DesktopSizePseudoEncoding) EncodedSize(*ClientConn, *Rectangle) int {
+	return 0
+}
+
+// DesktopNamePseudoEncoding signals a change of the desktop name, sent
+// as UTF-8 in an empty rectangle. Reading it updates the desktop name
+// of the connection.
+type DesktopNamePseudoEncoding struct {
+	Name string
 }
 
+func (*DesktopNamePseudoEncoding) Type() EncodingType {
+	return DesktopNamePseudoEncType
+}
+
+func (*DesktopNamePseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	var length uint32
+	if err := readFixedSize(c.r, &length); err != nil {
+		return nil, err
+	}
+	if err := c.checkMessageSize(int64(length)); err != nil {
+		return nil, err
+	}
+
+	name := make([]byte, length)
+	if _, err := io.ReadFull(c.r, name); err != nil {
+		return nil, err
+	}
+
+	c.DesktopName = string(name)
+	return &DesktopNamePseudoEncoding{c.DesktopName}, nil
+}
+
+// LastRectPseudoEncoding marks the end of a framebuffer update whose
+// rectangle count wasn't known in advance, in which case the server
+// declares the maximum count of 65535. The rectangle carries no data
+// and isn't included in the received FramebufferUpdateMsg.
+type LastRectPseudoEncoding struct{}
+
+func (*LastRectPseudoEncoding) Type() EncodingType {
+	return LastRectPseudoEncType
+}
+
+func (*LastRectPseudoEncoding) Read(*ClientConn, *Rectangle) (Encoding, error) {
+	return new(LastRectPseudoEncoding), nil
+}
+
+// CursorPosPseudoEncoding reports the pointer position on the server,
+// e.g. after the server warped the pointer. The position is carried in
+// the rectangle's x and y, and there is no payload to read.
+type CursorPosPseudoEncoding struct {
+	X, Y uint16
+}
+
+func (*CursorPosPseudoEncoding) Type() EncodingType {
+	return CursorPosPseudoEncType
+}
+
+func (*CursorPosPseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	return &CursorPosPseudoEncoding{rect.X, rect.Y}, nil
+}
+
+// LED state bits of the LEDStatePseudoEncoding.
+const (
+	ScrollLockLED = 1 << iota
+	NumLockLED
+	CapsLockLED
+)
+
+// LEDStatePseudoEncoding reports the state of the keyboard LEDs on the
+// server. The payload is a single byte; the rectangle's position and
+// size are meaningless and are ignored.
+type LEDStatePseudoEncoding struct {
+	State uint8
+}
+
+func (*LEDStatePseudoEncoding) Type() EncodingType {
+	return LEDStatePseudoEncType
+}
+
+func (*LEDStatePseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	enc := new(LEDStatePseudoEncoding)
+	if err := readFixedSize(c.r, &enc.State); err != nil {
+		return nil, err
+	}
+	return enc, nil
+}
+
+// Reasons for an ExtendedDesktopSize change, sent in the rectangle's
+// x-position.
+const (
+	ResizeByServer      = 0
+	ResizeByClient      = 1
+	ResizeByOtherClient = 2
+)
+
+// Status codes of an ExtendedDesktopSize change, sent in the
+// rectangle's y-position. A status other than ResizeOK reports why a
+// SetDesktopSize request from this client failed.
+const (
+	ResizeOK = iota
+	ResizeProhibited
+	ResizeOutOfResources
+	ResizeInvalidLayout
+)
+
+// Screen describes one screen of the multi-screen layout of the
+// framebuffer.
+type Screen struct {
+	ID     uint32
+	X      uint16
+	Y      uint16
+	Width  uint16
+	Height uint16
+	Flags  uint32
+}
+
+// ExtendedDesktopSizePseudoEncoding signals a change of the framebuffer
+// size together with its layout of screens. Reading it updates the
+// framebuffer size of the connection.
+type ExtendedDesktopSizePseudoEncoding struct {
+	// Reason tells who initiated the change, see ResizeByServer.
+	Reason uint16
+
+	// Status is the result of the change, see ResizeOK.
+	Status uint16
+
+	// The new framebuffer size.
+	Width, Height uint16
+
+	Screens []Screen
+}
+
+func (*ExtendedDesktopSizePseudoEncoding) Type() EncodingType {
+	return ExtendedDesktopSizePseudoEncType
+}
+
+func (*ExtendedDesktopSizePseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	var numScreens uint8
+	if err := readFixedSize(c.r, &numScreens); err != nil {
+		return nil, err
+	}
+
+	padding := make([]byte, 3)
+	if _, err := io.ReadFull(c.r, padding); err != nil {
+		return nil, err
+	}
+
+	enc := &ExtendedDesktopSizePseudoEncoding{
+		Reason:  rect.X,
+		Status:  rect.Y,
+		Width:   rect.Width,
+		Height:  rect.Height,
+		Screens: make([]Screen, numScreens),
+	}
+	if err := readFixedSize(c.r, enc.Screens); err != nil {
+		return nil, err
+	}
+
+	c.FrameBufferWidth = rect.Width
+	c.FrameBufferHeight = rect.Height
+
+	return enc, nil
+}
+
+// CursorPseudoEncoding carries the shape of the cursor, to be drawn
+// locally by the client.
 type CursorPseudoEncoding struct {
-	rgba []byte
+	// The hotspot of the cursor, i.e. the pixel of the cursor image at
+	// the pointer position.
+	HotspotX uint16
+	HotspotY uint16
+
+	// KeepMaskedPixels, set on the encoding passed to SetEncodings,
+	// keeps the pixels outside the cursor mask as sent by the server
+	// instead of making them transparent.
+	KeepMaskedPixels bool
+
+	// Mask is the cursor's 1bpp mask, with rows padded to whole bytes
+	// and the most significant bit being the leftmost pixel. A set bit
+	// marks a pixel of the cursor.
+	Mask []byte
+
+	rgba          []byte
+	width, height uint16
 }
 
 func (*CursorPseudoEncoding) Type() EncodingType {
 	return CursorPseudoEncType
 }
 
-func (*CursorPseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+func (p *CursorPseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
 	var err error
 	var rgbaBuffer []byte
 	if rgbaBuffer, err = c.pixelFormat.ReadPixels(c.r, int(rect.Height)*int(rect.Width)); err != nil {
 		return nil, err
 	}
-	enc := new(CursorPseudoEncoding)
-	enc.rgba = rgbaBuffer
+	enc := &CursorPseudoEncoding{
+		HotspotX:         rect.X,
+		HotspotY:         rect.Y,
+		KeepMaskedPixels: p.KeepMaskedPixels,
+		rgba:             rgbaBuffer,
+		width:            rect.Width,
+		height:           rect.Height,
+	}
 
-	mask := make([]byte, (rect.Width+7)/8*rect.Height)
-	if _, err := io.ReadFull(c.r, mask); err != nil {
+	if enc.Mask, err = readBitmap(c.r, int(rect.Width), int(rect.Height)); err != nil {
 		return nil, err
 	}
+	if !enc.KeepMaskedPixels {
+		applyCursorMask(rgbaBuffer, enc.Mask, int(rect.Width), int(rect.Height))
+	}
 
-	// set masked pixels to black (not just alpha because we're using pre-multiplied RGBA)
-	rectStride := 4 * rect.Width
-	for i := uint16(0); i < rect.Height; i++ {
-		for j := uint16(0); j < rect.Width; j += 8 {
-			for idx, k := j/8, 7; k >= 0; k-- {
-				if (mask[idx] & (1 << uint(k))) == 0 {
-					pIdx := j*4 + i*rectStride
-					rgbaBuffer[pIdx] = 0
-					rgbaBuffer[pIdx+1] = 0
-					rgbaBuffer[pIdx+2] = 0
-					rgbaBuffer[pIdx+3] = 0
-				}
+	return enc, nil
+}
+
+func (*CursorPseudoEncoding) EncodedSize(c *ClientConn, rect *Rectangle) int {
+	width, height := int(rect.Width), int(rect.Height)
+	return width*height*int(c.pixelFormat.ByPP) + (width+7)/8*height
+}
+
+// readBitmap reads a 1bpp cursor bitmap, whose rows are padded to whole
+// bytes, with the most significant bit being the leftmost pixel.
+func readBitmap(r io.Reader, width, height int) ([]byte, error) {
+	bitmap := make([]byte, (width+7)/8*height)
+	if _, err := io.ReadFull(r, bitmap); err != nil {
+		return nil, err
+	}
+	return bitmap, nil
+}
+
+// bitmapBit reports whether the bit of the pixel (x, y) is set in a 1bpp
+// cursor bitmap.
+func bitmapBit(bitmap []byte, width, x, y int) bool {
+	return bitmap[y*((width+7)/8)+x/8]&(0x80>>uint(x%8)) != 0
+}
+
+// applyCursorMask makes the pixels not in the cursor mask transparent.
+// They are set to black too, since the RGBA is alpha-premultiplied.
+func applyCursorMask(rgba []byte, mask []byte, width, height int) {
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if !bitmapBit(mask, width, x, y) {
+				p := 4 * (y*width + x)
+				rgba[p], rgba[p+1], rgba[p+2], rgba[p+3] = 0, 0, 0, 0
 			}
 		}
 	}
+}
+
+// XCursorPseudoEncoding carries the shape of the cursor as two colors
+// and a bitmap choosing between them, like X11 cursors, to be drawn
+// locally by the client.
+type XCursorPseudoEncoding struct {
+	CursorPseudoEncoding
+}
+
+func (*XCursorPseudoEncoding) Type() EncodingType {
+	return XCursorPseudoEncType
+}
+
+func (*XCursorPseudoEncoding) EncodedSize(c *ClientConn, rect *Rectangle) int {
+	width, height := int(rect.Width), int(rect.Height)
+	if width == 0 || height == 0 {
+		return 0
+	}
+	return 6 + 2*((width+7)/8*height)
+}
+
+func (p *XCursorPseudoEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	width, height := int(rect.Width), int(rect.Height)
+	enc := &XCursorPseudoEncoding{CursorPseudoEncoding{
+		HotspotX:         rect.X,
+		HotspotY:         rect.Y,
+		KeepMaskedPixels: p.KeepMaskedPixels,
+		rgba:             make([]byte, 4*width*height),
+		width:            rect.Width,
+		height:           rect.Height,
+	}}
+	if width == 0 || height == 0 {
+		return enc, nil
+	}
+
+	var colors [2][3]uint8 // primary, secondary
+	if err := readFixedSize(c.r, &colors); err != nil {
+		return nil, err
+	}
+	bitmap, err := readBitmap(c.r, width, height)
+	if err != nil {
+		return nil, err
+	}
+	if enc.Mask, err = readBitmap(c.r, width, height); err != nil {
+		return nil, err
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			rgb := colors[1]
+			if bitmapBit(bitmap, width, x, y) {
+				rgb = colors[0]
+			}
+			p := 4 * (y*width + x)
+			enc.rgba[p], enc.rgba[p+1], enc.rgba[p+2], enc.rgba[p+3] = rgb[0], rgb[1], rgb[2], 255
+		}
+	}
+	if !enc.KeepMaskedPixels {
+		applyCursorMask(enc.rgba, enc.Mask, width, height)
+	}
 
 	return enc, nil
 }
 
+// Width returns the width of the cursor image.
+func (enc *CursorPseudoEncoding) Width() uint16 {
+	return enc.width
+}
+
+// Height returns the height of the cursor image.
+func (enc *CursorPseudoEncoding) Height() uint16 {
+	return enc.height
+}
+
 func (enc *CursorPseudoEncoding) RGBA(*Rectangle) ([]byte, error) {
 	return getData(enc.rgba)
 }
 
 func (enc *CursorPseudoEncoding) PNG(rect *Rectangle) ([]byte, error) {
-	return rgbaToPNG(enc.rgba, int(rect.Width), int(rect.Height))
+	return encodePNG(enc, rect)
+}
+
+func (enc *CursorPseudoEncoding) WritePNG(w io.Writer, rect *Rectangle) error {
+	return writeRGBAPNG(w, enc.rgba, int(rect.Width), int(rect.Height))
+}
+
+func (enc *CursorPseudoEncoding) Image(rect *Rectangle) (image.Image, error) {
+	return rgbaImage(enc.rgba, int(rect.Width), int(rect.Height))
+}
+
+func (enc *CursorPseudoEncoding) JPEG(rect *Rectangle, quality int) ([]byte, error) {
+	img, err := enc.Image(rect)
+	if err != nil {
+		return nil, err
+	}
+	return jpegEncode(img, quality)
 }
 
+// Hextile subencoding mask bits, see RFC 6143 Section 7.7.4. Apart from
+// Raw, which overrides all the others, the bits may be combined freely:
+// a background or foreground pixel that isn't specified is inherited
+// from the previous tile.
+const (
+	hextileRaw = 1 << iota
+	hextileBackgroundSpecified
+	hextileForegroundSpecified
+	hextileAnySubrects
+	hextileSubrectsColoured
+)
+
+// HextileEncoding divides the rectangle into 16x16 tiles, each either
+// raw or drawn as a background with subrectangles.
+//
+// See RFC 6143 Section 7.7.4
 type HextileEncoding struct {
-	png []byte
+	img *image.RGBA
 }
 
 func (*HextileEncoding) Type() EncodingType {
@@ -157,122 +911,121 @@ func (*HextileEncoding) Type() EncodingType {
 }
 
 func (enc *HextileEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
-	var err error
-	width := int(rect.Width)
-	height := int(rect.Height)
+	img := image.NewRGBA(image.Rect(0, 0, int(rect.Width), int(rect.Height)))
+	if err := decodeHextile(c, img, img.Rect); err != nil {
+		return nil, err
+	}
+	return &HextileEncoding{img}, nil
+}
+
+func (*HextileEncoding) DecodeInto(c *ClientConn, rect *Rectangle, dst *image.RGBA) error {
+	area, err := inPlaceArea(rect, dst)
+	if err != nil {
+		return err
+	}
+	return decodeHextile(c, dst, area)
+}
+
+// decodeHextile decodes the tiles of a Hextile rectangle into the area
+// of img.
+func decodeHextile(c *ClientConn, img *image.RGBA, area image.Rectangle) error {
 	pf := c.pixelFormat
-	img := image.NewRGBA(image.Rect(0, 0, width, height))
-	bg := image.NewUniform(color.Black)
-	fg := image.NewUniform(color.Black)
-
-	tw := 16
-	th := 16
-	twLast := width % 16
-	thLast := height % 16
-	txLast := width - twLast
-	tyLast := height - thLast
-	pixelBuffer := make([]byte, pf.ByPP)
-	subrectBox := make([]byte, 2)
-	for ty := 0; ty < height; ty += 16 {
-		if ty == tyLast {
-			th = thLast
-		}
-		tw = 16
+	bg := color.RGBA{0, 0, 0, 255}
+	fg := color.RGBA{0, 0, 0, 255}
 
-		for tx := 0; tx < width; tx += 16 {
-			if tx == txLast {
-				tw = twLast
-			}
+	pixel := make([]byte, 4)
+	subrectBox := make([]byte, 2)
+	for ty := area.Min.Y; ty < area.Max.Y; ty += 16 {
+		for tx := area.Min.X; tx < area.Max.X; tx += 16 {
+			tile := image.Rect(tx, ty, tx+16, ty+16).Intersect(area)
 
 			// read subencoding mask
-			var subencoding uint8
-			if err = readFixedSize(c.r, &subencoding); err != nil {
-				return nil, err
+			subencoding, err := c.r.ReadByte()
+			if err != nil {
+				return err
 			}
 
-			dstRect := image.Rect(tx, ty, tx+tw, ty+th)
-
 			// raw
-			if subencoding&1 != 0 {
-				var rgbaBuffer []byte
-				if rgbaBuffer, err = pf.ReadPixels(c.r, tw*th); err != nil {
-					return nil, err
+			if subencoding&hextileRaw != 0 {
+				if err = readPixelRows(c.r, pf, img, tile); err != nil {
+					return err
 				}
-				draw.Draw(img, dstRect, newRGBAImage(rgbaBuffer, tw, th), image.ZP, draw.Src)
 				continue
 			}
 
 			// background/foreground specified
-			if subencoding&2 != 0 {
-				if bg, err = enc.readPixelToUniform(c.r, pf, pixelBuffer); err != nil {
-					return nil, err
+			if subencoding&hextileBackgroundSpecified != 0 {
+				if bg, err = readPixelRGBA(c.r, pf, pixel); err != nil {
+					return err
 				}
 			}
-			if subencoding&4 != 0 {
-				if fg, err = enc.readPixelToUniform(c.r, pf, pixelBuffer); err != nil {
-					return nil, err
+			if subencoding&hextileForegroundSpecified != 0 {
+				if fg, err = readPixelRGBA(c.r, pf, pixel); err != nil {
+					return err
 				}
 			}
 
 			// draw background first
-			draw.Draw(img, dstRect, bg, image.ZP, draw.Src)
+			fillRGBA(img, tile, bg)
 
 			// done if no subrects
-			if subencoding&8 == 0 {
+			if subencoding&hextileAnySubrects == 0 {
 				continue
 			}
 
-			// colored?
-			var subrectColored bool = false
-			if subencoding&16 != 0 {
-				subrectColored = true
-			}
+			// colored? each subrect then has its own pixel value and
+			// the foreground is left untouched
+			subrectColored := subencoding&hextileSubrectsColoured != 0
 
-			var numSubRect uint8
-			if err = readFixedSize(c.r, &numSubRect); err != nil {
-				return nil, err
+			numSubRect, err := c.r.ReadByte()
+			if err != nil {
+				return err
 			}
 
 			// draw subrects
 			for i := uint8(0); i < numSubRect; i++ {
-				uImg := fg
+				col := fg
 				if subrectColored {
-					if uImg, err = enc.readPixelToUniform(c.r, pf, pixelBuffer); err != nil {
-						return nil, err
+					if col, err = readPixelRGBA(c.r, pf, pixel); err != nil {
+						return err
 					}
 				}
 
 				if _, err := io.ReadFull(c.r, subrectBox); err != nil {
-					return nil, err
+					return err
 				}
 				sy := ty + int(subrectBox[0]&0xF)
 				sx := tx + int(subrectBox[0]>>4)
 				sh := int(subrectBox[1]&0xF) + 1
 				sw := int(subrectBox[1]>>4) + 1
-				dstRect = image.Rect(sx, sy, sx+sw, sy+sh)
-				draw.Draw(img, dstRect, uImg, image.ZP, draw.Src)
+				fillRGBA(img, image.Rect(sx, sy, sx+sw, sy+sh).Intersect(area), col)
 			}
 		}
 	}
 
-	hEnc := new(HextileEncoding)
-	if hEnc.png, err = pngEncode(img); err != nil {
-		return nil, err
-	}
-	return hEnc, nil
+	return nil
 }
 
-func (*HextileEncoding) readPixelToUniform(r io.Reader, pf *PixelFormat, buffer []byte) (*image.Uniform, error) {
-	var err error
-	if buffer, err = pf.ReadPixels(r, 1); err != nil {
-		return nil, err
-	}
+func (enc *HextileEncoding) Image(*Rectangle) (image.Image, error) {
+	return enc.img, nil
+}
+
+func (enc *HextileEncoding) RGBA(*Rectangle) ([]byte, error) {
+	return enc.img.Pix, nil
+}
+
+// PNG encodes the decoded tiles as a PNG image. The encoding is done on
+// each call, so prefer RGBA when the pixels are needed.
+func (enc *HextileEncoding) PNG(rect *Rectangle) ([]byte, error) {
+	return encodePNG(enc, rect)
+}
 
-	return image.NewUniform(color.RGBA{buffer[0], buffer[1], buffer[2], buffer[3]}), nil
+func (enc *HextileEncoding) WritePNG(w io.Writer, _ *Rectangle) error {
+	return png.Encode(w, enc.img)
 }
 
-func (enc *HextileEncoding) PNG(*Rectangle) ([]byte, error) {
-	return getData(enc.png)
+func (enc *HextileEncoding) JPEG(_ *Rectangle, quality int) ([]byte, error) {
+	return jpegEncode(enc.img, quality)
 }
 
 // utils functions
@@ -293,14 +1046,53 @@ func newRGBAImage(rgba []byte, width int, height int) image.Image {
 	return img
 }
 
-func rgbaToPNG(rgba []byte, width int, height int) ([]byte, error) {
+// rgbaImage returns the decoded RGBA pixels as an image, which shares
+// the pixels.
+func rgbaImage(rgba []byte, width int, height int) (image.Image, error) {
 	var err error
 	if rgba, err = getData(rgba); err != nil {
 		return nil, err
 	}
 
 	// rgba buffer should not be modified
-	return pngEncode(newRGBAImage(rgba, width, height))
+	return newRGBAImage(rgba, width, height), nil
+}
+
+func writeRGBAPNG(w io.Writer, rgba []byte, width int, height int) error {
+	img, err := rgbaImage(rgba, width, height)
+	if err != nil {
+		return err
+	}
+	return png.Encode(w, img)
+}
+
+// pngWriter is implemented by the encodings that can write their image
+// as PNG. WritePNG streams the PNG to the writer, while PNG buffers it.
+type pngWriter interface {
+	WritePNG(io.Writer, *Rectangle) error
+}
+
+// encodePNG returns the PNG written by the encoding as a byte slice.
+func encodePNG(enc pngWriter, rect *Rectangle) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := enc.WritePNG(buf, rect); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// jpegEncode encodes the image as JPEG with the given quality, from 1
+// to 100. Transparent pixels come out black.
+func jpegEncode(img image.Image, quality int) ([]byte, error) {
+	if quality < 1 || quality > 100 {
+		return nil, fmt.Errorf("invalid JPEG quality: %d", quality)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 func pngEncode(img image.Image) ([]byte, error) {
@@ -0,0 +1,645 @@
+package vnc
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"testing"
+)
+
+// markerEncoding is an encoding outside the package's known types whose
+// rectangles carry no data.
+type markerEncoding struct {
+	t      EncodingType
+	pseudo bool
+}
+
+func (e *markerEncoding) Type() EncodingType { return e.t }
+func (e *markerEncoding) Pseudo() bool       { return e.pseudo }
+
+func (e *markerEncoding) Read(*ClientConn, *Rectangle) (Encoding, error) {
+	return e, nil
+}
+
+func TestRegisterEncoding(t *testing.T) {
+	global := &markerEncoding{t: -0x7001}
+	RegisterEncoding(global)
+	t.Cleanup(func() {
+		registryMu.Lock()
+		delete(registry, global.t)
+		registryMu.Unlock()
+	})
+
+	data := wire(FramebufferUpdateMID, uint8(0), uint16(1), uint16(0), uint16(0), uint16(1), uint16(1), global.t)
+
+	// registered with the package
+	c, _ := newTestClient(nil, data)
+	msg, err := c.ReceiveMsg()
+	if err != nil {
+		t.Fatal(err)
+	} else if enc := msg.(*FramebufferUpdateMsg).Rectangles[0].Encoding; enc != global {
+		t.Errorf("got encoding %v, want the package's", enc)
+	}
+
+	// the connection's registry takes precedence
+	c, _ = newTestClient(nil, data)
+	local := &markerEncoding{t: global.t}
+	c.RegisterEncoding(local)
+	if msg, err = c.ReceiveMsg(); err != nil {
+		t.Fatal(err)
+	} else if enc := msg.(*FramebufferUpdateMsg).Rectangles[0].Encoding; enc != local {
+		t.Errorf("got encoding %v, want the connection's", enc)
+	}
+
+	// and SetEncodings over both
+	c, _ = newTestClient(nil, data)
+	c.RegisterEncoding(local)
+	sent := &markerEncoding{t: global.t}
+	if err := c.SendMsg(&SetEncodingsMsg{Encodings: []Encoding{sent}}); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = c.ReceiveMsg(); err != nil {
+		t.Fatal(err)
+	} else if enc := msg.(*FramebufferUpdateMsg).Rectangles[0].Encoding; enc != sent {
+		t.Errorf("got encoding %v, want the sent one", enc)
+	}
+
+	// unknown types are still rejected
+	c, _ = newTestClient(nil, wire(FramebufferUpdateMID, uint8(0), uint16(1),
+		uint16(0), uint16(0), uint16(1), uint16(1), EncodingType(-0x7002)))
+	if _, err := c.ReceiveMsg(); err == nil {
+		t.Error("no error for an unregistered encoding")
+	}
+
+	if enc := builtinEncoding(global.t); enc != global {
+		t.Errorf("server got encoding %v, want the package's", enc)
+	}
+}
+
+func TestPseudoEncoding(t *testing.T) {
+	tests := []struct {
+		name    string
+		pseudo  bool
+		strict  bool
+		rect    Rectangle
+		wantErr bool
+	}{
+		{"pseudo larger than the framebuffer", true, false, Rectangle{Width: 2000, Height: 2000}, false},
+		{"pseudo outside the framebuffer", true, true, Rectangle{X: 1000, Y: 700, Width: 100, Height: 100}, false},
+		{"pixels larger than the framebuffer", false, false, Rectangle{Width: 2000, Height: 2000}, true},
+		{"pixels outside the framebuffer", false, true, Rectangle{X: 1000, Y: 700, Width: 100, Height: 100}, true},
+		{"pixels inside the framebuffer", false, true, Rectangle{X: 10, Y: 10, Width: 100, Height: 100}, false},
+	}
+	for _, tt := range tests {
+		enc := &markerEncoding{t: EncodingType(-0x7000), pseudo: tt.pseudo}
+		data := wire(FramebufferUpdateMID, uint8(0), uint16(1),
+			tt.rect.X, tt.rect.Y, tt.rect.Width, tt.rect.Height, enc.t)
+		c, _ := newTestClient(&ClientConnConfig{Strict: tt.strict}, data)
+		c.RegisterEncoding(enc)
+
+		msg, err := c.ReceiveMsg()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		// pseudo rectangles are neither drawn nor marked dirty
+		update := msg.(*FramebufferUpdateMsg)
+		fb := NewFramebuffer(1024, 768)
+		err = fb.Apply(update)
+		if tt.pseudo && err != nil {
+			t.Errorf("%s: Apply: %v", tt.name, err)
+		} else if !tt.pseudo && err == nil {
+			t.Errorf("%s: Apply drew an encoding without pixels", tt.name)
+		}
+		g := NewTileGrid(1024, 768, 64)
+		g.Clear()
+		g.MarkUpdate(update)
+		if dirty := len(g.Dirty()) > 0; dirty == tt.pseudo {
+			t.Errorf("%s: dirty tiles %v", tt.name, g.Dirty())
+		}
+	}
+}
+
+func TestIsPseudoEncoding(t *testing.T) {
+	tests := []struct {
+		enc  Encoding
+		want bool
+	}{
+		{&RawEncoding{}, false},
+		{&HextileEncoding{}, false},
+		{&DesktopSizePseudoEncoding{}, true},
+		{&ExtendedClipboardPseudoEncoding{}, true},
+		{&markerEncoding{t: 1000}, false},
+		{&markerEncoding{t: 1000, pseudo: true}, true},
+		// the method takes precedence over the type
+		{&markerEncoding{t: CursorPseudoEncType}, false},
+	}
+	for _, tt := range tests {
+		if got := isPseudoEncoding(tt.enc); got != tt.want {
+			t.Errorf("%T of type %d: got %v, want %v", tt.enc, tt.enc.Type(), got, tt.want)
+		}
+	}
+}
+
+func TestLEDState(t *testing.T) {
+	// the position and size of pseudo-encoding rectangles are not
+	// checked against the framebuffer, even in Strict mode
+	c, tc := newTestClient(&ClientConnConfig{Strict: true}, wire(FramebufferUpdateMID, uint8(0), uint16(1),
+		uint16(5000), uint16(5000), uint16(3000), uint16(3000), LEDStatePseudoEncType, uint8(NumLockLED|CapsLockLED)))
+	c.encodingMap[LEDStatePseudoEncType] = &LEDStatePseudoEncoding{}
+
+	msg, err := c.ReceiveMsg()
+	if err != nil {
+		t.Fatal(err)
+	} else if !consumed(c, tc) {
+		t.Error("data left unread")
+	}
+	rects := msg.(*FramebufferUpdateMsg).Rectangles
+	if len(rects) != 1 {
+		t.Fatalf("got %d rectangles, want 1", len(rects))
+	}
+	if got := rects[0].EncodingType(); got != LEDStatePseudoEncType {
+		t.Errorf("got encoding type %d, want %d", got, LEDStatePseudoEncType)
+	}
+	if enc := rects[0].Encoding.(*LEDStatePseudoEncoding); enc.State != NumLockLED|CapsLockLED {
+		t.Errorf("got LED state %#x, want %#x", enc.State, NumLockLED|CapsLockLED)
+	}
+}
+
+func TestRectangleEncodingType(t *testing.T) {
+	for _, enc := range []Encoding{&RawEncoding{}, &CopyRectEncoding{},
+		&DesktopSizePseudoEncoding{}, &CursorPseudoEncoding{}, &LEDStatePseudoEncoding{}} {
+		rect := Rectangle{Encoding: enc}
+		if got := rect.EncodingType(); got != enc.Type() {
+			t.Errorf("%T: got encoding type %d, want %d", enc, got, enc.Type())
+		}
+	}
+}
+
+func TestHextileEncoding(t *testing.T) {
+	red, green := pixel(255, 0, 0), pixel(0, 255, 0)
+	blue, white := pixel(0, 0, 255), pixel(255, 255, 255)
+	yellow, cyan := pixel(255, 255, 0), pixel(0, 255, 255)
+	rgba := func(p []byte) color.RGBA {
+		return color.RGBA{p[2], p[1], p[0], 255}
+	}
+
+	// The first tile sets the background to red and the foreground to
+	// green, the second tile uses every combination of subencodings.
+	for mask := 0; mask < 32; mask++ {
+		data := wire(uint8(hextileBackgroundSpecified|hextileForegroundSpecified), red, green, uint8(mask))
+		wantBg, wantSub := rgba(red), rgba(red)
+		switch {
+		case mask&hextileRaw != 0:
+			data = append(data, pixels(16*16, cyan)...)
+			wantBg, wantSub = rgba(cyan), rgba(cyan)
+		default:
+			if mask&hextileBackgroundSpecified != 0 {
+				data = append(data, blue...)
+				wantBg, wantSub = rgba(blue), rgba(blue)
+			}
+			if mask&hextileForegroundSpecified != 0 {
+				data = append(data, white...)
+			}
+			if mask&hextileAnySubrects != 0 {
+				data = append(data, 1)
+				switch {
+				case mask&hextileSubrectsColoured != 0:
+					data = append(data, yellow...)
+					wantSub = rgba(yellow)
+				case mask&hextileForegroundSpecified != 0:
+					wantSub = rgba(white)
+				default:
+					wantSub = rgba(green)
+				}
+				// a 2x1 subrectangle at (1,1)
+				data = append(data, 0x11, 0x10)
+			}
+		}
+
+		rect := &Rectangle{X: 4, Y: 2, Width: 32, Height: 16}
+		c, tc := newTestClient(nil, data)
+		enc, err := (&HextileEncoding{}).Read(c, rect)
+		if err != nil {
+			t.Errorf("mask %05b: %v", mask, err)
+			continue
+		} else if !consumed(c, tc) {
+			t.Errorf("mask %05b: data left unread", mask)
+		}
+		img := enc.(*HextileEncoding).img
+		if got := img.RGBAAt(0, 0); got != rgba(red) {
+			t.Errorf("mask %05b: first tile is %v", mask, got)
+		}
+		if got := img.RGBAAt(16, 0); got != wantBg {
+			t.Errorf("mask %05b: background is %v, want %v", mask, got, wantBg)
+		}
+		if got := img.RGBAAt(18, 1); got != wantSub {
+			t.Errorf("mask %05b: subrectangle is %v, want %v", mask, got, wantSub)
+		}
+		if got := img.RGBAAt(19, 1); got != wantBg {
+			t.Errorf("mask %05b: pixel right of the subrectangle is %v, want %v", mask, got, wantBg)
+		}
+
+		// the PNG is encoded on demand from the same pixels
+		pngData, err := enc.(*HextileEncoding).PNG(rect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := png.Decode(bytes.NewReader(pngData))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := enc.(*HextileEncoding).WritePNG(&buf, rect); err != nil || !bytes.Equal(buf.Bytes(), pngData) {
+			t.Errorf("mask %05b: WritePNG differs from PNG: %v", mask, err)
+		}
+		for _, p := range []image.Point{{0, 0}, {16, 0}, {18, 1}, {19, 1}} {
+			if got := color.RGBAModel.Convert(decoded.At(p.X, p.Y)); got != img.RGBAAt(p.X, p.Y) {
+				t.Errorf("mask %05b: PNG pixel %v is %v, want %v", mask, p, got, img.RGBAAt(p.X, p.Y))
+			}
+		}
+
+		// decoding in place gives the same pixels at the position
+		c, tc = newTestClient(nil, data)
+		dst := image.NewRGBA(image.Rect(0, 0, 40, 20))
+		if err := (&HextileEncoding{}).DecodeInto(c, rect, dst); err != nil {
+			t.Errorf("mask %05b: DecodeInto: %v", mask, err)
+		} else if !consumed(c, tc) {
+			t.Errorf("mask %05b: DecodeInto left data unread", mask)
+		}
+		if got := dst.SubImage(image.Rect(4, 2, 36, 18)).(*image.RGBA); !equalRGBA(got, img) {
+			t.Errorf("mask %05b: DecodeInto differs from Read", mask)
+		}
+	}
+}
+
+// equalRGBA reports whether the images have the same size and pixels.
+func equalRGBA(a, b *image.RGBA) bool {
+	if a.Rect.Dx() != b.Rect.Dx() || a.Rect.Dy() != b.Rect.Dy() {
+		return false
+	}
+	for y := 0; y < a.Rect.Dy(); y++ {
+		for x := 0; x < a.Rect.Dx(); x++ {
+			if a.RGBAAt(a.Rect.Min.X+x, a.Rect.Min.Y+y) != b.RGBAAt(b.Rect.Min.X+x, b.Rect.Min.Y+y) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// hextileBenchData returns a 256x256 Hextile rectangle of tiles with a
+// background and eight coloured subrectangles each.
+func hextileBenchData() ([]byte, *Rectangle) {
+	rect := &Rectangle{Width: 256, Height: 256}
+	var data []byte
+	for i := 0; i < 16*16; i++ {
+		data = append(data, hextileBackgroundSpecified|hextileAnySubrects|hextileSubrectsColoured)
+		data = append(data, pixel(uint8(i), 0, 0)...)
+		data = append(data, 8)
+		for j := uint8(0); j < 8; j++ {
+			data = append(data, pixel(0, j*32, 255)...)
+			data = append(data, j<<4|j, 0x11)
+		}
+	}
+	return data, rect
+}
+
+// BenchmarkHextile compares decoding the tiles only, as Read does now,
+// with also encoding them as PNG, as Read used to do for every
+// rectangle.
+func BenchmarkHextile(b *testing.B) {
+	data, rect := hextileBenchData()
+	for _, eager := range []bool{false, true} {
+		name := "lazy"
+		if eager {
+			name = "eager PNG"
+		}
+		b.Run(name, func(b *testing.B) {
+			c, tc := newTestClient(nil, nil)
+			b.SetBytes(int64(rect.Width) * int64(rect.Height) * 4)
+			for i := 0; i < b.N; i++ {
+				tc.in.Write(data)
+				enc, err := (&HextileEncoding{}).Read(c, rect)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if eager {
+					if _, err := enc.(*HextileEncoding).PNG(rect); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRREEncoding(t *testing.T) {
+	red, blue := pixel(255, 0, 0), pixel(0, 0, 255)
+	tests := []struct {
+		name    string
+		enc     Encoding
+		data    []byte
+		wantErr bool
+	}{
+		{"RRE", &RREEncoding{}, wire(uint32(1), red, blue, uint16(1), uint16(2), uint16(2), uint16(1)), false},
+		{"CoRRE", &CoRREEncoding{}, wire(uint32(1), red, blue, uint8(1), uint8(2), uint8(2), uint8(1)), false},
+		{"RRE outside", &RREEncoding{}, wire(uint32(1), red, blue, uint16(3), uint16(3), uint16(2), uint16(2)), true},
+	}
+	for _, tt := range tests {
+		c, tc := newTestClient(nil, tt.data)
+		rect := &Rectangle{Width: 4, Height: 4}
+		enc, err := tt.enc.Read(c, rect)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		img, _ := enc.(ImageEncoding).Image(rect)
+		for _, p := range []struct {
+			x, y int
+			r, b uint8
+		}{{0, 0, 255, 0}, {1, 2, 0, 255}, {2, 2, 0, 255}, {3, 2, 255, 0}, {1, 3, 255, 0}} {
+			got := img.(*image.RGBA).RGBAAt(p.x, p.y)
+			if got.R != p.r || got.B != p.b {
+				t.Errorf("%s: pixel (%d,%d) is %v", tt.name, p.x, p.y, got)
+			}
+		}
+		if !consumed(c, tc) {
+			t.Errorf("%s: data left unread", tt.name)
+		}
+	}
+}
+
+func TestCursorEncodings(t *testing.T) {
+	red, blue := pixel(255, 0, 0), pixel(0, 0, 255)
+	tests := []struct {
+		name string
+		enc  Encoding
+		data []byte
+		want [4]color.RGBA // the 2x2 image
+	}{
+		{
+			name: "cursor",
+			enc:  &CursorPseudoEncoding{},
+			data: wire(red, blue, blue, red, uint8(0x80), uint8(0x40)),
+			want: [4]color.RGBA{{255, 0, 0, 255}, {}, {}, {255, 0, 0, 255}},
+		},
+		{
+			name: "cursor keeping masked pixels",
+			enc:  &CursorPseudoEncoding{KeepMaskedPixels: true},
+			data: wire(red, blue, blue, red, uint8(0x80), uint8(0x40)),
+			want: [4]color.RGBA{{255, 0, 0, 255}, {0, 0, 255, 255}, {0, 0, 255, 255}, {255, 0, 0, 255}},
+		},
+		{
+			name: "XCursor",
+			enc:  &XCursorPseudoEncoding{},
+			// primary white, secondary black, diagonal image, mask
+			// without the bottom right pixel
+			data: wire([3]uint8{255, 255, 255}, [3]uint8{0, 0, 0}, uint8(0x80), uint8(0x40), uint8(0xc0), uint8(0x80)),
+			want: [4]color.RGBA{{255, 255, 255, 255}, {0, 0, 0, 255}, {0, 0, 0, 255}, {}},
+		},
+	}
+	for _, tt := range tests {
+		c, tc := newTestClient(nil, tt.data)
+		rect := &Rectangle{X: 1, Y: 0, Width: 2, Height: 2}
+		enc, err := tt.enc.Read(c, rect)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		} else if !consumed(c, tc) {
+			t.Errorf("%s: data left unread", tt.name)
+		}
+		// the mask comes last
+		var mask []byte
+		switch enc := enc.(type) {
+		case *CursorPseudoEncoding:
+			mask = enc.Mask
+		case *XCursorPseudoEncoding:
+			mask = enc.Mask
+		}
+		if want := tt.data[len(tt.data)-2:]; !bytes.Equal(mask, want) {
+			t.Errorf("%s: got mask %v, want %v", tt.name, mask, want)
+		}
+		if framed, ok := tt.enc.(FramedEncoding); ok && framed.EncodedSize(c, rect) != len(tt.data) {
+			t.Errorf("%s: EncodedSize is %d, want %d", tt.name, framed.EncodedSize(c, rect), len(tt.data))
+		}
+		img, err := enc.(ImageEncoding).Image(rect)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		for i, want := range tt.want {
+			if got := img.(*image.RGBA).RGBAAt(i%2, i/2); got != want {
+				t.Errorf("%s: pixel %d is %v, want %v", tt.name, i, got, want)
+			}
+		}
+	}
+}
+
+func TestPseudoEncodingUpdates(t *testing.T) {
+	c, tc := newTestClient(nil, wire(FramebufferUpdateMID, uint8(0), uint16(0xffff),
+		uint16(0), uint16(0), uint16(800), uint16(600), DesktopSizePseudoEncType,
+		uint16(0), uint16(0), uint16(0), uint16(0), DesktopNamePseudoEncType, uint32(4), "desk",
+		uint16(10), uint16(20), uint16(0), uint16(0), CursorPosPseudoEncType,
+		uint16(0), uint16(0), uint16(0), uint16(0), LEDStatePseudoEncType, uint8(CapsLockLED),
+		uint16(ResizeByClient), uint16(ResizeOK), uint16(640), uint16(480), ExtendedDesktopSizePseudoEncType,
+		uint8(1), [3]byte{}, Screen{ID: 1, Width: 640, Height: 480},
+		uint16(0), uint16(0), uint16(0), uint16(0), LastRectPseudoEncType))
+	for _, enc := range []Encoding{&DesktopSizePseudoEncoding{}, &DesktopNamePseudoEncoding{},
+		&CursorPosPseudoEncoding{}, &LEDStatePseudoEncoding{}, &ExtendedDesktopSizePseudoEncoding{}} {
+		c.encodingMap[enc.Type()] = enc
+	}
+
+	msg, err := c.ReceiveMsg()
+	if err != nil {
+		t.Fatal(err)
+	} else if !consumed(c, tc) {
+		t.Error("data left unread")
+	}
+	rects := msg.(*FramebufferUpdateMsg).Rectangles
+	if len(rects) != 5 {
+		t.Fatalf("got %d rectangles, want 5 before LastRect", len(rects))
+	}
+	if enc := rects[0].Encoding.(*DesktopSizePseudoEncoding); enc.Width != 800 || enc.Height != 600 {
+		t.Errorf("DesktopSize %+v", enc)
+	}
+	if enc := rects[1].Encoding.(*DesktopNamePseudoEncoding); enc.Name != "desk" || c.DesktopName != "desk" {
+		t.Errorf("DesktopName %+v, connection %q", enc, c.DesktopName)
+	}
+	if enc := rects[2].Encoding.(*CursorPosPseudoEncoding); enc.X != 10 || enc.Y != 20 {
+		t.Errorf("CursorPos %+v", enc)
+	}
+	if enc := rects[3].Encoding.(*LEDStatePseudoEncoding); enc.State != CapsLockLED {
+		t.Errorf("LEDState %+v", enc)
+	}
+	enc := rects[4].Encoding.(*ExtendedDesktopSizePseudoEncoding)
+	if enc.Reason != ResizeByClient || len(enc.Screens) != 1 || enc.Screens[0].Width != 640 {
+		t.Errorf("ExtendedDesktopSize %+v", enc)
+	}
+	if c.FrameBufferWidth != 640 || c.FrameBufferHeight != 480 {
+		t.Errorf("framebuffer resized to %dx%d", c.FrameBufferWidth, c.FrameBufferHeight)
+	}
+}
+
+func TestCursorHotspot(t *testing.T) {
+	red, blue := pixel(255, 0, 0), pixel(0, 0, 255)
+	c, tc := newTestClient(nil, wire(FramebufferUpdateMID, uint8(0), uint16(1),
+		uint16(3), uint16(2), uint16(2), uint16(1), CursorPseudoEncType, red, blue, uint8(0xc0)))
+	c.encodingMap[CursorPseudoEncType] = &CursorPseudoEncoding{}
+
+	msg, err := c.ReceiveMsg()
+	if err != nil {
+		t.Fatal(err)
+	} else if !consumed(c, tc) {
+		t.Error("data left unread")
+	}
+	rect := &msg.(*FramebufferUpdateMsg).Rectangles[0]
+	enc := rect.Encoding.(*CursorPseudoEncoding)
+	if enc.HotspotX != 3 || enc.HotspotY != 2 {
+		t.Errorf("got hotspot (%d,%d), want (3,2)", enc.HotspotX, enc.HotspotY)
+	}
+	if enc.Width() != 2 || enc.Height() != 1 {
+		t.Errorf("got size %dx%d, want 2x1", enc.Width(), enc.Height())
+	}
+	img := decodedImage(enc, rect)
+	if got := img.RGBAAt(1, 0); got.B != 255 || got.A != 255 {
+		t.Errorf("cursor pixel (1,0) is %v, want blue", got)
+	}
+}
+
+func TestCopyRectEncoding(t *testing.T) {
+	c, _ := newTestClient(nil, wire(uint16(0), uint16(0)))
+	rect := &Rectangle{X: 1, Y: 1, Width: 2, Height: 2}
+	enc, err := (&CopyRectEncoding{}).Read(c, rect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rect.Encoding = enc
+
+	// the source and destination overlap
+	fb := NewFramebuffer(4, 4)
+	draw.Draw(fb.Image(), image.Rect(0, 0, 2, 2), image.NewUniform(color.RGBA{200, 0, 0, 255}), image.ZP, draw.Src)
+	if err := fb.Apply(&FramebufferUpdateMsg{[]Rectangle{*rect}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []image.Point{{0, 0}, {1, 1}, {2, 2}, {2, 1}} {
+		if got := fb.Image().RGBAAt(p.X, p.Y); got.R != 200 {
+			t.Errorf("pixel %v is %v after the copy", p, got)
+		}
+	}
+	if got := fb.Image().RGBAAt(3, 3); got.R != 0 {
+		t.Errorf("pixel (3,3) is %v, outside of the copy", got)
+	}
+}
+
+func TestRawEncoding(t *testing.T) {
+	data := wire(pixel(255, 0, 0), pixel(0, 255, 0), pixel(0, 0, 255), pixel(1, 2, 3))
+	c, tc := newTestClient(nil, data)
+	rect := &Rectangle{Width: 2, Height: 2}
+	enc, err := (&RawEncoding{}).Read(c, rect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rgba, _ := enc.(*RawEncoding).RGBA(rect)
+	want := []byte{255, 0, 0, 255, 0, 255, 0, 255, 0, 0, 255, 255, 1, 2, 3, 255}
+	if !bytes.Equal(rgba, want) || !consumed(c, tc) {
+		t.Errorf("got %v, want %v", rgba, want)
+	}
+}
+
+func TestRawEncodingWriteRect(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for i, c := range []color.RGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255},
+		{255, 255, 255, 255}, {0, 0, 0, 255}, {255, 0, 255, 255}} {
+		img.SetRGBA(i%3, i/3, c)
+	}
+	rgb565 := RFBPixelFormat{BPP: 16, Depth: 16, BigEndian: 1, TrueColor: 1,
+		RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 11, GreenShift: 5}
+	rgb24 := PixelFormatRGB888()
+	rgb24.BPP = 24
+
+	for _, rpf := range []RFBPixelFormat{PixelFormatRGB888(), PixelFormatBGR233(), rgb565, rgb24} {
+		rpf := rpf
+		pf := NewPixelFormat(&rpf)
+		buf := new(bytes.Buffer)
+		if err := (&RawEncoding{}).WriteRect(buf, pf, img, 5, 6); err != nil {
+			t.Errorf("%d bpp: %v", rpf.BPP, err)
+			continue
+		}
+
+		c, tc := newTestClient(nil, wire(FramebufferUpdateMID, uint8(0), uint16(1), buf.Bytes()))
+		c.pixelFormat = pf
+		msg, err := c.ReceiveMsg()
+		if err != nil {
+			t.Errorf("%d bpp: %v", rpf.BPP, err)
+			continue
+		} else if !consumed(c, tc) {
+			t.Errorf("%d bpp: data left unread", rpf.BPP)
+		}
+		rect := &msg.(*FramebufferUpdateMsg).Rectangles[0]
+		if rect.X != 5 || rect.Y != 6 || rect.Width != 3 || rect.Height != 2 {
+			t.Errorf("%d bpp: got rectangle %+v", rpf.BPP, *rect)
+		}
+		if got := decodedImage(rect.Encoding, rect); !bytes.Equal(got.Pix, img.Pix) {
+			t.Errorf("%d bpp: got pixels %v, want %v", rpf.BPP, got.Pix, img.Pix)
+		}
+	}
+
+	big := image.NewRGBA(image.Rect(0, 0, 1<<16, 1))
+	rpf := PixelFormatRGB888()
+	if err := (&RawEncoding{}).WriteRect(io.Discard, NewPixelFormat(&rpf), big, 0, 0); err == nil {
+		t.Error("no error writing a rectangle wider than 65535 pixels")
+	}
+}
+
+func TestEncodingJPEG(t *testing.T) {
+	rect := &Rectangle{Width: 16, Height: 16}
+	c, _ := newTestClient(nil, pixels(16*16, pixel(255, 0, 0)))
+	raw, err := (&RawEncoding{}).Read(c, rect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ = newTestClient(nil, wire(uint8(hextileBackgroundSpecified), pixel(255, 0, 0)))
+	hextile, err := (&HextileEncoding{}).Read(c, rect)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type jpegEncoder interface {
+		JPEG(*Rectangle, int) ([]byte, error)
+	}
+	for _, enc := range []Encoding{raw, hextile} {
+		data, err := enc.(jpegEncoder).JPEG(rect, 90)
+		if err != nil {
+			t.Errorf("%T: %v", enc, err)
+			continue
+		}
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%T: %v", enc, err)
+			continue
+		}
+		if r, g, b, _ := img.At(8, 8).RGBA(); r>>8 < 240 || g>>8 > 15 || b>>8 > 15 {
+			t.Errorf("%T: decoded pixel %v, want red", enc, img.At(8, 8))
+		}
+
+		if _, err := enc.(jpegEncoder).JPEG(rect, 0); err == nil {
+			t.Errorf("%T: no error for quality 0", enc)
+		}
+	}
+}
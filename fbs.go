@@ -0,0 +1,141 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// fbsHeader starts FrameBufferStream files, as written by vncrec and
+// rfbproxy.
+const fbsHeader = "FBS 001.000\n"
+
+// maxFBSBlockSize limits the size of the blocks ReplayConn reads, so a
+// corrupt recording can't make it allocate huge buffers.
+const maxFBSBlockSize = DefaultMaxMessageSize
+
+// Recorder records the data sent by a server in the FrameBufferStream
+// (FBS) format, to be replayed with ReplayConn. The data is stored in
+// blocks, each with the time it was received in milliseconds since the
+// recording started. Set it as ClientConnConfig.Recorder.
+type Recorder struct {
+	mu    sync.Mutex
+	w     io.Writer
+	start time.Time
+}
+
+// NewRecorder writes the FBS header to w and returns a Recorder writing
+// blocks to it.
+func NewRecorder(w io.Writer) (*Recorder, error) {
+	if _, err := io.WriteString(w, fbsHeader); err != nil {
+		return nil, err
+	}
+	return &Recorder{w: w, start: time.Now()}, nil
+}
+
+// Write records p as a block: its length, the data padded to a multiple
+// of 4 bytes and the timestamp.
+func (r *Recorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	timestamp := uint32(time.Since(r.start) / time.Millisecond)
+	block := new(bytes.Buffer)
+	writeFixedSize(block, uint32(len(p)))
+	block.Write(p)
+	block.Write(make([]byte, -len(p)&3))
+	writeFixedSize(block, timestamp)
+	if _, err := r.w.Write(block.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ReplayConn is a net.Conn playing back an FBS recording, to feed a
+// recorded session to NewClientConn. Reads return the recorded data as
+// fast as it is read, regardless of the timestamps; writes are
+// discarded.
+type ReplayConn struct {
+	r io.Reader
+
+	// the rest of the current block
+	block []byte
+
+	// Timestamp is the time of the block being read, in milliseconds
+	// since the recording started.
+	Timestamp time.Duration
+}
+
+// NewReplayConn reads the FBS header from r and returns a ReplayConn
+// playing back the recording.
+func NewReplayConn(r io.Reader) (*ReplayConn, error) {
+	header := make([]byte, len(fbsHeader))
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	} else if string(header[:4]) != fbsHeader[:4] {
+		return nil, fmt.Errorf("invalid FBS header: %q", header)
+	}
+	return &ReplayConn{r: r}, nil
+}
+
+func (c *ReplayConn) Read(b []byte) (int, error) {
+	for len(c.block) == 0 {
+		var length uint32
+		if err := readFixedSize(c.r, &length); err != nil {
+			return 0, err
+		}
+
+		if length > maxFBSBlockSize {
+			return 0, fmt.Errorf("FBS block of %d bytes exceeds the maximum of %d bytes", length, maxFBSBlockSize)
+		}
+
+		// the data is padded to a multiple of 4 and followed by the
+		// timestamp
+		data := make([]byte, (int64(length)+3)&^3+4)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		timestamp := binary.BigEndian.Uint32(data[len(data)-4:])
+		c.Timestamp = time.Duration(timestamp) * time.Millisecond
+		c.block = data[:length]
+	}
+
+	n := copy(b, c.block)
+	c.block = c.block[n:]
+	return n, nil
+}
+
+func (c *ReplayConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (c *ReplayConn) Close() error {
+	return nil
+}
+
+func (c *ReplayConn) LocalAddr() net.Addr {
+	return nopAddr("fbs")
+}
+
+func (c *ReplayConn) RemoteAddr() net.Addr {
+	return nopAddr("fbs")
+}
+
+func (c *ReplayConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (c *ReplayConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (c *ReplayConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
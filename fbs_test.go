@@ -0,0 +1,63 @@
+package vnc
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRecorderReplay(t *testing.T) {
+	rec := new(bytes.Buffer)
+	r, err := NewRecorder(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := []string{"RFB 003.008\n", "a", "", "abcd", "abcde"}
+	for _, chunk := range chunks {
+		if n, err := r.Write([]byte(chunk)); err != nil || n != len(chunk) {
+			t.Fatalf("Write(%q) = %d, %v", chunk, n, err)
+		}
+	}
+	if rec.Len()%4 != 0 {
+		t.Errorf("blocks are not padded to 4 bytes: %d bytes", rec.Len())
+	}
+
+	c, err := NewReplayConn(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "RFB 003.008\naabcdabcde"; string(data) != want {
+		t.Errorf("replayed %q, want %q", data, want)
+	}
+	if c.Timestamp > time.Second {
+		t.Errorf("timestamp %v", c.Timestamp)
+	}
+}
+
+func TestReplayConnMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"bad header", []byte("RFB 003.008\n")},
+		{"truncated block", wire(fbsHeader, uint32(8), "abcd")},
+		{"missing timestamp", wire(fbsHeader, uint32(4), "abcd")},
+		{"wrapping length", wire(fbsHeader, uint32(0xfffffffd), "abcd")},
+		{"huge length", wire(fbsHeader, uint32(0xffffffff))},
+		{"too large block", wire(fbsHeader, uint32(maxFBSBlockSize+1))},
+	}
+	for _, tt := range tests {
+		c, err := NewReplayConn(bytes.NewReader(tt.data))
+		if err == nil {
+			_, err = io.ReadAll(c)
+		}
+		if err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package vnc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// FencePseudoEncType is the Fence pseudo-encoding. A client includes it
+// in SetEncodings to announce support for the fence messages.
+const FencePseudoEncType = EncodingType(-312)
+
+// FenceMID is the message type of both the client and server fence
+// messages.
+const FenceMID MessageID = 248
+
+// Fence flags.
+const (
+	FenceBlockBefore = 1 << 0
+	FenceBlockAfter  = 1 << 1
+	FenceSyncNext    = 1 << 2
+	FenceRequest     = 1 << 31
+)
+
+// maxFencePayload is the largest payload a fence message may carry.
+const maxFencePayload = 64
+
+// FencePseudoEncoding announces support for the fence messages. The
+// server confirms it by sending a ServerFenceMsg.
+type FencePseudoEncoding struct{}
+
+func (*FencePseudoEncoding) Type() EncodingType {
+	return FencePseudoEncType
+}
+
+func (*FencePseudoEncoding) Read(*ClientConn, *Rectangle) (Encoding, error) {
+	return new(FencePseudoEncoding), nil
+}
+
+// ClientFenceMsg inserts a synchronization barrier in the client's
+// message stream. A fence with FenceRequest set must be answered by the
+// server with the same payload, and the answer to a ServerFenceMsg
+// request must have FenceRequest cleared.
+type ClientFenceMsg struct {
+	Flags   uint32
+	Payload []byte
+}
+
+func (m *ClientFenceMsg) Send(c *ClientConn) error {
+	buf, err := marshalFence(m.Flags, m.Payload)
+	if err != nil {
+		return err
+	}
+	_, err = c.w.Write(buf)
+	return err
+}
+
+// ServerFenceMsg is a synchronization barrier sent by the server. To
+// receive it, add it to ClientConnConfig.ServerMessages.
+type ServerFenceMsg struct {
+	Flags   uint32
+	Payload []byte
+}
+
+func (*ServerFenceMsg) ID() MessageID {
+	return FenceMID
+}
+
+func (*ServerFenceMsg) Receive(c *ClientConn) (ServerMessage, error) {
+	var header struct {
+		_      [3]byte // padding
+		Flags  uint32
+		Length uint8
+	}
+	if err := readFixedSize(c.r, &header); err != nil {
+		return nil, err
+	}
+	if header.Length > maxFencePayload {
+		return nil, fmt.Errorf("fence payload of %d bytes exceeds %d bytes", header.Length, maxFencePayload)
+	}
+
+	msg := &ServerFenceMsg{Flags: header.Flags, Payload: make([]byte, header.Length)}
+	if _, err := io.ReadFull(c.r, msg.Payload); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// marshalFence returns the wire form of a fence message.
+func marshalFence(flags uint32, payload []byte) ([]byte, error) {
+	if len(payload) > maxFencePayload {
+		return nil, fmt.Errorf("fence payload of %d bytes exceeds %d bytes", len(payload), maxFencePayload)
+	}
+
+	buf := new(bytes.Buffer)
+	header := struct {
+		ID     MessageID
+		_      [3]byte // padding
+		Flags  uint32
+		Length uint8
+	}{ID: FenceMID, Flags: flags, Length: uint8(len(payload))}
+	if err := writeFixedSize(buf, header); err != nil {
+		return nil, err
+	}
+	buf.Write(payload)
+	return buf.Bytes(), nil
+}
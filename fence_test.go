@@ -0,0 +1,61 @@
+package vnc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFenceRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   uint32
+		payload []byte
+		wantErr bool
+	}{
+		{"empty", FenceRequest | FenceBlockBefore, nil, false},
+		{"payload", FenceRequest | FenceSyncNext, []byte("abc"), false},
+		{"answer", FenceBlockAfter, []byte{1, 2, 3, 4}, false},
+		{"largest payload", FenceRequest, bytes.Repeat([]byte{7}, 64), false},
+		{"payload too long", FenceRequest, bytes.Repeat([]byte{7}, 65), true},
+	}
+	for _, tt := range tests {
+		c, tc := newTestClient(nil, nil)
+		err := c.SendMsg(&ClientFenceMsg{Flags: tt.flags, Payload: tt.payload})
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		want := wire(FenceMID, [3]byte{}, tt.flags, uint8(len(tt.payload)), string(tt.payload))
+		if !bytes.Equal(tc.out.Bytes(), want) {
+			t.Errorf("%s: sent %v, want %v", tt.name, tc.out.Bytes(), want)
+		}
+
+		// the server's fence has the same layout, so the client reads
+		// back what it sent
+		cfg := &ClientConnConfig{ServerMessages: map[MessageID]ServerMessage{FenceMID: new(ServerFenceMsg)}}
+		c, _ = newTestClient(cfg, tc.out.Bytes())
+		msg, err := c.ReceiveMsg()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		fence := msg.(*ServerFenceMsg)
+		if fence.Flags != tt.flags || !bytes.Equal(fence.Payload, tt.payload) {
+			t.Errorf("%s: received %+v", tt.name, fence)
+		}
+	}
+}
+
+func TestServerFenceTooLong(t *testing.T) {
+	cfg := &ClientConnConfig{ServerMessages: map[MessageID]ServerMessage{FenceMID: new(ServerFenceMsg)}}
+	c, _ := newTestClient(cfg, wire(FenceMID, [3]byte{}, uint32(FenceRequest), uint8(65)))
+	if _, err := c.ReceiveMsg(); err == nil {
+		t.Error("accepted a fence payload of 65 bytes")
+	}
+}
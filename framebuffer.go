@@ -0,0 +1,192 @@
+package vnc
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+)
+
+// Framebuffer maintains a client-side copy of the remote screen, built
+// by compositing the rectangles of framebuffer updates.
+type Framebuffer struct {
+	// Tiles, if set, tracks the tiles changed by applied updates, for
+	// renderers that upload the screen tile by tile.
+	Tiles *TileGrid
+
+	img        *image.RGBA
+	background image.Image
+}
+
+// NewFramebuffer returns a width x height framebuffer cleared to black.
+func NewFramebuffer(width, height int) *Framebuffer {
+	fb := &Framebuffer{background: image.NewUniform(color.Black)}
+	fb.img = image.NewRGBA(image.Rect(0, 0, width, height))
+	fb.Clear()
+	return fb
+}
+
+// SetBackground sets the color used to clear the areas of the
+// framebuffer that have no content yet, such as the area exposed when
+// the framebuffer grows. It does not change the existing content.
+func (fb *Framebuffer) SetBackground(c color.Color) {
+	fb.background = image.NewUniform(c)
+}
+
+// Clear fills the whole framebuffer with the background color.
+func (fb *Framebuffer) Clear() {
+	draw.Draw(fb.img, fb.img.Bounds(), fb.background, image.ZP, draw.Src)
+}
+
+// Resize changes the size of the framebuffer. The content of the area
+// common to the old and the new size is kept, and the rest is cleared
+// to the background color.
+func (fb *Framebuffer) Resize(width, height int) {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), fb.background, image.ZP, draw.Src)
+	draw.Draw(img, img.Bounds(), fb.img, image.ZP, draw.Src)
+	fb.img = img
+}
+
+// Image returns the framebuffer image. The image is owned by the
+// framebuffer and is replaced when the framebuffer is resized.
+func (fb *Framebuffer) Image() *image.RGBA {
+	return fb.img
+}
+
+// PNG returns the framebuffer image encoded as PNG.
+func (fb *Framebuffer) PNG() ([]byte, error) {
+	return pngEncode(fb.img)
+}
+
+// WritePNG writes the framebuffer image to w, encoded as PNG.
+func (fb *Framebuffer) WritePNG(w io.Writer) error {
+	return png.Encode(w, fb.img)
+}
+
+// Apply draws the rectangles of a framebuffer update onto the
+// framebuffer. CopyRect rectangles are copied from the existing content,
+// DesktopSize rectangles resize the framebuffer, and other
+// pseudo-encodings are ignored.
+func (fb *Framebuffer) Apply(m *FramebufferUpdateMsg) error {
+	for i := range m.Rectangles {
+		if err := fb.applyRect(&m.Rectangles[i]); err != nil {
+			return err
+		}
+	}
+
+	if fb.Tiles != nil {
+		fb.Tiles.MarkUpdate(m)
+	}
+	return nil
+}
+
+func (fb *Framebuffer) applyRect(rect *Rectangle) error {
+	dst := image.Rect(int(rect.X), int(rect.Y),
+		int(rect.X)+int(rect.Width), int(rect.Y)+int(rect.Height))
+
+	switch enc := rect.Encoding.(type) {
+	case *DesktopSizePseudoEncoding, *ExtendedDesktopSizePseudoEncoding:
+		fb.Resize(int(rect.Width), int(rect.Height))
+		return nil
+
+	case *CopyRectEncoding:
+		enc.Draw(fb.img, rect)
+		return nil
+
+	case ImageEncoding:
+		if isPseudoEncoding(rect.Encoding) {
+			return nil
+		}
+		src, err := enc.Image(rect)
+		if err != nil {
+			return err
+		}
+		draw.Draw(fb.img, dst, src, src.Bounds().Min, draw.Src)
+		return nil
+
+	case interface {
+		RGBA(*Rectangle) ([]byte, error)
+	}:
+		if isPseudoEncoding(rect.Encoding) {
+			return nil
+		}
+		rgba, err := enc.RGBA(rect)
+		if err != nil {
+			return err
+		}
+		draw.Draw(fb.img, dst, newRGBAImage(rgba, int(rect.Width), int(rect.Height)), image.ZP, draw.Src)
+		return nil
+
+	case interface {
+		PNG(*Rectangle) ([]byte, error)
+	}:
+		data, err := enc.PNG(rect)
+		if err != nil {
+			return err
+		}
+		src, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		draw.Draw(fb.img, dst, src, src.Bounds().Min, draw.Src)
+		return nil
+	}
+
+	if isPseudoEncoding(rect.Encoding) {
+		return nil
+	}
+	return fmt.Errorf("cannot draw encoding type %d", rect.Type())
+}
+
+// DirectFramebufferUpdateMsg reads framebuffer updates straight into
+// Framebuffer. Rectangles whose encoding implements InPlaceEncoding are
+// decoded into the framebuffer's image without intermediate buffers,
+// and the others are decoded with Read and applied like with Apply. To
+// use it, put it in ClientConnConfig.ServerMessages; like
+// StreamingFramebufferUpdateMsg, the messages it returns have no
+// rectangles. The rectangles decoded in place that ReceiveMsg passes to
+// ClientConnConfig.OnRectangle hold no pixel data.
+type DirectFramebufferUpdateMsg struct {
+	Framebuffer *Framebuffer
+}
+
+func (*DirectFramebufferUpdateMsg) ID() MessageID {
+	return FramebufferUpdateMID
+}
+
+func (m *DirectFramebufferUpdateMsg) Receive(c *ClientConn) (ServerMessage, error) {
+	fb := m.Framebuffer
+	var inPlace bool
+	decode := func(enc Encoding, rect *Rectangle) (Encoding, error) {
+		// rectangles outside the framebuffer are left to applyRect,
+		// which clips them
+		ipe, ok := enc.(InPlaceEncoding)
+		area := image.Rect(int(rect.X), int(rect.Y),
+			int(rect.X)+int(rect.Width), int(rect.Y)+int(rect.Height))
+		inPlace = ok && !isPseudoEncoding(enc) && area.In(fb.img.Rect)
+		if !inPlace {
+			return enc.Read(c, rect)
+		}
+		return enc, ipe.DecodeInto(c, rect, fb.img)
+	}
+	apply := func(rect *Rectangle) error {
+		if !inPlace {
+			if err := fb.applyRect(rect); err != nil {
+				return err
+			}
+		}
+		if fb.Tiles != nil {
+			fb.Tiles.markRectangle(rect)
+		}
+		return nil
+	}
+
+	if err := receiveFramebufferUpdate(c, decode, apply); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
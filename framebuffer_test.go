@@ -0,0 +1,139 @@
+package vnc
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"testing"
+)
+
+func TestFramebufferResize(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	white := color.RGBA{255, 255, 255, 255}
+	black := color.RGBA{0, 0, 0, 255}
+
+	fb := NewFramebuffer(2, 2)
+	if got := fb.Image().RGBAAt(1, 1); got != black {
+		t.Errorf("new framebuffer pixel is %v, want %v", got, black)
+	}
+	fb.Image().SetRGBA(1, 1, red)
+
+	// setting the background does not change the existing content
+	fb.SetBackground(white)
+	if got := fb.Image().RGBAAt(0, 0); got != black {
+		t.Errorf("pixel is %v after SetBackground, want %v", got, black)
+	}
+
+	fb.Resize(3, 1)
+	img := fb.Image()
+	if want := image.Rect(0, 0, 3, 1); img.Bounds() != want {
+		t.Errorf("got bounds %v, want %v", img.Bounds(), want)
+	}
+	if got := img.RGBAAt(0, 0); got != black {
+		t.Errorf("kept pixel is %v, want %v", got, black)
+	}
+	if got := img.RGBAAt(2, 0); got != white {
+		t.Errorf("exposed pixel is %v, want %v", got, white)
+	}
+
+	fb.Resize(2, 2)
+	fb.Image().SetRGBA(0, 0, red)
+	fb.Clear()
+	for _, p := range []image.Point{{0, 0}, {1, 1}} {
+		if got := fb.Image().RGBAAt(p.X, p.Y); got != white {
+			t.Errorf("pixel %v is %v after Clear, want %v", p, got, white)
+		}
+	}
+}
+
+func TestFramebufferApply(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	white := color.RGBA{255, 255, 255, 255}
+	redTiles := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	draw.Draw(redTiles, redTiles.Bounds(), image.NewUniform(red), image.Point{}, draw.Src)
+	tests := []struct {
+		name   string
+		rects  []Rectangle
+		bounds image.Rectangle
+		pixels map[image.Point]color.RGBA
+	}{
+		{"raw", []Rectangle{
+			{X: 1, Y: 1, Width: 1, Height: 1, Encoding: &RawEncoding{rgba: []byte{255, 0, 0, 255}}},
+		}, image.Rect(0, 0, 4, 4), map[image.Point]color.RGBA{{1, 1}: red, {2, 2}: white}},
+		{"image", []Rectangle{
+			{X: 2, Y: 3, Width: 2, Height: 1, Encoding: &HextileEncoding{redTiles}},
+		}, image.Rect(0, 0, 4, 4), map[image.Point]color.RGBA{{2, 3}: red, {3, 3}: red, {1, 3}: white}},
+		{"copied", []Rectangle{
+			{X: 1, Y: 1, Width: 1, Height: 1, Encoding: &RawEncoding{rgba: []byte{255, 0, 0, 255}}},
+			{X: 3, Y: 3, Width: 1, Height: 1, Encoding: &CopyRectEncoding{SX: 1, SY: 1}},
+		}, image.Rect(0, 0, 4, 4), map[image.Point]color.RGBA{{3, 3}: red}},
+		{"resized", []Rectangle{
+			{X: 0, Y: 0, Width: 1, Height: 1, Encoding: &RawEncoding{rgba: []byte{255, 0, 0, 255}}},
+			{Width: 6, Height: 2, Encoding: &DesktopSizePseudoEncoding{}},
+		}, image.Rect(0, 0, 6, 2), map[image.Point]color.RGBA{{0, 0}: red, {5, 1}: white}},
+		{"pseudo-encodings ignored", []Rectangle{
+			{Width: 2, Height: 2, Encoding: &CursorPseudoEncoding{}},
+		}, image.Rect(0, 0, 4, 4), map[image.Point]color.RGBA{{0, 0}: white}},
+	}
+	for _, tt := range tests {
+		fb := NewFramebuffer(4, 4)
+		fb.SetBackground(white)
+		fb.Clear()
+		if err := fb.Apply(&FramebufferUpdateMsg{tt.rects}); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		img := fb.Image()
+		if img.Bounds() != tt.bounds {
+			t.Errorf("%s: got bounds %v, want %v", tt.name, img.Bounds(), tt.bounds)
+		}
+		for p, want := range tt.pixels {
+			if got := img.RGBAAt(p.X, p.Y); got != want {
+				t.Errorf("%s: pixel %v is %v, want %v", tt.name, p, got, want)
+			}
+		}
+	}
+}
+
+func TestFramebufferTiles(t *testing.T) {
+	fb := NewFramebuffer(100, 50)
+	fb.Tiles = NewTileGrid(100, 50, 32)
+	fb.Tiles.Clear()
+
+	err := fb.Apply(&FramebufferUpdateMsg{[]Rectangle{
+		{X: 30, Y: 0, Width: 4, Height: 1, Encoding: &RawEncoding{rgba: make([]byte, 16)}},
+		{Width: 1, Height: 1, Encoding: &CursorPseudoEncoding{}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []image.Rectangle{image.Rect(0, 0, 32, 32), image.Rect(32, 0, 64, 32)}
+	if got := fb.Tiles.Dirty(); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("dirty tiles %v, want %v", got, want)
+	}
+}
+
+func TestFramebufferPNG(t *testing.T) {
+	fb := NewFramebuffer(3, 2)
+	fb.Image().SetRGBA(2, 1, color.RGBA{1, 2, 3, 255})
+
+	data, err := fb.PNG()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := fb.WritePNG(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{data, buf.Bytes()} {
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r, g, b, _ := img.At(2, 1).RGBA(); r>>8 != 1 || g>>8 != 2 || b>>8 != 3 {
+			t.Errorf("decoded pixel %v", img.At(2, 1))
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// GIIPseudoEncType is the General Input Interface pseudo-encoding. A
+// client includes it in SetEncodings to announce support for the GII
+// messages.
+const GIIPseudoEncType = EncodingType(-305)
+
+// GIIMID is the message type of both the client and server GII
+// messages, which are distinguished by a sub-type.
+const GIIMID MessageID = 253
+
+// GII message sub-types.
+const (
+	giiInjectEvents      = 0
+	giiVersion           = 1
+	giiDeviceCreation    = 2
+	giiDeviceDestruction = 3
+
+	// giiBigEndian is set in the sub-type byte of big-endian messages.
+	giiBigEndian = 0x80
+)
+
+// GII event types.
+const (
+	GIIKeyPress         = 5
+	GIIKeyRelease       = 6
+	GIIKeyRepeat        = 7
+	GIIPointerRelative  = 8
+	GIIPointerAbsolute  = 9
+	GIIButtonPress      = 10
+	GIIButtonRelease    = 11
+	GIIValuatorRelative = 12
+	GIIValuatorAbsolute = 13
+)
+
+// GIIEventMask returns the bit of the event type in the event mask of
+// GIIDevice.CanGenerate.
+func GIIEventMask(eventType uint8) uint32 {
+	return 1 << eventType
+}
+
+// giiVersionSupported is the GII version implemented.
+const giiVersionSupported = 1
+
+// GIIPseudoEncoding announces support for the GII messages. The server
+// confirms it by sending a GIIServerMsg with its supported versions.
+type GIIPseudoEncoding struct{}
+
+func (*GIIPseudoEncoding) Type() EncodingType {
+	return GIIPseudoEncType
+}
+
+func (*GIIPseudoEncoding) Read(*ClientConn, *Rectangle) (Encoding, error) {
+	return new(GIIPseudoEncoding), nil
+}
+
+// GIIServerMsg is a GII message from the server: either the range of
+// GII versions it supports, or the answer to a GIICreateDeviceMsg. To
+// receive it, add it to ClientConnConfig.ServerMessages.
+type GIIServerMsg struct {
+	// MinVersion and MaxVersion are set by a version message.
+	MinVersion, MaxVersion uint16
+
+	// DeviceOrigin is set by a device creation response. It identifies
+	// the new device in events, or is 0 if the creation failed.
+	DeviceOrigin uint32
+
+	// Created reports whether this is a device creation response.
+	Created bool
+}
+
+func (*GIIServerMsg) ID() MessageID {
+	return GIIMID
+}
+
+func (*GIIServerMsg) Receive(c *ClientConn) (ServerMessage, error) {
+	var subType uint8
+	if err := readFixedSize(c.r, &subType); err != nil {
+		return nil, err
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if subType&giiBigEndian != 0 {
+		order = binary.BigEndian
+	}
+	subType &^= giiBigEndian
+
+	var length uint16
+	if err := binary.Read(c.r, order, &length); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return nil, err
+	}
+
+	msg := new(GIIServerMsg)
+	switch {
+	case subType == giiVersion && length == 4:
+		msg.MaxVersion = order.Uint16(payload)
+		msg.MinVersion = order.Uint16(payload[2:])
+	case subType == giiDeviceCreation && length == 4:
+		msg.DeviceOrigin = order.Uint32(payload)
+		msg.Created = true
+	default:
+		return nil, fmt.Errorf("invalid GII server message: sub-type %d, length %d", subType, length)
+	}
+	return msg, nil
+}
+
+// writeGII writes a big-endian GII client message with the given
+// sub-type and payload.
+func writeGII(c *ClientConn, subType uint8, payload []byte) error {
+	if len(payload) > 0xffff {
+		return fmt.Errorf("GII message of %d bytes is too long", len(payload))
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write([]byte{byte(GIIMID), giiBigEndian | subType})
+	writeFixedSize(buf, uint16(len(payload)))
+	buf.Write(payload)
+	_, err := c.w.Write(buf.Bytes())
+	return err
+}
+
+// GIIVersionMsg tells the server the GII version the client uses, in
+// reply to the server's version message.
+type GIIVersionMsg struct{}
+
+func (*GIIVersionMsg) Send(c *ClientConn) error {
+	return writeGII(c, giiVersion, []byte{0, giiVersionSupported})
+}
+
+// GIIValuator describes an axis of a GII device, such as the pressure
+// of a tablet pen.
+type GIIValuator struct {
+	Index     uint32
+	LongName  string // at most 74 bytes
+	ShortName string // at most 4 bytes
+
+	RangeMin, RangeCenter, RangeMax int32
+
+	// The SI unit of the values, and the factors converting them to it:
+	// (value + SIAdd) * SIMul / SIDiv * 2^SIShift.
+	SIUnit                       uint32
+	SIAdd, SIMul, SIDiv, SIShift int32
+}
+
+// GIIDevice describes an input device to create on the server.
+type GIIDevice struct {
+	Name                string // at most 31 bytes
+	VendorID, ProductID uint32
+
+	// CanGenerate is the mask of the event types the device sends,
+	// see GIIEventMask.
+	CanGenerate uint32
+
+	NumRegisters uint32
+	NumButtons   uint32
+	Valuators    []GIIValuator
+}
+
+// GIICreateDeviceMsg creates an input device on the server, which
+// answers with a GIIServerMsg carrying the device origin to use in the
+// device's events.
+type GIICreateDeviceMsg struct {
+	Device GIIDevice
+}
+
+func (m *GIICreateDeviceMsg) Send(c *ClientConn) error {
+	d := &m.Device
+	buf := new(bytes.Buffer)
+	if err := writeGIIString(buf, d.Name, 32); err != nil {
+		return err
+	}
+	writeFixedSize(buf, []uint32{d.VendorID, d.ProductID, d.CanGenerate,
+		d.NumRegisters, uint32(len(d.Valuators)), d.NumButtons})
+
+	for _, v := range d.Valuators {
+		writeFixedSize(buf, v.Index)
+		if err := writeGIIString(buf, v.LongName, 75); err != nil {
+			return err
+		}
+		if err := writeGIIString(buf, v.ShortName, 5); err != nil {
+			return err
+		}
+		writeFixedSize(buf, []int32{v.RangeMin, v.RangeCenter, v.RangeMax})
+		writeFixedSize(buf, v.SIUnit)
+		writeFixedSize(buf, []int32{v.SIAdd, v.SIMul, v.SIDiv, v.SIShift})
+	}
+
+	return writeGII(c, giiDeviceCreation, buf.Bytes())
+}
+
+// writeGIIString writes s as a nul-terminated string in a field of the
+// given size.
+func writeGIIString(w io.Writer, s string, size int) error {
+	if len(s) >= size {
+		return fmt.Errorf("GII name %q exceeds %d bytes", s, size-1)
+	}
+	field := make([]byte, size)
+	copy(field, s)
+	_, err := w.Write(field)
+	return err
+}
+
+// GIIDestroyDeviceMsg removes a device created with GIICreateDeviceMsg.
+type GIIDestroyDeviceMsg struct {
+	DeviceOrigin uint32
+}
+
+func (m *GIIDestroyDeviceMsg) Send(c *ClientConn) error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, m.DeviceOrigin)
+	return writeGII(c, giiDeviceDestruction, payload)
+}
+
+// A GIIEvent is an input event of a GII device, sent with GIIEventsMsg.
+type GIIEvent interface {
+	writeGIIEvent(w io.Writer) error
+}
+
+// GIIPointerEvent moves the pointer of a device, to an absolute position
+// or relative to the current one.
+type GIIPointerEvent struct {
+	Relative       bool
+	DeviceOrigin   uint32
+	X, Y, Z, Wheel int32
+}
+
+func (e *GIIPointerEvent) writeGIIEvent(w io.Writer) error {
+	eventType := uint8(GIIPointerAbsolute)
+	if e.Relative {
+		eventType = GIIPointerRelative
+	}
+	return writeFixedSize(w, struct {
+		Size, Type   uint8
+		_            uint16 // padding
+		DeviceOrigin uint32
+		X, Y, Z      int32
+		Wheel        int32
+	}{Size: 24, Type: eventType, DeviceOrigin: e.DeviceOrigin, X: e.X, Y: e.Y, Z: e.Z, Wheel: e.Wheel})
+}
+
+// GIIButtonEvent presses or releases a button of a device.
+type GIIButtonEvent struct {
+	Pressed      bool
+	DeviceOrigin uint32
+	Button       uint32
+}
+
+func (e *GIIButtonEvent) writeGIIEvent(w io.Writer) error {
+	eventType := uint8(GIIButtonRelease)
+	if e.Pressed {
+		eventType = GIIButtonPress
+	}
+	return writeFixedSize(w, struct {
+		Size, Type   uint8
+		_            uint16 // padding
+		DeviceOrigin uint32
+		Button       uint32
+	}{Size: 12, Type: eventType, DeviceOrigin: e.DeviceOrigin, Button: e.Button})
+}
+
+// GIIValuatorEvent sets consecutive valuators of a device, starting
+// with the one at index First, to absolute values or changes them by
+// relative amounts.
+type GIIValuatorEvent struct {
+	Relative     bool
+	DeviceOrigin uint32
+	First        uint32
+	Values       []int32
+}
+
+func (e *GIIValuatorEvent) writeGIIEvent(w io.Writer) error {
+	size := 16 + 4*len(e.Values)
+	if size > 0xff {
+		return fmt.Errorf("too many GII valuator values: %d", len(e.Values))
+	}
+	eventType := uint8(GIIValuatorAbsolute)
+	if e.Relative {
+		eventType = GIIValuatorRelative
+	}
+	header := struct {
+		Size, Type   uint8
+		_            uint16 // padding
+		DeviceOrigin uint32
+		First, Count uint32
+	}{Size: uint8(size), Type: eventType, DeviceOrigin: e.DeviceOrigin, First: e.First, Count: uint32(len(e.Values))}
+	if err := writeFixedSize(w, header); err != nil {
+		return err
+	}
+	return writeFixedSize(w, e.Values)
+}
+
+// GIIEventsMsg injects events of devices created with
+// GIICreateDeviceMsg.
+type GIIEventsMsg struct {
+	Events []GIIEvent
+}
+
+func (m *GIIEventsMsg) Send(c *ClientConn) error {
+	buf := new(bytes.Buffer)
+	for _, e := range m.Events {
+		if err := e.writeGIIEvent(buf); err != nil {
+			return err
+		}
+	}
+	return writeGII(c, giiInjectEvents, buf.Bytes())
+}
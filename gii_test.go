@@ -0,0 +1,107 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestGIIServerMsg(t *testing.T) {
+	le := func(v ...interface{}) []byte {
+		buf := new(bytes.Buffer)
+		for _, x := range v {
+			binary.Write(buf, binary.LittleEndian, x)
+		}
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    GIIServerMsg
+		wantErr bool
+	}{
+		{"version, big-endian", wire(GIIMID, uint8(giiBigEndian|giiVersion), uint16(4), uint16(1), uint16(1)),
+			GIIServerMsg{MinVersion: 1, MaxVersion: 1}, false},
+		{"version, little-endian", append(wire(GIIMID, uint8(giiVersion)), le(uint16(4), uint16(2), uint16(1))...),
+			GIIServerMsg{MinVersion: 1, MaxVersion: 2}, false},
+		{"device created, big-endian", wire(GIIMID, uint8(giiBigEndian|giiDeviceCreation), uint16(4), uint32(42)),
+			GIIServerMsg{DeviceOrigin: 42, Created: true}, false},
+		{"device created, little-endian", append(wire(GIIMID, uint8(giiDeviceCreation)), le(uint16(4), uint32(42))...),
+			GIIServerMsg{DeviceOrigin: 42, Created: true}, false},
+		{"device creation failed", wire(GIIMID, uint8(giiBigEndian|giiDeviceCreation), uint16(4), uint32(0)),
+			GIIServerMsg{Created: true}, false},
+		{"invalid length", wire(GIIMID, uint8(giiBigEndian|giiVersion), uint16(2), uint16(1)), GIIServerMsg{}, true},
+		{"invalid sub-type", wire(GIIMID, uint8(giiBigEndian|giiInjectEvents), uint16(0)), GIIServerMsg{}, true},
+	}
+	for _, tt := range tests {
+		cfg := &ClientConnConfig{ServerMessages: map[MessageID]ServerMessage{GIIMID: new(GIIServerMsg)}}
+		c, tc := newTestClient(cfg, tt.data)
+		msg, err := c.ReceiveMsg()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		}
+		if err != nil || *msg.(*GIIServerMsg) != tt.want {
+			t.Errorf("%s: got %+v, %v, want %+v", tt.name, msg, err, tt.want)
+		} else if !consumed(c, tc) {
+			t.Errorf("%s: data left unread", tt.name)
+		}
+	}
+}
+
+func TestGIIClientMsgs(t *testing.T) {
+	device := GIIDevice{
+		Name:        "pen",
+		VendorID:    1,
+		ProductID:   2,
+		CanGenerate: GIIEventMask(GIIPointerAbsolute) | GIIEventMask(GIIValuatorAbsolute),
+		NumButtons:  3,
+		Valuators: []GIIValuator{{
+			Index: 0, LongName: "Pressure", ShortName: "P",
+			RangeMin: 0, RangeCenter: 512, RangeMax: 1023,
+		}},
+	}
+	name := func(s string, size int) []byte {
+		field := make([]byte, size)
+		copy(field, s)
+		return field
+	}
+
+	tests := []struct {
+		name    string
+		msg     ClientMessage
+		want    []byte
+		wantErr bool
+	}{
+		{"version", &GIIVersionMsg{}, wire(GIIMID, uint8(giiBigEndian|giiVersion), uint16(2), uint16(1)), false},
+		{"create device", &GIICreateDeviceMsg{device}, wire(GIIMID, uint8(giiBigEndian|giiDeviceCreation), uint16(56+116),
+			name("pen", 32), uint32(1), uint32(2), device.CanGenerate, uint32(0), uint32(1), uint32(3),
+			uint32(0), name("Pressure", 75), name("P", 5), int32(0), int32(512), int32(1023),
+			uint32(0), int32(0), int32(0), int32(0), int32(0)), false},
+		{"device name too long", &GIICreateDeviceMsg{GIIDevice{Name: string(make([]byte, 32))}}, nil, true},
+		{"destroy device", &GIIDestroyDeviceMsg{42}, wire(GIIMID, uint8(giiBigEndian|giiDeviceDestruction), uint16(4), uint32(42)), false},
+		{"events", &GIIEventsMsg{[]GIIEvent{
+			&GIIPointerEvent{DeviceOrigin: 42, X: 10, Y: -20},
+			&GIIButtonEvent{Pressed: true, DeviceOrigin: 42, Button: 1},
+			&GIIValuatorEvent{DeviceOrigin: 42, First: 0, Values: []int32{700}},
+		}}, wire(GIIMID, uint8(giiBigEndian|giiInjectEvents), uint16(24+12+20),
+			uint8(24), uint8(GIIPointerAbsolute), uint16(0), uint32(42), int32(10), int32(-20), int32(0), int32(0),
+			uint8(12), uint8(GIIButtonPress), uint16(0), uint32(42), uint32(1),
+			uint8(20), uint8(GIIValuatorAbsolute), uint16(0), uint32(42), uint32(0), uint32(1), int32(700)), false},
+		{"too many valuator values", &GIIEventsMsg{[]GIIEvent{&GIIValuatorEvent{Values: make([]int32, 60)}}}, nil, true},
+	}
+	for _, tt := range tests {
+		c, tc := newTestClient(nil, nil)
+		err := c.SendMsg(tt.msg)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+		} else if err != nil || !bytes.Equal(tc.out.Bytes(), tt.want) {
+			t.Errorf("%s: sent %v, %v, want %v", tt.name, tc.out.Bytes(), err, tt.want)
+		}
+	}
+}
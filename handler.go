@@ -0,0 +1,89 @@
+package vnc
+
+import (
+	"context"
+	"time"
+)
+
+// MessageHandler holds callbacks for the messages received by Listen
+// and DrainServerMessages. Callbacks that are nil are skipped.
+type MessageHandler struct {
+	OnFramebufferUpdate func(*FramebufferUpdateMsg)
+	OnColorMap          func(*SetColorMapEntriesMsg)
+	OnBell              func()
+	OnServerCutText     func(string)
+
+	// OnMessage is called for all other messages, such as the ones
+	// added through ClientConnConfig.ServerMessages.
+	OnMessage func(ServerMessage)
+}
+
+func (h *MessageHandler) dispatch(msg ServerMessage) {
+	switch m := msg.(type) {
+	case *FramebufferUpdateMsg:
+		if h.OnFramebufferUpdate != nil {
+			h.OnFramebufferUpdate(m)
+		}
+	case *SetColorMapEntriesMsg:
+		if h.OnColorMap != nil {
+			h.OnColorMap(m)
+		}
+	case *BellMsg:
+		if h.OnBell != nil {
+			h.OnBell()
+		}
+	case *ServerCutTextMsg:
+		if h.OnServerCutText != nil {
+			h.OnServerCutText(m.Text)
+		}
+	default:
+		if h.OnMessage != nil {
+			h.OnMessage(msg)
+		}
+	}
+}
+
+// Listen receives messages from the server and dispatches them to the
+// callbacks of h, until an error occurs or the context is done. The
+// callbacks run on the calling goroutine, so the next message is not
+// read before they return. Listen always returns a non-nil error, which
+// is the context's error if it was canceled.
+//
+// Cancelation interrupts ReceiveMsg in the middle of a message, leaving
+// the rest of it unread, so the position in the stream is lost and the
+// connection must be closed once Listen returns the context's error.
+func (c *ClientConn) Listen(ctx context.Context, h *MessageHandler) error {
+	// unblock ReceiveMsg by moving the deadline to the past
+	nc := c.c
+	stop := onDone(ctx, func() { nc.SetReadDeadline(time.Unix(1, 0)) })
+	defer func() {
+		stop()
+		if ctx.Err() != nil {
+			nc.SetReadDeadline(time.Time{})
+		}
+	}()
+
+	for {
+		msg, err := c.ReceiveMsg()
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			return err
+		}
+		h.dispatch(msg)
+	}
+}
+
+// DrainServerMessages receives the messages already sent by the server
+// and dispatches them to the callbacks of h, returning once none is
+// pending, e.g. before requesting a full update. See TryReceiveMsg.
+func (c *ClientConn) DrainServerMessages(h *MessageHandler) error {
+	for {
+		msg, ok, err := c.TryReceiveMsg()
+		if err != nil || !ok {
+			return err
+		}
+		h.dispatch(msg)
+	}
+}
@@ -0,0 +1,105 @@
+package vnc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMessageHandler(t *testing.T) {
+	var got []string
+	h := &MessageHandler{
+		OnFramebufferUpdate: func(*FramebufferUpdateMsg) { got = append(got, "update") },
+		OnServerCutText:     func(text string) { got = append(got, "text "+text) },
+		OnMessage:           func(msg ServerMessage) { got = append(got, "other") },
+	}
+	for _, msg := range []ServerMessage{&FramebufferUpdateMsg{}, &BellMsg{},
+		&ServerCutTextMsg{Text: "hello"}, &SetColorMapEntriesMsg{}} {
+		h.dispatch(msg)
+	}
+	// the bell and color map callbacks are nil
+	if want := []string{"update", "text hello"}; len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got callbacks %q, want %q", got, want)
+	}
+}
+
+func TestDrainServerMessages(t *testing.T) {
+	c, server := newPipeClient(t)
+	go server.Write(wire(BellMID,
+		ServerCutTextMID, [3]byte{}, int32(4), "text",
+		FramebufferUpdateMID, uint8(0), uint16(1), [4]uint16{0, 0, 1, 1}, RawEncType, pixel(1, 2, 3),
+		BellMID))
+
+	var got []string
+	h := &MessageHandler{
+		OnBell:              func() { got = append(got, "bell") },
+		OnServerCutText:     func(text string) { got = append(got, text) },
+		OnFramebufferUpdate: func(*FramebufferUpdateMsg) { got = append(got, "update") },
+	}
+
+	// wait for the messages, which arrive in one write
+	if _, err := c.ReceiveMsg(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DrainServerMessages(h); err != nil {
+		t.Fatal(err)
+	}
+	if want := "[text update bell]"; fmt.Sprint(got) != want {
+		t.Errorf("dispatched %v, want %v", got, want)
+	}
+
+	// nothing left
+	if msg, ok, err := c.TryReceiveMsg(); msg != nil || ok || err != nil {
+		t.Errorf("got %v, %v, %v with no message pending", msg, ok, err)
+	}
+}
+
+func TestTryReceiveMsgPartial(t *testing.T) {
+	c, server := newPipeClient(t)
+	go func() {
+		// the rest of the message follows the first byte later
+		server.Write(wire(ServerCutTextMID))
+		time.Sleep(20 * time.Millisecond)
+		server.Write(wire([3]byte{}, int32(2), "hi"))
+	}()
+
+	var msg ServerMessage
+	var err error
+	for ok := false; !ok && err == nil; {
+		msg, ok, err = c.TryReceiveMsg()
+	}
+	if err != nil {
+		t.Fatal(err)
+	} else if text := msg.(*ServerCutTextMsg).Text; text != "hi" {
+		t.Errorf("got %q", text)
+	}
+}
+
+func TestListen(t *testing.T) {
+	c, server := newPipeClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bells := 0
+	h := &MessageHandler{OnBell: func() {
+		if bells++; bells == 2 {
+			cancel()
+		}
+	}}
+	go server.Write(wire(BellMID, BellMID))
+
+	if err := c.Listen(ctx, h); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+	if bells != 2 {
+		t.Errorf("got %d bells, want 2", bells)
+	}
+
+	// the connection is usable again once the deadline is cleared
+	go server.Write(wire(BellMID))
+	if _, err := c.ReceiveMsg(); err != nil {
+		t.Error(err)
+	}
+}
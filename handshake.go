@@ -1,27 +1,105 @@
 package vnc
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"time"
 )
 
 const (
 	ProtocolVersion3_3 = "RFB 003.003\n"
 	ProtocolVersion3_7 = "RFB 003.007\n"
 	ProtocolVersion3_8 = "RFB 003.008\n"
+
+	// ProtocolVersion3_889 is announced by Apple Remote Desktop servers,
+	// which follow it with their own security types. It sorts after
+	// ProtocolVersion3_8, whose handshake it otherwise uses, and is
+	// accepted in Strict mode.
+	ProtocolVersion3_889 = "RFB 003.889\n"
 )
 
-func (c *ClientConn) Handshake() (err error) {
-	if err = c.hsProtocolVersion(); err != nil {
-		return err
+// Errors returned by the handshake. They may be wrapped with details,
+// so test for them with errors.Is.
+var (
+	// ErrUnsupportedProtocolVersion is returned if the server's
+	// ProtocolVersion is malformed or not supported by the client.
+	ErrUnsupportedProtocolVersion = errors.New("Unsupported Protocol Version.")
+
+	// ErrNoSecurityTypes is returned if the server refuses the
+	// connection by offering no security types, or the invalid security
+	// type with protocol version 3.3.
+	ErrNoSecurityTypes = errors.New("No security types.")
+
+	// ErrNoSuitableAuth is returned if none of the security types
+	// offered by the server is in ClientConnConfig.Auth.
+	ErrNoSuitableAuth = errors.New("No suitable Auth scheme found.")
+)
+
+// SecurityResultError is returned if the server reports that the
+// security handshake failed, typically because of a wrong password.
+type SecurityResultError struct {
+	// Code is the SecurityResult sent by the server: 1 for failed, 2
+	// for too many attempts.
+	Code uint32
+
+	// Reason is the reason sent by the server, if any.
+	Reason string
+}
+
+func (e *SecurityResultError) Error() string {
+	msg := "Security handshake failed."
+	if e.Code == 2 {
+		msg = "Security handshake failed (too many attempts)."
 	}
-	if err = c.hsSecurity(); err != nil {
-		return err
+	if e.Reason != "" {
+		msg = fmt.Sprintf("%s Reason: %s", msg, e.Reason)
 	}
-	if err = c.hsInit(); err != nil {
-		return err
+	return msg
+}
+
+func (c *ClientConn) Handshake() (err error) {
+	return c.HandshakeContext(context.Background())
+}
+
+// HandshakeContext is like Handshake, but gives up when the context is
+// done. The context's deadline is applied to the connection for the
+// duration of the handshake, and cancelation interrupts any blocked
+// read or write.
+func (c *ClientConn) HandshakeContext(ctx context.Context) error {
+	nc := c.c
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		if err := nc.SetDeadline(deadline); err != nil {
+			return err
+		}
 	}
-	return
+
+	// unblock pending I/O by moving the deadline to the past
+	stop := onDone(ctx, func() { nc.SetDeadline(time.Unix(1, 0)) })
+	defer func() {
+		stop()
+		if hasDeadline || ctx.Err() != nil {
+			nc.SetDeadline(time.Time{})
+		}
+	}()
+
+	phases := []func() error{c.hsProtocolVersion, c.hsSecurity, c.hsInit}
+	for _, phase := range phases {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := phase(); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			return err
+		}
+	}
+	return nil
 }
 
 func (c *ClientConn) hsProtocolVersion() error {
@@ -32,23 +110,40 @@ func (c *ClientConn) hsProtocolVersion() error {
 		return err
 	}
 
+	// A server speaking another protocol, e.g. HTTP on the wrong port,
+	// is told apart from an unsupported RFB version by the received
+	// bytes.
+	if !bytes.HasPrefix(pvBuf, []byte("RFB ")) || pvBuf[11] != '\n' {
+		return fmt.Errorf("%w Not an RFB server, received %q.", ErrUnsupportedProtocolVersion, pvBuf)
+	}
+
+	if c.config.Strict {
+		switch pv := string(pvBuf); pv {
+		case ProtocolVersion3_3, ProtocolVersion3_7, ProtocolVersion3_8, ProtocolVersion3_889:
+		default:
+			return fmt.Errorf("%w Non-standard version %q.", ErrUnsupportedProtocolVersion, pv)
+		}
+	}
+
 	var major, minor int
-	if n, err := fmt.Sscanf(string(pvBuf), "RFB %d.%d\n", &major, &minor); err != nil {
-		return err
-	} else if n != 2 {
-		return fmt.Errorf("Invalid Protocol Version format.")
+	if n, err := fmt.Sscanf(string(pvBuf), "RFB %d.%d\n", &major, &minor); err != nil || n != 2 {
+		return fmt.Errorf("%w Invalid format %q.", ErrUnsupportedProtocolVersion, pvBuf)
 	} else if major != 3 || minor < 3 {
-		return fmt.Errorf("Unsupported Protocol Version.")
+		return fmt.Errorf("%w %q", ErrUnsupportedProtocolVersion, pvBuf)
 	}
 
 	if minor < 7 {
 		c.protocolVersion = ProtocolVersion3_3
 	} else if minor == 7 {
 		c.protocolVersion = ProtocolVersion3_7
+	} else if minor == 889 {
+		c.protocolVersion = ProtocolVersion3_889
 	} else {
 		c.protocolVersion = ProtocolVersion3_8
 	}
 
+	c.debugf("server protocol version %q, using %q", pvBuf, c.protocolVersion)
+
 	// Respond with the version we will support
 	if _, err := c.c.Write([]byte(c.protocolVersion)); err != nil {
 		return err
@@ -66,9 +161,9 @@ func (c *ClientConn) hsSecurity() error {
 			return err
 		} else if numSecTypes == 0 {
 			if reason, err := c.hsErrorReason(); err != nil {
-				return fmt.Errorf("No security types.")
+				return ErrNoSecurityTypes
 			} else {
-				return fmt.Errorf("No security types. Reason: %s", reason)
+				return fmt.Errorf("%w Reason: %s", ErrNoSecurityTypes, reason)
 			}
 		}
 
@@ -76,6 +171,13 @@ func (c *ClientConn) hsSecurity() error {
 		if err := readFixedSize(c.r, serverSecTypes); err != nil {
 			return err
 		}
+		if c.config.Strict {
+			for _, secType := range serverSecTypes {
+				if secType == InvalidSecType {
+					return fmt.Errorf("Server offered the Invalid security type.")
+				}
+			}
+		}
 
 		clientSecTypes := c.config.Auth
 	FindAuth:
@@ -89,8 +191,9 @@ func (c *ClientConn) hsSecurity() error {
 			}
 		}
 		if auth == nil {
-			return fmt.Errorf("No suitable Auth scheme found. Server supported: %#v", serverSecTypes)
+			return fmt.Errorf("%w Server supported: %#v", ErrNoSuitableAuth, serverSecTypes)
 		}
+		c.debugf("server security types %v, using %d", serverSecTypes, auth.Type())
 
 		// Respond back with the security type we'll use
 		if err := writeFixedSize(c.c, auth.Type()); err != nil {
@@ -101,10 +204,18 @@ func (c *ClientConn) hsSecurity() error {
 		var secType uint32
 		if err := readFixedSize(c.r, &secType); err != nil {
 			return err
-		} else if secType == 0 { // Connection failed
-			return fmt.Errorf("Failed to connect.")
+		} else if secType == 0 { // Connection failed, followed by the reason
+			if reason, err := c.hsErrorReason(); err != nil {
+				return ErrNoSecurityTypes
+			} else {
+				return fmt.Errorf("%w Reason: %s", ErrNoSecurityTypes, reason)
+			}
+		} else if c.config.Strict && secType != uint32(NoneSecType) && secType != uint32(VNCSecType) {
+			return fmt.Errorf("Security type %d is not allowed by protocol version 3.3.", secType)
 		}
 
+		// the server dictates the security type, so any of the
+		// configured ones may match
 		for _, curAuth := range c.config.Auth {
 			if curAuth.Type() == SecurityType(secType) {
 				// We use the first matching supported authentication
@@ -113,8 +224,9 @@ func (c *ClientConn) hsSecurity() error {
 			}
 		}
 		if auth == nil {
-			return fmt.Errorf("No suitable Auth scheme found. Server requested: %d", secType)
+			return fmt.Errorf("%w Server requested: %d", ErrNoSuitableAuth, secType)
 		}
+		c.debugf("server requested security type %d", secType)
 	}
 
 	c.securityType = auth.Type()
@@ -135,24 +247,26 @@ func (c *ClientConn) hsSecurityResult() error {
 	if err := readFixedSize(c.r, &secResult); err != nil {
 		return err
 	}
+	c.debugf("security result %d", secResult)
 
-	var errMsg string
 	switch secResult {
 	case 0:
 		return nil
-	case 1:
-		errMsg = "Security handshake failed."
-	case 2:
-		errMsg = "Security handshake failed (too many attempts)."
+	case 1, 2:
+	default:
+		if c.config.Strict {
+			return fmt.Errorf("Invalid SecurityResult %d.", secResult)
+		}
 	}
 
+	resultErr := &SecurityResultError{Code: secResult}
 	if c.protocolVersion >= ProtocolVersion3_8 {
 		if reason, err := c.hsErrorReason(); err == nil {
-			errMsg = fmt.Sprintf("%s Reason: %s", errMsg, reason)
+			resultErr.Reason = reason
 		}
 	}
 
-	return fmt.Errorf(errMsg)
+	return resultErr
 }
 
 func (c *ClientConn) hsInit() error {
@@ -167,35 +281,82 @@ func (c *ClientConn) hsInit() error {
 	}
 
 	// 7.3.2 ServerInit
-	if err := readFixedSize(c.r, &c.FrameBufferWidth); err != nil {
+	// The fixed-size part is read first, so the whole message can be
+	// handed to OnServerInit before it is parsed.
+	raw := make([]byte, 24)
+	if _, err := io.ReadFull(c.r, raw); err != nil {
 		return err
 	}
-
-	if err := readFixedSize(c.r, &c.FrameBufferHeight); err != nil {
+	nameLength := binary.BigEndian.Uint32(raw[20:])
+	if err := c.checkMessageSize(int64(nameLength)); err != nil {
+		return err
+	}
+	nameBytes := make([]byte, nameLength)
+	if _, err := io.ReadFull(c.r, nameBytes); err != nil {
 		return err
 	}
+	raw = append(raw, nameBytes...)
 
-	// read pixel format
-	rpf := new(RFBPixelFormat)
-	if err := readFixedSize(c.r, rpf); err != nil {
+	if c.config.OnServerInit != nil {
+		c.config.OnServerInit(raw)
+	}
+
+	r := bytes.NewReader(raw)
+	if err := readFixedSize(r, &c.FrameBufferWidth); err != nil {
 		return err
 	}
-	c.pixelFormat = NewPixelFormat(rpf)
 
-	// read desktop name
-	var nameLength uint32
-	if err := readFixedSize(c.r, &nameLength); err != nil {
+	if err := readFixedSize(r, &c.FrameBufferHeight); err != nil {
 		return err
 	}
 
-	nameBytes := make([]byte, nameLength)
-	if err := readFixedSize(c.r, nameBytes); err != nil {
+	// read pixel format
+	rpf, err := readRFBPixelFormat(r)
+	if err != nil {
 		return err
 	}
+	c.setPixelFormat(NewPixelFormat(rpf))
+
+	// desktop name
 	c.DesktopName = string(nameBytes)
+	c.debugf("server init: %dx%d framebuffer, %d bpp, desktop %q",
+		c.FrameBufferWidth, c.FrameBufferHeight, rpf.BPP, c.DesktopName)
 
 	// there's more if Tight Security Type is chosen
+	if c.securityType == TightSecType {
+		return c.hsTightInit()
+	}
+
+	return nil
+}
+
+func (c *ClientConn) hsTightInit() error {
+	var counts struct {
+		NumServerMessages uint16
+		NumClientMessages uint16
+		NumEncodings      uint16
+		_                 uint16 // padding
+	}
+	if err := readFixedSize(c.r, &counts); err != nil {
+		return err
+	}
 
+	c.ServerCaps = new(TightServerCaps)
+	lists := []struct {
+		n    uint16
+		caps *[]TightCapability
+	}{
+		{counts.NumServerMessages, &c.ServerCaps.ServerMessages},
+		{counts.NumClientMessages, &c.ServerCaps.ClientMessages},
+		{counts.NumEncodings, &c.ServerCaps.Encodings},
+	}
+	for _, l := range lists {
+		caps := make([]tightCapability, l.n)
+		if err := readFixedSize(c.r, caps); err != nil {
+			return err
+		}
+		*l.caps = tightCapabilities(caps)
+	}
 	return nil
 }
 
@@ -204,6 +365,9 @@ func (c *ClientConn) hsErrorReason() (string, error) {
 	if err := readFixedSize(c.r, &reasonLen); err != nil {
 		return "", err
 	}
+	if err := c.checkMessageSize(int64(reasonLen)); err != nil {
+		return "", err
+	}
 
 	reason := make([]byte, reasonLen)
 	if _, err := io.ReadFull(c.r, reason); err != nil {
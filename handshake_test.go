@@ -0,0 +1,226 @@
+package vnc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProtocolVersion(t *testing.T) {
+	tests := []struct {
+		server  string
+		strict  bool
+		want    string
+		wantErr bool
+	}{
+		{"RFB 003.003\n", false, ProtocolVersion3_3, false},
+		{"RFB 003.005\n", false, ProtocolVersion3_3, false},
+		{"RFB 003.007\n", false, ProtocolVersion3_7, false},
+		{"RFB 003.008\n", false, ProtocolVersion3_8, false},
+		{"RFB 003.889\n", false, ProtocolVersion3_889, false},
+		{"RFB 003.889\n", true, ProtocolVersion3_889, false},
+		{"RFB 003.010\n", false, ProtocolVersion3_8, false},
+		{"RFB 003.005\n", true, "", true},
+		{"RFB 003.002\n", false, "", true},
+		{"RFB 004.000\n", false, "", true},
+		{"RFB 003.00x\n", false, "", true},
+		{"HTTP/1.1 400", false, "", true},
+	}
+	for _, tt := range tests {
+		c, tc := newTestClient(&ClientConnConfig{Strict: tt.strict}, []byte(tt.server))
+		err := c.hsProtocolVersion()
+		if tt.wantErr {
+			if !errors.Is(err, ErrUnsupportedProtocolVersion) {
+				t.Errorf("%q (strict %v): got %v, want ErrUnsupportedProtocolVersion", tt.server, tt.strict, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q (strict %v): %v", tt.server, tt.strict, err)
+		} else if c.ProtocolVersion() != tt.want || tc.out.String() != tt.want {
+			t.Errorf("%q (strict %v): negotiated %q, answered %q, want %q",
+				tt.server, tt.strict, c.ProtocolVersion(), tc.out.String(), tt.want)
+		}
+	}
+
+	// a server speaking another protocol is reported with its bytes
+	c, _ := newTestClient(nil, []byte("HTTP/1.1 400 Bad Request\r\n"))
+	if err := c.hsProtocolVersion(); !errors.Is(err, ErrUnsupportedProtocolVersion) ||
+		!strings.Contains(err.Error(), `"HTTP/1.1 400"`) {
+		t.Errorf("got %v for an HTTP response", err)
+	}
+
+	// 3.889 is told apart from 3.8 but uses its handshake
+	if !(ProtocolVersion3_889 > ProtocolVersion3_8) {
+		t.Error("ProtocolVersion3_889 doesn't sort after ProtocolVersion3_8")
+	}
+}
+
+func TestStrictHandshake(t *testing.T) {
+	tests := []struct {
+		name    string
+		phase   func(c *ClientConn) error
+		server  []byte
+		strict  bool
+		wantErr bool
+	}{
+		{"standard version", (*ClientConn).hsProtocolVersion, []byte("RFB 003.008\n"), true, false},
+		{"non-standard version", (*ClientConn).hsProtocolVersion, []byte("RFB 003.005\n"), false, false},
+		{"non-standard version, strict", (*ClientConn).hsProtocolVersion, []byte("RFB 003.005\n"), true, true},
+		{"Invalid security type offered", (*ClientConn).hsSecurity, wire(uint8(2), InvalidSecType, NoneSecType), false, false},
+		{"Invalid security type offered, strict", (*ClientConn).hsSecurity, wire(uint8(2), InvalidSecType, NoneSecType), true, true},
+		{"undefined SecurityResult", (*ClientConn).hsSecurityResult, wire(uint32(3)), false, true},
+		{"undefined SecurityResult, strict", (*ClientConn).hsSecurityResult, wire(uint32(3)), true, true},
+	}
+	for _, tt := range tests {
+		c, _ := newTestClient(&ClientConnConfig{Strict: tt.strict}, tt.server)
+		c.protocolVersion = ProtocolVersion3_7
+		err := tt.phase(c)
+		if tt.wantErr && err == nil {
+			t.Errorf("%s: no error", tt.name)
+		} else if !tt.wantErr && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+
+	// protocol version 3.3 only defines the None and VNC security types
+	for _, strict := range []bool{false, true} {
+		c, _ := newTestClient(&ClientConnConfig{Strict: strict, Auth: []ClientAuth{&NoneAuth{}}}, wire(uint32(16)))
+		c.protocolVersion = ProtocolVersion3_3
+		err := c.hsSecurity()
+		if err == nil || (err.Error() == "Security type 16 is not allowed by protocol version 3.3.") != strict {
+			t.Errorf("strict %v: got %v for security type 16", strict, err)
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	init := serverInit("desk")
+	tests := []struct {
+		name    string
+		cfg     ClientConnConfig
+		server  []byte
+		client  []byte // sent by the client
+		wantErr error  // matched with errors.Is, or by its text
+	}{
+		{"3.3", ClientConnConfig{}, wire("RFB 003.003\n", uint32(NoneSecType), init),
+			wire(ProtocolVersion3_3, uint8(1)), nil},
+		{"3.3 exclusive", ClientConnConfig{Exclusive: true}, wire("RFB 003.003\n", uint32(NoneSecType), init),
+			wire(ProtocolVersion3_3, uint8(0)), nil},
+		{"3.3 refused", ClientConnConfig{}, wire("RFB 003.003\n", uint32(0), uint32(4), "busy"),
+			wire(ProtocolVersion3_3), ErrNoSecurityTypes},
+		{"3.3 Tight in Strict mode", ClientConnConfig{Strict: true}, wire("RFB 003.003\n", uint32(TightSecType)),
+			wire(ProtocolVersion3_3), errors.New("Security type 16 is not allowed by protocol version 3.3.")},
+		{"3.7", ClientConnConfig{}, wire("RFB 003.007\n", uint8(1), NoneSecType, init),
+			wire(ProtocolVersion3_7, NoneSecType, uint8(1)), nil},
+		{"3.8", ClientConnConfig{}, wire("RFB 003.008\n", uint8(2), VNCSecType, NoneSecType, uint32(0), init),
+			wire(ProtocolVersion3_8, NoneSecType, uint8(1)), nil},
+		{"3.8 refused", ClientConnConfig{}, wire("RFB 003.008\n", uint8(0), uint32(4), "busy"),
+			wire(ProtocolVersion3_8), ErrNoSecurityTypes},
+		{"3.8 no suitable auth", ClientConnConfig{}, wire("RFB 003.008\n", uint8(1), VNCSecType),
+			wire(ProtocolVersion3_8), ErrNoSuitableAuth},
+		{"unsupported version", ClientConnConfig{}, []byte("RFB 004.000\n"),
+			nil, ErrUnsupportedProtocolVersion},
+		{"3.8 failed", ClientConnConfig{}, wire("RFB 003.008\n", uint8(1), NoneSecType, uint32(1), uint32(6), "denied"),
+			wire(ProtocolVersion3_8, NoneSecType), &SecurityResultError{Code: 1, Reason: "denied"}},
+	}
+	for _, tt := range tests {
+		cfg := tt.cfg
+		c, tc := newTestClient(&cfg, tt.server)
+		err := c.Handshake()
+		var resultErr *SecurityResultError
+		switch {
+		case tt.wantErr == nil:
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			} else if c.DesktopName != "desk" || c.FrameBufferWidth != 640 || c.FrameBufferHeight != 480 {
+				t.Errorf("%s: got desktop %q of %dx%d", tt.name, c.DesktopName, c.FrameBufferWidth, c.FrameBufferHeight)
+			} else if c.ProtocolVersion() != string(tt.client[:12]) || c.SecurityType() != NoneSecType {
+				t.Errorf("%s: negotiated %q with security type %d", tt.name, c.ProtocolVersion(), c.SecurityType())
+			}
+		case errors.As(tt.wantErr, &resultErr):
+			if got, ok := err.(*SecurityResultError); !ok || *got != *resultErr {
+				t.Errorf("%s: got %v, want %v", tt.name, err, tt.wantErr)
+			}
+		case errors.Is(err, tt.wantErr):
+			if tt.wantErr == ErrNoSecurityTypes && !strings.Contains(err.Error(), "busy") {
+				t.Errorf("%s: no reason in %q", tt.name, err)
+			}
+		case err == nil || err.Error() != tt.wantErr.Error():
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if !bytes.Equal(tc.out.Bytes(), tt.client) {
+			t.Errorf("%s: client sent %q, want %q", tt.name, tc.out.Bytes(), tt.client)
+		}
+	}
+}
+
+func TestOnServerInit(t *testing.T) {
+	rpf := PixelFormatRGB888()
+	init := wire(uint16(640), uint16(480), rpf, uint32(4), "test")
+
+	var raw []byte
+	c, _ := newTestClient(&ClientConnConfig{OnServerInit: func(b []byte) {
+		raw = append([]byte(nil), b...)
+	}}, init)
+	if err := c.hsInit(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, init) {
+		t.Errorf("got ServerInit %x, want %x", raw, init)
+	}
+	if c.FrameBufferWidth != 640 || c.FrameBufferHeight != 480 || c.DesktopName != "test" {
+		t.Errorf("got %dx%d %q, want 640x480 \"test\"", c.FrameBufferWidth, c.FrameBufferHeight, c.DesktopName)
+	}
+}
+
+func TestOnPixelFormatChange(t *testing.T) {
+	var got []RFBPixelFormat
+	c, _ := newTestClient(&ClientConnConfig{OnPixelFormatChange: func(pf *PixelFormat) {
+		got = append(got, *pf.RFBPixelFormat)
+	}}, serverInit("test"))
+	if err := c.hsInit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UseBGR233(); err != nil {
+		t.Fatal(err)
+	}
+	// an invalid format is neither sent nor announced
+	c.SendMsg(&SetPixelFormatMsg{RFBPixelFormat: RFBPixelFormat{BPP: 12}})
+
+	want := []RFBPixelFormat{PixelFormatRGB888(), PixelFormatBGR233()}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("OnPixelFormatChange called with %+v, want %+v", got, want)
+	}
+}
+
+func TestHandshakeContext(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	expired, cancel2 := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel2()
+
+	for _, ctx := range []context.Context{canceled, expired} {
+		// the server never sends its protocol version
+		c, _ := newPipeClient(t)
+		start := time.Now()
+		err := c.HandshakeContext(ctx)
+		if err != ctx.Err() {
+			t.Errorf("got %v, want %v", err, ctx.Err())
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("handshake returned after %v", d)
+		}
+	}
+
+	// the context also bounds the dial
+	ctx, cancel3 := context.WithCancel(context.Background())
+	cancel3()
+	cfg := &ClientConnConfig{Address: "127.0.0.1:1", ServerMessages: make(map[MessageID]ServerMessage)}
+	if _, err := NewClientConnContext(ctx, cfg, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("dial with a canceled context: got %v", err)
+	}
+}
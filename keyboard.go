@@ -0,0 +1,75 @@
+package vnc
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Symbols typed with shift on a US keyboard layout.
+const shiftedSymbols = `~!@#$%^&*()_+{}|:"<>?`
+
+// unicodeKeysym is or-ed with a code point to form its Unicode keysym.
+const unicodeKeysym = 0x01000000
+
+// TypeKey presses and releases the key with the given keysym.
+func (c *ClientConn) TypeKey(keysym uint32) error {
+	if err := c.SendMsg(&KeyEventMsg{DownFlag: 1, Key: keysym}); err != nil {
+		return err
+	}
+	return c.SendMsg(&KeyEventMsg{DownFlag: 0, Key: keysym})
+}
+
+// TypeString types the string by pressing and releasing the key of
+// each character. Uppercase letters and shifted symbols are typed with
+// shift held down. Characters beyond Latin-1 are typed with Unicode
+// keysyms, which require a server supporting them, as most current ones
+// do. Newlines, tabs and backspaces are supported, but no other control
+// characters.
+func (c *ClientConn) TypeString(s string) error {
+	for _, r := range s {
+		keysym, shift, err := runeToKeysym(r)
+		if err != nil {
+			return err
+		}
+
+		if shift {
+			if err := c.SendMsg(&KeyEventMsg{DownFlag: 1, Key: KeyShiftLeft}); err != nil {
+				return err
+			}
+		}
+		if err := c.TypeKey(keysym); err != nil {
+			return err
+		}
+		if shift {
+			if err := c.SendMsg(&KeyEventMsg{DownFlag: 0, Key: KeyShiftLeft}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runeToKeysym returns the keysym typing r, and whether shift must be
+// held down for it.
+func runeToKeysym(r rune) (keysym uint32, shift bool, err error) {
+	switch r {
+	case '\n', '\r':
+		return KeyReturn, false, nil
+	case '\t':
+		return KeyTab, false, nil
+	case '\b':
+		return KeyBackSpace, false, nil
+	}
+
+	if r < ' ' || (r >= 0x7f && r < 0xa0) {
+		return 0, false, fmt.Errorf("no keysym for character %q", r)
+	}
+	if r > unicode.MaxLatin1 {
+		return unicodeKeysym | uint32(r), false, nil
+	}
+
+	// Latin-1 keysyms are equal to their code points
+	shift = unicode.IsUpper(r) || strings.ContainsRune(shiftedSymbols, r)
+	return uint32(r), shift, nil
+}
@@ -0,0 +1,74 @@
+package vnc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRuneToKeysym(t *testing.T) {
+	tests := []struct {
+		r       rune
+		keysym  uint32
+		shift   bool
+		wantErr bool
+	}{
+		{'a', 'a', false, false},
+		{'A', 'A', true, false},
+		{'1', '1', false, false},
+		{'!', '!', true, false},
+		{'"', '"', true, false},
+		{'\'', '\'', false, false},
+		{'\n', KeyReturn, false, false},
+		{'\r', KeyReturn, false, false},
+		{'\t', KeyTab, false, false},
+		{'\b', KeyBackSpace, false, false},
+		{'é', 0xe9, false, false},
+		{'É', 0xc9, true, false},
+		{'あ', 0x01003042, false, false},
+		{'€', 0x010020ac, false, false},
+		{0x1b, 0, false, true},
+		{0x7f, 0, false, true},
+		{0x85, 0, false, true},
+	}
+	for _, tt := range tests {
+		keysym, shift, err := runeToKeysym(tt.r)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: no error", tt.r)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.r, err)
+		} else if keysym != tt.keysym || shift != tt.shift {
+			t.Errorf("%q: got keysym %#x, shift %v, want %#x, %v", tt.r, keysym, shift, tt.keysym, tt.shift)
+		}
+	}
+}
+
+func TestTypeString(t *testing.T) {
+	key := func(down uint8, keysym uint32) []byte {
+		return wire(KeyEventMID, down, [2]byte{}, keysym)
+	}
+	tests := []struct {
+		s       string
+		want    [][]byte
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"a", [][]byte{key(1, 'a'), key(0, 'a')}, false},
+		{"B", [][]byte{key(1, KeyShiftLeft), key(1, 'B'), key(0, 'B'), key(0, KeyShiftLeft)}, false},
+		{"\n", [][]byte{key(1, KeyReturn), key(0, KeyReturn)}, false},
+		{"a\x00", [][]byte{key(1, 'a'), key(0, 'a')}, true},
+	}
+	for _, tt := range tests {
+		c, tc := newTestClient(nil, nil)
+		err := c.TypeString(tt.s)
+		if tt.wantErr != (err != nil) {
+			t.Errorf("%q: got error %v", tt.s, err)
+		}
+		if want := bytes.Join(tt.want, nil); !bytes.Equal(tc.out.Bytes(), want) {
+			t.Errorf("%q: sent %x, want %x", tt.s, tc.out.Bytes(), want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package vnc
+
+// X11 keysyms of non-printable keys, for use in KeyEventMsg.Key. The
+// values match keysymdef.h. Printable Latin-1 characters use their code
+// point as keysym.
+const (
+	// TTY function keys
+	KeyBackSpace  = 0xff08
+	KeyTab        = 0xff09
+	KeyLinefeed   = 0xff0a
+	KeyClear      = 0xff0b
+	KeyReturn     = 0xff0d
+	KeyPause      = 0xff13
+	KeyScrollLock = 0xff14
+	KeySysReq     = 0xff15
+	KeyEscape     = 0xff1b
+	KeyDelete     = 0xffff
+
+	// Cursor control
+	KeyHome     = 0xff50
+	KeyLeft     = 0xff51
+	KeyUp       = 0xff52
+	KeyRight    = 0xff53
+	KeyDown     = 0xff54
+	KeyPageUp   = 0xff55
+	KeyPageDown = 0xff56
+	KeyEnd      = 0xff57
+	KeyBegin    = 0xff58
+
+	// Misc functions
+	KeySelect  = 0xff60
+	KeyPrint   = 0xff61
+	KeyExecute = 0xff62
+	KeyInsert  = 0xff63
+	KeyUndo    = 0xff65
+	KeyRedo    = 0xff66
+	KeyMenu    = 0xff67
+	KeyFind    = 0xff68
+	KeyCancel  = 0xff69
+	KeyHelp    = 0xff6a
+	KeyBreak   = 0xff6b
+	KeyNumLock = 0xff7f
+
+	// Keypad
+	KeyKPEnter     = 0xff8d
+	KeyKPHome      = 0xff95
+	KeyKPLeft      = 0xff96
+	KeyKPUp        = 0xff97
+	KeyKPRight     = 0xff98
+	KeyKPDown      = 0xff99
+	KeyKPPageUp    = 0xff9a
+	KeyKPPageDown  = 0xff9b
+	KeyKPEnd       = 0xff9c
+	KeyKPBegin     = 0xff9d
+	KeyKPInsert    = 0xff9e
+	KeyKPDelete    = 0xff9f
+	KeyKPEqual     = 0xffbd
+	KeyKPMultiply  = 0xffaa
+	KeyKPAdd       = 0xffab
+	KeyKPSeparator = 0xffac
+	KeyKPSubtract  = 0xffad
+	KeyKPDecimal   = 0xffae
+	KeyKPDivide    = 0xffaf
+	KeyKP0         = 0xffb0
+	KeyKP1         = 0xffb1
+	KeyKP2         = 0xffb2
+	KeyKP3         = 0xffb3
+	KeyKP4         = 0xffb4
+	KeyKP5         = 0xffb5
+	KeyKP6         = 0xffb6
+	KeyKP7         = 0xffb7
+	KeyKP8         = 0xffb8
+	KeyKP9         = 0xffb9
+
+	// Function keys
+	KeyF1  = 0xffbe
+	KeyF2  = 0xffbf
+	KeyF3  = 0xffc0
+	KeyF4  = 0xffc1
+	KeyF5  = 0xffc2
+	KeyF6  = 0xffc3
+	KeyF7  = 0xffc4
+	KeyF8  = 0xffc5
+	KeyF9  = 0xffc6
+	KeyF10 = 0xffc7
+	KeyF11 = 0xffc8
+	KeyF12 = 0xffc9
+
+	// Modifiers
+	KeyShiftLeft    = 0xffe1
+	KeyShiftRight   = 0xffe2
+	KeyControlLeft  = 0xffe3
+	KeyControlRight = 0xffe4
+	KeyCapsLock     = 0xffe5
+	KeyShiftLock    = 0xffe6
+	KeyMetaLeft     = 0xffe7
+	KeyMetaRight    = 0xffe8
+	KeyAltLeft      = 0xffe9
+	KeyAltRight     = 0xffea
+	KeySuperLeft    = 0xffeb
+	KeySuperRight   = 0xffec
+	KeyHyperLeft    = 0xffed
+	KeyHyperRight   = 0xffee
+	KeyAltGr        = 0xfe03 // ISO_Level3_Shift
+)
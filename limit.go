@@ -0,0 +1,29 @@
+package vnc
+
+// DecodeLimiter bounds the number of rectangles decoded at the same
+// time by the connections sharing it. Decoding allocates buffers for
+// the whole rectangle, so sharing one limiter between many sessions
+// bounds the memory they take on a constrained host. Set it as
+// ClientConnConfig.DecodeLimiter. It is safe for concurrent use.
+type DecodeLimiter struct {
+	sem chan struct{}
+}
+
+// NewDecodeLimiter returns a DecodeLimiter allowing n rectangles to be
+// decoded at the same time, or one if n is less than 1.
+func NewDecodeLimiter(n int) *DecodeLimiter {
+	if n < 1 {
+		n = 1
+	}
+	return &DecodeLimiter{sem: make(chan struct{}, n)}
+}
+
+// acquire blocks until a rectangle may be decoded.
+func (l *DecodeLimiter) acquire() {
+	l.sem <- struct{}{}
+}
+
+// release ends the decoding of a rectangle.
+func (l *DecodeLimiter) release() {
+	<-l.sem
+}
@@ -0,0 +1,63 @@
+package vnc
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowEncoding is an encoding without data whose Read takes a while,
+// recording the largest number of rectangles decoded at once.
+type slowEncoding struct {
+	active, max int32
+}
+
+func (*slowEncoding) Type() EncodingType { return -0x7004 }
+
+func (e *slowEncoding) Read(*ClientConn, *Rectangle) (Encoding, error) {
+	n := atomic.AddInt32(&e.active, 1)
+	for {
+		max := atomic.LoadInt32(&e.max)
+		if n <= max || atomic.CompareAndSwapInt32(&e.max, max, n) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond)
+	atomic.AddInt32(&e.active, -1)
+	return e, nil
+}
+
+func TestDecodeLimiter(t *testing.T) {
+	const sessions, rects, limit = 8, 10, 2
+	enc := new(slowEncoding)
+	l := NewDecodeLimiter(limit)
+
+	update := wire(FramebufferUpdateMID, uint8(0), uint16(rects))
+	for i := 0; i < rects; i++ {
+		update = append(update, wire(uint16(0), uint16(0), uint16(1), uint16(1), enc.Type())...)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < sessions; i++ {
+		c, _ := newTestClient(&ClientConnConfig{DecodeLimiter: l}, update)
+		c.RegisterEncoding(enc)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.ReceiveMsg(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if max := atomic.LoadInt32(&enc.max); max > limit {
+		t.Errorf("%d rectangles decoded at once, want at most %d", max, limit)
+	} else if max == 0 {
+		t.Error("no rectangle decoded")
+	}
+	if len(l.sem) != 0 {
+		t.Errorf("%d decodes still hold the limiter", len(l.sem))
+	}
+}
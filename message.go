@@ -1,5 +1,7 @@
 package vnc
 
+import "fmt"
+
 type MessageID uint8
 
 type ServerMessage interface {
@@ -14,5 +16,31 @@ type ServerMessage interface {
 
 type ClientMessage interface {
 	// Send writes the content of the message to the writer, including the message type.
+	// It must only be called through ClientConn.SendMsg, which prevents
+	// messages sent concurrently from interleaving on the wire and
+	// flushes the buffered writer.
 	Send(*ClientConn) error
 }
+
+// UnsupportedMessageError is returned by ReceiveMsg for a server message
+// it can't read. The rest of the message is left unread, so the
+// position in the stream is lost and the connection must be closed.
+type UnsupportedMessageError struct {
+	ID MessageID
+}
+
+func (e *UnsupportedMessageError) Error() string {
+	return fmt.Sprintf("Unsupported Server Message %v.", e.ID)
+}
+
+// MessageSizeError is returned when the peer declares variable-length
+// data, such as cut text, longer than the MaxMessageSize of the
+// ClientConnConfig or ServerConnConfig. The data is left unread, so the
+// connection must be closed.
+type MessageSizeError struct {
+	Size, Max int64
+}
+
+func (e *MessageSizeError) Error() string {
+	return fmt.Sprintf("Message of %d bytes exceeds the maximum of %d bytes.", e.Size, e.Max)
+}
@@ -6,6 +6,9 @@ import (
 	"unicode"
 )
 
+// Client message types. The ID field of the client messages matches
+// their wire layout, but Send always writes the correct message type,
+// so it doesn't need to be set.
 const (
 	SetPixelFormatMID MessageID = iota
 	_
@@ -16,6 +19,11 @@ const (
 	ClientCutTextMID
 )
 
+// SetPixelFormatMsg sets the pixel format the server encodes pixels in.
+// The client decodes with the new format, PixelFormat, from the moment
+// the message is written. With ClientConnConfig.BatchWrites that is when
+// it is buffered, before Flush sends it to the server, so flush before
+// receiving further updates.
 type SetPixelFormatMsg struct {
 	ID MessageID
 	_  [3]byte // padding
@@ -23,14 +31,108 @@ type SetPixelFormatMsg struct {
 }
 
 func (m *SetPixelFormatMsg) Send(c *ClientConn) error {
-	if err := writeFixedSize(c.c, m); err != nil {
+	if err := m.RFBPixelFormat.Validate(); err != nil {
 		return err
 	}
 
-	c.pixelFormat = NewPixelFormat(&m.RFBPixelFormat)
+	sent := *m
+	sent.ID = SetPixelFormatMID
+	pf, _ := sent.RFBPixelFormat.MarshalBinary()
+	if _, err := c.w.Write(append([]byte{byte(sent.ID), 0, 0, 0}, pf...)); err != nil {
+		return err
+	}
+
+	c.lastSetPixelFormat = &sent
+	c.setPixelFormat(NewPixelFormat(&sent.RFBPixelFormat))
 	return nil
 }
 
+// UseRGBA8888 requests the PixelFormatRGBA8888 pixel format, which
+// decodes without a color map and with the least conversion. It must be
+// called after Handshake.
+func (c *ClientConn) UseRGBA8888() error {
+	return c.SendMsg(&SetPixelFormatMsg{RFBPixelFormat: PixelFormatRGBA8888()})
+}
+
+// UseBGR233 requests the 8bpp PixelFormatBGR233 pixel format, which
+// cuts the bandwidth of uncompressed pixel data by three quarters
+// compared to 32bpp at the cost of color fidelity. It must be called
+// after Handshake.
+func (c *ClientConn) UseBGR233() error {
+	return c.SendMsg(&SetPixelFormatMsg{RFBPixelFormat: PixelFormatBGR233()})
+}
+
+// ForceTrueColor makes sure the server sends true-color pixels, so the
+// connection never uses a color map. If the current pixel format uses
+// a color map, it requests a true-color format of the same size: BGR233
+// for 8bpp, RGB565 for 16bpp and RGB888 otherwise, keeping the byte
+// order. It must be called after Handshake.
+func (c *ClientConn) ForceTrueColor() error {
+	pf := c.pixelFormat
+	if pf == nil {
+		return fmt.Errorf("no pixel format before the handshake")
+	}
+	if pf.TrueColor != 0 {
+		return nil
+	}
+
+	var rpf RFBPixelFormat
+	switch {
+	case pf.BPP <= 8:
+		rpf = PixelFormatBGR233()
+	case pf.BPP <= 16:
+		rpf = RFBPixelFormat{
+			BPP:        16,
+			Depth:      16,
+			TrueColor:  1,
+			RedMax:     31,
+			GreenMax:   63,
+			BlueMax:    31,
+			RedShift:   11,
+			GreenShift: 5,
+			BlueShift:  0,
+		}
+	default:
+		rpf = PixelFormatRGB888()
+	}
+	rpf.BigEndian = pf.BigEndian
+
+	if err := c.SendMsg(&SetPixelFormatMsg{RFBPixelFormat: rpf}); err != nil {
+		return err
+	}
+	if c.pixelFormat.ColorMap != nil {
+		return fmt.Errorf("pixel format still uses a color map")
+	}
+	return nil
+}
+
+// SetEncodings sends a SetEncodingsMsg for the given encoding types, in
+// order of preference, followed by the ones registered with
+// RequestAlways. The types are resolved to the encodings registered on
+// the connection, then the ones registered with RegisterEncoding, then
+// the ones implemented by this package.
+func (c *ClientConn) SetEncodings(types ...EncodingType) error {
+	msg := new(SetEncodingsMsg)
+	listed := make(map[EncodingType]bool)
+	// copied so that the caller's slice is never appended to in place
+	all := append(append([]EncodingType(nil), types...), alwaysRequestedTypes()...)
+	for _, t := range all {
+		if listed[t] {
+			continue
+		}
+		listed[t] = true
+
+		enc, ok := c.registeredEncodings[t]
+		if !ok {
+			if enc = builtinEncoding(t); enc == nil {
+				return fmt.Errorf("unsupported encoding type: %d", t)
+			}
+		}
+		msg.Encodings = append(msg.Encodings, enc)
+	}
+	return c.SendMsg(msg)
+}
+
 type SetEncodingsMsg struct {
 	ID        MessageID
 	Encodings []Encoding
@@ -48,20 +150,24 @@ func (m *SetEncodingsMsg) Send(c *ClientConn) error {
 		encMap[t] = e
 	}
 
-	buf := make([]byte, 2, 4+4*numEncs)
-	buf[0] = byte(m.ID)
-	w := bytes.NewBuffer(buf)
+	w := bytes.NewBuffer(make([]byte, 0, 4+4*numEncs))
+	w.WriteByte(byte(SetEncodingsMID))
+	w.WriteByte(0) // padding
 
 	if err := writeFixedSize(w, uint16(numEncs)); err != nil {
 		return err
 	} else if err = writeFixedSize(w, encTypes); err != nil {
 		return err
-	} else if _, err = c.c.Write(w.Bytes()); err != nil {
+	} else if _, err = c.w.Write(w.Bytes()); err != nil {
 		return err
 	}
 
 	// set encoding map
 	c.encodingMap = encMap
+	c.lastSetEncodings = &SetEncodingsMsg{
+		ID:        SetEncodingsMID,
+		Encodings: append([]Encoding(nil), m.Encodings...),
+	}
 
 	return nil
 }
@@ -76,7 +182,32 @@ type FramebufferUpdateRequestMsg struct {
 }
 
 func (m *FramebufferUpdateRequestMsg) Send(c *ClientConn) error {
-	return writeFixedSize(c.c, m)
+	msg := *m
+	msg.ID = FramebufferUpdateRequestMID
+	return writeFixedSize(c.w, &msg)
+}
+
+// RequestFramebufferUpdate requests an update of the whole framebuffer.
+// If incremental is true, the server only sends the areas that changed
+// since the last update.
+func (c *ClientConn) RequestFramebufferUpdate(incremental bool) error {
+	return c.RequestFramebufferUpdateRect(incremental, 0, 0, c.FrameBufferWidth, c.FrameBufferHeight)
+}
+
+// RequestFramebufferUpdateRect requests an update of the w x h area of
+// the framebuffer at (x, y).
+func (c *ClientConn) RequestFramebufferUpdateRect(incremental bool, x, y, w, h uint16) error {
+	var inc uint8
+	if incremental {
+		inc = 1
+	}
+	return c.SendMsg(&FramebufferUpdateRequestMsg{
+		Incremental: inc,
+		X:           x,
+		Y:           y,
+		Width:       w,
+		Height:      h,
+	})
 }
 
 type KeyEventMsg struct {
@@ -87,7 +218,9 @@ type KeyEventMsg struct {
 }
 
 func (m *KeyEventMsg) Send(c *ClientConn) error {
-	return writeFixedSize(c.c, m)
+	msg := *m
+	msg.ID = KeyEventMID
+	return writeFixedSize(c.w, &msg)
 }
 
 type PointerEventMsg struct {
@@ -98,34 +231,85 @@ type PointerEventMsg struct {
 }
 
 func (m *PointerEventMsg) Send(c *ClientConn) error {
-	return writeFixedSize(c.c, m)
+	msg := *m
+	msg.ID = PointerEventMID
+	return writeFixedSize(c.w, &msg)
 }
 
+// ClientCutTextMsg sends text to the server's cut buffer.
+//
+// If the server announced text support of the Extended Clipboard, the
+// text is sent as UTF-8 in an extended clipboard Provide message.
+// Otherwise the legacy format is used, which only allows Latin-1
+// (ISO 8859-1) characters; other text is rejected with an error.
 type ClientCutTextMsg struct {
 	ID   MessageID
-	Text string // Latin-1 (ISO 8859-1) characters only
+	Text string
 }
 
 func (m *ClientCutTextMsg) Send(c *ClientConn) error {
+	if c.ExtendedClipboard() {
+		return NewClipboardTextProvide(m.Text).Send(c)
+	}
+
+	textBytes := make([]byte, 0, len(m.Text))
 	for _, char := range m.Text {
 		if char > unicode.MaxLatin1 {
-			return fmt.Errorf("Character '%s' is not valid Latin-1", char)
+			return fmt.Errorf("Character %q is not valid Latin-1", char)
 		}
+		textBytes = append(textBytes, byte(char))
 	}
 
-	textBytes := []byte(m.Text)
 	textLength := uint32(len(textBytes))
 	buf := make([]byte, 4, 8+textLength)
-	buf[0] = byte(m.ID)
+	buf[0] = byte(ClientCutTextMID)
 	w := bytes.NewBuffer(buf)
 
 	if err := writeFixedSize(w, textLength); err != nil {
 		return err
 	} else if _, err = w.Write(textBytes); err != nil {
 		return err
-	} else if _, err = c.c.Write(w.Bytes()); err != nil {
+	} else if _, err = c.w.Write(w.Bytes()); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// SetDesktopSizeMID is the message type of SetDesktopSizeMsg.
+const SetDesktopSizeMID MessageID = 251
+
+// SetDesktopSizeMsg asks the server to change the framebuffer size and
+// screen layout. It requires the server to support the
+// ExtendedDesktopSize pseudo-encoding, which is also how the server
+// replies, with the Status of an ExtendedDesktopSizePseudoEncoding
+// whose Reason is ResizeByClient.
+type SetDesktopSizeMsg struct {
+	Width   uint16
+	Height  uint16
+	Screens []Screen
+}
+
+func (m *SetDesktopSizeMsg) Send(c *ClientConn) error {
+	if len(m.Screens) == 0 || len(m.Screens) > 255 {
+		return fmt.Errorf("invalid number of screens: %d", len(m.Screens))
+	}
+
+	header := struct {
+		ID         MessageID
+		_          uint8 // padding
+		Width      uint16
+		Height     uint16
+		NumScreens uint8
+		_          uint8 // padding
+	}{ID: SetDesktopSizeMID, Width: m.Width, Height: m.Height, NumScreens: uint8(len(m.Screens))}
+
+	buf := new(bytes.Buffer)
+	if err := writeFixedSize(buf, header); err != nil {
+		return err
+	} else if err = writeFixedSize(buf, m.Screens); err != nil {
+		return err
+	}
+	_, err := c.w.Write(buf.Bytes())
+	return err
+}
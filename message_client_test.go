@@ -0,0 +1,172 @@
+package vnc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestClientMessages(t *testing.T) {
+	tests := []struct {
+		name    string
+		send    func(c *ClientConn) error
+		want    []byte
+		wantErr bool
+	}{
+		{"SetEncodings", func(c *ClientConn) error {
+			// the ID field is ignored
+			return c.SendMsg(&SetEncodingsMsg{ID: 99, Encodings: []Encoding{&HextileEncoding{}, &RawEncoding{}}})
+		}, wire(SetEncodingsMID, uint8(0), uint16(2), HextileEncType, RawEncType), false},
+		{"SetEncodings by type", func(c *ClientConn) error {
+			return c.SetEncodings(TightEncType, RawEncType, TightEncType, DesktopSizePseudoEncType)
+			// LastRect is always requested, after the listed types
+		}, wire(SetEncodingsMID, uint8(0), uint16(4), TightEncType, RawEncType, DesktopSizePseudoEncType, LastRectPseudoEncType), false},
+		{"SetEncodings unsupported", func(c *ClientConn) error {
+			return c.SetEncodings(EncodingType(0x7002))
+		}, nil, true},
+		{"SetEncodings empty", func(c *ClientConn) error {
+			return c.SendMsg(&SetEncodingsMsg{})
+		}, wire(SetEncodingsMID, uint8(0), uint16(0)), false},
+		{"full update request", func(c *ClientConn) error {
+			return c.RequestFramebufferUpdate(true)
+		}, wire(FramebufferUpdateRequestMID, uint8(1), uint16(0), uint16(0), uint16(1024), uint16(768)), false},
+		{"area update request", func(c *ClientConn) error {
+			return c.RequestFramebufferUpdateRect(false, 10, 20, 30, 40)
+		}, wire(FramebufferUpdateRequestMID, uint8(0), uint16(10), uint16(20), uint16(30), uint16(40)), false},
+		{"KeyEvent", func(c *ClientConn) error {
+			return c.SendMsg(&KeyEventMsg{DownFlag: 1, Key: KeyReturn})
+		}, wire(KeyEventMID, uint8(1), [2]byte{}, uint32(KeyReturn)), false},
+		{"PointerEvent", func(c *ClientConn) error {
+			return c.SendMsg(&PointerEventMsg{ButtonMask: 5, X: 300, Y: 2})
+		}, wire(PointerEventMID, uint8(5), uint16(300), uint16(2)), false},
+		{"ClientCutText", func(c *ClientConn) error {
+			return c.SendMsg(&ClientCutTextMsg{Text: "text"})
+		}, wire(ClientCutTextMID, [3]byte{}, uint32(4), "text"), false},
+		{"ClientCutText Latin-1", func(c *ClientConn) error {
+			return c.SendMsg(&ClientCutTextMsg{Text: "é"})
+		}, wire(ClientCutTextMID, [3]byte{}, uint32(1), uint8(0xe9)), false},
+		{"ClientCutText beyond Latin-1", func(c *ClientConn) error {
+			return c.SendMsg(&ClientCutTextMsg{Text: "€"})
+		}, nil, true},
+		{"SetPixelFormat", func(c *ClientConn) error {
+			return c.SendMsg(&SetPixelFormatMsg{ID: 99, RFBPixelFormat: PixelFormatBGR233()})
+		}, wire(SetPixelFormatMID, [3]byte{}, unhex("08080001000700070003000306000000")), false},
+		{"UseRGBA8888", (*ClientConn).UseRGBA8888,
+			wire(SetPixelFormatMID, [3]byte{}, unhex("2018000100ff00ff00ff000810000000")), false},
+		{"UseBGR233", (*ClientConn).UseBGR233,
+			wire(SetPixelFormatMID, [3]byte{}, unhex("08080001000700070003000306000000")), false},
+		{"SetPixelFormat invalid", func(c *ClientConn) error {
+			return c.SendMsg(&SetPixelFormatMsg{RFBPixelFormat: RFBPixelFormat{BPP: 12}})
+		}, nil, true},
+		{"SetDesktopSize", func(c *ClientConn) error {
+			return c.SendMsg(&SetDesktopSizeMsg{Width: 800, Height: 600,
+				Screens: []Screen{{ID: 1, Width: 800, Height: 600}}})
+		}, wire(SetDesktopSizeMID, uint8(0), uint16(800), uint16(600), uint8(1), uint8(0),
+			uint32(1), uint16(0), uint16(0), uint16(800), uint16(600), uint32(0)), false},
+		{"SetDesktopSize without screens", func(c *ClientConn) error {
+			return c.SendMsg(&SetDesktopSizeMsg{Width: 800, Height: 600})
+		}, nil, true},
+	}
+	for _, tt := range tests {
+		c, tc := newTestClient(nil, nil)
+		err := tt.send(c)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !bytes.Equal(tc.out.Bytes(), tt.want) {
+			t.Errorf("%s: sent %x, want %x", tt.name, tc.out.Bytes(), tt.want)
+		}
+	}
+}
+
+func TestForceTrueColor(t *testing.T) {
+	tests := []struct {
+		name string
+		rpf  RFBPixelFormat
+		want []byte // the pixel format sent, nil if none
+	}{
+		{"true color", PixelFormatRGB888(), nil},
+		{"8bpp color map", RFBPixelFormat{BPP: 8, Depth: 8}, unhex("08080001000700070003000306000000")},
+		{"16bpp color map", RFBPixelFormat{BPP: 16, Depth: 16, BigEndian: 1}, unhex("10100101001f003f001f0b0500000000")},
+		{"32bpp color map", RFBPixelFormat{BPP: 32, Depth: 24}, unhex("2018000100ff00ff00ff100800000000")},
+	}
+	for _, tt := range tests {
+		c, tc := newTestClient(nil, nil)
+		rpf := tt.rpf
+		c.pixelFormat = NewPixelFormat(&rpf)
+		if err := c.ForceTrueColor(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var want []byte
+		if tt.want != nil {
+			want = wire(SetPixelFormatMID, [3]byte{}, tt.want)
+		}
+		if !bytes.Equal(tc.out.Bytes(), want) {
+			t.Errorf("%s: sent %x, want %x", tt.name, tc.out.Bytes(), want)
+		}
+		if c.PixelFormat().TrueColor == 0 || c.PixelFormat().ColorMap != nil {
+			t.Errorf("%s: pixel format %+v after ForceTrueColor", tt.name, *c.PixelFormat().RFBPixelFormat)
+		}
+	}
+}
+
+func TestSetEncodingsMap(t *testing.T) {
+	c, _ := newTestClient(nil, nil)
+	if err := c.SetEncodings(HextileEncType); err != nil {
+		t.Fatal(err)
+	}
+	// Raw is always decodable, even if not requested
+	for _, typ := range []EncodingType{HextileEncType, RawEncType} {
+		if _, ok := c.encodingMap[typ]; !ok {
+			t.Errorf("encoding %d not in the encoding map", typ)
+		}
+	}
+	if _, ok := c.encodingMap[TightEncType]; ok {
+		t.Error("Tight in the encoding map without being requested")
+	}
+}
+
+func TestSetEncodingsSliceUnchanged(t *testing.T) {
+	// the spare capacity must not receive the always requested types
+	types := make([]EncodingType, 1, 4)
+	types[0] = RawEncType
+	spare := types[:4]
+	spare[1] = HextileEncType
+
+	c, _ := newTestClient(nil, nil)
+	if err := c.SetEncodings(types...); err != nil {
+		t.Fatal(err)
+	}
+	if spare[1] != HextileEncType {
+		t.Errorf("SetEncodings wrote %d beyond the length of its argument", spare[1])
+	}
+}
+
+func TestRequestAlways(t *testing.T) {
+	saved := alwaysRequestedTypes()
+	enc := &markerEncoding{t: -0x7003}
+	t.Cleanup(func() {
+		registryMu.Lock()
+		alwaysRequested = saved
+		delete(registry, enc.t)
+		registryMu.Unlock()
+	})
+	RequestAlways(enc)
+	RequestAlways(enc)
+
+	c, tc := newTestClient(nil, nil)
+	if err := c.SetEncodings(RawEncType); err != nil {
+		t.Fatal(err)
+	}
+	want := wire(SetEncodingsMID, uint8(0), uint16(3), RawEncType, LastRectPseudoEncType, enc.t)
+	if !bytes.Equal(tc.out.Bytes(), want) {
+		t.Errorf("sent %x, want %x", tc.out.Bytes(), want)
+	}
+	if got, _ := c.encoding(enc.t); got != enc {
+		t.Errorf("got encoding %v, want the registered one", got)
+	}
+}
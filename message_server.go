@@ -3,6 +3,7 @@ package vnc
 import (
 	"fmt"
 	"io"
+	"time"
 )
 
 const (
@@ -23,45 +24,151 @@ func (*FramebufferUpdateMsg) ID() MessageID {
 }
 
 func (*FramebufferUpdateMsg) Receive(c *ClientConn) (ServerMessage, error) {
+	var rects []Rectangle
+	err := ReceiveFramebufferUpdate(c, func(rect *Rectangle) error {
+		rects = append(rects, *rect)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &FramebufferUpdateMsg{rects}, nil
+}
+
+// StreamingFramebufferUpdateMsg reads framebuffer updates like
+// FramebufferUpdateMsg, but passes each rectangle to Handler as soon as
+// it is decoded instead of collecting them, so only one rectangle is
+// held in memory at a time. To use it, put it in
+// ClientConnConfig.ServerMessages; the messages it returns have no
+// rectangles.
+type StreamingFramebufferUpdateMsg struct {
+	// Handler is called with every rectangle of an update, in order.
+	// An error aborts reading the update and is returned by ReceiveMsg.
+	Handler func(*Rectangle) error
+}
+
+func (*StreamingFramebufferUpdateMsg) ID() MessageID {
+	return FramebufferUpdateMID
+}
+
+func (m *StreamingFramebufferUpdateMsg) Receive(c *ClientConn) (ServerMessage, error) {
+	if err := ReceiveFramebufferUpdate(c, m.Handler); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReceiveFramebufferUpdate reads a FramebufferUpdate message, whose
+// message type has already been read, and calls fn with each rectangle
+// as soon as it is decoded. The rectangle is not used after fn returns.
+// An error returned by fn aborts reading the message.
+func ReceiveFramebufferUpdate(c *ClientConn, fn func(*Rectangle) error) error {
+	return receiveFramebufferUpdate(c, nil, fn)
+}
+
+// receiveFramebufferUpdate is ReceiveFramebufferUpdate, decoding the
+// rectangles with decode if not nil, or else with their encoding's Read.
+func receiveFramebufferUpdate(c *ClientConn, decode func(Encoding, *Rectangle) (Encoding, error), fn func(*Rectangle) error) error {
 	// Read off the padding
 	padding := make([]byte, 1)
 	if _, err := io.ReadFull(c.r, padding); err != nil {
-		return nil, err
+		return err
 	}
 
 	var numRects uint16
 	if err := readFixedSize(c.r, &numRects); err != nil {
-		return nil, err
+		return err
 	}
 
-	rects := make([]Rectangle, numRects)
 	for i := uint16(0); i < numRects; i++ {
-		rect := &rects[i]
+		rect := &Rectangle{}
 
 		box := []*uint16{&rect.X, &rect.Y, &rect.Width, &rect.Height}
 		for _, val := range box {
 			if err := readFixedSize(c.r, val); err != nil {
-				return nil, err
+				return err
 			}
 		}
 
 		var encType EncodingType
 		if err := readFixedSize(c.r, &encType); err != nil {
-			return nil, err
+			return err
+		}
+		if c.config.Logger != nil {
+			c.debugf("rectangle %dx%d+%d+%d, encoding %d", rect.Width, rect.Height, rect.X, rect.Y, encType)
+		}
+		if encType == LastRectPseudoEncType {
+			break
 		}
-		enc, ok := c.encodingMap[encType]
+		enc, ok := c.encoding(encType)
 		if !ok {
-			return nil, fmt.Errorf("unsupported encoding type: %d", encType)
+			return fmt.Errorf("unsupported encoding type: %d", encType)
+		}
+
+		// Decoding allocates for the whole rectangle, so one larger than
+		// the framebuffer is rejected before its pixels are read.
+		pseudo := isPseudoEncoding(enc)
+		if !pseudo || encType == CursorPseudoEncType || encType == XCursorPseudoEncType {
+			if rect.Width > c.FrameBufferWidth || rect.Height > c.FrameBufferHeight {
+				return fmt.Errorf("rectangle %dx%d is larger than the %dx%d framebuffer",
+					rect.Width, rect.Height, c.FrameBufferWidth, c.FrameBufferHeight)
+			}
+		}
+		if c.config.Strict && !pseudo {
+			if int(rect.X)+int(rect.Width) > int(c.FrameBufferWidth) ||
+				int(rect.Y)+int(rect.Height) > int(c.FrameBufferHeight) {
+				return fmt.Errorf("rectangle %dx%d+%d+%d exceeds the framebuffer",
+					rect.Width, rect.Height, rect.X, rect.Y)
+			}
+		}
+
+		if l := c.config.DecodeLimiter; l != nil {
+			l.acquire()
+		}
+
+		var start int64
+		var startTime time.Time
+		if c.config.StrictFraming || c.config.Metrics != nil {
+			start = c.consumed()
+			startTime = time.Now()
 		}
 
 		var err error
-		rect.Encoding, err = enc.Read(c, rect)
+		if decode != nil {
+			rect.Encoding, err = decode(enc, rect)
+		} else {
+			rect.Encoding, err = enc.Read(c, rect)
+		}
+		if l := c.config.DecodeLimiter; l != nil {
+			l.release()
+		}
 		if err != nil {
-			return nil, err
+			return err
+		}
+
+		if c.config.Metrics != nil {
+			c.config.Metrics.RecordDecode(encType, time.Since(startTime), int(c.consumed()-start))
+		}
+
+		if framed, ok := enc.(FramedEncoding); ok && c.config.StrictFraming {
+			want := framed.EncodedSize(c, rect)
+			if got := c.consumed() - start; got != int64(want) {
+				return fmt.Errorf("encoding %d (%T) consumed %d bytes of a %dx%d rectangle instead of %d",
+					encType, enc, got, rect.Width, rect.Height, want)
+			}
+		}
+		if c.config.OnRectangle != nil {
+			c.config.OnRectangle(int(i), int(numRects), rect)
+		}
+		if err := fn(rect); err != nil {
+			return err
 		}
 	}
 
-	return &FramebufferUpdateMsg{rects}, nil
+	c.frameRate.record(time.Now())
+	c.notifyRefresh()
+
+	return nil
 }
 
 // SetColorMapEntriesMsg is sent by the server to set values into
@@ -100,6 +207,14 @@ func (*SetColorMapEntriesMsg) Receive(c *ClientConn) (ServerMessage, error) {
 		return nil, err
 	}
 
+	// Apply the new entries before returning, so that the pixels of any
+	// following message are decoded with the updated color map.
+	if pf := c.pixelFormat; pf != nil && pf.TrueColor == 0 {
+		if err := pf.UpdateColorMap(msg.FirstColor, msg.Colors); err != nil {
+			return nil, err
+		}
+	}
+
 	return msg, nil
 }
 
@@ -112,15 +227,26 @@ func (*BellMsg) ID() MessageID {
 	return BellMID
 }
 
-func (*BellMsg) Receive(*ClientConn) (ServerMessage, error) {
+func (*BellMsg) Receive(c *ClientConn) (ServerMessage, error) {
+	if c.config.OnBell != nil {
+		select {
+		case c.config.OnBell <- struct{}{}:
+		default:
+		}
+	}
 	return &BellMsg{}, nil
 }
 
 // ServerCutTextMsg indicates the server has new text in the cut buffer.
 //
+// If the Extended Clipboard pseudo-encoding was negotiated, the server
+// may send extended messages instead. Extended is then set, and Text
+// holds the provided text, if any.
+//
 // See RFC 6143 Section 7.6.4
 type ServerCutTextMsg struct {
-	Text string
+	Text     string
+	Extended *ExtendedClipboard
 }
 
 func (*ServerCutTextMsg) ID() MessageID {
@@ -133,15 +259,50 @@ func (*ServerCutTextMsg) Receive(c *ClientConn) (ServerMessage, error) {
 		return nil, err
 	}
 
-	var textLength uint32
+	var textLength int32
 	if err := readFixedSize(c.r, &textLength); err != nil {
 		return nil, err
 	}
 
+	if textLength < 0 {
+		if err := c.checkMessageSize(-int64(textLength)); err != nil {
+			return nil, err
+		}
+		payload := make([]byte, -int64(textLength))
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return nil, err
+		}
+
+		cb, err := readExtendedClipboard(payload, c.maxMessageSize())
+		if err != nil {
+			return nil, err
+		}
+		if cb.Flags&ClipboardCaps != 0 {
+			c.clipboardCaps = cb
+		}
+
+		msg := &ServerCutTextMsg{Extended: cb}
+		msg.Text, _ = cb.Text()
+		return msg, nil
+	}
+
+	if err := c.checkMessageSize(int64(textLength)); err != nil {
+		return nil, err
+	}
 	textBytes := make([]byte, textLength)
 	if _, err := io.ReadFull(c.r, textBytes); err != nil {
 		return nil, err
 	}
 
-	return &ServerCutTextMsg{string(textBytes)}, nil
+	return &ServerCutTextMsg{Text: latin1ToString(textBytes)}, nil
+}
+
+// latin1ToString decodes Latin-1 (ISO 8859-1) text, whose bytes are
+// equal to their code points.
+func latin1ToString(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
 }
@@ -0,0 +1,440 @@
+package vnc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"runtime"
+	"testing"
+)
+
+func TestMaxMessageSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		max     uint32
+		receive func(c *ClientConn) error
+		data    []byte
+		size    int64 // of the MessageSizeError, 0 for no error
+		refused bool  // the handshake fails with ErrNoSecurityTypes
+	}{
+		{"cut text of 2 GiB", 0, receiveMsg, wire(ServerCutTextMID, [3]byte{}, int32(0x7fffffff)), 0x7fffffff, false},
+		{"extended cut text of 2 GiB", 0, receiveMsg, wire(ServerCutTextMID, [3]byte{}, int32(-0x80000000)), 0x80000000, false},
+		{"cut text at the limit", 4, receiveMsg, wire(ServerCutTextMID, [3]byte{}, int32(4), "text"), 0, false},
+		{"cut text over the limit", 4, receiveMsg, wire(ServerCutTextMID, [3]byte{}, int32(5), "texts"), 5, false},
+		{"desktop name of 4 GiB", 0, receiveMsg, wire(FramebufferUpdateMID, uint8(0), uint16(1),
+			[4]uint16{}, DesktopNamePseudoEncType, uint32(0xffffffff)), 0xffffffff, false},
+		{"failure reason of 4 GiB", 0, (*ClientConn).hsSecurity, wire(uint8(0), uint32(0xffffffff)), 0, true},
+		{"ServerInit name of 4 GiB", 0, (*ClientConn).hsInit, wire([20]byte{}, uint32(0xffffffff)), 0xffffffff, false},
+		{"ServerInit name over the limit", 8, (*ClientConn).hsInit, wire([20]byte{}, uint32(9), "123456789"), 9, false},
+	}
+	for _, tt := range tests {
+		c, _ := newTestClient(&ClientConnConfig{MaxMessageSize: tt.max}, tt.data)
+		c.protocolVersion = ProtocolVersion3_8
+		c.encodingMap[DesktopNamePseudoEncType] = &DesktopNamePseudoEncoding{}
+
+		err := tt.receive(c)
+		var sizeErr *MessageSizeError
+		switch {
+		case tt.refused:
+			// the reason is dropped, the refusal still reported
+			if !errors.Is(err, ErrNoSecurityTypes) {
+				t.Errorf("%s: got %v, want ErrNoSecurityTypes", tt.name, err)
+			}
+		case tt.size == 0:
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+		case !errors.As(err, &sizeErr):
+			t.Errorf("%s: got %v, want a MessageSizeError", tt.name, err)
+		case sizeErr.Size != tt.size:
+			t.Errorf("%s: got a size of %d, want %d", tt.name, sizeErr.Size, tt.size)
+		}
+	}
+}
+
+// receiveMsg receives a message, for tests that only need the error.
+func receiveMsg(c *ClientConn) error {
+	_, err := c.ReceiveMsg()
+	return err
+}
+
+type shortEncoding struct{}
+
+func (*shortEncoding) Type() EncodingType                             { return 0x7001 }
+func (*shortEncoding) Read(*ClientConn, *Rectangle) (Encoding, error) { return new(shortEncoding), nil }
+func (*shortEncoding) EncodedSize(_ *ClientConn, rect *Rectangle) int {
+	return int(rect.Width) * int(rect.Height)
+}
+
+func TestStrictFraming(t *testing.T) {
+	tests := []struct {
+		name    string
+		enc     Encoding
+		data    []byte
+		wantErr bool
+	}{
+		{"raw", &RawEncoding{}, wire([4]uint16{0, 0, 2, 1}, RawEncType, pixel(1, 2, 3), pixel(4, 5, 6)), false},
+		{"cursor", &CursorPseudoEncoding{}, wire([4]uint16{0, 0, 2, 1}, CursorPseudoEncType, pixel(1, 2, 3), pixel(4, 5, 6), uint8(0xc0)), false},
+		{"short", &shortEncoding{}, wire([4]uint16{0, 0, 2, 1}, EncodingType(0x7001)), true},
+	}
+	for _, tt := range tests {
+		data := append(wire(FramebufferUpdateMID, uint8(0), uint16(1)), tt.data...)
+		c, _ := newTestClient(&ClientConnConfig{StrictFraming: true}, data)
+		c.encodingMap[tt.enc.Type()] = tt.enc
+		_, err := c.ReceiveMsg()
+		if tt.wantErr && err == nil {
+			t.Errorf("%s: no error", tt.name)
+		} else if !tt.wantErr && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestStrictRectangles(t *testing.T) {
+	tests := []struct {
+		name    string
+		rect    [4]uint16
+		strict  bool
+		wantErr bool
+	}{
+		{"inside", [4]uint16{1022, 766, 2, 2}, true, false},
+		{"outside, tolerated", [4]uint16{1023, 767, 2, 2}, false, false},
+		{"outside, strict", [4]uint16{1023, 767, 2, 2}, true, true},
+		{"larger than the framebuffer", [4]uint16{0, 0, 1025, 1}, false, true},
+	}
+	for _, tt := range tests {
+		numPixels := int(tt.rect[2]) * int(tt.rect[3])
+		data := wire(FramebufferUpdateMID, uint8(0), uint16(1), tt.rect, RawEncType, pixels(numPixels, pixel(1, 2, 3)))
+		c, _ := newTestClient(&ClientConnConfig{Strict: tt.strict}, data)
+		_, err := c.ReceiveMsg()
+		if tt.wantErr && err == nil {
+			t.Errorf("%s: no error", tt.name)
+		} else if !tt.wantErr && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestSetColorMapEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		first   uint16
+		colors  []Color
+		pixel   uint8
+		want    [3]uint8
+		wantErr bool
+	}{
+		{"first entries", 0, []Color{{65535, 0, 0}, {0, 65535, 0}}, 1, [3]uint8{0, 255, 0}, false},
+		{"last entry", 255, []Color{{0, 0, 65535}}, 255, [3]uint8{0, 0, 255}, false},
+		{"beyond the color map", 255, []Color{{0, 0, 0}, {0, 0, 0}}, 0, [3]uint8{}, true},
+	}
+	for _, tt := range tests {
+		data := wire(SetColorMapEntriesMID, uint8(0), tt.first, uint16(len(tt.colors)), tt.colors,
+			FramebufferUpdateMID, uint8(0), uint16(1), [4]uint16{0, 0, 1, 1}, RawEncType, tt.pixel)
+		c, _ := newTestClient(nil, data)
+		rpf := RFBPixelFormat{BPP: 8, Depth: 8}
+		c.pixelFormat = NewPixelFormat(&rpf)
+
+		msg, err := c.ReceiveMsg()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if m := msg.(*SetColorMapEntriesMsg); m.FirstColor != tt.first || len(m.Colors) != len(tt.colors) {
+			t.Errorf("%s: got %+v", tt.name, m)
+		}
+
+		// the pixels of the following update use the new entries
+		msg, err = c.ReceiveMsg()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		rect := &msg.(*FramebufferUpdateMsg).Rectangles[0]
+		rgba, _ := rect.Encoding.(*RawEncoding).RGBA(rect)
+		if got := [3]uint8{rgba[0], rgba[1], rgba[2]}; got != tt.want {
+			t.Errorf("%s: pixel %d decoded as %v, want %v", tt.name, tt.pixel, got, tt.want)
+		}
+	}
+}
+
+func TestServerMessages(t *testing.T) {
+	bell := make(chan struct{}, 1)
+	c, tc := newTestClient(&ClientConnConfig{OnBell: bell}, wire(
+		BellMID,
+		BellMID, // dropped, the channel is full
+		ServerCutTextMID, [3]byte{}, int32(5), "h\xe9llo",
+		uint8(99)))
+
+	for i := 0; i < 2; i++ {
+		if msg, err := c.ReceiveMsg(); err != nil {
+			t.Fatal(err)
+		} else if _, ok := msg.(*BellMsg); !ok {
+			t.Fatalf("got %T, want a BellMsg", msg)
+		}
+	}
+	if len(bell) != 1 {
+		t.Errorf("%d bells on the channel, want 1", len(bell))
+	}
+
+	msg, err := c.ReceiveMsg()
+	if err != nil {
+		t.Fatal(err)
+	} else if text := msg.(*ServerCutTextMsg).Text; text != "héllo" {
+		t.Errorf("got cut text %q", text)
+	}
+
+	var unsupported *UnsupportedMessageError
+	if _, err := c.ReceiveMsg(); !errors.As(err, &unsupported) || unsupported.ID != 99 {
+		t.Errorf("got %v, want an UnsupportedMessageError for 99", err)
+	} else if !consumed(c, tc) {
+		t.Error("data left unread")
+	}
+}
+
+func TestDefaultServerMessage(t *testing.T) {
+	cfg := &ClientConnConfig{DefaultServerMessage: func(c *ClientConn, id MessageID) (ServerMessage, error) {
+		if id != 99 {
+			return nil, &UnsupportedMessageError{id}
+		}
+		var skip [3]byte
+		return nil, readFixedSize(c.Reader(), &skip)
+	}}
+	c, tc := newTestClient(cfg, wire(uint8(99), [3]byte{}, BellMID, uint8(98)))
+
+	if msg, err := c.ReceiveMsg(); msg != nil || err != nil {
+		t.Errorf("got %v, %v for a skipped message", msg, err)
+	}
+	if msg, err := c.ReceiveMsg(); err != nil {
+		t.Error(err)
+	} else if _, ok := msg.(*BellMsg); !ok {
+		t.Errorf("got %T after the skipped message, want a BellMsg", msg)
+	}
+	if _, err := c.ReceiveMsg(); err == nil {
+		t.Error("no error for an unknown message")
+	} else if !consumed(c, tc) {
+		t.Error("data left unread")
+	}
+}
+
+func TestStreamingFramebufferUpdate(t *testing.T) {
+	update := wire(FramebufferUpdateMID, uint8(0), uint16(2),
+		[4]uint16{0, 0, 1, 1}, RawEncType, pixel(1, 2, 3),
+		[4]uint16{1, 0, 1, 1}, RawEncType, pixel(4, 5, 6))
+
+	var got []uint16
+	stream := &StreamingFramebufferUpdateMsg{Handler: func(rect *Rectangle) error {
+		got = append(got, rect.X)
+		if len(got) == 3 {
+			return errors.New("stop")
+		}
+		return nil
+	}}
+	cfg := &ClientConnConfig{ServerMessages: map[MessageID]ServerMessage{FramebufferUpdateMID: stream}}
+	c, _ := newTestClient(cfg, append(update, update...))
+
+	if msg, err := c.ReceiveMsg(); err != nil {
+		t.Fatal(err)
+	} else if msg != stream || fmt.Sprint(got) != "[0 1]" {
+		t.Errorf("got %v, handler saw %v", msg, got)
+	}
+	if _, err := c.ReceiveMsg(); err == nil || err.Error() != "stop" {
+		t.Errorf("got %v, want the handler's error", err)
+	}
+}
+
+// BenchmarkUpdate4K receives 3840x2160 framebuffer updates sent as Raw
+// strips of 64 rows, collected by FramebufferUpdateMsg or streamed by
+// StreamingFramebufferUpdateMsg. Besides the allocations, it reports
+// the heap held by a received update as peak-B.
+func BenchmarkUpdate4K(b *testing.B) {
+	const width, height, strip = 3840, 2160, 64
+	var rects []interface{}
+	for y := 0; y < height; y += strip {
+		h := strip
+		if y+h > height {
+			h = height - y
+		}
+		rects = append(rects, [4]uint16{0, uint16(y), width, uint16(h)}, RawEncType, make([]byte, width*h*4))
+	}
+	update := wire(append([]interface{}{FramebufferUpdateMID, uint8(0), uint16(len(rects) / 3)}, rects...)...)
+
+	for _, streaming := range []bool{false, true} {
+		name := "collected"
+		var cfg *ClientConnConfig
+		if streaming {
+			name = "streaming"
+			cfg = &ClientConnConfig{ServerMessages: map[MessageID]ServerMessage{
+				FramebufferUpdateMID: &StreamingFramebufferUpdateMsg{Handler: func(*Rectangle) error { return nil }},
+			}}
+		}
+		b.Run(name, func(b *testing.B) {
+			c, tc := newTestClient(cfg, nil)
+			c.FrameBufferWidth, c.FrameBufferHeight = width, height
+
+			// the input buffered by the connection is not counted
+			var before, after runtime.MemStats
+			tc.in.Write(update)
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			msg, err := c.ReceiveMsg()
+			if err != nil {
+				b.Fatal(err)
+			}
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			runtime.KeepAlive(msg)
+
+			b.SetBytes(int64(len(update)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tc.in.Write(update)
+				if _, err := c.ReceiveMsg(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc)), "peak-B")
+		})
+	}
+}
+
+func TestUpdateCallbacks(t *testing.T) {
+	metrics := new(DecodeMetrics)
+	var progress []string
+	cfg := &ClientConnConfig{
+		Metrics: metrics,
+		OnRectangle: func(index, total int, rect *Rectangle) {
+			progress = append(progress, fmt.Sprintf("%d/%d %d", index, total, rect.Type()))
+		},
+	}
+	c, _ := newTestClient(cfg, wire(FramebufferUpdateMID, uint8(0), uint16(0xffff),
+		[4]uint16{0, 0, 2, 1}, RawEncType, pixel(1, 2, 3), pixel(4, 5, 6),
+		[4]uint16{0, 0, 1, 1}, RawEncType, pixel(7, 8, 9),
+		[4]uint16{}, LastRectPseudoEncType))
+
+	if _, err := c.ReceiveMsg(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"0/65535 0", "1/65535 0"}; fmt.Sprint(progress) != fmt.Sprint(want) {
+		t.Errorf("OnRectangle called with %v, want %v", progress, want)
+	}
+	if got := metrics.Stats()[RawEncType]; got.Rectangles != 2 || got.Bytes != 12 {
+		t.Errorf("Raw metrics %+v, want 2 rectangles of 12 bytes", got)
+	}
+}
+
+func TestDirectFramebufferUpdate(t *testing.T) {
+	red, blue := pixel(255, 0, 0), pixel(0, 0, 255)
+	update := wire(FramebufferUpdateMID, uint8(0), uint16(4),
+		[4]uint16{0, 0, 2, 2}, RawEncType, red, blue, blue, red,
+		[4]uint16{2, 0, 4, 2}, HextileEncType, uint8(hextileBackgroundSpecified), blue,
+		[4]uint16{0, 2, 2, 2}, CopyRectEncType, uint16(0), uint16(0),
+		// clipped at the edge of the framebuffer
+		[4]uint16{5, 3, 2, 2}, RawEncType, red, red, red, red)
+
+	var want *image.RGBA
+	for _, direct := range []bool{false, true} {
+		fb := NewFramebuffer(6, 4)
+		var cfg *ClientConnConfig
+		if direct {
+			cfg = &ClientConnConfig{ServerMessages: map[MessageID]ServerMessage{
+				FramebufferUpdateMID: &DirectFramebufferUpdateMsg{Framebuffer: fb},
+			}}
+		}
+		c, tc := newTestClient(cfg, update)
+		c.encodingMap[HextileEncType] = &HextileEncoding{}
+		c.encodingMap[CopyRectEncType] = &CopyRectEncoding{}
+
+		msg, err := c.ReceiveMsg()
+		if err != nil {
+			t.Fatalf("direct %v: %v", direct, err)
+		} else if !consumed(c, tc) {
+			t.Errorf("direct %v: data left unread", direct)
+		}
+		if !direct {
+			if err := fb.Apply(msg.(*FramebufferUpdateMsg)); err != nil {
+				t.Fatal(err)
+			}
+			want = fb.Image()
+			continue
+		}
+		if !bytes.Equal(fb.Image().Pix, want.Pix) {
+			t.Errorf("decoding in place gives %v, want %v", fb.Image().Pix, want.Pix)
+		}
+	}
+	// (1, 3) is copied from the raw red pixel at (1, 1)
+	if got := want.RGBAAt(1, 3); got.R != 255 || got.B != 0 {
+		t.Errorf("copied pixel is %v, want red", got)
+	}
+}
+
+// scrollingText returns a framebuffer update scrolling a width x height
+// screen up by a 16 pixel line of text: a CopyRect of the screen and a
+// Hextile rectangle of the new line, whose tiles draw glyph strokes as
+// subrectangles in the foreground color.
+func scrollingText(width, height uint16) []byte {
+	line := wire([4]uint16{0, height - 16, width, 16}, HextileEncType)
+	for i := 0; i < int(width)/16; i++ {
+		line = append(line, hextileBackgroundSpecified|hextileForegroundSpecified|hextileAnySubrects)
+		line = append(line, pixel(255, 255, 255)...)
+		line = append(line, pixel(0, 0, 0)...)
+		line = append(line, 12)
+		for j := uint8(0); j < 12; j++ {
+			// alternating vertical and horizontal strokes
+			if j%2 == 0 {
+				line = append(line, (j+2)<<4|3, 0<<4|9)
+			} else {
+				line = append(line, 2<<4|(j+1), 11<<4|0)
+			}
+		}
+	}
+	return append(wire(FramebufferUpdateMID, uint8(0), uint16(2),
+		[4]uint16{0, 0, width, height - 16}, CopyRectEncType, uint16(0), uint16(16)), line...)
+}
+
+// BenchmarkScrollingText applies updates scrolling a 1024x768 terminal
+// by a line of text, decoded with Read and applied to the framebuffer
+// with Apply, or decoded in place by DirectFramebufferUpdateMsg.
+func BenchmarkScrollingText(b *testing.B) {
+	update := scrollingText(1024, 768)
+	for _, direct := range []bool{false, true} {
+		name := "apply"
+		if direct {
+			name = "direct"
+		}
+		b.Run(name, func(b *testing.B) {
+			fb := NewFramebuffer(1024, 768)
+			var cfg *ClientConnConfig
+			if direct {
+				cfg = &ClientConnConfig{ServerMessages: map[MessageID]ServerMessage{
+					FramebufferUpdateMID: &DirectFramebufferUpdateMsg{Framebuffer: fb},
+				}}
+			}
+			c, tc := newTestClient(cfg, nil)
+			c.encodingMap[HextileEncType] = &HextileEncoding{}
+			c.encodingMap[CopyRectEncType] = &CopyRectEncoding{}
+
+			b.SetBytes(int64(len(update)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				tc.in.Write(update)
+				msg, err := c.ReceiveMsg()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if !direct {
+					if err := fb.Apply(msg.(*FramebufferUpdateMsg)); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
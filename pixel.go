@@ -3,7 +3,9 @@ package vnc
 import (
 	"encoding/binary"
 	"fmt"
+	"image"
 	"io"
+	"sync"
 )
 
 // PixelFormat describes the way a pixel is formatted for a VNC connection.
@@ -34,6 +36,147 @@ type RFBPixelFormat struct {
 	_          [3]byte
 }
 
+// rfbPixelFormatSize is the size of a pixel format on the wire.
+const rfbPixelFormatSize = 16
+
+// MarshalBinary returns the 16 bytes of the pixel format on the wire,
+// with the channel maximums big-endian and the padding zeroed.
+func (rpf RFBPixelFormat) MarshalBinary() ([]byte, error) {
+	b := make([]byte, rfbPixelFormatSize)
+	b[0], b[1], b[2], b[3] = rpf.BPP, rpf.Depth, rpf.BigEndian, rpf.TrueColor
+	binary.BigEndian.PutUint16(b[4:], rpf.RedMax)
+	binary.BigEndian.PutUint16(b[6:], rpf.GreenMax)
+	binary.BigEndian.PutUint16(b[8:], rpf.BlueMax)
+	b[10], b[11], b[12] = rpf.RedShift, rpf.GreenShift, rpf.BlueShift
+	return b, nil
+}
+
+// UnmarshalBinary sets the pixel format from its 16 bytes on the wire.
+func (rpf *RFBPixelFormat) UnmarshalBinary(data []byte) error {
+	if len(data) != rfbPixelFormatSize {
+		return fmt.Errorf("invalid pixel format size: %d", len(data))
+	}
+	*rpf = RFBPixelFormat{
+		BPP:        data[0],
+		Depth:      data[1],
+		BigEndian:  data[2],
+		TrueColor:  data[3],
+		RedMax:     binary.BigEndian.Uint16(data[4:]),
+		GreenMax:   binary.BigEndian.Uint16(data[6:]),
+		BlueMax:    binary.BigEndian.Uint16(data[8:]),
+		RedShift:   data[10],
+		GreenShift: data[11],
+		BlueShift:  data[12],
+	}
+	return nil
+}
+
+// readRFBPixelFormat reads a pixel format from the wire.
+func readRFBPixelFormat(r io.Reader) (*RFBPixelFormat, error) {
+	data := make([]byte, rfbPixelFormatSize)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	rpf := new(RFBPixelFormat)
+	return rpf, rpf.UnmarshalBinary(data)
+}
+
+// PixelFormatRGB888 returns the common 32bpp true-color format with
+// 8 bits per channel, stored little-endian as blue, green, red, padding.
+func PixelFormatRGB888() RFBPixelFormat {
+	return RFBPixelFormat{
+		BPP:        32,
+		Depth:      24,
+		TrueColor:  1,
+		RedMax:     255,
+		GreenMax:   255,
+		BlueMax:    255,
+		RedShift:   16,
+		GreenShift: 8,
+		BlueShift:  0,
+	}
+}
+
+// PixelFormatRGBA8888 returns the 32bpp true-color little-endian format
+// whose bytes are ordered red, green, blue, unused, like image.RGBA.
+func PixelFormatRGBA8888() RFBPixelFormat {
+	return RFBPixelFormat{
+		BPP:        32,
+		Depth:      24,
+		TrueColor:  1,
+		RedMax:     255,
+		GreenMax:   255,
+		BlueMax:    255,
+		RedShift:   0,
+		GreenShift: 8,
+		BlueShift:  16,
+	}
+}
+
+// PixelFormatBGR233 returns the 8bpp true-color format with 3 bits of
+// red and green and 2 bits of blue, red being the least significant.
+// Decoded channels are scaled to the full 8-bit range, so a channel at
+// its maximum is 255.
+func PixelFormatBGR233() RFBPixelFormat {
+	return RFBPixelFormat{
+		BPP:        8,
+		Depth:      8,
+		TrueColor:  1,
+		RedMax:     7,
+		GreenMax:   7,
+		BlueMax:    3,
+		RedShift:   0,
+		GreenShift: 3,
+		BlueShift:  6,
+	}
+}
+
+// Validate checks that the pixel format is one the client can decode:
+// 8, 16, 24 or 32 bits per pixel, and for true-color formats, channels
+// with a maximum of the form 2^n-1 that fit into the pixel without
+// overlapping.
+func (rpf RFBPixelFormat) Validate() error {
+	switch rpf.BPP {
+	case 8, 16, 24, 32:
+	default:
+		return fmt.Errorf("invalid bits per pixel: %d", rpf.BPP)
+	}
+
+	if rpf.Depth == 0 || rpf.Depth > rpf.BPP {
+		return fmt.Errorf("invalid depth %d for %d bits per pixel", rpf.Depth, rpf.BPP)
+	}
+
+	if rpf.TrueColor == 0 {
+		return nil
+	}
+
+	channels := []struct {
+		name  string
+		max   uint16
+		shift uint8
+	}{
+		{"red", rpf.RedMax, rpf.RedShift},
+		{"green", rpf.GreenMax, rpf.GreenShift},
+		{"blue", rpf.BlueMax, rpf.BlueShift},
+	}
+	var used uint64
+	for _, ch := range channels {
+		if ch.max == 0 || ch.max&(ch.max+1) != 0 {
+			return fmt.Errorf("invalid %s maximum: %d", ch.name, ch.max)
+		}
+		mask := uint64(ch.max) << ch.shift
+		if ch.shift >= rpf.BPP || mask >= 1<<rpf.BPP {
+			return fmt.Errorf("%s channel exceeds %d bits per pixel", ch.name, rpf.BPP)
+		}
+		if used&mask != 0 {
+			return fmt.Errorf("%s channel overlaps another channel", ch.name)
+		}
+		used |= mask
+	}
+
+	return nil
+}
+
 func NewPixelFormat(rpf *RFBPixelFormat) *PixelFormat {
 	pf := new(PixelFormat)
 	pf.RFBPixelFormat = rpf
@@ -55,32 +198,84 @@ func NewPixelFormat(rpf *RFBPixelFormat) *PixelFormat {
 	return pf
 }
 
+// ReadPixels reads numPixels pixels in the pixel format and returns them
+// as RGBA.
 func (pf *PixelFormat) ReadPixels(r io.Reader, numPixels int) ([]byte, error) {
-	pixelBuffer := make([]byte, pf.ByPP)
+	return pf.ReadPixelsInto(r, numPixels, nil)
+}
+
+// ReadPixelsInto is like ReadPixels, but decodes into dst if it has the
+// capacity for the RGBA pixels, so a buffer can be reused across calls.
+// It returns the slice of dst, or of a new buffer, holding the pixels.
+func (pf *PixelFormat) ReadPixelsInto(r io.Reader, numPixels int, dst []byte) ([]byte, error) {
+	switch pf.ByPP {
+	case 1, 2, 3, 4:
+	default:
+		return nil, fmt.Errorf("unsupported bytes per pixel: %d", pf.ByPP)
+	}
+
 	rgbaSize := numPixels * 4
-	rgbaBuffer := make([]byte, rgbaSize)
-	for i := 0; i < rgbaSize; i += 4 {
-		if _, err := io.ReadFull(r, pixelBuffer); err != nil {
+	if cap(dst) < rgbaSize {
+		dst = make([]byte, rgbaSize)
+	}
+	rgbaBuffer := dst[:rgbaSize]
+
+	// pixels already in RGBA byte order only need the alpha set
+	if pf.isRGBA8888() {
+		if _, err := io.ReadFull(r, rgbaBuffer); err != nil {
 			return nil, err
 		}
+		for i := 3; i < rgbaSize; i += 4 {
+			rgbaBuffer[i] = 255
+		}
+		return rgbaBuffer, nil
+	}
+
+	// read all pixels at once into a pooled buffer
+	byPP := int(pf.ByPP)
+	bp := pixelDataPool.Get().(*[]byte)
+	defer pixelDataPool.Put(bp)
+	if cap(*bp) < numPixels*byPP {
+		*bp = make([]byte, numPixels*byPP)
+	}
+	data := (*bp)[:numPixels*byPP]
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
 
-		rgbaBuffer[i], rgbaBuffer[i+1], rgbaBuffer[i+2] = pf.pixelToRGB(pixelBuffer)
+	for i := 0; i < rgbaSize; i += 4 {
+		var err error
+		if rgbaBuffer[i], rgbaBuffer[i+1], rgbaBuffer[i+2], err = pf.pixelToRGB(data[:byPP]); err != nil {
+			return nil, err
+		}
 		rgbaBuffer[i+3] = 255
+		data = data[byPP:]
 	}
 
 	return rgbaBuffer, nil
 }
 
-func (pf *PixelFormat) pixelToRGB(buffer []byte) (r, g, b uint8) {
-	var pixel uint32
-	switch pf.ByPP {
-	case 1:
-		pixel = uint32(buffer[0])
-	case 2:
-		pixel = uint32(pf.ByteOrder.Uint16(buffer))
-	case 4:
-		pixel = pf.ByteOrder.Uint32(buffer)
+// pixelDataPool holds the buffers ReadPixelsInto reads the pixel data
+// into before converting it.
+var pixelDataPool = sync.Pool{
+	New: func() interface{} { return new([]byte) },
+}
+
+// isRGBA8888 reports whether the pixels are 32-bit true color with 8
+// bits per channel, their bytes ordered red, green, blue, unused.
+func (pf *PixelFormat) isRGBA8888() bool {
+	if pf.TrueColor == 0 || pf.ByPP != 4 ||
+		pf.RedMax != 255 || pf.GreenMax != 255 || pf.BlueMax != 255 {
+		return false
+	}
+	if pf.ByteOrder == binary.BigEndian {
+		return pf.RedShift == 24 && pf.GreenShift == 16 && pf.BlueShift == 8
 	}
+	return pf.RedShift == 0 && pf.GreenShift == 8 && pf.BlueShift == 16
+}
+
+func (pf *PixelFormat) pixelToRGB(buffer []byte) (r, g, b uint8, err error) {
+	pixel := pf.pixelValue(buffer)
 
 	if pf.TrueColor != 0 {
 		r = pf.scaleToUint8((pixel>>pf.RedShift)&uint32(pf.RedMax), pf.RedMax)
@@ -88,6 +283,9 @@ func (pf *PixelFormat) pixelToRGB(buffer []byte) (r, g, b uint8) {
 		b = pf.scaleToUint8((pixel>>pf.BlueShift)&uint32(pf.BlueMax), pf.BlueMax)
 	} else {
 		cm := pf.ColorMap
+		if pixel >= uint32(len(cm)) {
+			return 0, 0, 0, fmt.Errorf("pixel value %d exceeds the color map size %d", pixel, len(cm))
+		}
 		r = pf.scaleToUint8(uint32(cm[pixel].R), 65535)
 		g = pf.scaleToUint8(uint32(cm[pixel].G), 65535)
 		b = pf.scaleToUint8(uint32(cm[pixel].B), 65535)
@@ -95,20 +293,112 @@ func (pf *PixelFormat) pixelToRGB(buffer []byte) (r, g, b uint8) {
 	return
 }
 
-// good enough for pixel values?
+// writePixels writes the pixels of the given area of img in the pixel
+// format. Only true-color formats are supported.
+func (pf *PixelFormat) writePixels(w io.Writer, img image.Image, area image.Rectangle) error {
+	if pf.TrueColor == 0 {
+		return fmt.Errorf("writing color map pixels is not supported")
+	}
+
+	buf := make([]byte, int(pf.ByPP)*area.Dx())
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		p := buf
+		for x := area.Min.X; x < area.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			pixel := uint32(pf.scaleFromUint16(r, pf.RedMax))<<pf.RedShift |
+				uint32(pf.scaleFromUint16(g, pf.GreenMax))<<pf.GreenShift |
+				uint32(pf.scaleFromUint16(b, pf.BlueMax))<<pf.BlueShift
+			pf.putPixelValue(p, pixel)
+			p = p[pf.ByPP:]
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putPixelValue stores the pixel value in its bytes, the inverse of
+// pixelValue.
+func (pf *PixelFormat) putPixelValue(buffer []byte, pixel uint32) {
+	switch pf.ByPP {
+	case 1:
+		buffer[0] = uint8(pixel)
+	case 2:
+		pf.ByteOrder.PutUint16(buffer, uint16(pixel))
+	case 3:
+		if pf.ByteOrder == binary.BigEndian {
+			buffer[0], buffer[1], buffer[2] = uint8(pixel>>16), uint8(pixel>>8), uint8(pixel)
+		} else {
+			buffer[0], buffer[1], buffer[2] = uint8(pixel), uint8(pixel>>8), uint8(pixel>>16)
+		}
+	case 4:
+		pf.ByteOrder.PutUint32(buffer, pixel)
+	}
+}
+
+// pixelValue assembles the pixel value from its bytes.
+func (pf *PixelFormat) pixelValue(buffer []byte) (pixel uint32) {
+	switch pf.ByPP {
+	case 1:
+		pixel = uint32(buffer[0])
+	case 2:
+		pixel = uint32(pf.ByteOrder.Uint16(buffer))
+	case 3:
+		if pf.ByteOrder == binary.BigEndian {
+			pixel = uint32(buffer[0])<<16 | uint32(buffer[1])<<8 | uint32(buffer[2])
+		} else {
+			pixel = uint32(buffer[0]) | uint32(buffer[1])<<8 | uint32(buffer[2])<<16
+		}
+	case 4:
+		pixel = pf.ByteOrder.Uint32(buffer)
+	}
+	return
+}
+
+// scaleToUint8 scales a color component of a channel with the given
+// maximum to 8 bits, so that the maximum maps to 255. An unused channel,
+// with a maximum of 0, is always 0.
 func (pf *PixelFormat) scaleToUint8(num uint32, max uint16) uint8 {
+	if max == 0 {
+		return 0
+	}
 	return uint8(float64(num)*255/float64(max) + 0.5)
 }
 
+// scaleFromUint16 scales a 16-bit color component to a channel with the
+// given maximum.
+func (pf *PixelFormat) scaleFromUint16(num uint32, max uint16) uint16 {
+	return uint16(float64(num)*float64(max)/65535 + 0.5)
+}
+
 type Color struct {
 	R, G, B uint16
 }
 
 type ColorMap []Color
 
+// UpdateColorMap sets the entries starting at firstColor. It returns an
+// error if they don't all fit into the color map.
 func (cm ColorMap) UpdateColorMap(firstColor uint16, colors []Color) error {
-	if n := len(colors); copy(cm[int(firstColor):int(firstColor)+n], colors) != n {
-		return fmt.Errorf("error occurred while updating color map")
+	end := int(firstColor) + len(colors)
+	if end > len(cm) {
+		return fmt.Errorf("color map entries %d to %d exceed the color map size %d", firstColor, end-1, len(cm))
 	}
+	copy(cm[firstColor:end], colors)
 	return nil
 }
+
+// UpdateColorMap sets the entries of the color map starting at
+// firstColor, growing the color map if needed up to the number of pixel
+// values of the format, e.g. 65536 for 16 bits per pixel. Entries
+// beyond that are an error.
+func (pf *PixelFormat) UpdateColorMap(firstColor uint16, colors []Color) error {
+	end := int(firstColor) + len(colors)
+	if end > len(pf.ColorMap) && pf.BPP < 32 && end <= 1<<pf.BPP {
+		grown := make(ColorMap, end)
+		copy(grown, pf.ColorMap)
+		pf.ColorMap = grown
+	}
+	return pf.ColorMap.UpdateColorMap(firstColor, colors)
+}
@@ -0,0 +1,275 @@
+package vnc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPixelFormatValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*RFBPixelFormat)
+		wantErr bool
+	}{
+		{"RGB888", func(*RFBPixelFormat) {}, false},
+		{"RGB565", func(rpf *RFBPixelFormat) {
+			*rpf = RFBPixelFormat{BPP: 16, Depth: 16, TrueColor: 1,
+				RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 11, GreenShift: 5}
+		}, false},
+		{"BGR233", func(rpf *RFBPixelFormat) { *rpf = PixelFormatBGR233() }, false},
+		{"color map", func(rpf *RFBPixelFormat) { *rpf = RFBPixelFormat{BPP: 8, Depth: 8} }, false},
+		{"12 bits per pixel", func(rpf *RFBPixelFormat) { rpf.BPP = 12 }, true},
+		{"depth 0", func(rpf *RFBPixelFormat) { rpf.Depth = 0 }, true},
+		{"depth beyond the pixel", func(rpf *RFBPixelFormat) { rpf.Depth = 33 }, true},
+		{"maximum 0", func(rpf *RFBPixelFormat) { rpf.GreenMax = 0 }, true},
+		{"maximum not 2^n-1", func(rpf *RFBPixelFormat) { rpf.BlueMax = 200 }, true},
+		{"shift beyond the pixel", func(rpf *RFBPixelFormat) { rpf.RedShift = 32 }, true},
+		{"channel beyond the pixel", func(rpf *RFBPixelFormat) { rpf.RedShift = 28 }, true},
+		{"overlapping channels", func(rpf *RFBPixelFormat) { rpf.GreenShift = 4 }, true},
+	}
+	for _, tt := range tests {
+		rpf := PixelFormatRGB888()
+		tt.modify(&rpf)
+		if err := rpf.Validate(); tt.wantErr && err == nil {
+			t.Errorf("%s: no error", tt.name)
+		} else if !tt.wantErr && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestSetPixelFormatValidates(t *testing.T) {
+	c, tc := newTestClient(nil, nil)
+	rpf := PixelFormatRGB888()
+	rpf.BPP = 12
+	if err := c.SendMsg(&SetPixelFormatMsg{RFBPixelFormat: rpf}); err == nil {
+		t.Error("no error for an invalid pixel format")
+	}
+	if tc.out.Len() != 0 || c.pixelFormat.BPP != 32 {
+		t.Errorf("invalid pixel format sent or applied")
+	}
+}
+
+func TestPixelFormatMarshalBinary(t *testing.T) {
+	rpf := RFBPixelFormat{BPP: 16, Depth: 15, BigEndian: 1, TrueColor: 1,
+		RedMax: 31, GreenMax: 31, BlueMax: 0x1f, RedShift: 10, GreenShift: 5}
+	want := unhex("100f0101001f001f001f0a0500000000")
+
+	data, err := rpf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(data, want) {
+		t.Errorf("got %x, want %x", data, want)
+	}
+
+	var got RFBPixelFormat
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	} else if got != rpf {
+		t.Errorf("round trip gives %+v, want %+v", got, rpf)
+	}
+	if err := got.UnmarshalBinary(data[:15]); err == nil {
+		t.Error("no error for 15 bytes")
+	}
+}
+
+func TestReadPixels(t *testing.T) {
+	bgr233 := PixelFormatBGR233()
+	rgb565be := RFBPixelFormat{BPP: 16, Depth: 16, BigEndian: 1, TrueColor: 1,
+		RedMax: 31, GreenMax: 63, BlueMax: 31, RedShift: 11, GreenShift: 5}
+	rgb24 := RFBPixelFormat{BPP: 24, Depth: 24, TrueColor: 1,
+		RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 16, GreenShift: 8}
+	rgbaBE := RFBPixelFormat{BPP: 32, Depth: 24, BigEndian: 1, TrueColor: 1,
+		RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 24, GreenShift: 16, BlueShift: 8}
+	rgbaColorMap := PixelFormatRGBA8888()
+	rgbaColorMap.TrueColor = 0
+	tests := []struct {
+		name string
+		rpf  RFBPixelFormat
+		data []byte
+		want []byte
+	}{
+		{"RGB888", PixelFormatRGB888(), []byte{3, 2, 1, 0, 0xff, 0, 0x80, 0}, []byte{1, 2, 3, 255, 0x80, 0, 0xff, 255}},
+		{"RGBA8888", PixelFormatRGBA8888(), []byte{1, 2, 3, 0, 4, 5, 6, 7}, []byte{1, 2, 3, 255, 4, 5, 6, 255}},
+		{"RGBA8888 big-endian", rgbaBE, []byte{1, 2, 3, 0, 4, 5, 6, 7}, []byte{1, 2, 3, 255, 4, 5, 6, 255}},
+		{"RGBA8888 without true color", rgbaColorMap, []byte{1, 0, 0, 0}, []byte{0, 0, 0, 255}},
+		{"BGR233", bgr233, []byte{0x07, 0x38, 0xc0, 0x49}, []byte{
+			255, 0, 0, 255,
+			0, 255, 0, 255,
+			0, 0, 255, 255,
+			36, 36, 85, 255}},
+		{"RGB565 big-endian", rgb565be, []byte{0xf8, 0x00, 0x07, 0xe0, 0x00, 0x1f}, []byte{
+			255, 0, 0, 255,
+			0, 255, 0, 255,
+			0, 0, 255, 255}},
+		{"24 bits per pixel", rgb24, []byte{3, 2, 1}, []byte{1, 2, 3, 255}},
+	}
+	for _, tt := range tests {
+		rpf := tt.rpf
+		pf := NewPixelFormat(&rpf)
+		n := len(tt.data) / int(pf.ByPP)
+		got, err := pf.ReadPixels(bytes.NewReader(tt.data), n)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+
+		// decoding into a buffer reuses it
+		dst := make([]byte, 4*n, 4*n+4)
+		got, err = pf.ReadPixelsInto(bytes.NewReader(tt.data), n, dst)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if &got[0] != &dst[0] || !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got %v in another buffer", tt.name, got)
+		}
+	}
+
+	rpf := PixelFormatRGB888()
+	rpf.BPP = 40
+	if _, err := NewPixelFormat(&rpf).ReadPixels(bytes.NewReader(make([]byte, 10)), 2); err == nil {
+		t.Error("no error for 5 bytes per pixel")
+	}
+}
+
+func TestReadPixelsIntoAllocs(t *testing.T) {
+	rpf := PixelFormatRGB888()
+	pf := NewPixelFormat(&rpf)
+	data := make([]byte, 64*64*4)
+	dst := make([]byte, len(data))
+	r := bytes.NewReader(data)
+	allocs := testing.AllocsPerRun(10, func() {
+		r.Reset(data)
+		if _, err := pf.ReadPixelsInto(r, 64*64, dst); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("got %v allocations per call, want 0", allocs)
+	}
+}
+
+func TestScaleToUint8(t *testing.T) {
+	tests := []struct {
+		num  uint32
+		max  uint16
+		want uint8
+	}{
+		{0, 0, 0},
+		{0, 1, 0},
+		{1, 1, 255},
+		{3, 7, 109},
+		{7, 7, 255},
+		{2, 3, 170},
+		{16, 31, 132},
+		{128, 255, 128},
+		{32768, 65535, 128},
+		{65535, 65535, 255},
+	}
+	var pf PixelFormat
+	for _, tt := range tests {
+		if got := pf.scaleToUint8(tt.num, tt.max); got != tt.want {
+			t.Errorf("scaleToUint8(%d, %d) = %d, want %d", tt.num, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateColorMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		bpp     uint8
+		first   uint16
+		count   int
+		size    int // of the color map afterwards
+		wantErr bool
+	}{
+		{"within 256 entries", 8, 250, 6, 256, false},
+		{"beyond 8 bits per pixel", 8, 250, 7, 256, true},
+		{"grown for 16 bits per pixel", 16, 1000, 24, 1024, false},
+		{"grown to 65536 entries", 16, 65535, 1, 65536, false},
+		{"beyond 16 bits per pixel", 16, 65535, 2, 256, true},
+		{"not grown for 32 bits per pixel", 32, 256, 1, 256, true},
+	}
+	for _, tt := range tests {
+		rpf := RFBPixelFormat{BPP: tt.bpp, Depth: tt.bpp}
+		pf := NewPixelFormat(&rpf)
+		colors := make([]Color, tt.count)
+		colors[tt.count-1] = Color{1, 2, 3}
+
+		err := pf.UpdateColorMap(tt.first, colors)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if last := int(tt.first) + tt.count - 1; pf.ColorMap[last] != colors[tt.count-1] {
+			t.Errorf("%s: entry %d not set", tt.name, last)
+		}
+		if len(pf.ColorMap) != tt.size {
+			t.Errorf("%s: color map of %d entries, want %d", tt.name, len(pf.ColorMap), tt.size)
+		}
+	}
+}
+
+func TestReadPixelsColorMap(t *testing.T) {
+	rpf := RFBPixelFormat{BPP: 16, Depth: 16}
+	pf := NewPixelFormat(&rpf)
+	pf.ColorMap[255] = Color{65535, 0, 0}
+
+	got, err := pf.ReadPixels(bytes.NewReader([]byte{255, 0}), 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if want := []byte{255, 0, 0, 255}; !bytes.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// the color map has 256 entries
+	if _, err := pf.ReadPixels(bytes.NewReader([]byte{0, 1}), 1); err == nil {
+		t.Error("no error for a pixel beyond the color map")
+	}
+}
+
+// BenchmarkReadPixels compares a 1920x1080 Raw update in the RGBA8888
+// format, copied directly, with one in the RGB888 format, converted pixel
+// by pixel.
+func BenchmarkReadPixels(b *testing.B) {
+	const numPixels = 1920 * 1080
+	data := make([]byte, numPixels*4)
+	for _, f := range []struct {
+		name string
+		rpf  RFBPixelFormat
+	}{
+		{"RGBA8888", PixelFormatRGBA8888()},
+		{"RGB888", PixelFormatRGB888()},
+	} {
+		rpf := f.rpf
+		pf := NewPixelFormat(&rpf)
+		b.Run(f.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			r := bytes.NewReader(data)
+			for i := 0; i < b.N; i++ {
+				r.Reset(data)
+				if _, err := pf.ReadPixels(r, numPixels); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRawUpdate receives framebuffer updates of one 256x256 Raw
+// rectangle in the RGB888 format, reporting the allocations per update.
+func BenchmarkRawUpdate(b *testing.B) {
+	update := wire(FramebufferUpdateMID, uint8(0), uint16(1),
+		uint16(0), uint16(0), uint16(256), uint16(256), RawEncType, make([]byte, 256*256*4))
+	c, tc := newTestClient(nil, nil)
+	b.SetBytes(int64(len(update)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tc.in.Write(update)
+		if _, err := c.ReceiveMsg(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
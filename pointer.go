@@ -0,0 +1,110 @@
+package vnc
+
+import (
+	"sync"
+	"time"
+)
+
+// PointerThrottle sends pointer events to the server, coalescing rapid
+// motion so that at most one event is sent per interval. The last
+// position is always sent, at the end of the interval it was delayed
+// to, and button presses and releases are sent immediately, with the
+// latest position, so no transition is lost.
+//
+// Errors of delayed sends are returned by the next call.
+type PointerThrottle struct {
+	c        *ClientConn
+	interval time.Duration
+
+	mu      sync.Mutex
+	mask    uint8
+	x, y    uint16
+	pending bool      // whether a motion awaits sending
+	last    time.Time // when the last event was sent
+	timer   *time.Timer
+	err     error // error of a delayed send
+}
+
+// NewPointerThrottle returns a PointerThrottle sending pointer events on
+// the connection at most every interval, but for button changes.
+func (c *ClientConn) NewPointerThrottle(interval time.Duration) *PointerThrottle {
+	return &PointerThrottle{c: c, interval: interval}
+}
+
+// Move moves the pointer to x, y. If an event was sent less than the
+// interval ago, the motion is delayed, and replaced by later ones.
+func (t *PointerThrottle) Move(x, y uint16) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.x, t.y = x, y
+	if wait := t.interval - time.Since(t.last); wait > 0 {
+		t.pending = true
+		if t.timer == nil {
+			t.timer = time.AfterFunc(wait, t.sendPending)
+		}
+		return t.takeErr()
+	}
+	return t.send()
+}
+
+// Press presses the buttons set in the mask, bit 0 being the left
+// button, as in PointerEventMsg.
+func (t *PointerThrottle) Press(buttons uint8) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.mask |= buttons
+	return t.send()
+}
+
+// Release releases the buttons set in the mask.
+func (t *PointerThrottle) Release(buttons uint8) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.mask &^= buttons
+	return t.send()
+}
+
+// Flush sends a delayed motion immediately.
+func (t *PointerThrottle) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.pending {
+		return t.takeErr()
+	}
+	return t.send()
+}
+
+// sendPending sends a delayed motion when its interval has passed.
+func (t *PointerThrottle) sendPending() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timer = nil
+	if t.pending {
+		if err := t.send(); err != nil && t.err == nil {
+			t.err = err
+		}
+	}
+}
+
+// send sends the current state, including any delayed motion. It must
+// be called with mu held.
+func (t *PointerThrottle) send() error {
+	if err := t.takeErr(); err != nil {
+		return err
+	}
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+
+	t.pending = false
+	t.last = time.Now()
+	return t.c.SendMsg(&PointerEventMsg{ButtonMask: t.mask, X: t.x, Y: t.y})
+}
+
+func (t *PointerThrottle) takeErr() error {
+	err := t.err
+	t.err = nil
+	return err
+}
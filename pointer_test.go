@@ -0,0 +1,63 @@
+package vnc
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestPointerThrottle(t *testing.T) {
+	event := func(mask uint8, x, y uint16) []byte {
+		return wire(PointerEventMID, mask, x, y)
+	}
+	tests := []struct {
+		name  string
+		calls func(p *PointerThrottle) error
+		want  [][]byte
+	}{
+		{"first motion sent", func(p *PointerThrottle) error {
+			return p.Move(1, 2)
+		}, [][]byte{event(0, 1, 2)}},
+		{"motion coalesced", func(p *PointerThrottle) error {
+			p.Move(1, 2)
+			p.Move(3, 4)
+			p.Move(5, 6)
+			return p.Flush()
+		}, [][]byte{event(0, 1, 2), event(0, 5, 6)}},
+		{"nothing to flush", func(p *PointerThrottle) error {
+			p.Move(1, 2)
+			return p.Flush()
+		}, [][]byte{event(0, 1, 2)}},
+		{"buttons sent immediately", func(p *PointerThrottle) error {
+			p.Move(1, 2)
+			p.Move(3, 4)
+			p.Press(1)
+			p.Press(4)
+			return p.Release(1)
+		}, [][]byte{event(0, 1, 2), event(1, 3, 4), event(5, 3, 4), event(4, 3, 4)}},
+	}
+	for _, tt := range tests {
+		c, tc := newTestClient(nil, nil)
+		p := c.NewPointerThrottle(time.Hour)
+		if err := tt.calls(p); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if want := bytes.Join(tt.want, nil); !bytes.Equal(tc.out.Bytes(), want) {
+			t.Errorf("%s: sent %x, want %x", tt.name, tc.out.Bytes(), want)
+		}
+	}
+}
+
+func TestPointerThrottleDelayed(t *testing.T) {
+	c, tc := newTestClient(nil, nil)
+	p := c.NewPointerThrottle(10 * time.Millisecond)
+	p.Move(1, 2)
+	p.Move(3, 4)
+
+	time.Sleep(50 * time.Millisecond)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if want := wire(PointerEventMID, uint8(0), uint16(1), uint16(2), PointerEventMID, uint8(0), uint16(3), uint16(4)); !bytes.Equal(tc.out.Bytes(), want) {
+		t.Errorf("sent %x, want %x", tc.out.Bytes(), want)
+	}
+}
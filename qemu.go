@@ -0,0 +1,184 @@
+package vnc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Pseudo-encodings of the QEMU extensions.
+const (
+	QEMUExtendedKeyEventPseudoEncType = EncodingType(-258)
+	QEMUAudioPseudoEncType            = EncodingType(-259)
+)
+
+// QEMUMID is the message type shared by the QEMU client and server
+// messages, which are distinguished by a submessage type.
+const QEMUMID MessageID = 255
+
+// QEMU client submessage types.
+const (
+	qemuExtendedKeyEventSubMID = 0
+	qemuAudioSubMID            = 1
+)
+
+// QEMUExtendedKeyEventPseudoEncoding announces support for
+// QEMUKeyEventMsg. The server confirms it by sending an empty rectangle
+// with this encoding.
+type QEMUExtendedKeyEventPseudoEncoding struct{}
+
+func (*QEMUExtendedKeyEventPseudoEncoding) Type() EncodingType {
+	return QEMUExtendedKeyEventPseudoEncType
+}
+
+func (*QEMUExtendedKeyEventPseudoEncoding) Read(*ClientConn, *Rectangle) (Encoding, error) {
+	return new(QEMUExtendedKeyEventPseudoEncoding), nil
+}
+
+// QEMUKeyEventMsg is a key event carrying the PC keyboard scancode of
+// the key along with its keysym, so the server doesn't need to map the
+// keysym back to a key. Extended scancodes, prefixed with 0xe0, are
+// sent as 0xe000 | code.
+type QEMUKeyEventMsg struct {
+	DownFlag uint16
+	Key      uint32 // keysym
+	KeyCode  uint32 // scancode
+}
+
+func (m *QEMUKeyEventMsg) Send(c *ClientConn) error {
+	return writeFixedSize(c.w, struct {
+		ID    MessageID
+		SubID uint8
+		QEMUKeyEventMsg
+	}{QEMUMID, qemuExtendedKeyEventSubMID, *m})
+}
+
+// QEMU audio sample formats.
+const (
+	QEMUAudioU8 = iota
+	QEMUAudioS8
+	QEMUAudioU16
+	QEMUAudioS16
+	QEMUAudioU32
+	QEMUAudioS32
+)
+
+// QEMU audio client operations.
+const (
+	QEMUAudioEnable = iota
+	QEMUAudioDisable
+	QEMUAudioSetFormat
+)
+
+// QEMU audio server operations.
+const (
+	QEMUAudioEnd = iota
+	QEMUAudioBegin
+	QEMUAudioData
+)
+
+// QEMUAudioFormat describes the PCM samples streamed by the server.
+type QEMUAudioFormat struct {
+	SampleFormat uint8
+	Channels     uint8
+	Frequency    uint32
+}
+
+// QEMUAudioPseudoEncoding announces support for the QEMU audio
+// messages. The server confirms it by sending an empty rectangle with
+// this encoding.
+type QEMUAudioPseudoEncoding struct{}
+
+func (*QEMUAudioPseudoEncoding) Type() EncodingType {
+	return QEMUAudioPseudoEncType
+}
+
+func (*QEMUAudioPseudoEncoding) Read(*ClientConn, *Rectangle) (Encoding, error) {
+	return new(QEMUAudioPseudoEncoding), nil
+}
+
+// QEMUAudioClientMsg enables or disables the audio stream, or sets its
+// sample format. Format is only sent with QEMUAudioSetFormat.
+type QEMUAudioClientMsg struct {
+	Operation uint16
+	Format    QEMUAudioFormat
+}
+
+func (m *QEMUAudioClientMsg) Send(c *ClientConn) error {
+	header := struct {
+		ID        MessageID
+		SubID     uint8
+		Operation uint16
+	}{QEMUMID, qemuAudioSubMID, m.Operation}
+
+	switch m.Operation {
+	case QEMUAudioEnable, QEMUAudioDisable:
+		return writeFixedSize(c.w, header)
+	case QEMUAudioSetFormat:
+		if m.Format.SampleFormat > QEMUAudioS32 {
+			return fmt.Errorf("invalid QEMU audio sample format: %d", m.Format.SampleFormat)
+		}
+		buf := new(bytes.Buffer)
+		if err := writeFixedSize(buf, header); err != nil {
+			return err
+		} else if err = writeFixedSize(buf, m.Format); err != nil {
+			return err
+		} else if _, err = c.w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		c.qemuAudioFormat = m.Format
+		return nil
+	}
+	return fmt.Errorf("invalid QEMU audio operation: %d", m.Operation)
+}
+
+// QEMUAudioMsg is an audio stream message from the server. To receive
+// it, add it to ClientConnConfig.ServerMessages.
+type QEMUAudioMsg struct {
+	Operation uint16
+
+	// Format is the sample format last set by the client, which the
+	// samples of a QEMUAudioData message are in.
+	Format QEMUAudioFormat
+
+	// Data holds the PCM samples of a QEMUAudioData message.
+	Data []byte
+}
+
+func (*QEMUAudioMsg) ID() MessageID {
+	return QEMUMID
+}
+
+func (*QEMUAudioMsg) Receive(c *ClientConn) (ServerMessage, error) {
+	var subID uint8
+	if err := readFixedSize(c.r, &subID); err != nil {
+		return nil, err
+	} else if subID != qemuAudioSubMID {
+		return nil, fmt.Errorf("unsupported QEMU server message %d", subID)
+	}
+
+	msg := &QEMUAudioMsg{Format: c.qemuAudioFormat}
+	if err := readFixedSize(c.r, &msg.Operation); err != nil {
+		return nil, err
+	}
+
+	switch msg.Operation {
+	case QEMUAudioEnd, QEMUAudioBegin:
+	case QEMUAudioData:
+		var length uint32
+		if err := readFixedSize(c.r, &length); err != nil {
+			return nil, err
+		}
+		if err := c.checkMessageSize(int64(length)); err != nil {
+			return nil, err
+		}
+		msg.Data = make([]byte, length)
+		if _, err := io.ReadFull(c.r, msg.Data); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid QEMU audio operation: %d", msg.Operation)
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,71 @@
+package vnc
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestQEMUClientMsgs(t *testing.T) {
+	format := QEMUAudioFormat{SampleFormat: QEMUAudioS16, Channels: 2, Frequency: 44100}
+	tests := []struct {
+		name    string
+		msg     ClientMessage
+		want    []byte
+		wantErr bool
+	}{
+		{"key event", &QEMUKeyEventMsg{DownFlag: 1, Key: 'a', KeyCode: 0x1e},
+			wire(QEMUMID, uint8(0), uint16(1), uint32('a'), uint32(0x1e)), false},
+		{"extended key", &QEMUKeyEventMsg{Key: 0xff52, KeyCode: 0xe048},
+			wire(QEMUMID, uint8(0), uint16(0), uint32(0xff52), uint32(0xe048)), false},
+		{"audio enable", &QEMUAudioClientMsg{Operation: QEMUAudioEnable},
+			wire(QEMUMID, uint8(1), uint16(QEMUAudioEnable)), false},
+		{"audio format", &QEMUAudioClientMsg{Operation: QEMUAudioSetFormat, Format: format},
+			wire(QEMUMID, uint8(1), uint16(QEMUAudioSetFormat), uint8(QEMUAudioS16), uint8(2), uint32(44100)), false},
+		{"invalid sample format", &QEMUAudioClientMsg{Operation: QEMUAudioSetFormat, Format: QEMUAudioFormat{SampleFormat: 6}}, nil, true},
+		{"invalid operation", &QEMUAudioClientMsg{Operation: 3}, nil, true},
+	}
+	for _, tt := range tests {
+		c, tc := newTestClient(nil, nil)
+		err := c.SendMsg(tt.msg)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+		} else if err != nil || !bytes.Equal(tc.out.Bytes(), tt.want) {
+			t.Errorf("%s: sent %v, %v, want %v", tt.name, tc.out.Bytes(), err, tt.want)
+		}
+	}
+}
+
+func TestQEMUAudioMsg(t *testing.T) {
+	format := QEMUAudioFormat{SampleFormat: QEMUAudioU8, Channels: 1, Frequency: 8000}
+	cfg := &ClientConnConfig{MaxMessageSize: 16, ServerMessages: map[MessageID]ServerMessage{QEMUMID: new(QEMUAudioMsg)}}
+	c, _ := newTestClient(cfg, wire(
+		QEMUMID, uint8(1), uint16(QEMUAudioBegin),
+		QEMUMID, uint8(1), uint16(QEMUAudioData), uint32(3), []byte{1, 2, 3},
+		QEMUMID, uint8(1), uint16(QEMUAudioEnd),
+		QEMUMID, uint8(1), uint16(QEMUAudioData), uint32(0xffffffff)))
+	if err := c.SendMsg(&QEMUAudioClientMsg{Operation: QEMUAudioSetFormat, Format: format}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, op := range []uint16{QEMUAudioBegin, QEMUAudioData, QEMUAudioEnd} {
+		msg, err := c.ReceiveMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		audio := msg.(*QEMUAudioMsg)
+		if audio.Operation != op || audio.Format != format {
+			t.Errorf("got %+v, want operation %d", audio, op)
+		}
+		if op == QEMUAudioData && !bytes.Equal(audio.Data, []byte{1, 2, 3}) {
+			t.Errorf("got samples %v", audio.Data)
+		}
+	}
+
+	var sizeErr *MessageSizeError
+	if _, err := c.ReceiveMsg(); !errors.As(err, &sizeErr) {
+		t.Errorf("got %v for 4 GiB of samples, want a MessageSizeError", err)
+	}
+}
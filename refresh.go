@@ -0,0 +1,90 @@
+package vnc
+
+import "context"
+
+// StartAutoRefresh requests an update of the whole framebuffer, then
+// keeps the screen updating by requesting another update every time one
+// has been received, until the context is done. The updates themselves
+// must be read by a receive loop, such as Listen, running alongside.
+//
+// Each request is sent once the update before it has been fully read,
+// before ReceiveMsg returns it, so callbacks may still be processing
+// that update when the next one arrives. Calling StartAutoRefresh before
+// starting the receive loop is fine: the first update is not missed.
+//
+// Only the error of the first request is returned; a later failure
+// stops the refreshing and surfaces as an error of the receive loop.
+func (c *ClientConn) StartAutoRefresh(ctx context.Context, incremental bool) error {
+	updates := make(chan updateSize, 1)
+	c.refreshMu.Lock()
+	c.refreshChans = append(c.refreshChans, updates)
+	c.refreshMu.Unlock()
+
+	size := updateSize{c.FrameBufferWidth, c.FrameBufferHeight}
+	if err := c.requestUpdate(size, false); err != nil {
+		c.stopRefresh(updates)
+		return err
+	}
+
+	go func() {
+		defer c.stopRefresh(updates)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case size := <-updates:
+				if err := c.requestUpdate(size, incremental); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// updateSize is the framebuffer size after an update, passed from the
+// receive loop so the refresh goroutine doesn't read it concurrently.
+type updateSize struct {
+	width, height uint16
+}
+
+func (c *ClientConn) requestUpdate(size updateSize, incremental bool) error {
+	msg := &FramebufferUpdateRequestMsg{Width: size.width, Height: size.height}
+	if incremental {
+		msg.Incremental = 1
+	}
+	if err := c.SendMsg(msg); err != nil {
+		return err
+	}
+
+	// the request is waited on, so it can't stay batched
+	return c.Flush()
+}
+
+// notifyRefresh tells the auto-refresh goroutines that an update has
+// been received. A pending notification is replaced, so requests don't
+// pile up behind a slow connection.
+func (c *ClientConn) notifyRefresh() {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
+	size := updateSize{c.FrameBufferWidth, c.FrameBufferHeight}
+	for _, ch := range c.refreshChans {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- size
+	}
+}
+
+func (c *ClientConn) stopRefresh(updates chan updateSize) {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+	for i, ch := range c.refreshChans {
+		if ch == updates {
+			c.refreshChans = append(c.refreshChans[:i], c.refreshChans[i+1:]...)
+			return
+		}
+	}
+}
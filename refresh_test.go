@@ -0,0 +1,65 @@
+package vnc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestStartAutoRefresh(t *testing.T) {
+	c, server := newPipeClient(t)
+	c.FrameBufferWidth, c.FrameBufferHeight = 4, 2
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	request := func(incremental uint8, w, h uint16) []byte {
+		return wire(FramebufferUpdateRequestMID, incremental, uint16(0), uint16(0), w, h)
+	}
+	readRequest := func(want []byte) {
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(server, got); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(got, want) {
+			t.Fatalf("got request %x, want %x", got, want)
+		}
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- c.StartAutoRefresh(ctx, true) }()
+	readRequest(request(0, 4, 2))
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	// each update is followed by an incremental request, of the new size
+	// after a resize
+	updates := []struct {
+		data []byte
+		want []byte
+	}{
+		{wire(FramebufferUpdateMID, uint8(0), uint16(0)), request(1, 4, 2)},
+		{wire(FramebufferUpdateMID, uint8(0), uint16(1), [4]uint16{0, 0, 6, 3}, DesktopSizePseudoEncType), request(1, 6, 3)},
+	}
+	c.encodingMap[DesktopSizePseudoEncType] = &DesktopSizePseudoEncoding{}
+	for _, u := range updates {
+		go server.Write(u.data)
+		if _, err := c.ReceiveMsg(); err != nil {
+			t.Fatal(err)
+		}
+		readRequest(u.want)
+	}
+
+	cancel()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		c.refreshMu.Lock()
+		n := len(c.refreshChans)
+		c.refreshMu.Unlock()
+		if n == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("refreshing not stopped")
+		}
+	}
+}
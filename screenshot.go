@@ -0,0 +1,116 @@
+package vnc
+
+import (
+	"context"
+	"image"
+	"time"
+)
+
+// Screenshot connects to the server at cfg.Address, captures the whole
+// screen and returns it encoded as PNG. It reads framebuffer updates
+// until every pixel of the screen has been received, which takes more
+// than one update with servers that split the first one. The context
+// bounds the whole capture.
+func Screenshot(ctx context.Context, cfg *ClientConnConfig) ([]byte, error) {
+	if cfg.ServerMessages == nil {
+		cfg.ServerMessages = make(map[MessageID]ServerMessage)
+	}
+	c, err := NewClientConnContext(ctx, cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if err := c.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+
+	png, err := c.screenshot(ctx)
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		return nil, ctxErr
+	}
+	return png, err
+}
+
+func (c *ClientConn) screenshot(ctx context.Context) ([]byte, error) {
+	// unblock pending I/O by moving the deadline to the past
+	nc := c.c
+	stop := onDone(ctx, func() { nc.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	if err := c.setupSession(); err != nil {
+		return nil, err
+	}
+
+	fb := NewFramebuffer(int(c.FrameBufferWidth), int(c.FrameBufferHeight))
+	missing := newCoverage(fb.Image().Bounds())
+	for !missing.complete() {
+		msg, err := c.ReceiveMsg()
+		if err != nil {
+			return nil, err
+		}
+		update, ok := msg.(*FramebufferUpdateMsg)
+		if !ok {
+			continue
+		}
+		if err := fb.Apply(update); err != nil {
+			return nil, err
+		}
+
+		resized := false
+		for i := range update.Rectangles {
+			rect := &update.Rectangles[i]
+			switch t := rect.Type(); {
+			case t == DesktopSizePseudoEncType || t == ExtendedDesktopSizePseudoEncType:
+				missing = newCoverage(fb.Image().Bounds())
+				resized = true
+			case !isPseudoEncoding(rect.Encoding):
+				missing.add(image.Rect(int(rect.X), int(rect.Y),
+					int(rect.X)+int(rect.Width), int(rect.Y)+int(rect.Height)))
+			}
+		}
+
+		// the content after a resize may not follow without asking
+		if resized || !missing.complete() {
+			if err := c.RequestFramebufferUpdate(false); err != nil {
+				return nil, err
+			} else if err := c.Flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return fb.PNG()
+}
+
+// coverage tracks which pixels of an area have been received.
+type coverage struct {
+	bounds    image.Rectangle
+	received  []bool
+	remaining int
+}
+
+func newCoverage(bounds image.Rectangle) *coverage {
+	return &coverage{
+		bounds:    bounds,
+		received:  make([]bool, bounds.Dx()*bounds.Dy()),
+		remaining: bounds.Dx() * bounds.Dy(),
+	}
+}
+
+func (cv *coverage) add(r image.Rectangle) {
+	r = r.Intersect(cv.bounds)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := cv.received[(y-cv.bounds.Min.Y)*cv.bounds.Dx():]
+		for x := r.Min.X - cv.bounds.Min.X; x < r.Max.X-cv.bounds.Min.X; x++ {
+			if !row[x] {
+				row[x] = true
+				cv.remaining--
+			}
+		}
+	}
+}
+
+func (cv *coverage) complete() bool {
+	return cv.remaining == 0
+}
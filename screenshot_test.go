@@ -0,0 +1,85 @@
+package vnc
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestCoverage(t *testing.T) {
+	tests := []struct {
+		name     string
+		rects    []image.Rectangle
+		complete bool
+	}{
+		{"nothing", nil, false},
+		{"whole", []image.Rectangle{image.Rect(0, 0, 4, 3)}, true},
+		{"beyond the bounds", []image.Rectangle{image.Rect(-2, -2, 10, 10)}, true},
+		{"halves", []image.Rectangle{image.Rect(0, 0, 4, 2), image.Rect(0, 1, 4, 3)}, true},
+		{"overlapping, one pixel missing", []image.Rectangle{
+			image.Rect(0, 0, 4, 2), image.Rect(0, 0, 4, 2), image.Rect(1, 2, 4, 3)}, false},
+	}
+	for _, tt := range tests {
+		cv := newCoverage(image.Rect(0, 0, 4, 3))
+		for _, r := range tt.rects {
+			cv.add(r)
+		}
+		if cv.complete() != tt.complete {
+			t.Errorf("%s: complete %v, %d pixels remaining", tt.name, cv.complete(), cv.remaining)
+		}
+	}
+}
+
+func TestScreenshot(t *testing.T) {
+	red, blue := []byte{255, 0, 0, 0}, []byte{0, 0, 255, 0}
+	tests := []struct {
+		name     string
+		updates  []byte
+		requests int // update requests after the first
+		width    int
+	}{
+		{"one update", wire(FramebufferUpdateMID, uint8(0), uint16(1),
+			[4]uint16{0, 0, 4, 2}, RawEncType, pixels(4, red), pixels(4, blue)), 0, 4},
+		{"split update", wire(
+			FramebufferUpdateMID, uint8(0), uint16(1), [4]uint16{0, 0, 4, 1}, RawEncType, pixels(4, red),
+			BellMID,
+			FramebufferUpdateMID, uint8(0), uint16(1), [4]uint16{0, 1, 4, 1}, RawEncType, pixels(4, blue)), 1, 4},
+		{"resized", wire(
+			FramebufferUpdateMID, uint8(0), uint16(2),
+			[4]uint16{0, 0, 4, 1}, RawEncType, pixels(4, red),
+			[4]uint16{0, 0, 2, 2}, DesktopSizePseudoEncType,
+			FramebufferUpdateMID, uint8(0), uint16(1), [4]uint16{0, 0, 2, 2}, RawEncType, pixels(2, red), pixels(2, blue)), 1, 2},
+	}
+	for _, tt := range tests {
+		c, tc := newTestClient(nil, tt.updates)
+		c.FrameBufferWidth, c.FrameBufferHeight = 4, 2
+
+		data, err := c.screenshot(context.Background())
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if img.Bounds().Dx() != tt.width || img.Bounds().Dy() != 2 {
+			t.Errorf("%s: got a %v screenshot", tt.name, img.Bounds())
+		}
+		if r, _, b, _ := img.At(0, 1).RGBA(); r != 0 || b != 0xffff {
+			t.Errorf("%s: bottom left pixel %v, want blue", tt.name, img.At(0, 1))
+		}
+		if !consumed(c, tc) {
+			t.Errorf("%s: data left unread", tt.name)
+		}
+
+		// the requests follow SetPixelFormat and SetEncodings
+		request := wire(FramebufferUpdateRequestMID, uint8(0))
+		if got := bytes.Count(tc.out.Bytes(), request) - 1; got != tt.requests {
+			t.Errorf("%s: %d more update requests, want %d", tt.name, got, tt.requests)
+		}
+	}
+}
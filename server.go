@@ -0,0 +1,473 @@
+package vnc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"image"
+	"io"
+	"net"
+	"sync"
+	"unicode"
+)
+
+// A ServerAuth implements the server side of an authentication scheme.
+type ServerAuth interface {
+	// Type returns the security type sent to the client.
+	Type() SecurityType
+
+	// Handshake is called to authenticate the client, as part of the
+	// general RFB handshake. A non-nil error fails the security
+	// handshake.
+	Handshake(*ServerConn) error
+}
+
+// NoneServerAuth is the server side of the "none" authentication.
+type NoneServerAuth struct{}
+
+func (*NoneServerAuth) Type() SecurityType {
+	return NoneSecType
+}
+
+func (*NoneServerAuth) Handshake(*ServerConn) error {
+	return nil
+}
+
+// VNCServerAuth is the server side of VNC authentication.
+type VNCServerAuth struct {
+	Password string
+}
+
+func (*VNCServerAuth) Type() SecurityType {
+	return VNCSecType
+}
+
+func (a *VNCServerAuth) Handshake(s *ServerConn) error {
+	challenge := make([]byte, 16)
+	if _, err := rand.Read(challenge); err != nil {
+		return err
+	}
+	if _, err := s.c.Write(challenge); err != nil {
+		return err
+	}
+
+	response := make([]byte, 16)
+	if _, err := io.ReadFull(s.r, response); err != nil {
+		return err
+	}
+
+	expected, err := (&VNCAuth{}).encrypt(a.Password, challenge)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(response, expected) != 1 {
+		return fmt.Errorf("Authentication failed.")
+	}
+	return nil
+}
+
+// A ServerConnConfig structure is used to configure a ServerConn.
+type ServerConnConfig struct {
+	// A slice of ServerAuth methods offered to the client, in order of
+	// preference. Protocol version 3.3 clients get the first one. If
+	// empty, no authentication is required.
+	Auth []ServerAuth
+
+	// Size of the framebuffer announced in ServerInit.
+	FrameBufferWidth  uint16
+	FrameBufferHeight uint16
+
+	// Pixel format announced in ServerInit. If BPP is zero,
+	// PixelFormatRGB888 is used.
+	PixelFormat RFBPixelFormat
+
+	// Name of the desktop announced in ServerInit.
+	DesktopName string
+
+	// MaxMessageSize limits the length the client may declare for cut
+	// text, so a hostile client can't make the server allocate huge
+	// buffers. If 0, DefaultMaxMessageSize is used.
+	MaxMessageSize uint32
+}
+
+// ServerConn is the server side of an RFB connection.
+type ServerConn struct {
+	c               net.Conn
+	r               *bufio.Reader
+	config          *ServerConnConfig
+	protocolVersion string
+	sendMu          sync.Mutex // serializes the Send methods and pixel format changes
+
+	// The pixel format requested by the client, which framebuffer
+	// updates are sent in.
+	pixelFormat *PixelFormat
+
+	// The encodings requested by the client, in order of preference.
+	encodings []EncodingType
+
+	// Shared reports whether the client asked to share the desktop
+	// with other clients, sent in ClientInit.
+	Shared bool
+}
+
+func NewServerConn(cfg *ServerConnConfig, c net.Conn) *ServerConn {
+	if len(cfg.Auth) == 0 {
+		cfg.Auth = []ServerAuth{&NoneServerAuth{}}
+	}
+	if cfg.PixelFormat.BPP == 0 {
+		cfg.PixelFormat = PixelFormatRGB888()
+	}
+
+	rpf := cfg.PixelFormat
+	return &ServerConn{
+		c:           c,
+		r:           bufio.NewReader(c),
+		config:      cfg,
+		pixelFormat: NewPixelFormat(&rpf),
+	}
+}
+
+func (s *ServerConn) Close() error {
+	return s.c.Close()
+}
+
+// PixelFormat returns the pixel format requested by the client.
+func (s *ServerConn) PixelFormat() *PixelFormat {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	return s.pixelFormat
+}
+
+// Encodings returns the encodings requested by the client.
+func (s *ServerConn) Encodings() []EncodingType {
+	return s.encodings
+}
+
+// Handshake performs the server side of the RFB handshake.
+func (s *ServerConn) Handshake() error {
+	if err := s.hsProtocolVersion(); err != nil {
+		return err
+	}
+	if err := s.hsSecurity(); err != nil {
+		return err
+	}
+	return s.hsInit()
+}
+
+func (s *ServerConn) hsProtocolVersion() error {
+	if _, err := s.c.Write([]byte(ProtocolVersion3_8)); err != nil {
+		return err
+	}
+
+	pvBuf := make([]byte, 12)
+	if _, err := io.ReadFull(s.r, pvBuf); err != nil {
+		return err
+	}
+
+	var major, minor int
+	if n, err := fmt.Sscanf(string(pvBuf), "RFB %d.%d\n", &major, &minor); err != nil || n != 2 {
+		return fmt.Errorf("%w Invalid format %q.", ErrUnsupportedProtocolVersion, pvBuf)
+	} else if major != 3 || minor < 3 {
+		return fmt.Errorf("%w %q", ErrUnsupportedProtocolVersion, pvBuf)
+	}
+
+	if minor < 7 {
+		s.protocolVersion = ProtocolVersion3_3
+	} else if minor == 7 {
+		s.protocolVersion = ProtocolVersion3_7
+	} else {
+		s.protocolVersion = ProtocolVersion3_8
+	}
+	return nil
+}
+
+func (s *ServerConn) hsSecurity() error {
+	var auth ServerAuth
+
+	if s.protocolVersion >= ProtocolVersion3_7 {
+		secTypes := make([]SecurityType, len(s.config.Auth))
+		for i, a := range s.config.Auth {
+			secTypes[i] = a.Type()
+		}
+		buf := new(bytes.Buffer)
+		if err := writeFixedSize(buf, uint8(len(secTypes))); err != nil {
+			return err
+		} else if err = writeFixedSize(buf, secTypes); err != nil {
+			return err
+		} else if _, err = s.c.Write(buf.Bytes()); err != nil {
+			return err
+		}
+
+		var secType SecurityType
+		if err := readFixedSize(s.r, &secType); err != nil {
+			return err
+		}
+		for _, a := range s.config.Auth {
+			if a.Type() == secType {
+				auth = a
+				break
+			}
+		}
+		if auth == nil {
+			return s.hsSecurityResult(fmt.Errorf("Unsupported security type %d.", secType))
+		}
+
+	} else { // v3.3
+		auth = s.config.Auth[0]
+		if err := writeFixedSize(s.c, uint32(auth.Type())); err != nil {
+			return err
+		}
+	}
+
+	err := auth.Handshake(s)
+	if auth.Type() == NoneSecType && s.protocolVersion < ProtocolVersion3_8 {
+		return err
+	}
+	return s.hsSecurityResult(err)
+}
+
+// hsSecurityResult sends the SecurityResult for the outcome of the
+// authentication, and returns authErr.
+func (s *ServerConn) hsSecurityResult(authErr error) error {
+	if authErr == nil {
+		return writeFixedSize(s.c, uint32(0))
+	}
+
+	buf := new(bytes.Buffer)
+	writeFixedSize(buf, uint32(1))
+	if s.protocolVersion >= ProtocolVersion3_8 {
+		reason := authErr.Error()
+		writeFixedSize(buf, uint32(len(reason)))
+		buf.WriteString(reason)
+	}
+	if _, err := s.c.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return authErr
+}
+
+func (s *ServerConn) hsInit() error {
+	// 7.3.1 ClientInit
+	var sharedFlag uint8
+	if err := readFixedSize(s.r, &sharedFlag); err != nil {
+		return err
+	}
+	s.Shared = sharedFlag != 0
+
+	// 7.3.2 ServerInit
+	buf := new(bytes.Buffer)
+	writeFixedSize(buf, s.config.FrameBufferWidth)
+	writeFixedSize(buf, s.config.FrameBufferHeight)
+	pf, _ := s.config.PixelFormat.MarshalBinary()
+	buf.Write(pf)
+	writeFixedSize(buf, uint32(len(s.config.DesktopName)))
+	buf.WriteString(s.config.DesktopName)
+
+	_, err := s.c.Write(buf.Bytes())
+	return err
+}
+
+// ReceiveMsg reads the next message sent by the client. It returns one
+// of *SetPixelFormatMsg, *SetEncodingsMsg, *FramebufferUpdateRequestMsg,
+// *KeyEventMsg, *PointerEventMsg, *ClientCutTextMsg or
+// *ExtendedClientCutTextMsg. The Encodings of a SetEncodingsMsg only
+// hold the encodings implemented by this package or registered with
+// RegisterEncoding; all requested types are available through Encodings.
+func (s *ServerConn) ReceiveMsg() (ClientMessage, error) {
+	var mid MessageID
+	if err := readFixedSize(s.r, &mid); err != nil {
+		return nil, err
+	}
+
+	switch mid {
+	case SetPixelFormatMID:
+		padding := make([]byte, 3)
+		if _, err := io.ReadFull(s.r, padding); err != nil {
+			return nil, err
+		}
+		rpf, err := readRFBPixelFormat(s.r)
+		if err != nil {
+			return nil, err
+		}
+		if err := rpf.Validate(); err != nil {
+			return nil, err
+		}
+		msg := &SetPixelFormatMsg{ID: mid, RFBPixelFormat: *rpf}
+		pf := NewPixelFormat(rpf)
+		s.sendMu.Lock()
+		s.pixelFormat = pf
+		s.sendMu.Unlock()
+		return msg, nil
+
+	case SetEncodingsMID:
+		var header struct {
+			_            uint8 // padding
+			NumEncodings uint16
+		}
+		if err := readFixedSize(s.r, &header); err != nil {
+			return nil, err
+		}
+		encTypes := make([]EncodingType, header.NumEncodings)
+		if err := readFixedSize(s.r, encTypes); err != nil {
+			return nil, err
+		}
+		s.encodings = encTypes
+
+		msg := &SetEncodingsMsg{ID: mid}
+		for _, t := range encTypes {
+			if enc := builtinEncoding(t); enc != nil {
+				msg.Encodings = append(msg.Encodings, enc)
+			}
+		}
+		return msg, nil
+
+	case FramebufferUpdateRequestMID:
+		msg := &FramebufferUpdateRequestMsg{ID: mid}
+		for _, v := range []interface{}{&msg.Incremental, &msg.X, &msg.Y, &msg.Width, &msg.Height} {
+			if err := readFixedSize(s.r, v); err != nil {
+				return nil, err
+			}
+		}
+		return msg, nil
+
+	case KeyEventMID:
+		msg := &KeyEventMsg{ID: mid}
+		var body struct {
+			DownFlag uint8
+			_        [2]byte // padding
+			Key      uint32
+		}
+		if err := readFixedSize(s.r, &body); err != nil {
+			return nil, err
+		}
+		msg.DownFlag, msg.Key = body.DownFlag, body.Key
+		return msg, nil
+
+	case PointerEventMID:
+		msg := &PointerEventMsg{ID: mid}
+		for _, v := range []interface{}{&msg.ButtonMask, &msg.X, &msg.Y} {
+			if err := readFixedSize(s.r, v); err != nil {
+				return nil, err
+			}
+		}
+		return msg, nil
+
+	case ClientCutTextMID:
+		padding := make([]byte, 3)
+		if _, err := io.ReadFull(s.r, padding); err != nil {
+			return nil, err
+		}
+
+		var textLength int32
+		if err := readFixedSize(s.r, &textLength); err != nil {
+			return nil, err
+		}
+
+		if textLength < 0 {
+			if err := s.checkMessageSize(-int64(textLength)); err != nil {
+				return nil, err
+			}
+			payload := make([]byte, -int64(textLength))
+			if _, err := io.ReadFull(s.r, payload); err != nil {
+				return nil, err
+			}
+			cb, err := readExtendedClipboard(payload, s.maxMessageSize())
+			if err != nil {
+				return nil, err
+			}
+			return &ExtendedClientCutTextMsg{*cb}, nil
+		}
+
+		if err := s.checkMessageSize(int64(textLength)); err != nil {
+			return nil, err
+		}
+		textBytes := make([]byte, textLength)
+		if _, err := io.ReadFull(s.r, textBytes); err != nil {
+			return nil, err
+		}
+		return &ClientCutTextMsg{ID: mid, Text: latin1ToString(textBytes)}, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported Client Message %v.", mid)
+}
+
+// maxMessageSize returns the MaxMessageSize in effect.
+func (s *ServerConn) maxMessageSize() int64 {
+	if s.config.MaxMessageSize != 0 {
+		return int64(s.config.MaxMessageSize)
+	}
+	return DefaultMaxMessageSize
+}
+
+// checkMessageSize returns a MessageSizeError if the client declared
+// data of the given size that exceeds MaxMessageSize.
+func (s *ServerConn) checkMessageSize(size int64) error {
+	if max := s.maxMessageSize(); size > max {
+		return &MessageSizeError{Size: size, Max: max}
+	}
+	return nil
+}
+
+// SendFramebufferUpdate sends the given areas of img to the client as
+// Raw encoded rectangles, in the pixel format requested by the client.
+// Without areas, the whole image is sent. The Send methods are safe for
+// concurrent use; each message is written as a whole.
+func (s *ServerConn) SendFramebufferUpdate(img image.Image, areas ...image.Rectangle) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	if len(areas) == 0 {
+		areas = []image.Rectangle{img.Bounds()}
+	}
+
+	w := bufio.NewWriter(s.c)
+	header := []interface{}{FramebufferUpdateMID, uint8(0), uint16(len(areas))}
+	for _, v := range header {
+		if err := writeFixedSize(w, v); err != nil {
+			return err
+		}
+	}
+
+	for _, area := range areas {
+		if err := writeRectHeader(w, uint16(area.Min.X), uint16(area.Min.Y), area.Dx(), area.Dy(), RawEncType); err != nil {
+			return err
+		}
+		if err := s.pixelFormat.writePixels(w, img, area); err != nil {
+			return err
+		}
+	}
+
+	return w.Flush()
+}
+
+// SendBell rings the bell on the client.
+func (s *ServerConn) SendBell() error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	return writeFixedSize(s.c, BellMID)
+}
+
+// SendCutText sends text to the client's cut buffer. The text is sent
+// as Latin-1 (ISO 8859-1), so other characters are rejected with an
+// error.
+func (s *ServerConn) SendCutText(text string) error {
+	latin1 := make([]byte, 0, len(text))
+	for _, char := range text {
+		if char > unicode.MaxLatin1 {
+			return fmt.Errorf("Character %q is not valid Latin-1", char)
+		}
+		latin1 = append(latin1, byte(char))
+	}
+
+	buf := new(bytes.Buffer)
+	writeFixedSize(buf, ServerCutTextMID)
+	buf.Write([]byte{0, 0, 0})
+	writeFixedSize(buf, uint32(len(latin1)))
+	buf.Write(latin1)
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	_, err := s.c.Write(buf.Bytes())
+	return err
+}
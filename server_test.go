@@ -0,0 +1,263 @@
+package vnc
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"net"
+	"sync"
+	"testing"
+)
+
+// newTestServer returns a ServerConn reading the client messages in
+// data.
+func newTestServer(cfg *ServerConnConfig, data []byte) (*ServerConn, *testConn) {
+	if cfg == nil {
+		cfg = new(ServerConnConfig)
+	}
+	tc := new(testConn)
+	tc.in.Write(data)
+	return NewServerConn(cfg, tc), tc
+}
+
+func TestServerConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	img.SetRGBA(3, 1, color.RGBA{255, 0, 0, 255})
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- func() error {
+			s := NewServerConn(&ServerConnConfig{
+				Auth:              []ServerAuth{&VNCServerAuth{Password: "secret"}},
+				FrameBufferWidth:  4,
+				FrameBufferHeight: 2,
+				DesktopName:       "server",
+			}, server)
+			if err := s.Handshake(); err != nil {
+				return err
+			}
+			for i := 0; i < 3; i++ {
+				if _, err := s.ReceiveMsg(); err != nil {
+					return err
+				}
+			}
+			if s.PixelFormat().BPP != 8 || len(s.Encodings()) != 2 {
+				t.Errorf("server got pixel format %+v, encodings %v", *s.PixelFormat().RFBPixelFormat, s.Encodings())
+			}
+			return s.SendFramebufferUpdate(img)
+		}()
+	}()
+
+	c, err := NewClientConn(&ClientConnConfig{
+		Auth:           []ClientAuth{&VNCAuth{Password: "secret"}},
+		ServerMessages: make(map[MessageID]ServerMessage),
+	}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if c.FrameBufferWidth != 4 || c.FrameBufferHeight != 2 || c.DesktopName != "server" {
+		t.Errorf("got ServerInit %dx%d %q", c.FrameBufferWidth, c.FrameBufferHeight, c.DesktopName)
+	}
+
+	// the update is sent in the pixel format the client asked for
+	if err := c.SendMsg(&SetPixelFormatMsg{RFBPixelFormat: PixelFormatBGR233()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendMsg(&SetEncodingsMsg{Encodings: []Encoding{&HextileEncoding{}, &RawEncoding{}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RequestFramebufferUpdate(false); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := c.ReceiveMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rect := &msg.(*FramebufferUpdateMsg).Rectangles[0]
+	if got := decodedImage(rect.Encoding, rect).RGBAAt(3, 1); got != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("got pixel %v, want red", got)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerConcurrentSends(t *testing.T) {
+	// an update larger than the write buffer takes several writes
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	s, tc := newTestServer(nil, nil)
+
+	const n = 8
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := s.SendFramebufferUpdate(img); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := s.SendCutText("text"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	c, ctc := newTestClient(nil, tc.out.Bytes())
+	counts := make(map[MessageID]int)
+	for i := 0; i < 2*n; i++ {
+		msg, err := c.ReceiveMsg()
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		counts[msg.ID()]++
+	}
+	if counts[FramebufferUpdateMID] != n || counts[ServerCutTextMID] != n {
+		t.Errorf("got messages %v, want %d of each", counts, n)
+	} else if !consumed(c, ctc) {
+		t.Error("data left unread")
+	}
+}
+
+func TestServerReceiveMsg(t *testing.T) {
+	s, _ := newTestServer(nil, wire(
+		KeyEventMID, uint8(1), [2]byte{}, uint32(KeyReturn),
+		PointerEventMID, uint8(4), uint16(10), uint16(20),
+		ClientCutTextMID, [3]byte{}, uint32(4), "text",
+		uint8(99)))
+
+	msg, err := s.ReceiveMsg()
+	if m, ok := msg.(*KeyEventMsg); err != nil || !ok || m.DownFlag != 1 || m.Key != KeyReturn {
+		t.Errorf("got %+v, %v, want a KeyEventMsg", msg, err)
+	}
+	msg, err = s.ReceiveMsg()
+	if m, ok := msg.(*PointerEventMsg); err != nil || !ok || m.ButtonMask != 4 || m.X != 10 || m.Y != 20 {
+		t.Errorf("got %+v, %v, want a PointerEventMsg", msg, err)
+	}
+	msg, err = s.ReceiveMsg()
+	if m, ok := msg.(*ClientCutTextMsg); err != nil || !ok || m.Text != "text" {
+		t.Errorf("got %+v, %v, want a ClientCutTextMsg", msg, err)
+	}
+	if _, err := s.ReceiveMsg(); err == nil {
+		t.Error("no error for an unknown message type")
+	}
+}
+
+func TestServerCutTextLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     []byte
+		wantErr bool
+	}{
+		{"text", wire(ClientCutTextMID, [3]byte{}, int32(5), "hello"), false},
+		{"long text", wire(ClientCutTextMID, [3]byte{}, int32(1025)), true},
+		{"huge text", wire(ClientCutTextMID, [3]byte{}, int32(0x7fffffff)), true},
+		{"huge extended", wire(ClientCutTextMID, [3]byte{}, int32(-0x80000000)), true},
+	}
+	for _, tt := range tests {
+		s, _ := newTestServer(&ServerConnConfig{MaxMessageSize: 1024}, tt.msg)
+		msg, err := s.ReceiveMsg()
+		var sizeErr *MessageSizeError
+		if tt.wantErr && !errors.As(err, &sizeErr) {
+			t.Errorf("%s: got %v, want a MessageSizeError", tt.name, err)
+		} else if !tt.wantErr && (err != nil || msg.(*ClientCutTextMsg).Text != "hello") {
+			t.Errorf("%s: got %+v, %v", tt.name, msg, err)
+		}
+	}
+}
+
+func TestServerHandshake(t *testing.T) {
+	for _, auth := range [][]ServerAuth{nil, {}, {&VNCServerAuth{Password: "pw"}, &NoneServerAuth{}}} {
+		a, b := net.Pipe()
+		cfg := &ServerConnConfig{Auth: auth, FrameBufferWidth: 320, FrameBufferHeight: 200, DesktopName: "desk"}
+		s := NewServerConn(cfg, b)
+		done := make(chan error, 1)
+		go func() {
+			done <- s.Handshake()
+		}()
+
+		c, err := NewClientConn(&ClientConnConfig{
+			Auth:           []ClientAuth{&VNCAuth{Password: "pw"}, &NoneAuth{}},
+			ServerMessages: map[MessageID]ServerMessage{},
+		}, a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Handshake(); err != nil {
+			t.Errorf("%d auth methods: client: %v", len(auth), err)
+		} else if err := <-done; err != nil {
+			t.Errorf("%d auth methods: server: %v", len(auth), err)
+		} else if c.DesktopName != "desk" || c.FrameBufferWidth != 320 || c.FrameBufferHeight != 200 {
+			t.Errorf("%d auth methods: ServerInit read as %q %dx%d", len(auth), c.DesktopName, c.FrameBufferWidth, c.FrameBufferHeight)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestServerHandshake3_3(t *testing.T) {
+	s, tc := newTestServer(&ServerConnConfig{Auth: []ServerAuth{}, DesktopName: "d"}, wire(ProtocolVersion3_3, uint8(1)))
+	if err := s.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	pf, _ := PixelFormatRGB888().MarshalBinary()
+	want := wire(ProtocolVersion3_8, uint32(NoneSecType), uint16(0), uint16(0), pf, uint32(1), "d")
+	if !bytes.Equal(tc.out.Bytes(), want) {
+		t.Errorf("server wrote %v, want %v", tc.out.Bytes(), want)
+	}
+}
+
+func TestServerSendCutText(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    []byte
+		wantErr bool
+	}{
+		{"hello", wire(ServerCutTextMID, [3]byte{}, uint32(5), "hello"), false},
+		{"café", wire(ServerCutTextMID, [3]byte{}, uint32(4), "caf", uint8(0xe9)), false},
+		{"€", nil, true},
+	}
+	for _, tt := range tests {
+		s, tc := newTestServer(nil, nil)
+		err := s.SendCutText(tt.text)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("SendCutText(%q): %v", tt.text, err)
+		} else if !bytes.Equal(tc.out.Bytes(), tt.want) {
+			t.Errorf("SendCutText(%q) wrote %v, want %v", tt.text, tc.out.Bytes(), tt.want)
+		}
+	}
+}
+
+func TestCutTextRoundTrip(t *testing.T) {
+	const text = "é"
+	c, tc := newTestClient(nil, nil)
+	if err := c.SendMsg(&ClientCutTextMsg{Text: text}); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newTestServer(nil, tc.out.Bytes())
+	msg, err := s.ReceiveMsg()
+	if m, ok := msg.(*ClientCutTextMsg); err != nil || !ok || m.Text != text {
+		t.Errorf("client to server: got %+v, %v, want %q", msg, err, text)
+	}
+
+	s, stc := newTestServer(nil, nil)
+	if err := s.SendCutText(text); err != nil {
+		t.Fatal(err)
+	}
+	c, _ = newTestClient(nil, stc.out.Bytes())
+	smsg, err := c.ReceiveMsg()
+	if m, ok := smsg.(*ServerCutTextMsg); err != nil || !ok || m.Text != text {
+		t.Errorf("server to client: got %+v, %v, want %q", smsg, err, text)
+	}
+}
@@ -0,0 +1,173 @@
+package vnc
+
+import (
+	"context"
+	"sync"
+)
+
+// Session is a ready-to-use connection returned by Connect. It keeps
+// requesting framebuffer updates in the background and delivers every
+// message received from the server on Events.
+type Session struct {
+	*ClientConn
+
+	// Events delivers the messages received from the server. It is
+	// closed when the session ends; Err then returns the reason.
+	Events <-chan ServerMessage
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+	done      chan struct{}
+	mu        sync.Mutex
+	err       error
+}
+
+// Connect dials the server at cfg.Address, performs the handshake,
+// requests a 32bpp true-color pixel format and a default set of
+// encodings, and starts a receive loop that keeps the screen updated.
+// The context bounds the dial and the handshake only; use Close to end
+// the session.
+func Connect(ctx context.Context, cfg *ClientConnConfig) (*Session, error) {
+	if cfg.ServerMessages == nil {
+		cfg.ServerMessages = make(map[MessageID]ServerMessage)
+	}
+	c, err := NewClientConnContext(ctx, cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.HandshakeContext(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if err := c.setupSession(); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	events := make(chan ServerMessage, 16)
+	s := &Session{
+		ClientConn: c,
+		Events:     events,
+		closing:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go s.loop(events)
+
+	return s, nil
+}
+
+// setupSession negotiates the pixel format and encodings used by a
+// Session and requests the initial full framebuffer update. The
+// messages are flushed even with ClientConnConfig.BatchWrites, since the
+// update they ask for is waited on.
+func (c *ClientConn) setupSession() error {
+	if err := c.UseRGBA8888(); err != nil {
+		return err
+	}
+
+	encMsg := &SetEncodingsMsg{
+		Encodings: []Encoding{
+			&CopyRectEncoding{},
+			&HextileEncoding{},
+			&RawEncoding{},
+			&DesktopSizePseudoEncoding{},
+		},
+	}
+	if err := c.SendMsg(encMsg); err != nil {
+		return err
+	}
+
+	if err := c.RequestFramebufferUpdate(false); err != nil {
+		return err
+	}
+	return c.Flush()
+}
+
+func (s *Session) loop(events chan<- ServerMessage) {
+	defer close(s.done)
+	defer close(events)
+
+	for {
+		msg, err := s.ReceiveMsg()
+		if err != nil {
+			// reading fails once Close closes the connection, which is
+			// no error of the session
+			select {
+			case <-s.closing:
+			default:
+				s.setErr(err)
+			}
+			return
+		}
+
+		// Ask for the next update as soon as the current one is in.
+		// The message is matched by ID, so updates read with
+		// StreamingFramebufferUpdateMsg or DirectFramebufferUpdateMsg
+		// keep the screen updating too.
+		if msg.ID() == FramebufferUpdateMID {
+			if err := s.RequestFramebufferUpdate(true); err != nil {
+				s.setErr(err)
+				return
+			} else if err := s.Flush(); err != nil {
+				s.setErr(err)
+				return
+			}
+		}
+
+		select {
+		case events <- msg:
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+func (s *Session) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// Err returns the error that ended the session, if any. It is nil if
+// the session was ended by Close.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// KeyEvent sends a key press or release for the given keysym.
+func (s *Session) KeyEvent(keysym uint32, down bool) error {
+	var downFlag uint8
+	if down {
+		downFlag = 1
+	}
+	return s.SendMsg(&KeyEventMsg{DownFlag: downFlag, Key: keysym})
+}
+
+// PointerEvent sends the pointer position and button state.
+func (s *Session) PointerEvent(buttonMask uint8, x, y uint16) error {
+	return s.SendMsg(&PointerEventMsg{ButtonMask: buttonMask, X: x, Y: y})
+}
+
+// CutText sends text to the server's clipboard.
+func (s *Session) CutText(text string) error {
+	return s.SendMsg(&ClientCutTextMsg{Text: text})
+}
+
+// Close closes the connection and waits for the receive loop to end.
+// It may be called more than once; later calls return the result of the
+// first.
+func (s *Session) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closing)
+		s.closeErr = s.ClientConn.Close()
+	})
+	<-s.done
+	return s.closeErr
+}
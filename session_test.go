@@ -0,0 +1,163 @@
+package vnc
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveUpdates accepts one connection on l, performs the server side of
+// a 3.8 handshake without authentication for a 16x8 screen, and answers
+// every framebuffer update request with a whole-screen Raw rectangle,
+// until the client is gone or stop is closed.
+func serveUpdates(t *testing.T, l net.Listener, stop <-chan struct{}) {
+	nc, err := l.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer nc.Close()
+
+	buf := make([]byte, 12)
+	if _, err := nc.Write([]byte("RFB 003.008\n")); err != nil {
+		return
+	} else if _, err := io.ReadFull(nc, buf); err != nil {
+		return
+	} else if _, err := nc.Write(wire(uint8(1), NoneSecType)); err != nil {
+		return
+	} else if _, err := io.ReadFull(nc, buf[:1]); err != nil {
+		return
+	} else if _, err := nc.Write(wire(uint32(0))); err != nil {
+		return
+	} else if _, err := io.ReadFull(nc, buf[:1]); err != nil {
+		return
+	}
+	rpf := PixelFormatRGB888()
+	if _, err := nc.Write(wire(uint16(16), uint16(8), rpf, uint32(4), "test")); err != nil {
+		return
+	}
+
+	// Session asks for 32 bits per pixel
+	update := wire(FramebufferUpdateMID, uint8(0), uint16(1), [4]uint16{0, 0, 16, 8}, RawEncType,
+		make([]byte, 16*8*4))
+	for {
+		if _, err := io.ReadFull(nc, buf[:1]); err != nil {
+			return
+		}
+		switch MessageID(buf[0]) {
+		case SetPixelFormatMID:
+			_, err = io.ReadFull(nc, make([]byte, 19))
+		case SetEncodingsMID:
+			if _, err = io.ReadFull(nc, buf[:3]); err == nil {
+				_, err = io.ReadFull(nc, make([]byte, 4*int(binary.BigEndian.Uint16(buf[1:3]))))
+			}
+		case FramebufferUpdateRequestMID:
+			if _, err = io.ReadFull(nc, buf[:9]); err != nil {
+				return
+			}
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_, err = nc.Write(update)
+		default:
+			t.Errorf("unexpected client message %d", buf[0])
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	tests := []struct {
+		name      string
+		streaming bool
+	}{
+		{"buffered", false},
+		{"streaming", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Skip(err)
+			}
+			defer l.Close()
+			stop := make(chan struct{})
+			defer close(stop)
+			go serveUpdates(t, l, stop)
+
+			var rects int
+			var messages map[MessageID]ServerMessage
+			if tt.streaming {
+				messages = map[MessageID]ServerMessage{
+					FramebufferUpdateMID: &StreamingFramebufferUpdateMsg{Handler: func(*Rectangle) error {
+						rects++
+						return nil
+					}},
+				}
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			s, err := Connect(ctx, &ClientConnConfig{Address: l.Addr().String(), ServerMessages: messages})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the loop keeps requesting updates after the first one
+			for i := 0; i < 3; i++ {
+				select {
+				case msg := <-s.Events:
+					if msg.ID() != FramebufferUpdateMID {
+						t.Fatalf("got message %d, want an update", msg.ID())
+					}
+				case <-ctx.Done():
+					t.Fatalf("got %d updates", i)
+				}
+			}
+
+			if err := s.Close(); err != nil {
+				t.Errorf("Close: %v", err)
+			}
+			if err := s.Close(); err != nil {
+				t.Errorf("second Close: %v", err)
+			}
+			if err := s.Err(); err != nil {
+				t.Errorf("Err after Close: %v", err)
+			}
+			if tt.streaming && rects < 3 {
+				t.Errorf("handler got %d rectangles, want at least 3", rects)
+			}
+		})
+	}
+}
+
+func TestSessionServerClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	stop := make(chan struct{})
+	close(stop)
+	go serveUpdates(t, l, stop)
+
+	s, err := Connect(context.Background(), &ClientConnConfig{Address: l.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for range s.Events {
+	}
+	if s.Err() == nil {
+		t.Error("Err is nil after the server closed the connection")
+	}
+}
@@ -0,0 +1,120 @@
+package vnc
+
+import (
+	"sync"
+	"time"
+)
+
+// fpsWindow is the length of the rolling window over which the
+// framebuffer update rate is computed.
+const fpsWindow = 5 * time.Second
+
+// Stats contains diagnostic information observed on a connection.
+type Stats struct {
+	// FPS is the rate of FramebufferUpdate messages received from the
+	// server, in updates per second, averaged over a rolling window.
+	FPS float64
+}
+
+// Stats returns a snapshot of the diagnostic information for the
+// connection. It is safe to call concurrently with ReceiveMsg.
+func (c *ClientConn) Stats() Stats {
+	return Stats{
+		FPS: c.frameRate.rate(time.Now()),
+	}
+}
+
+// frameRate tracks the arrival times of framebuffer updates within
+// the rolling window.
+type frameRate struct {
+	mu    sync.Mutex
+	times []time.Time
+}
+
+func (f *frameRate) record(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.times = append(f.times, t)
+	f.prune(t)
+}
+
+func (f *frameRate) rate(now time.Time) float64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.prune(now)
+	if len(f.times) < 2 {
+		return 0
+	}
+
+	// The window ends now rather than at the last update, so the rate
+	// drops once the server stops sending updates.
+	span := now.Sub(f.times[0])
+	if span <= 0 {
+		return 0
+	}
+	return float64(len(f.times)-1) / span.Seconds()
+}
+
+// prune drops the arrival times that fell out of the window. The
+// caller must hold f.mu.
+func (f *frameRate) prune(now time.Time) {
+	cutoff := now.Add(-fpsWindow)
+	i := 0
+	for i < len(f.times) && f.times[i].Before(cutoff) {
+		i++
+	}
+	if i > 0 {
+		f.times = append(f.times[:0], f.times[i:]...)
+	}
+}
+
+// Metrics receives measurements of a connection. Set it as
+// ClientConnConfig.Metrics. Its methods are called from the goroutine
+// receiving messages.
+type Metrics interface {
+	// RecordDecode is called after each rectangle is decoded, with the
+	// rectangle's encoding type, the time its Read took and the number
+	// of bytes it consumed.
+	RecordDecode(enc EncodingType, d time.Duration, bytes int)
+}
+
+// DecodeMetrics is a Metrics aggregating the decoding measurements per
+// encoding type. It is safe for concurrent use.
+type DecodeMetrics struct {
+	mu    sync.Mutex
+	stats map[EncodingType]DecodeStats
+}
+
+// DecodeStats are the totals of the rectangles decoded with an
+// encoding.
+type DecodeStats struct {
+	Rectangles int
+	Duration   time.Duration
+	Bytes      int64
+}
+
+func (m *DecodeMetrics) RecordDecode(enc EncodingType, d time.Duration, bytes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stats == nil {
+		m.stats = make(map[EncodingType]DecodeStats)
+	}
+	s := m.stats[enc]
+	s.Rectangles++
+	s.Duration += d
+	s.Bytes += int64(bytes)
+	m.stats[enc] = s
+}
+
+// Stats returns a snapshot of the totals per encoding type.
+func (m *DecodeMetrics) Stats() map[EncodingType]DecodeStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := make(map[EncodingType]DecodeStats, len(m.stats))
+	for enc, s := range m.stats {
+		stats[enc] = s
+	}
+	return stats
+}
@@ -0,0 +1,32 @@
+package vnc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFrameRate(t *testing.T) {
+	start := time.Unix(1000, 0)
+	tests := []struct {
+		name  string
+		times []time.Duration // since start
+		now   time.Duration
+		want  float64
+	}{
+		{"no updates", nil, 0, 0},
+		{"one update", []time.Duration{0}, time.Second, 0},
+		{"10 per second", []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond}, 200 * time.Millisecond, 10},
+		{"old updates dropped", []time.Duration{0, 4 * time.Second, 4500 * time.Millisecond, 5 * time.Second}, 6 * time.Second, 1},
+		{"stalled", []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond}, 2 * time.Second, 1},
+		{"stalled past the window", []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond}, 6 * time.Second, 0},
+	}
+	for _, tt := range tests {
+		var f frameRate
+		for _, d := range tt.times {
+			f.record(start.Add(d))
+		}
+		if got := f.rate(start.Add(tt.now)); got != tt.want {
+			t.Errorf("%s: got %v updates per second, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package vnc
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+)
+
+// Tight compression control values (upper nibble of the control byte).
+const (
+	tightFill = 0x08
+	tightJPEG = 0x09
+
+	tightExplicitFilter = 0x04
+	tightStreamMask     = 0x03
+)
+
+// Tight filter ids for the basic compression.
+const (
+	tightFilterCopy = iota
+	tightFilterPalette
+	tightFilterGradient
+)
+
+// Data shorter than this is sent without zlib compression.
+const tightMinToCompress = 12
+
+// Ranges of the JPEG quality and compression level pseudo-encodings.
+// Level 0 is the lowest type of each range, level 9 the highest.
+const (
+	JPEGQualityLevel0PseudoEncType = EncodingType(-32)
+	JPEGQualityLevel9PseudoEncType = EncodingType(-23)
+	CompressionLevel0PseudoEncType = EncodingType(-256)
+	CompressionLevel9PseudoEncType = EncodingType(-247)
+	maxEncodingLevel               = 9
+)
+
+// JPEGQualityEncoding returns the pseudo-encoding that hints the server
+// to use the given JPEG quality level, from 0 (lowest) to 9 (highest).
+// It returns an error if the level is out of range.
+func JPEGQualityEncoding(level int) (Encoding, error) {
+	if level < 0 || level > maxEncodingLevel {
+		return nil, fmt.Errorf("JPEG quality level %d out of range", level)
+	}
+	return &levelPseudoEncoding{JPEGQualityLevel0PseudoEncType + EncodingType(level)}, nil
+}
+
+// CompressionLevelEncoding returns the pseudo-encoding that hints the
+// server to use the given compression level, from 0 (fastest) to 9
+// (best compression). It returns an error if the level is out of range.
+func CompressionLevelEncoding(level int) (Encoding, error) {
+	if level < 0 || level > maxEncodingLevel {
+		return nil, fmt.Errorf("compression level %d out of range", level)
+	}
+	return &levelPseudoEncoding{CompressionLevel0PseudoEncType + EncodingType(level)}, nil
+}
+
+// levelPseudoEncoding is a JPEG quality or compression level hint. It is
+// only sent in SetEncodings; servers never send rectangles with it.
+type levelPseudoEncoding struct {
+	encType EncodingType
+}
+
+func (enc *levelPseudoEncoding) Type() EncodingType {
+	return enc.encType
+}
+
+func (enc *levelPseudoEncoding) Read(*ClientConn, *Rectangle) (Encoding, error) {
+	return enc, nil
+}
+
+// isLevelPseudoEncType reports whether t is a JPEG quality or
+// compression level pseudo-encoding.
+func isLevelPseudoEncType(t EncodingType) bool {
+	return t >= JPEGQualityLevel0PseudoEncType && t <= JPEGQualityLevel9PseudoEncType ||
+		t >= CompressionLevel0PseudoEncType && t <= CompressionLevel9PseudoEncType
+}
+
+// TightEncoding is the Tight encoding, which combines zlib compressed
+// pixel data, optionally pre-processed by a filter, with solid fills
+// and JPEG compressed rectangles.
+//
+// See https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#tight-encoding
+type TightEncoding struct {
+	rgba []byte
+}
+
+func (*TightEncoding) Type() EncodingType {
+	return TightEncType
+}
+
+func (*TightEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	var ctrl uint8
+	if err := readFixedSize(c.r, &ctrl); err != nil {
+		return nil, err
+	}
+
+	// the lower 4 bits tell which zlib streams to reset
+	c.tightZlib.resetMask(ctrl & 0x0f)
+	ctrl >>= 4
+
+	var err error
+	enc := new(TightEncoding)
+	switch {
+	case ctrl == tightFill:
+		enc.rgba, err = enc.readFill(c, rect)
+	case ctrl == tightJPEG:
+		enc.rgba, err = enc.readJPEG(c, rect)
+	case ctrl > tightJPEG:
+		err = fmt.Errorf("invalid tight compression control: %#x", ctrl)
+	default:
+		enc.rgba, err = enc.readBasic(c, rect, ctrl)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return enc, nil
+}
+
+func (enc *TightEncoding) RGBA(*Rectangle) ([]byte, error) {
+	return getData(enc.rgba)
+}
+
+func (enc *TightEncoding) Image(rect *Rectangle) (image.Image, error) {
+	return rgbaImage(enc.rgba, int(rect.Width), int(rect.Height))
+}
+
+func (enc *TightEncoding) PNG(rect *Rectangle) ([]byte, error) {
+	return encodePNG(enc, rect)
+}
+
+func (enc *TightEncoding) WritePNG(w io.Writer, rect *Rectangle) error {
+	return writeRGBAPNG(w, enc.rgba, int(rect.Width), int(rect.Height))
+}
+
+func (enc *TightEncoding) readFill(c *ClientConn, rect *Rectangle) ([]byte, error) {
+	pixel, err := enc.readTPixels(c, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	numPixels := int(rect.Width) * int(rect.Height)
+	rgba := make([]byte, 4*numPixels)
+	for i := 0; i < len(rgba); i += 4 {
+		copy(rgba[i:i+4], pixel)
+	}
+	return rgba, nil
+}
+
+func (enc *TightEncoding) readJPEG(c *ClientConn, rect *Rectangle) ([]byte, error) {
+	length, err := readCompactLength(c.r)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return nil, err
+	}
+
+	src, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, int(rect.Width), int(rect.Height)))
+	draw.Draw(img, img.Bounds(), src, src.Bounds().Min, draw.Src)
+	return img.Pix, nil
+}
+
+func (enc *TightEncoding) readBasic(c *ClientConn, rect *Rectangle, ctrl uint8) ([]byte, error) {
+	stream := int(ctrl & tightStreamMask)
+	width := int(rect.Width)
+	height := int(rect.Height)
+	pixSize := c.tightPixelSize()
+
+	var filter uint8 = tightFilterCopy
+	if ctrl&tightExplicitFilter != 0 {
+		if err := readFixedSize(c.r, &filter); err != nil {
+			return nil, err
+		}
+	}
+
+	switch filter {
+	case tightFilterCopy:
+		data, err := c.readTightData(stream, width*height*pixSize)
+		if err != nil {
+			return nil, err
+		}
+		return enc.tpixelsToRGBA(c, data)
+
+	case tightFilterPalette:
+		var maxColor uint8
+		if err := readFixedSize(c.r, &maxColor); err != nil {
+			return nil, err
+		}
+		numColors := int(maxColor) + 1
+		palette, err := enc.readTPixels(c, numColors)
+		if err != nil {
+			return nil, err
+		}
+
+		// two colors are packed as a bitmap, more as one byte per pixel
+		rowSize := width
+		if numColors == 2 {
+			rowSize = (width + 7) / 8
+		}
+		data, err := c.readTightData(stream, rowSize*height)
+		if err != nil {
+			return nil, err
+		}
+
+		rgba := make([]byte, 4*width*height)
+		for y := 0; y < height; y++ {
+			row := data[y*rowSize : (y+1)*rowSize]
+			for x := 0; x < width; x++ {
+				var idx int
+				if numColors == 2 {
+					idx = int(row[x/8]>>uint(7-x%8)) & 1
+				} else {
+					idx = int(row[x])
+				}
+				if idx >= numColors {
+					return nil, fmt.Errorf("tight palette index %d out of range", idx)
+				}
+				copy(rgba[4*(y*width+x):], palette[4*idx:4*idx+4])
+			}
+		}
+		return rgba, nil
+
+	case tightFilterGradient:
+		data, err := c.readTightData(stream, width*height*pixSize)
+		if err != nil {
+			return nil, err
+		}
+		return enc.gradientToRGBA(c, data, width, height)
+	}
+
+	return nil, fmt.Errorf("invalid tight filter: %d", filter)
+}
+
+// readTPixels reads numPixels pixels in the TPIXEL format and returns
+// them as RGBA.
+func (enc *TightEncoding) readTPixels(c *ClientConn, numPixels int) ([]byte, error) {
+	data := make([]byte, numPixels*c.tightPixelSize())
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return nil, err
+	}
+	return enc.tpixelsToRGBA(c, data)
+}
+
+func (*TightEncoding) tpixelsToRGBA(c *ClientConn, data []byte) ([]byte, error) {
+	if c.tightPixelSize() != 3 {
+		return c.pixelFormat.ReadPixels(bytes.NewReader(data), len(data)/int(c.pixelFormat.ByPP))
+	}
+
+	// compact 24-bit pixels are sent as red, green, blue
+	rgba := make([]byte, len(data)/3*4)
+	for i, j := 0, 0; i < len(data); i, j = i+3, j+4 {
+		rgba[j], rgba[j+1], rgba[j+2], rgba[j+3] = data[i], data[i+1], data[i+2], 255
+	}
+	return rgba, nil
+}
+
+// gradientToRGBA reverses the gradient filter, which sends every color
+// component as the difference to a prediction made from the pixels to
+// the left, above, and above-left.
+func (enc *TightEncoding) gradientToRGBA(c *ClientConn, data []byte, width, height int) ([]byte, error) {
+	pf := c.pixelFormat
+	if pf.TrueColor == 0 {
+		return nil, fmt.Errorf("tight gradient filter requires a true color pixel format")
+	}
+
+	pixSize := c.tightPixelSize()
+	maxes := [3]uint16{pf.RedMax, pf.GreenMax, pf.BlueMax}
+	shifts := [3]uint8{pf.RedShift, pf.GreenShift, pf.BlueShift}
+	components := func(pixel []byte) (comp [3]int) {
+		if pixSize == 3 {
+			return [3]int{int(pixel[0]), int(pixel[1]), int(pixel[2])}
+		}
+		v := pf.pixelValue(pixel)
+		for i := range comp {
+			comp[i] = int(v>>shifts[i]) & int(maxes[i])
+		}
+		return
+	}
+
+	prevRow := make([][3]int, width)
+	thisRow := make([][3]int, width)
+	rgba := make([]byte, 4*width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			diff := components(data[(y*width+x)*pixSize:])
+			for i := range diff {
+				var left, upLeft int
+				up := prevRow[x][i]
+				if x > 0 {
+					left = thisRow[x-1][i]
+					upLeft = prevRow[x-1][i]
+				}
+
+				predicted := left + up - upLeft
+				if predicted < 0 {
+					predicted = 0
+				} else if predicted > int(maxes[i]) {
+					predicted = int(maxes[i])
+				}
+				thisRow[x][i] = (predicted + diff[i]) & int(maxes[i])
+			}
+
+			p := 4 * (y*width + x)
+			for i, v := range thisRow[x] {
+				rgba[p+i] = pf.scaleToUint8(uint32(v), maxes[i])
+			}
+			rgba[p+3] = 255
+		}
+		prevRow, thisRow = thisRow, prevRow
+	}
+	return rgba, nil
+}
+
+// tightPixelSize returns the size of a TPIXEL, which is packed into 3
+// bytes for 32bpp formats with a depth of 24 and 8 bits per channel.
+func (c *ClientConn) tightPixelSize() int {
+	pf := c.pixelFormat
+	if pf.TrueColor != 0 && pf.BPP == 32 && pf.Depth == 24 &&
+		pf.RedMax == 255 && pf.GreenMax == 255 && pf.BlueMax == 255 {
+		return 3
+	}
+	return int(pf.ByPP)
+}
+
+// readTightData reads size bytes of basic compression data, which is
+// compressed through one of the connection's zlib streams unless it is
+// too short to be worth it.
+func (c *ClientConn) readTightData(stream int, size int) ([]byte, error) {
+	if size < tightMinToCompress {
+		data := make([]byte, size)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+
+	length, err := readCompactLength(c.r)
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := c.tightZlib.read(c.r, stream, length)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(zr, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readCompactLength reads a length encoded in 1 to 3 bytes, 7 bits per
+// byte with the high bit set if another byte follows.
+func readCompactLength(r io.Reader) (int, error) {
+	var b uint8
+	length := 0
+	for i := uint(0); i < 3; i++ {
+		if err := readFixedSize(r, &b); err != nil {
+			return 0, err
+		}
+		if i == 2 {
+			length |= int(b) << 14
+			break
+		}
+		length |= int(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return length, nil
+}
@@ -0,0 +1,221 @@
+package vnc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"testing"
+)
+
+// compactLength encodes a Tight compact length.
+func compactLength(n int) []byte {
+	switch {
+	case n < 1<<7:
+		return []byte{byte(n)}
+	case n < 1<<14:
+		return []byte{byte(n) | 0x80, byte(n >> 7)}
+	}
+	return []byte{byte(n) | 0x80, byte(n>>7) | 0x80, byte(n >> 14)}
+}
+
+func TestCompactLength(t *testing.T) {
+	for _, n := range []int{0, 1, 127, 128, 10000, 16383, 16384, 4194303} {
+		c, _ := newTestClient(nil, compactLength(n))
+		if got, err := readCompactLength(c.r); err != nil || got != n {
+			t.Errorf("%d: got %d, %v", n, got, err)
+		}
+	}
+}
+
+// tightStreams compresses the data of Tight rectangles through
+// persistent zlib streams, like a server.
+type tightStreams struct {
+	bufs [4]*bytes.Buffer
+	zws  [4]*zlib.Writer
+}
+
+// data returns the data of a rectangle sent through stream n, which is
+// restarted first if reset is set.
+func (s *tightStreams) data(n int, reset bool, raw []byte) []byte {
+	if len(raw) < tightMinToCompress {
+		return raw
+	}
+	if s.zws[n] == nil || reset {
+		s.bufs[n] = new(bytes.Buffer)
+		s.zws[n] = zlib.NewWriter(s.bufs[n])
+	}
+	s.zws[n].Write(raw)
+	s.zws[n].Flush()
+	compressed := append([]byte(nil), s.bufs[n].Bytes()...)
+	s.bufs[n].Reset()
+	return append(compactLength(len(compressed)), compressed...)
+}
+
+func TestTightEncoding(t *testing.T) {
+	// TPIXELs are sent as red, green, blue
+	red, green, blue := []byte{255, 0, 0}, []byte{0, 255, 0}, []byte{0, 0, 255}
+	tpixel := func(p []byte) []byte { return p }
+	basic := func(stream int, reset uint8, filter ...uint8) []byte {
+		if len(filter) == 0 {
+			return []byte{byte(stream)<<4 | reset}
+		}
+		return []byte{byte(tightExplicitFilter|stream)<<4 | reset, filter[0]}
+	}
+
+	var s tightStreams
+	gradientRaw := wire(
+		[]byte{10, 20, 30}, []byte{5, 5, 5},
+		[]byte{2, 4, 6}, []byte{0, 0, 0})
+
+	tests := []struct {
+		name          string
+		width, height uint16
+		data          []byte
+		want          []color.RGBA
+		wantErr       bool
+	}{
+		{"fill", 2, 2, wire(uint8(tightFill<<4), tpixel(green)), []color.RGBA{
+			{0, 255, 0, 255}, {0, 255, 0, 255}, {0, 255, 0, 255}, {0, 255, 0, 255}}, false},
+		{"copy uncompressed", 2, 1, wire(basic(0, 0), tpixel(red), tpixel(blue)), []color.RGBA{
+			{255, 0, 0, 255}, {0, 0, 255, 255}}, false},
+		{"copy filter compressed", 4, 1, wire(basic(1, 0, tightFilterCopy),
+			s.data(1, false, wire(tpixel(red), tpixel(green), tpixel(blue), tpixel(red)))), []color.RGBA{
+			{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}, {255, 0, 0, 255}}, false},
+		{"same stream continued", 4, 1, wire(basic(1, 0),
+			s.data(1, false, wire(tpixel(blue), tpixel(blue), tpixel(green), tpixel(green)))), []color.RGBA{
+			{0, 0, 255, 255}, {0, 0, 255, 255}, {0, 255, 0, 255}, {0, 255, 0, 255}}, false},
+		{"stream reset", 4, 1, wire(basic(1, 1<<1),
+			s.data(1, true, wire(tpixel(green), tpixel(red), tpixel(red), tpixel(red)))), []color.RGBA{
+			{0, 255, 0, 255}, {255, 0, 0, 255}, {255, 0, 0, 255}, {255, 0, 0, 255}}, false},
+		{"palette bitmap", 9, 1, wire(basic(0, 0, tightFilterPalette), uint8(1), tpixel(red), tpixel(blue),
+			uint8(0xa0), uint8(0x80)), []color.RGBA{
+			{0, 0, 255, 255}, {255, 0, 0, 255}, {0, 0, 255, 255}, {255, 0, 0, 255}, {255, 0, 0, 255},
+			{255, 0, 0, 255}, {255, 0, 0, 255}, {255, 0, 0, 255}, {0, 0, 255, 255}}, false},
+		{"palette of 3", 3, 1, wire(basic(2, 0, tightFilterPalette), uint8(2), tpixel(red), tpixel(green), tpixel(blue),
+			uint8(2), uint8(0), uint8(1)), []color.RGBA{
+			{0, 0, 255, 255}, {255, 0, 0, 255}, {0, 255, 0, 255}}, false},
+		{"palette index out of range", 2, 1, wire(basic(0, 0, tightFilterPalette), uint8(2), tpixel(red), tpixel(green), tpixel(blue),
+			uint8(3), uint8(0)), nil, true},
+		{"gradient", 2, 2, wire(basic(3, 0, tightFilterGradient), s.data(3, false, gradientRaw)), []color.RGBA{
+			// (15,25,35) is predicted from the left, the second row from
+			// above and above-left
+			{10, 20, 30, 255}, {15, 25, 35, 255}, {12, 24, 36, 255}, {17, 29, 41, 255}}, false},
+		{"invalid filter", 1, 1, wire(basic(0, 0, 3)), nil, true},
+		{"invalid control", 1, 1, wire(uint8(0xa0)), nil, true},
+	}
+	// the rectangles share the zlib streams of one connection
+	c, tc := newTestClient(nil, nil)
+	for _, tt := range tests {
+		rect := &Rectangle{Width: tt.width, Height: tt.height}
+		if tt.wantErr {
+			bad, _ := newTestClient(nil, tt.data)
+			if _, err := (&TightEncoding{}).Read(bad, rect); err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		}
+
+		tc.in.Write(tt.data)
+		enc, err := (&TightEncoding{}).Read(c, rect)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		} else if !consumed(c, tc) {
+			t.Fatalf("%s: data left unread", tt.name)
+		}
+
+		rgba, _ := enc.(*TightEncoding).RGBA(rect)
+		img := newRGBAImage(rgba, int(tt.width), int(tt.height)).(*image.RGBA)
+		for i, want := range tt.want {
+			x, y := i%int(tt.width), i/int(tt.width)
+			if got := img.RGBAAt(x, y); got != want {
+				t.Errorf("%s: pixel (%d,%d) is %v, want %v", tt.name, x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestTightJPEG(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	draw.Draw(src, src.Rect, image.NewUniform(color.RGBA{200, 100, 50, 255}), image.ZP, draw.Src)
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, src, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, tc := newTestClient(nil, wire(uint8(tightJPEG<<4), compactLength(buf.Len()), buf.Bytes()))
+	rect := &Rectangle{Width: 16, Height: 8}
+	enc, err := (&TightEncoding{}).Read(c, rect)
+	if err != nil {
+		t.Fatal(err)
+	} else if !consumed(c, tc) {
+		t.Error("data left unread")
+	}
+	rgba, _ := enc.(*TightEncoding).RGBA(rect)
+	got := newRGBAImage(rgba, 16, 8).(*image.RGBA).RGBAAt(7, 3)
+	near := func(a, b uint8) bool { return a-b < 8 || b-a < 8 }
+	if !near(got.R, 200) || !near(got.G, 100) || !near(got.B, 50) || got.A != 255 {
+		t.Errorf("decoded %v, want about {200 100 50 255}", got)
+	}
+}
+
+func TestTightPixelSize(t *testing.T) {
+	deep := PixelFormatRGB888()
+	deep.Depth = 32
+	tests := []struct {
+		name string
+		rpf  RFBPixelFormat
+		want int
+	}{
+		{"RGB888", PixelFormatRGB888(), 3},
+		{"BGR233", PixelFormatBGR233(), 1},
+		{"depth 32", deep, 4},
+	}
+	for _, tt := range tests {
+		c, _ := newTestClient(nil, nil)
+		c.pixelFormat = NewPixelFormat(&tt.rpf)
+		if got := c.tightPixelSize(); got != tt.want {
+			t.Errorf("%s: TPIXEL of %d bytes, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLevelEncodings(t *testing.T) {
+	tests := []struct {
+		newEnc func(int) (Encoding, error)
+		level  int
+		want   EncodingType
+	}{
+		{JPEGQualityEncoding, 0, -32},
+		{JPEGQualityEncoding, 9, -23},
+		{CompressionLevelEncoding, 0, -256},
+		{CompressionLevelEncoding, 6, -250},
+	}
+	for _, tt := range tests {
+		enc, err := tt.newEnc(tt.level)
+		if err != nil {
+			t.Errorf("level %d: %v", tt.level, err)
+			continue
+		}
+		if got := enc.Type(); got != tt.want {
+			t.Errorf("got type %d, want %d", got, tt.want)
+		}
+		if !tt.want.IsPseudo() {
+			t.Errorf("type %d is not pseudo", tt.want)
+		}
+		if enc := builtinEncoding(tt.want); enc == nil || enc.Type() != tt.want {
+			t.Errorf("server decoded type %d as %v", tt.want, enc)
+		}
+	}
+
+	for _, level := range []int{-1, 10} {
+		if enc, err := JPEGQualityEncoding(level); err == nil {
+			t.Errorf("JPEG quality level %d: got %v, want an error", level, enc)
+		}
+		if enc, err := CompressionLevelEncoding(level); err == nil {
+			t.Errorf("compression level %d: got %v, want an error", level, enc)
+		}
+	}
+}
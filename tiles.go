@@ -0,0 +1,125 @@
+package vnc
+
+import (
+	"image"
+)
+
+// DefaultTileSize is the tile edge length used by NewTileGrid when a
+// size of zero is given.
+const DefaultTileSize = 256
+
+// TileGrid divides a framebuffer into fixed-size square tiles and
+// tracks which tiles have been touched by framebuffer updates. This
+// lets renderers that keep the screen in tiled textures upload only
+// the tiles that changed, instead of arbitrary rectangles.
+type TileGrid struct {
+	size       int
+	bounds     image.Rectangle
+	cols, rows int
+	dirty      []bool
+}
+
+// NewTileGrid returns a TileGrid covering a width x height framebuffer
+// with tiles of size x size pixels. All tiles start out dirty.
+func NewTileGrid(width, height, size int) *TileGrid {
+	if size <= 0 {
+		size = DefaultTileSize
+	}
+	g := &TileGrid{size: size}
+	g.Resize(width, height)
+	return g
+}
+
+// TileSize returns the edge length of the tiles in pixels.
+func (g *TileGrid) TileSize() int {
+	return g.size
+}
+
+// Dimensions returns the number of tile columns and rows.
+func (g *TileGrid) Dimensions() (cols, rows int) {
+	return g.cols, g.rows
+}
+
+// Resize changes the framebuffer size covered by the grid. Since the
+// whole screen content is invalidated by a resize, all tiles are
+// marked dirty.
+func (g *TileGrid) Resize(width, height int) {
+	g.bounds = image.Rect(0, 0, width, height)
+	g.cols = (width + g.size - 1) / g.size
+	g.rows = (height + g.size - 1) / g.size
+	g.dirty = make([]bool, g.cols*g.rows)
+	for i := range g.dirty {
+		g.dirty[i] = true
+	}
+}
+
+// MarkRect marks every tile intersecting r as dirty.
+func (g *TileGrid) MarkRect(r image.Rectangle) {
+	r = r.Intersect(g.bounds)
+	if r.Empty() {
+		return
+	}
+
+	for row := r.Min.Y / g.size; row <= (r.Max.Y-1)/g.size; row++ {
+		for col := r.Min.X / g.size; col <= (r.Max.X-1)/g.size; col++ {
+			g.dirty[row*g.cols+col] = true
+		}
+	}
+}
+
+// MarkUpdate marks the tiles touched by the rectangles of a
+// framebuffer update. A DesktopSize or ExtendedDesktopSize rectangle
+// resizes the grid, and other pseudo-encoding rectangles are ignored
+// since they do not change the framebuffer contents.
+func (g *TileGrid) MarkUpdate(m *FramebufferUpdateMsg) {
+	for i := range m.Rectangles {
+		g.markRectangle(&m.Rectangles[i])
+	}
+}
+
+// markRectangle marks the tiles covered by a rectangle of an update
+// dirty, or resizes the grid for a DesktopSize rectangle.
+func (g *TileGrid) markRectangle(rect *Rectangle) {
+	if t := rect.Type(); t == DesktopSizePseudoEncType || t == ExtendedDesktopSizePseudoEncType {
+		g.Resize(int(rect.Width), int(rect.Height))
+	} else if !isPseudoEncoding(rect.Encoding) {
+		g.MarkRect(image.Rect(int(rect.X), int(rect.Y),
+			int(rect.X)+int(rect.Width), int(rect.Y)+int(rect.Height)))
+	}
+}
+
+// IsDirty reports whether the tile at the given column and row is dirty.
+func (g *TileGrid) IsDirty(col, row int) bool {
+	if col < 0 || col >= g.cols || row < 0 || row >= g.rows {
+		return false
+	}
+	return g.dirty[row*g.cols+col]
+}
+
+// Dirty returns the framebuffer area of every dirty tile, in row-major
+// order. Tiles on the right and bottom edges are clipped to the
+// framebuffer size.
+func (g *TileGrid) Dirty() []image.Rectangle {
+	var tiles []image.Rectangle
+	for row := 0; row < g.rows; row++ {
+		for col := 0; col < g.cols; col++ {
+			if g.dirty[row*g.cols+col] {
+				tiles = append(tiles, g.tileRect(col, row))
+			}
+		}
+	}
+	return tiles
+}
+
+// Clear marks all tiles as clean. It is typically called once the
+// dirty tiles have been uploaded.
+func (g *TileGrid) Clear() {
+	for i := range g.dirty {
+		g.dirty[i] = false
+	}
+}
+
+func (g *TileGrid) tileRect(col, row int) image.Rectangle {
+	x, y := col*g.size, row*g.size
+	return image.Rect(x, y, x+g.size, y+g.size).Intersect(g.bounds)
+}
@@ -0,0 +1,72 @@
+package vnc
+
+import (
+	"image"
+	"testing"
+)
+
+func TestTileGrid(t *testing.T) {
+	tests := []struct {
+		name  string
+		marks []image.Rectangle
+		want  []image.Rectangle
+	}{
+		{"nothing marked", nil, nil},
+		{"one tile", []image.Rectangle{image.Rect(10, 10, 20, 20)},
+			[]image.Rectangle{image.Rect(0, 0, 64, 64)}},
+		{"across tiles", []image.Rectangle{image.Rect(60, 60, 70, 70)}, []image.Rectangle{
+			image.Rect(0, 0, 64, 64), image.Rect(64, 0, 128, 64),
+			image.Rect(0, 64, 64, 100), image.Rect(64, 64, 128, 100)}},
+		{"edge tile clipped", []image.Rectangle{image.Rect(140, 90, 150, 100)},
+			[]image.Rectangle{image.Rect(128, 64, 150, 100)}},
+		{"tile boundary excluded", []image.Rectangle{image.Rect(0, 0, 64, 64)},
+			[]image.Rectangle{image.Rect(0, 0, 64, 64)}},
+		{"outside the framebuffer", []image.Rectangle{image.Rect(150, 0, 200, 10), image.Rect(-10, -10, 0, 0)}, nil},
+	}
+	for _, tt := range tests {
+		g := NewTileGrid(150, 100, 64)
+		if cols, rows := g.Dimensions(); cols != 3 || rows != 2 {
+			t.Fatalf("got %dx%d tiles, want 3x2", cols, rows)
+		}
+		g.Clear()
+		for _, r := range tt.marks {
+			g.MarkRect(r)
+		}
+		got := g.Dirty()
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: dirty tiles %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: dirty tiles %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestTileGridUpdate(t *testing.T) {
+	g := NewTileGrid(100, 100, 0)
+	if g.TileSize() != DefaultTileSize || !g.IsDirty(0, 0) {
+		t.Fatalf("new grid with tiles of %d, dirty %v", g.TileSize(), g.IsDirty(0, 0))
+	}
+	g.Clear()
+
+	g.MarkUpdate(&FramebufferUpdateMsg{[]Rectangle{
+		{X: 0, Y: 0, Width: 10, Height: 10, Encoding: &CursorPseudoEncoding{}},
+	}})
+	if g.IsDirty(0, 0) {
+		t.Error("cursor rectangle marked a tile dirty")
+	}
+
+	g.MarkUpdate(&FramebufferUpdateMsg{[]Rectangle{
+		{Width: 600, Height: 300, Encoding: &DesktopSizePseudoEncoding{}},
+	}})
+	if cols, rows := g.Dimensions(); cols != 3 || rows != 2 {
+		t.Errorf("got %dx%d tiles after the resize, want 3x2", cols, rows)
+	}
+	if !g.IsDirty(2, 1) || g.IsDirty(3, 1) || g.IsDirty(-1, 0) {
+		t.Error("not all tiles dirty after the resize, or tiles beyond the grid dirty")
+	}
+}
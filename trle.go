@@ -0,0 +1,368 @@
+package vnc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+)
+
+// TRLE and ZRLE tile subencodings. Values 2 to 16 are packed palette
+// tiles, values 130 to 255 palette RLE tiles, with the palette size
+// being the value itself and the value minus 128, respectively.
+const (
+	trleRaw                = 0
+	trleSolid              = 1
+	trleMaxPackedPalette   = 16
+	trleReusePackedPalette = 127
+	trlePlainRLE           = 128
+	trleReusePaletteRLE    = 129
+)
+
+// Tile sizes of the TRLE and ZRLE encodings.
+const (
+	trleTileSize = 16
+	zrleTileSize = 64
+)
+
+// TRLEEncoding is the Tiled Run-Length Encoding, which divides the
+// rectangle into 16x16 tiles, each sent raw, as a solid color, or
+// palette or run-length encoded.
+//
+// See RFC 6143 Section 7.7.5
+type TRLEEncoding struct {
+	img *image.RGBA
+}
+
+func (*TRLEEncoding) Type() EncodingType {
+	return TRLEEncType
+}
+
+func (*TRLEEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	d := newTRLEDecoder(c.pixelFormat, c.r, true)
+	img, err := d.decodeTiles(int(rect.Width), int(rect.Height), trleTileSize)
+	if err != nil {
+		return nil, err
+	}
+	return &TRLEEncoding{img}, nil
+}
+
+func (enc *TRLEEncoding) Image(*Rectangle) (image.Image, error) {
+	return enc.img, nil
+}
+
+func (enc *TRLEEncoding) RGBA(*Rectangle) ([]byte, error) {
+	return enc.img.Pix, nil
+}
+
+func (enc *TRLEEncoding) PNG(rect *Rectangle) ([]byte, error) {
+	return encodePNG(enc, rect)
+}
+
+func (enc *TRLEEncoding) WritePNG(w io.Writer, _ *Rectangle) error {
+	return png.Encode(w, enc.img)
+}
+
+// ZRLEEncoding is the Zlib Run-Length Encoding, which sends TRLE-like
+// 64x64 tiles through a zlib stream persisting for the lifetime of the
+// connection.
+//
+// See RFC 6143 Section 7.7.6
+type ZRLEEncoding struct {
+	img *image.RGBA
+}
+
+func (*ZRLEEncoding) Type() EncodingType {
+	return ZRLEEncType
+}
+
+func (*ZRLEEncoding) Read(c *ClientConn, rect *Rectangle) (Encoding, error) {
+	var length uint32
+	if err := readFixedSize(c.r, &length); err != nil {
+		return nil, err
+	}
+
+	zr, err := c.zrleZlib.read(c.r, 0, int(length))
+	if err != nil {
+		return nil, err
+	}
+
+	d := newTRLEDecoder(c.pixelFormat, zr, false)
+	img, err := d.decodeTiles(int(rect.Width), int(rect.Height), zrleTileSize)
+	if err != nil {
+		return nil, err
+	}
+	return &ZRLEEncoding{img}, nil
+}
+
+func (enc *ZRLEEncoding) Image(*Rectangle) (image.Image, error) {
+	return enc.img, nil
+}
+
+func (enc *ZRLEEncoding) RGBA(*Rectangle) ([]byte, error) {
+	return enc.img.Pix, nil
+}
+
+func (enc *ZRLEEncoding) PNG(rect *Rectangle) ([]byte, error) {
+	return encodePNG(enc, rect)
+}
+
+func (enc *ZRLEEncoding) WritePNG(w io.Writer, _ *Rectangle) error {
+	return png.Encode(w, enc.img)
+}
+
+// trleDecoder decodes the tiles shared by the TRLE and ZRLE encodings.
+type trleDecoder struct {
+	r  io.Reader
+	pf *PixelFormat
+
+	// CPIXEL size, and whether a 3-byte CPIXEL leaves out the first
+	// byte of the pixel rather than the last one.
+	pixSize  int
+	padFront bool
+
+	// Whether tiles may reuse the palette of a previous tile, which
+	// only TRLE allows.
+	reuse   bool
+	palette []byte // RGBA
+}
+
+func newTRLEDecoder(pf *PixelFormat, r io.Reader, reuse bool) *trleDecoder {
+	d := &trleDecoder{r: r, pf: pf, pixSize: int(pf.ByPP), reuse: reuse}
+
+	// 32bpp true color pixels whose colors fit in either the least or
+	// the most significant three bytes are sent as 3-byte CPIXELs.
+	if pf.TrueColor != 0 && pf.BPP == 32 && pf.Depth <= 24 {
+		mask := uint32(pf.RedMax)<<pf.RedShift |
+			uint32(pf.GreenMax)<<pf.GreenShift |
+			uint32(pf.BlueMax)<<pf.BlueShift
+		littleEndian := pf.ByteOrder == binary.LittleEndian
+		if mask&0xff000000 == 0 {
+			d.pixSize, d.padFront = 3, !littleEndian
+		} else if mask&0x000000ff == 0 {
+			d.pixSize, d.padFront = 3, littleEndian
+		}
+	}
+	return d
+}
+
+// decodeTiles decodes a width x height rectangle sent as tiles of the
+// given size, in left-to-right, top-to-bottom order.
+func (d *trleDecoder) decodeTiles(width, height, tileSize int) (*image.RGBA, error) {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for ty := 0; ty < height; ty += tileSize {
+		for tx := 0; tx < width; tx += tileSize {
+			tile := image.Rect(tx, ty, tx+tileSize, ty+tileSize).Intersect(img.Rect)
+			if err := d.decodeTile(img, tile); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return img, nil
+}
+
+func (d *trleDecoder) decodeTile(img *image.RGBA, tile image.Rectangle) error {
+	var subencoding uint8
+	if err := readFixedSize(d.r, &subencoding); err != nil {
+		return err
+	}
+
+	numPixels := tile.Dx() * tile.Dy()
+	switch {
+	case subencoding == trleRaw:
+		pixels, err := d.readCPixels(numPixels)
+		if err != nil {
+			return err
+		}
+		d.drawPixels(img, tile, pixels)
+		return nil
+
+	case subencoding == trleSolid:
+		pixel, err := d.readCPixels(1)
+		if err != nil {
+			return err
+		}
+		for y := tile.Min.Y; y < tile.Max.Y; y++ {
+			for x := tile.Min.X; x < tile.Max.X; x++ {
+				copy(img.Pix[img.PixOffset(x, y):], pixel)
+			}
+		}
+		return nil
+
+	case subencoding <= trleMaxPackedPalette || subencoding == trleReusePackedPalette && d.reuse:
+		if err := d.readPalette(int(subencoding), subencoding == trleReusePackedPalette); err != nil {
+			return err
+		}
+		indices, err := d.readPackedIndices(tile, len(d.palette)/4)
+		if err != nil {
+			return err
+		}
+		return d.drawIndices(img, tile, indices)
+
+	case subencoding == trlePlainRLE:
+		pixels := make([]byte, 0, 4*numPixels)
+		for len(pixels) < 4*numPixels {
+			pixel, err := d.readCPixels(1)
+			if err != nil {
+				return err
+			}
+			runLength, err := d.readRunLength()
+			if err != nil {
+				return err
+			}
+			if len(pixels)+4*runLength > 4*numPixels {
+				return fmt.Errorf("TRLE run exceeds the tile")
+			}
+			for i := 0; i < runLength; i++ {
+				pixels = append(pixels, pixel...)
+			}
+		}
+		d.drawPixels(img, tile, pixels)
+		return nil
+
+	case subencoding > trleReusePaletteRLE || subencoding == trleReusePaletteRLE && d.reuse:
+		if err := d.readPalette(int(subencoding)-trlePlainRLE, subencoding == trleReusePaletteRLE); err != nil {
+			return err
+		}
+		indices := make([]byte, 0, numPixels)
+		for len(indices) < numPixels {
+			var index uint8
+			if err := readFixedSize(d.r, &index); err != nil {
+				return err
+			}
+			runLength := 1
+			if index&0x80 != 0 {
+				var err error
+				if runLength, err = d.readRunLength(); err != nil {
+					return err
+				}
+				index &= 0x7f
+			}
+			if len(indices)+runLength > numPixels {
+				return fmt.Errorf("TRLE run exceeds the tile")
+			}
+			for i := 0; i < runLength; i++ {
+				indices = append(indices, index)
+			}
+		}
+		return d.drawIndices(img, tile, indices)
+	}
+
+	return fmt.Errorf("invalid TRLE subencoding: %d", subencoding)
+}
+
+// readCPixels reads numPixels CPIXELs and returns them as RGBA.
+func (d *trleDecoder) readCPixels(numPixels int) ([]byte, error) {
+	data := make([]byte, numPixels*d.pixSize)
+	if _, err := io.ReadFull(d.r, data); err != nil {
+		return nil, err
+	}
+
+	rgba := make([]byte, 4*numPixels)
+	pixel := make([]byte, d.pf.ByPP)
+	for i := 0; i < numPixels; i++ {
+		cpixel := data[i*d.pixSize : (i+1)*d.pixSize]
+		if d.pixSize < len(pixel) && d.padFront {
+			copy(pixel[1:], cpixel)
+		} else {
+			copy(pixel, cpixel)
+		}
+
+		var err error
+		p := rgba[4*i:]
+		if p[0], p[1], p[2], err = d.pf.pixelToRGB(pixel); err != nil {
+			return nil, err
+		}
+		p[3] = 255
+	}
+	return rgba, nil
+}
+
+// readPalette reads a palette of the given size, or keeps the previous
+// one if reuse is set.
+func (d *trleDecoder) readPalette(size int, reuse bool) error {
+	if reuse {
+		if d.palette == nil {
+			return fmt.Errorf("TRLE tile reuses a palette before any was sent")
+		}
+		return nil
+	}
+
+	var err error
+	d.palette, err = d.readCPixels(size)
+	return err
+}
+
+// readPackedIndices reads the palette indices of a packed palette tile,
+// using 1, 2 or 4 bits per pixel depending on the palette size. Each
+// row starts on a byte boundary.
+func (d *trleDecoder) readPackedIndices(tile image.Rectangle, paletteSize int) ([]byte, error) {
+	bits := 4
+	if paletteSize <= 2 {
+		bits = 1
+	} else if paletteSize <= 4 {
+		bits = 2
+	}
+
+	width, height := tile.Dx(), tile.Dy()
+	rowSize := (width*bits + 7) / 8
+	packed := make([]byte, rowSize*height)
+	if _, err := io.ReadFull(d.r, packed); err != nil {
+		return nil, err
+	}
+
+	indices := make([]byte, 0, width*height)
+	mask := byte(1<<uint(bits) - 1)
+	for y := 0; y < height; y++ {
+		row := packed[y*rowSize:]
+		for x := 0; x < width; x++ {
+			bit := x * bits
+			shift := uint(8 - bits - bit%8)
+			indices = append(indices, row[bit/8]>>shift&mask)
+		}
+	}
+	return indices, nil
+}
+
+// readRunLength reads a run length, sent as a sum of bytes with every
+// byte but the last being 255, minus one.
+func (d *trleDecoder) readRunLength() (int, error) {
+	length := 1
+	for {
+		var b uint8
+		if err := readFixedSize(d.r, &b); err != nil {
+			return 0, err
+		}
+		length += int(b)
+		if b != 255 {
+			return length, nil
+		}
+	}
+}
+
+// drawPixels copies the RGBA pixels of a tile into the image.
+func (d *trleDecoder) drawPixels(img *image.RGBA, tile image.Rectangle, pixels []byte) {
+	rowSize := 4 * tile.Dx()
+	for y := tile.Min.Y; y < tile.Max.Y; y++ {
+		copy(img.Pix[img.PixOffset(tile.Min.X, y):], pixels[:rowSize])
+		pixels = pixels[rowSize:]
+	}
+}
+
+// drawIndices draws the palette colors of a tile into the image.
+func (d *trleDecoder) drawIndices(img *image.RGBA, tile image.Rectangle, indices []byte) error {
+	numColors := len(d.palette) / 4
+	i := 0
+	for y := tile.Min.Y; y < tile.Max.Y; y++ {
+		for x := tile.Min.X; x < tile.Max.X; x++ {
+			index := int(indices[i])
+			if index >= numColors {
+				return fmt.Errorf("TRLE palette index %d out of range", index)
+			}
+			copy(img.Pix[img.PixOffset(x, y):], d.palette[4*index:4*index+4])
+			i++
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package vnc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// cpixel returns a CPIXEL in the RGB888 format of newTestClient, whose
+// unused most significant byte is left out.
+func cpixel(r, g, b uint8) []byte {
+	return []byte{b, g, r}
+}
+
+var (
+	trleRed   = cpixel(255, 0, 0)
+	trleGreen = cpixel(0, 255, 0)
+	trleBlue  = cpixel(0, 0, 255)
+	trleWhite = cpixel(255, 255, 255)
+	trleBlack = cpixel(0, 0, 0)
+)
+
+// trleColors maps the letters of the expected images to colors.
+var trleColors = map[byte]color.RGBA{
+	'r': {255, 0, 0, 255},
+	'g': {0, 255, 0, 255},
+	'b': {0, 0, 255, 255},
+	'w': {255, 255, 255, 255},
+	'k': {0, 0, 0, 255},
+}
+
+// checkImage compares img with want, a string of color letters in
+// row-major order.
+func checkImage(t *testing.T, name string, img *image.RGBA, want string) {
+	t.Helper()
+	width := img.Rect.Dx()
+	for i := range want {
+		x, y := i%width, i/width
+		if got := img.RGBAAt(x, y); got != trleColors[want[i]] {
+			t.Errorf("%s: pixel (%d,%d) is %v, want %c", name, x, y, got, want[i])
+		}
+	}
+}
+
+func TestTRLEEncoding(t *testing.T) {
+	tests := []struct {
+		name    string
+		width   uint16
+		data    []byte
+		want    string
+		wantErr bool
+	}{
+		{"raw", 4, wire(uint8(trleRaw),
+			trleRed, trleGreen, trleBlue, trleWhite, trleBlack, trleRed, trleGreen, trleBlue), "rgbwkrgb", false},
+		{"solid", 4, wire(uint8(trleSolid), trleGreen), "gggggggg", false},
+		{"packed palette of 2", 4, wire(uint8(2), trleRed, trleBlue,
+			uint8(0xa0), uint8(0x60)), "brbrrbbr", false},
+		{"packed palette of 3", 4, wire(uint8(3), trleRed, trleGreen, trleBlue,
+			uint8(0x18), uint8(0xa5)), "rgbrbbgg", false},
+		{"packed palette of 4", 3, wire(uint8(4), trleRed, trleGreen, trleBlue, trleWhite,
+			uint8(0x6c), uint8(0x24)), "gbwrbg", false},
+		{"packed palette of 5", 4, wire(uint8(5), trleRed, trleGreen, trleBlue, trleWhite, trleBlack,
+			uint8(0x01), uint8(0x23), uint8(0x44), uint8(0x00)), "rgbwkkrr", false},
+		{"packed palette of 16", 2, wire(uint8(16), pixels(15, trleBlack), trleWhite,
+			uint8(0xf0), uint8(0x0f)), "wkkw", false},
+		{"packed palette reused", 17, wire(uint8(2), trleRed, trleBlue, uint8(0x80), uint8(0x01),
+			uint8(trleReusePackedPalette), uint8(0x80)), "brrrrrrrrrrrrrrbb", false},
+		{"plain RLE", 4, wire(uint8(trlePlainRLE), trleRed, uint8(2), trleBlue, uint8(4)),
+			"rrrbbbbb", false},
+		{"palette RLE", 4, wire(uint8(130), trleRed, trleBlue, uint8(0x80), uint8(4),
+			uint8(1), uint8(0x81), uint8(1)), "rrrrrbbb", false},
+		{"palette RLE reused", 17, wire(uint8(130), trleRed, trleBlue, uint8(0x81), uint8(15),
+			uint8(trleReusePaletteRLE), uint8(0)), "bbbbbbbbbbbbbbbbr", false},
+		{"run exceeding the tile", 4, wire(uint8(trlePlainRLE), trleRed, uint8(8)), "", true},
+		{"index out of range", 4, wire(uint8(3), trleRed, trleGreen, trleBlue,
+			uint8(0xff), uint8(0xff)), "", true},
+		{"reuse before a palette", 4, wire(uint8(trleReusePackedPalette)), "", true},
+		{"invalid subencoding", 4, wire(uint8(17)), "", true},
+		{"truncated", 4, wire(uint8(trleRaw), trleRed), "", true},
+	}
+	for _, tt := range tests {
+		height := uint16(2)
+		if tt.width > 4 {
+			height = 1
+		}
+		c, tc := newTestClient(nil, tt.data)
+		rect := &Rectangle{Width: tt.width, Height: height}
+		enc, err := (&TRLEEncoding{}).Read(c, rect)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		} else if !consumed(c, tc) {
+			t.Errorf("%s: data left unread", tt.name)
+		}
+		checkImage(t, tt.name, enc.(*TRLEEncoding).img, tt.want)
+	}
+}
+
+func TestTRLELongRun(t *testing.T) {
+	// a run of 1+255+0 pixels fills the first tile
+	data := wire(uint8(trlePlainRLE), trleGreen, uint8(255), uint8(0), uint8(trleSolid), trleRed)
+	c, _ := newTestClient(nil, data)
+	enc, err := (&TRLEEncoding{}).Read(c, &Rectangle{Width: 16, Height: 32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := enc.(*TRLEEncoding).img
+	if got := img.RGBAAt(15, 15); got != trleColors['g'] {
+		t.Errorf("end of the first run is %v", got)
+	}
+	if got := img.RGBAAt(0, 16); got != trleColors['r'] {
+		t.Errorf("start of the second tile is %v", got)
+	}
+}
+
+func TestZRLEEncoding(t *testing.T) {
+	// the zlib stream persists across rectangles
+	tiles := [][]byte{
+		wire(uint8(trleSolid), trleGreen),
+		wire(uint8(2), trleRed, trleBlue, uint8(0xa0), uint8(0x60)),
+		// palette reuse is not allowed by ZRLE
+		wire(uint8(trleReusePackedPalette)),
+	}
+	want := []string{"gggggggg", "brbrrbbr", ""}
+
+	var stream bytes.Buffer
+	zw := zlib.NewWriter(&stream)
+	var data []byte
+	for _, tile := range tiles {
+		zw.Write(tile)
+		zw.Flush()
+		data = append(data, wire(uint32(stream.Len()), stream.Bytes())...)
+		stream.Reset()
+	}
+
+	c, tc := newTestClient(nil, data)
+	for i := range tiles {
+		enc, err := (&ZRLEEncoding{}).Read(c, &Rectangle{Width: 4, Height: 2})
+		if want[i] == "" {
+			if err == nil {
+				t.Errorf("rectangle %d: no error", i)
+			}
+			continue
+		} else if err != nil {
+			t.Fatalf("rectangle %d: %v", i, err)
+		}
+		checkImage(t, "ZRLE", enc.(*ZRLEEncoding).img, want[i])
+	}
+	if !consumed(c, tc) {
+		t.Error("data left unread")
+	}
+}
+
+func TestTRLECPixelSize(t *testing.T) {
+	rgb888 := PixelFormatRGB888()
+	bigEndian := PixelFormatRGB888()
+	bigEndian.BigEndian = 1
+	high := PixelFormatRGB888()
+	high.RedShift, high.GreenShift, high.BlueShift = 24, 16, 8
+	deep := PixelFormatRGB888()
+	deep.Depth, deep.RedMax, deep.RedShift = 32, 0x1ff, 16
+	bgr233 := PixelFormatBGR233()
+
+	tests := []struct {
+		name     string
+		rpf      *RFBPixelFormat
+		size     int
+		padFront bool
+	}{
+		{"RGB888", &rgb888, 3, false},
+		{"RGB888 big-endian", &bigEndian, 3, true},
+		{"most significant bytes", &high, 3, true},
+		{"depth 32", &deep, 4, false},
+		{"BGR233", &bgr233, 1, false},
+	}
+	for _, tt := range tests {
+		d := newTRLEDecoder(NewPixelFormat(tt.rpf), nil, true)
+		if d.pixSize != tt.size || d.padFront != tt.padFront {
+			t.Errorf("%s: CPIXEL of %d bytes, padded in front %v", tt.name, d.pixSize, d.padFront)
+		}
+	}
+}
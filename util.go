@@ -1,6 +1,7 @@
 package vnc
 
 import (
+	"context"
 	"encoding/binary"
 	"io"
 )
@@ -12,3 +13,27 @@ func readFixedSize(r io.Reader, data interface{}) error {
 func writeFixedSize(w io.Writer, data interface{}) error {
 	return binary.Write(w, binary.BigEndian, data)
 }
+
+// onDone calls f if ctx is done before the returned stop function is
+// called. Once stop returns, f is no longer running.
+func onDone(ctx context.Context, f func()) (stop func()) {
+	done := ctx.Done()
+	if done == nil {
+		return func() {}
+	}
+
+	stopc := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-done:
+			f()
+		case <-stopc:
+		}
+	}()
+	return func() {
+		close(stopc)
+		<-stopped
+	}
+}
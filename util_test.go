@@ -0,0 +1,125 @@
+package vnc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"image"
+	"net"
+	"testing"
+	"time"
+)
+
+// testConn is a net.Conn reading from in and recording what is written
+// to out, counting the writes.
+type testConn struct {
+	in     bytes.Buffer
+	out    bytes.Buffer
+	writes int
+}
+
+func (c *testConn) Read(b []byte) (int, error) { return c.in.Read(b) }
+
+func (c *testConn) Write(b []byte) (int, error) {
+	c.writes++
+	return c.out.Write(b)
+}
+
+func (*testConn) Close() error                     { return nil }
+func (*testConn) LocalAddr() net.Addr              { return nopAddr("test") }
+func (*testConn) RemoteAddr() net.Addr             { return nopAddr("test") }
+func (*testConn) SetDeadline(time.Time) error      { return nil }
+func (*testConn) SetReadDeadline(time.Time) error  { return nil }
+func (*testConn) SetWriteDeadline(time.Time) error { return nil }
+
+// newTestClient returns a ClientConn reading data, as after the
+// handshake with a 1024x768 framebuffer in the RGB888 pixel format, and
+// its connection.
+func newTestClient(cfg *ClientConnConfig, data []byte) (*ClientConn, *testConn) {
+	if cfg == nil {
+		cfg = new(ClientConnConfig)
+	}
+	if cfg.ServerMessages == nil {
+		cfg.ServerMessages = make(map[MessageID]ServerMessage)
+	}
+
+	tc := new(testConn)
+	tc.in.Write(data)
+	c, err := NewClientConn(cfg, tc)
+	if err != nil {
+		panic(err)
+	}
+	rpf := PixelFormatRGB888()
+	c.pixelFormat = NewPixelFormat(&rpf)
+	c.FrameBufferWidth, c.FrameBufferHeight = 1024, 768
+	return c, tc
+}
+
+// wire returns the big-endian encoding of the values, as sent on the
+// wire.
+func wire(values ...interface{}) []byte {
+	buf := new(bytes.Buffer)
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			buf.WriteString(s)
+			continue
+		}
+		if err := writeFixedSize(buf, v); err != nil {
+			panic(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// unhex decodes a hexadecimal test vector.
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// pixel returns a pixel in the RGB888 format of newTestClient.
+func pixel(r, g, b uint8) []byte {
+	return []byte{b, g, r, 0}
+}
+
+// pixels returns n times the pixel.
+func pixels(n int, p []byte) []byte {
+	return bytes.Repeat(p, n)
+}
+
+// newPipeClient returns a ClientConn over one end of a pipe, set up
+// like newTestClient, and the server's end.
+func newPipeClient(t *testing.T) (*ClientConn, net.Conn) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	c, err := NewClientConn(&ClientConnConfig{ServerMessages: make(map[MessageID]ServerMessage)}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpf := PixelFormatRGB888()
+	c.pixelFormat = NewPixelFormat(&rpf)
+	c.FrameBufferWidth, c.FrameBufferHeight = 1024, 768
+	return c, server
+}
+
+// consumed reports whether the client has read all the data of its
+// connection.
+func consumed(c *ClientConn, tc *testConn) bool {
+	return c.r.Buffered() == 0 && tc.in.Len() == 0
+}
+
+// decodedImage returns the pixels of a decoded rectangle.
+func decodedImage(enc Encoding, rect *Rectangle) *image.RGBA {
+	rgba, err := enc.(interface {
+		RGBA(*Rectangle) ([]byte, error)
+	}).RGBA(rect)
+	if err != nil {
+		panic(err)
+	}
+	return newRGBAImage(rgba, int(rect.Width), int(rect.Height)).(*image.RGBA)
+}
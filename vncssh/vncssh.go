@@ -0,0 +1,77 @@
+// Package vncssh connects to VNC servers through SSH tunnels, like
+// ssh -L. It is separate from package vnc so that only its users depend
+// on golang.org/x/crypto/ssh.
+package vncssh
+
+import (
+	"context"
+	"io"
+	"net"
+
+	vnc "github.com/rnd-user/go-vnc"
+	"golang.org/x/crypto/ssh"
+)
+
+// DialSSH opens a channel through the SSH client to cfg.Address and
+// returns a ClientConn for it, ready for the handshake. The address is
+// resolved by the SSH server, so a VNC server running on the SSH host
+// itself is typically reached at "localhost:5900".
+//
+// If the context is canceled while the channel is being opened, DialSSH
+// returns the context's error and the channel is closed once it opens.
+// SSH channels have no deadlines, so contexts passed to the ClientConn
+// can't interrupt blocked reads and writes; close the connection to
+// abort them.
+func DialSSH(ctx context.Context, cfg *vnc.ClientConnConfig, client *ssh.Client) (*vnc.ClientConn, error) {
+	return dial(ctx, cfg, client)
+}
+
+// dialer opens channels to addresses; *ssh.Client is one.
+type dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+func dial(ctx context.Context, cfg *vnc.ClientConnConfig, d dialer) (*vnc.ClientConn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if cfg.ServerMessages == nil {
+		cfg.ServerMessages = make(map[vnc.MessageID]vnc.ServerMessage)
+	}
+
+	type result struct {
+		ch  net.Conn
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ch, err := d.Dial("tcp", cfg.Address)
+		done <- result{ch, err}
+	}()
+
+	var ch net.Conn
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		ch = r.ch
+	case <-ctx.Done():
+		// Dial can't be interrupted, so close the channel it opens
+		go func() {
+			if r := <-done; r.err == nil {
+				r.ch.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+
+	// hide the net.Conn, whose deadline methods fail, so the stream
+	// gets no-op ones
+	c, err := vnc.NewClientConnRW(cfg, struct{ io.ReadWriteCloser }{ch})
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,110 @@
+package vncssh
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	vnc "github.com/rnd-user/go-vnc"
+)
+
+// testDialer opens the channels it is sent, after recording the
+// address.
+type testDialer struct {
+	addr  chan string
+	conns chan net.Conn
+}
+
+func newTestDialer() *testDialer {
+	return &testDialer{addr: make(chan string, 1), conns: make(chan net.Conn, 1)}
+}
+
+func (d *testDialer) Dial(network, addr string) (net.Conn, error) {
+	d.addr <- addr
+	return <-d.conns, nil
+}
+
+// serve runs the server side of the handshake with None
+// authentication.
+func serve(conn net.Conn, name string) error {
+	var init bytes.Buffer
+	rpf, _ := vnc.PixelFormatRGB888().MarshalBinary()
+	binary.Write(&init, binary.BigEndian, [2]uint16{640, 480})
+	init.Write(rpf)
+	binary.Write(&init, binary.BigEndian, uint32(len(name)))
+	init.WriteString(name)
+
+	steps := []struct {
+		send []byte
+		read int
+	}{
+		{append([]byte(vnc.ProtocolVersion3_8), 1, byte(vnc.NoneSecType)), 12 + 1},
+		{[]byte{0, 0, 0, 0}, 1}, // SecurityResult, ClientInit
+		{init.Bytes(), 0},
+	}
+	for _, s := range steps {
+		if _, err := conn.Write(s.send); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, make([]byte, s.read)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestDial(t *testing.T) {
+	d := newTestDialer()
+	client, server := net.Pipe()
+	defer server.Close()
+	d.conns <- client
+	go serve(server, "ssh")
+
+	c, err := dial(context.Background(), &vnc.ClientConnConfig{Address: "localhost:5900"}, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if addr := <-d.addr; addr != "localhost:5900" {
+		t.Errorf("dialed %q", addr)
+	}
+	if err := c.Handshake(); err != nil {
+		t.Fatal(err)
+	} else if c.DesktopName != "ssh" {
+		t.Errorf("got desktop name %q", c.DesktopName)
+	}
+}
+
+func TestDialCanceled(t *testing.T) {
+	d := newTestDialer()
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := dial(ctx, &vnc.ClientConnConfig{Address: "localhost:5900"}, d)
+		errc <- err
+	}()
+
+	<-d.addr
+	cancel()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dial not interrupted")
+	}
+
+	// the channel opened after the cancellation is closed
+	client, server := net.Pipe()
+	d.conns <- client
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v reading from the channel, want io.EOF", err)
+	}
+}
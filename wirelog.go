@@ -0,0 +1,104 @@
+package vnc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// Direction markers of the chunks written to ClientConnConfig.WireLog.
+const (
+	WireLogRead  = '<' // read from the server
+	WireLogWrite = '>' // written to the server
+)
+
+// SetWireLogging turns copying the wire stream to
+// ClientConnConfig.WireLog on or off. It is on initially.
+func (c *ClientConn) SetWireLogging(on bool) {
+	var off int32
+	if !on {
+		off = 1
+	}
+	atomic.StoreInt32(&c.wireLogOff, off)
+}
+
+// setConn makes nc the connection messages are read from and written
+// to. It may be built on top of the current connection, as when the
+// security handshake upgrades it to TLS; the current connection's bytes
+// are then no longer logged, so the log holds the decrypted stream.
+func (c *ClientConn) setConn(nc net.Conn) {
+	if w, ok := c.c.(*wireLogConn); ok {
+		w.muted = true
+	}
+	if c.config.WireLog != nil || c.config.Recorder != nil {
+		nc = &wireLogConn{Conn: nc, c: c}
+	}
+	c.c = nc
+	c.w = bufio.NewWriter(nc)
+	if c.config.StrictFraming || c.config.Metrics != nil {
+		c.r = bufio.NewReader(&countingReader{nc, &c.bytesRead})
+	} else {
+		c.r = bufio.NewReader(nc)
+	}
+}
+
+// consumed returns the number of bytes read from the connection and
+// consumed from the buffered reader, with StrictFraming or Metrics.
+func (c *ClientConn) consumed() int64 {
+	return c.bytesRead - int64(c.r.Buffered())
+}
+
+// countingReader counts the bytes read from r into n.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	*r.n += int64(n)
+	return n, err
+}
+
+// wireLogConn is a net.Conn copying the bytes read and written to the
+// client's WireLog, and the bytes read to its Recorder.
+type wireLogConn struct {
+	net.Conn
+	c     *ClientConn
+	muted bool
+}
+
+func (w *wireLogConn) Read(b []byte) (int, error) {
+	n, err := w.Conn.Read(b)
+	if n > 0 && !w.muted && w.c.config.Recorder != nil {
+		w.c.config.Recorder.Write(b[:n])
+	}
+	w.log(WireLogRead, b[:n])
+	return n, err
+}
+
+func (w *wireLogConn) Write(b []byte) (int, error) {
+	n, err := w.Conn.Write(b)
+	w.log(WireLogWrite, b[:n])
+	return n, err
+}
+
+// log writes a chunk to the WireLog. Errors are ignored, since failing
+// to log must not break the connection.
+func (w *wireLogConn) log(direction byte, data []byte) {
+	if len(data) == 0 || w.muted || w.c.config.WireLog == nil || atomic.LoadInt32(&w.c.wireLogOff) != 0 {
+		return
+	}
+
+	header := make([]byte, 5)
+	header[0] = direction
+	binary.BigEndian.PutUint32(header[1:], uint32(len(data)))
+
+	w.c.wireLogMu.Lock()
+	defer w.c.wireLogMu.Unlock()
+	if _, err := w.c.config.WireLog.Write(header); err == nil {
+		w.c.config.WireLog.Write(data)
+	}
+}
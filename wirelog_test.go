@@ -0,0 +1,63 @@
+package vnc
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestWireLog(t *testing.T) {
+	var log bytes.Buffer
+	c, _ := newTestClient(&ClientConnConfig{WireLog: &log}, wire(BellMID, BellMID, BellMID))
+
+	if _, err := c.ReceiveMsg(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RequestFramebufferUpdate(true); err != nil {
+		t.Fatal(err)
+	}
+	// the reads are buffered, so all bells were logged by the first read
+	want := wire(uint8(WireLogRead), uint32(3), BellMID, BellMID, BellMID,
+		uint8(WireLogWrite), uint32(10), FramebufferUpdateRequestMID, uint8(1), [4]uint16{0, 0, 1024, 768})
+	if !bytes.Equal(log.Bytes(), want) {
+		t.Errorf("logged %x, want %x", log.Bytes(), want)
+	}
+
+	// paused
+	log.Reset()
+	c.SetWireLogging(false)
+	c.SendMsg(&KeyEventMsg{Key: 'a'})
+	c.SetWireLogging(true)
+	c.SendMsg(&PointerEventMsg{})
+	if want := wire(uint8(WireLogWrite), uint32(6), PointerEventMID, uint8(0), uint32(0)); !bytes.Equal(log.Bytes(), want) {
+		t.Errorf("logged %x, want %x", log.Bytes(), want)
+	}
+}
+
+// upgradedConn stands for a connection built on top of another, like
+// the TLS connection of a security type.
+type upgradedConn struct {
+	net.Conn
+}
+
+func (u *upgradedConn) Write(b []byte) (int, error) {
+	// an "encrypted" stream twice the size
+	if _, err := u.Conn.Write(append(b, b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func TestWireLogUpgrade(t *testing.T) {
+	var log bytes.Buffer
+	c, _ := newTestClient(&ClientConnConfig{WireLog: &log}, nil)
+
+	// only the upgraded connection's plain bytes are logged
+	c.setConn(&upgradedConn{c.c})
+	if err := c.SendMsg(&PointerEventMsg{}); err != nil {
+		t.Fatal(err)
+	}
+	if want := wire(uint8(WireLogWrite), uint32(6), PointerEventMID, uint8(0), uint32(0)); !bytes.Equal(log.Bytes(), want) {
+		t.Errorf("logged %x, want %x", log.Bytes(), want)
+	}
+}
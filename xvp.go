@@ -0,0 +1,83 @@
+package vnc
+
+import "fmt"
+
+// XvpPseudoEncType is the xvp pseudo-encoding. A client includes it in
+// SetEncodings to announce support for the xvp messages.
+const XvpPseudoEncType = EncodingType(-309)
+
+// XvpMID is the message type of both the client and server xvp
+// messages.
+const XvpMID MessageID = 250
+
+// xvpVersion is the version of the xvp extension implemented.
+const xvpVersion = 1
+
+// Xvp operation codes. Fail and Init are sent by the server, the others
+// by the client.
+const (
+	XvpFail = iota
+	XvpInit
+	XvpShutdown
+	XvpReboot
+	XvpReset
+)
+
+// XvpPseudoEncoding announces support for the xvp messages. The server
+// confirms it by sending an XvpServerMsg with XvpInit.
+type XvpPseudoEncoding struct{}
+
+func (*XvpPseudoEncoding) Type() EncodingType {
+	return XvpPseudoEncType
+}
+
+func (*XvpPseudoEncoding) Read(*ClientConn, *Rectangle) (Encoding, error) {
+	return new(XvpPseudoEncoding), nil
+}
+
+// XvpMsg asks the server to shut down, reboot or reset the virtual
+// machine it gives access to.
+type XvpMsg struct {
+	Operation uint8
+}
+
+func (m *XvpMsg) Send(c *ClientConn) error {
+	switch m.Operation {
+	case XvpShutdown, XvpReboot, XvpReset:
+	default:
+		return fmt.Errorf("invalid xvp operation: %d", m.Operation)
+	}
+
+	_, err := c.w.Write([]byte{byte(XvpMID), 0, xvpVersion, m.Operation})
+	return err
+}
+
+// XvpServerMsg is sent by the server with XvpInit when it supports xvp,
+// and with XvpFail when an operation could not be carried out. To
+// receive it, add it to ClientConnConfig.ServerMessages.
+type XvpServerMsg struct {
+	Version   uint8
+	Operation uint8
+}
+
+func (*XvpServerMsg) ID() MessageID {
+	return XvpMID
+}
+
+func (*XvpServerMsg) Receive(c *ClientConn) (ServerMessage, error) {
+	var body struct {
+		_         uint8 // padding
+		Version   uint8
+		Operation uint8
+	}
+	if err := readFixedSize(c.r, &body); err != nil {
+		return nil, err
+	}
+
+	switch body.Operation {
+	case XvpFail, XvpInit:
+	default:
+		return nil, fmt.Errorf("invalid xvp server operation: %d", body.Operation)
+	}
+	return &XvpServerMsg{body.Version, body.Operation}, nil
+}
@@ -0,0 +1,54 @@
+package vnc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestXvpMsg(t *testing.T) {
+	tests := []struct {
+		op      uint8
+		wantErr bool
+	}{
+		{XvpShutdown, false},
+		{XvpReboot, false},
+		{XvpReset, false},
+		{XvpInit, true},
+		{XvpFail, true},
+		{5, true},
+	}
+	for _, tt := range tests {
+		c, tc := newTestClient(nil, nil)
+		err := c.SendMsg(&XvpMsg{Operation: tt.op})
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("operation %d: no error", tt.op)
+			}
+		} else if want := []byte{byte(XvpMID), 0, 1, tt.op}; err != nil || !bytes.Equal(tc.out.Bytes(), want) {
+			t.Errorf("operation %d: sent %v, %v, want %v", tt.op, tc.out.Bytes(), err, want)
+		}
+	}
+}
+
+func TestXvpServerMsg(t *testing.T) {
+	tests := []struct {
+		op      uint8
+		wantErr bool
+	}{
+		{XvpInit, false},
+		{XvpFail, false},
+		{XvpReboot, true},
+	}
+	for _, tt := range tests {
+		cfg := &ClientConnConfig{ServerMessages: map[MessageID]ServerMessage{XvpMID: new(XvpServerMsg)}}
+		c, _ := newTestClient(cfg, wire(XvpMID, uint8(0), uint8(1), tt.op))
+		msg, err := c.ReceiveMsg()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("operation %d: no error", tt.op)
+			}
+		} else if err != nil || *msg.(*XvpServerMsg) != (XvpServerMsg{1, tt.op}) {
+			t.Errorf("operation %d: got %+v, %v", tt.op, msg, err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package vnc
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+)
+
+// zlibStreams holds the zlib streams of a stateful encoding. A stream
+// persists across rectangles for the lifetime of the connection, until
+// the server tells the client to reset it. Tight uses up to four
+// streams, ZRLE uses the first one only.
+type zlibStreams [4]zlibStream
+
+type zlibStream struct {
+	in bytes.Buffer
+	zr io.ReadCloser
+}
+
+// read reads a block of length compressed bytes from r and feeds it to
+// stream n. It returns the stream's decompressor, from which the
+// decompressed data of the block is read.
+func (zs *zlibStreams) read(r io.Reader, n int, length int) (io.Reader, error) {
+	s := &zs[n]
+	if _, err := io.CopyN(&s.in, r, int64(length)); err != nil {
+		return nil, err
+	}
+
+	// The zlib header is only sent at the start of a stream, so the
+	// decompressor is created once and kept until the stream is reset.
+	if s.zr == nil {
+		zr, err := zlib.NewReader(&s.in)
+		if err != nil {
+			return nil, err
+		}
+		s.zr = zr
+	}
+	return s.zr, nil
+}
+
+// reset discards stream n, so the next block starts a new stream.
+func (zs *zlibStreams) reset(n int) {
+	s := &zs[n]
+	if s.zr != nil {
+		s.zr.Close()
+		s.zr = nil
+	}
+	s.in.Reset()
+}
+
+// resetMask resets the streams whose bit is set in mask, bit 0 being
+// stream 0.
+func (zs *zlibStreams) resetMask(mask uint8) {
+	for n := range zs {
+		if mask&(1<<uint(n)) != 0 {
+			zs.reset(n)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package vnc
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestZlibStreamsResetMask(t *testing.T) {
+	var s tightStreams
+	var zs zlibStreams
+	read := func(n int, block []byte, size int) ([]byte, error) {
+		r := bytes.NewReader(block)
+		length, err := readCompactLength(r)
+		if err != nil {
+			return nil, err
+		}
+		zr, err := zs.read(r, n, length)
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size)
+		_, err = io.ReadFull(zr, data)
+		return data, err
+	}
+
+	first := bytes.Repeat([]byte("first block "), 4)
+	second := bytes.Repeat([]byte("second block "), 4)
+	for _, n := range []int{0, 1} {
+		if got, err := read(n, s.data(n, false, first), len(first)); err != nil || !bytes.Equal(got, first) {
+			t.Fatalf("stream %d: got %q, %v", n, got, err)
+		}
+	}
+
+	// the control byte of a Tight rectangle resets stream 1 only, so
+	// stream 0 goes on without a zlib header
+	zs.resetMask(1 << 1)
+	if zs[0].zr == nil || zs[1].zr != nil {
+		t.Fatal("reset the wrong streams")
+	}
+	if got, err := read(0, s.data(0, false, second), len(second)); err != nil || !bytes.Equal(got, second) {
+		t.Errorf("continued stream: got %q, %v", got, err)
+	}
+	if got, err := read(1, s.data(1, true, second), len(second)); err != nil || !bytes.Equal(got, second) {
+		t.Errorf("reset stream: got %q, %v", got, err)
+	}
+
+	// a stream restarted by the server but not reset by the client
+	// can't be decompressed
+	if _, err := read(0, s.data(0, true, second), len(second)); err == nil {
+		t.Error("no error for a new stream without a reset")
+	}
+}